@@ -0,0 +1,85 @@
+// Package auth produces Proxy-Authorization header values for the authentication schemes
+// supported by proxyplease, independent of any network connection. It lets custom HTTP
+// stacks (fasthttp, h2c clients, ...) reuse the same authentication logic: feed each
+// Proxy-Authenticate challenge to an Authenticator and send back the token it returns.
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+)
+
+// ErrMalformedChallenge is returned when a Proxy-Authenticate value cannot be used to
+// continue the authentication sequence.
+var ErrMalformedChallenge = errors.New("received malformed challenge from the server")
+
+// Authenticator produces the Proxy-Authorization values of a challenge/response
+// authentication sequence. Authenticators are not safe for concurrent use and must be
+// used for a single proxy connection.
+type Authenticator interface {
+	// Scheme returns the name of the authentication scheme, ex: "NTLM".
+	Scheme() string
+	// Next returns the next Proxy-Authorization header value. challenge is the
+	// Proxy-Authenticate header value for this scheme received from the proxy, and must
+	// be empty when requesting the first token.
+	Next(challenge string) (string, error)
+	// Release frees any credentials or security contexts held by the Authenticator.
+	Release() error
+}
+
+// Basic returns the Proxy-Authorization header value for Basic authentication, with the
+// credentials encoded in UTF-8 as RFC 7617 prescribes for proxies announcing
+// charset="UTF-8".
+func Basic(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// BasicLatin1 returns the Proxy-Authorization header value for Basic authentication with
+// the credentials encoded in ISO-8859-1, which proxies announcing no charset often
+// expect, and false if they contain characters ISO-8859-1 cannot represent.
+func BasicLatin1(username, password string) (string, bool) {
+	var b []byte
+	for _, r := range username + ":" + password {
+		if r > 0xff {
+			return "", false
+		}
+		b = append(b, byte(r))
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString(b), true
+}
+
+// BasicCharset returns the charset parameter of a Basic challenge, ex: "UTF-8", or an
+// empty string if there is none.
+func BasicCharset(challenge string) string {
+	return ChallengeParams(challenge)["charset"]
+}
+
+// Bearer returns the Proxy-Authorization header value for Bearer token authentication.
+func Bearer(token string) string {
+	return "Bearer " + token
+}
+
+// Challenge returns the Proxy-Authenticate value from values matching scheme, or an
+// empty string if the proxy did not send one.
+func Challenge(values []string, scheme string) string {
+	for _, v := range SplitChallenges(values) {
+		if _, ok := challengeToken(v, scheme); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// decodeChallenge returns the decoded token following scheme in challenge.
+func decodeChallenge(scheme, challenge string) ([]byte, error) {
+	token, ok := challengeToken(challenge, scheme)
+	if !ok || token == "" {
+		return nil, ErrMalformedChallenge
+	}
+	return base64.StdEncoding.DecodeString(token)
+}
+
+// encodeToken returns the Proxy-Authorization value carrying token for scheme.
+func encodeToken(scheme string, token []byte) string {
+	return scheme + " " + base64.StdEncoding.EncodeToString(token)
+}
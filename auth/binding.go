@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/md5"
+	"crypto/x509"
+	"encoding/binary"
+
+	// hashes of certificate signatures
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// ChannelBinder is implemented by Authenticators able to bind their tokens to the TLS
+// connection they are sent over (RFC 5056), as proxies enforcing Extended Protection for
+// Authentication (EPA) require. SetChannelBinding must be called before the first Next.
+type ChannelBinder interface {
+	// SetChannelBinding sets the application data of the channel bindings, ex: the
+	// result of TLSServerEndPoint.
+	SetChannelBinding(appData []byte)
+}
+
+// TLSServerEndPoint returns the tls-server-end-point channel binding (RFC 5929) of a TLS
+// connection whose server presented cert: the hash of the certificate, prefixed with
+// "tls-server-end-point:". The hash is that of the certificate signature, or SHA-256 if
+// the signature uses MD5 or SHA-1.
+func TLSServerEndPoint(cert *x509.Certificate) []byte {
+	var h crypto.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		h = crypto.SHA384
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		h = crypto.SHA512
+	default:
+		h = crypto.SHA256
+	}
+	d := h.New()
+	d.Write(cert.Raw)
+	return d.Sum([]byte("tls-server-end-point:"))
+}
+
+// channelBindingHash returns the MD5 hash of the gss_channel_bindings_struct (RFC 2744)
+// carrying appData without addresses, as sent in NTLM and Kerberos tokens, or nil if
+// appData is empty.
+func channelBindingHash(appData []byte) []byte {
+	if len(appData) == 0 {
+		return nil
+	}
+	// initiator and acceptor address types and lengths are zero
+	b := make([]byte, 20, 20+len(appData))
+	binary.LittleEndian.PutUint32(b[16:], uint32(len(appData)))
+	h := md5.Sum(append(b, appData...))
+	return h[:]
+}
@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+)
+
+// digestAlgorithms are the supported Digest algorithms, from the strongest to the weakest.
+var digestAlgorithms = []string{"SHA-256-sess", "SHA-256", "MD5-sess", "MD5"}
+
+// DigestSession holds the state of a Digest authentication session with a proxy: the
+// current server nonce and the nonce count. It is safe for concurrent use, so dials
+// sharing a session never send the same nonce count twice.
+type DigestSession struct {
+	username, password string
+
+	mu        sync.Mutex
+	realm     string
+	nonce     string
+	opaque    string
+	qop       string
+	algorithm string
+	nc        uint32
+}
+
+// NewDigestSession returns a session authenticating with username and password.
+func NewDigestSession(username, password string) *DigestSession {
+	return &DigestSession{username: username, password: password}
+}
+
+// DigestState is the state of a DigestSession, saved with State to resume the session in
+// another process with Restore. It must be protected as the nonce can be replayed.
+type DigestState struct {
+	Realm     string `json:"realm"`
+	Nonce     string `json:"nonce"`
+	Opaque    string `json:"opaque,omitempty"`
+	QOP       string `json:"qop,omitempty"`
+	Algorithm string `json:"algorithm"`
+	NC        uint32 `json:"nc"` // Last nonce count sent.
+}
+
+// State returns the current nonce, its parameters and the last nonce count of s.
+func (s *DigestSession) State() DigestState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return DigestState{Realm: s.realm, Nonce: s.nonce, Opaque: s.opaque, QOP: s.qop, Algorithm: s.algorithm, NC: s.nc}
+}
+
+// Restore resumes the session saved in st, the next Authorization using the nonce count
+// after st.NC. States with an unsupported algorithm or qop are ignored.
+func (s *DigestSession) Restore(st DigestState) {
+	if st.Nonce == "" || digestAlgorithm(st.Algorithm) != st.Algorithm || st.QOP != "" && st.QOP != "auth" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.realm, s.nonce, s.opaque, s.qop, s.algorithm, s.nc = st.Realm, st.Nonce, st.Opaque, st.QOP, st.Algorithm, st.NC
+}
+
+// Challenge records a Digest challenge received in a Proxy-Authenticate header. A new
+// nonce resets the nonce count. stale reports whether the proxy flagged the previous
+// nonce as stale (stale=true), in which case the credentials are still valid and the
+// request should simply be retried with the new nonce.
+func (s *DigestSession) Challenge(challenge string) (stale bool, err error) {
+	rest, ok := challengeToken(challenge, "Digest")
+	if !ok {
+		return false, ErrMalformedChallenge
+	}
+	params := parseParams(rest)
+	if params["nonce"] == "" {
+		return false, ErrMalformedChallenge
+	}
+	algorithm := digestAlgorithm(params["algorithm"])
+	if algorithm == "" {
+		return false, fmt.Errorf("unsupported digest algorithm '%s'", params["algorithm"])
+	}
+
+	qop := ""
+	if q, ok := params["qop"]; ok {
+		for _, v := range strings.Split(q, ",") {
+			if strings.TrimSpace(v) == "auth" {
+				qop = "auth"
+			}
+		}
+		if qop == "" {
+			return false, fmt.Errorf("unsupported digest qop '%s'", q)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if params["nonce"] != s.nonce {
+		s.nc = 0
+	}
+	s.realm, s.nonce, s.opaque, s.qop, s.algorithm = params["realm"], params["nonce"], params["opaque"], qop, algorithm
+	return strings.EqualFold(params["stale"], "true"), nil
+}
+
+// Authorization returns the Proxy-Authorization header value for a request with the
+// given method and request-target, ex: "CONNECT" and "example.com:443". Each call uses
+// the next nonce count.
+func (s *DigestSession) Authorization(method, uri string) (string, error) {
+	s.mu.Lock()
+	if s.nonce == "" {
+		s.mu.Unlock()
+		return "", errors.New("digest session has not received a challenge")
+	}
+	s.nc++
+	realm, nonce, opaque, qop, algorithm, nc := s.realm, s.nonce, s.opaque, s.qop, s.algorithm, s.nc
+	s.mu.Unlock()
+
+	h := digestHash(algorithm)
+	sess := strings.HasSuffix(algorithm, "-sess")
+	var cnonce string
+	if qop != "" || sess {
+		var err error
+		if cnonce, err = newCnonce(); err != nil {
+			return "", err
+		}
+	}
+	ha1 := h(s.username + ":" + realm + ":" + s.password)
+	if sess {
+		ha1 = h(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `Digest username="%s", realm="%s", nonce="%s", uri="%s"`, quote(s.username), quote(realm), quote(nonce), quote(uri))
+	if qop == "" {
+		fmt.Fprintf(&b, `, response="%s"`, h(ha1+":"+nonce+":"+ha2))
+		if sess {
+			fmt.Fprintf(&b, `, cnonce="%s"`, cnonce)
+		}
+	} else {
+		ncs := fmt.Sprintf("%08x", nc)
+		response := h(ha1 + ":" + nonce + ":" + ncs + ":" + cnonce + ":" + qop + ":" + ha2)
+		fmt.Fprintf(&b, `, qop=%s, nc=%s, cnonce="%s", response="%s"`, qop, ncs, cnonce, response)
+	}
+	if opaque != "" {
+		fmt.Fprintf(&b, `, opaque="%s"`, quote(opaque))
+	}
+	b.WriteString(", algorithm=" + algorithm)
+	return b.String(), nil
+}
+
+// DigestChallenge returns the Digest challenge from values using the strongest supported
+// algorithm, or an empty string if there is none. Proxies may offer one challenge per
+// algorithm (RFC 7616).
+func DigestChallenge(values []string) string {
+	best, rank := "", len(digestAlgorithms)
+	for _, v := range SplitChallenges(values) {
+		params, ok := challengeToken(v, "Digest")
+		if !ok {
+			continue
+		}
+		alg := digestAlgorithm(parseParams(params)["algorithm"])
+		for i, a := range digestAlgorithms {
+			if a == alg && i < rank {
+				best, rank = v, i
+			}
+		}
+	}
+	return best
+}
+
+// digestAlgorithm returns the canonical name of a supported algorithm, or an empty string.
+// A missing algorithm means MD5.
+func digestAlgorithm(alg string) string {
+	if alg == "" {
+		return "MD5"
+	}
+	for _, a := range digestAlgorithms {
+		if strings.EqualFold(alg, a) {
+			return a
+		}
+	}
+	return ""
+}
+
+// digestHash returns the hex encoding hash function of algorithm.
+func digestHash(algorithm string) func(string) string {
+	newHash := md5.New
+	if strings.HasPrefix(algorithm, "SHA-256") {
+		newHash = sha256.New
+	}
+	return func(s string) string {
+		return hashHex(newHash(), s)
+	}
+}
+
+func hashHex(h hash.Hash, s string) string {
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func newCnonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// quote escapes s for use inside a quoted-string.
+func quote(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"errors"
+	"time"
+)
+
+// KerberosOptions select the Kerberos configuration and credentials used for Negotiate on
+// platforms without SSPI. They are ignored on Windows, where SSPI provides both, except
+// Flags.
+type KerberosOptions struct {
+	ConfigPath string // krb5.conf to use. Defaults to $KRB5_CONFIG, then /etc/krb5.conf.
+	KeytabPath string // Keytab holding the key of username, for headless services.
+	CCachePath string // Credential cache, ex: from kinit. Defaults to $KRB5CCNAME, then /tmp/krb5cc_<uid>.
+	// Now is the time source of the authenticator sent to the service, ex: the local time
+	// corrected by a measured clock skew. Defaults to time.Now. Requests to the KDC always
+	// use the local time.
+	Now func() time.Time
+	// Tickets persists service tickets across processes, so restarting processes do not
+	// request one from the KDC each time. If nil, tickets are kept in memory only.
+	Tickets TicketStore
+	// TGT supplies a login kept across authentications, used instead of the credentials
+	// above. See NewTGTManager.
+	TGT *TGTManager
+	// Flags are the context flags requested from the proxy. If zero, integrity and
+	// confidentiality are requested, or the SSPI defaults on Windows.
+	Flags ContextFlags
+}
+
+// ContextFlags are GSS-API context flags (RFC 2743), requested with SSPI as the matching
+// ISC_REQ flags.
+type ContextFlags uint32
+
+const (
+	// FlagDelegate delegates the credentials of the client to the proxy, for proxies that
+	// authenticate to upstream services on its behalf. Only supported with SSPI.
+	FlagDelegate ContextFlags = 1
+	// FlagMutual requires the proxy to authenticate itself with the token sent along with
+	// its success response, which is then checked with MutualVerifier.
+	FlagMutual ContextFlags = 2
+	// FlagConfidentiality requests confidentiality of messages protected with the context.
+	FlagConfidentiality ContextFlags = 16
+	// FlagIntegrity requests integrity of messages protected with the context.
+	FlagIntegrity ContextFlags = 32
+)
+
+// MutualVerifier is implemented by Authenticators requesting mutual authentication. After
+// the proxy accepted the last token, VerifyFinal checks the token the proxy returned with
+// its success response, given as the Proxy-Authenticate value, and fails if the proxy
+// did not prove its identity.
+type MutualVerifier interface {
+	VerifyFinal(challenge string) error
+}
+
+// ErrMutualAuthFailed is returned by MutualVerifier when the proxy did not prove its
+// identity.
+var ErrMutualAuthFailed = errors.New("the proxy failed mutual authentication")
+
+// TicketStore persists Kerberos service tickets. Stored values hold the session key of the
+// ticket and must be protected, ex: encrypted. Expired or rejected tickets should be
+// dropped by the store. Stores with a StoreTicketUntil(spn string, ticket []byte,
+// end time.Time) method are given the end time of the ticket with it instead.
+type TicketStore interface {
+	LoadTicket(spn string) []byte // Returns nil if no ticket is stored for spn.
+	StoreTicket(spn string, ticket []byte)
+}
+
+// ticketExpiryStore is implemented by TicketStores keeping tickets until their end time.
+type ticketExpiryStore interface {
+	StoreTicketUntil(spn string, ticket []byte, end time.Time)
+}
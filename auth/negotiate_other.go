@@ -0,0 +1,320 @@
+// +build !windows
+
+package auth
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	gasn1 "github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	krbflags "github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+type negotiateAuth struct {
+	spn      string
+	cl       *client.Client
+	shared   bool // cl belongs to a TGTManager
+	now      func() time.Time
+	tickets  TicketStore
+	flags    ContextFlags
+	bindings []byte
+	sent     bool
+
+	key    types.EncryptionKey // session key of the AP-REQ sent, to decrypt the AP-REP
+	sentAt time.Time           // authenticator time of the AP-REQ sent, echoed by the AP-REP
+}
+
+// storedTicket is a service ticket and its session key as saved to a TicketStore.
+type storedTicket struct {
+	Ticket []byte              `json:"ticket"`
+	Key    types.EncryptionKey `json:"key"`
+}
+
+// NewNegotiate returns an Authenticator for Negotiate (SPNEGO) targeting the service
+// principal spn, ex: "HTTP/proxy.example.com". Kerberos credentials are obtained from
+// username and password if supplied, else from the default credential cache.
+func NewNegotiate(spn, domain, username, password string) (Authenticator, error) {
+	return NewKerberosNegotiate(spn, domain, username, password, KerberosOptions{})
+}
+
+// NewKerberosNegotiate returns an Authenticator for Negotiate (SPNEGO) using Kerberos.
+// Credentials are taken from o.TGT if set, then from o.KeytabPath, then from username and
+// password, then from the credential cache. realm defaults to the default_realm of
+// krb5.conf.
+func NewKerberosNegotiate(spn, realm, username, password string, o KerberosOptions) (Authenticator, error) {
+	if o.Flags&FlagDelegate != 0 {
+		return nil, errors.New("credential delegation requires SSPI")
+	}
+	if o.Flags == 0 {
+		o.Flags = FlagIntegrity | FlagConfidentiality
+	}
+	if o.TGT != nil {
+		cl, err := o.TGT.client()
+		if err != nil {
+			return nil, err
+		}
+		return &negotiateAuth{spn: spn, cl: cl, shared: true, now: o.Now, tickets: o.Tickets, flags: o.Flags}, nil
+	}
+	cl, err := newKerberosClient(realm, username, password, o)
+	if err != nil {
+		return nil, err
+	}
+	return &negotiateAuth{spn: spn, cl: cl, now: o.Now, tickets: o.Tickets, flags: o.Flags}, nil
+}
+
+// newKerberosClient returns a client for the credentials of o.KeytabPath if set, then of
+// username and password, then of the credential cache.
+func newKerberosClient(realm, username, password string, o KerberosOptions) (*client.Client, error) {
+	cfg, err := loadKrb5Config(o.ConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	realm = strings.ToUpper(realm)
+	if realm == "" {
+		realm = cfg.LibDefaults.DefaultRealm
+	}
+
+	switch {
+	case o.KeytabPath != "":
+		if username == "" {
+			return nil, errors.New("a username is required to log in with a keytab")
+		}
+		kt, err := keytab.Load(o.KeytabPath)
+		if err != nil {
+			return nil, err
+		}
+		return client.NewWithKeytab(username, realm, kt, cfg, client.DisablePAFXFAST(true)), nil
+	case username != "" && password != "":
+		return client.NewWithPassword(username, realm, password, cfg, client.DisablePAFXFAST(true)), nil
+	default:
+		cc, err := credentials.LoadCCache(ccachePath(o.CCachePath))
+		if err != nil {
+			return nil, fmt.Errorf("no Kerberos credentials: %s", err)
+		}
+		return client.NewFromCCache(cc, cfg, client.DisablePAFXFAST(true))
+	}
+}
+
+func (a *negotiateAuth) Scheme() string {
+	return "Negotiate"
+}
+
+func (a *negotiateAuth) Next(challenge string) (string, error) {
+	// a Kerberos AP-REQ completes the exchange in a single token
+	if a.sent {
+		return "", ErrMalformedChallenge
+	}
+	now := a.now
+	if now == nil {
+		now = time.Now
+	}
+	tkt, key, err := a.serviceTicket()
+	if err != nil {
+		return "", err
+	}
+	t := now()
+	token, err := negTokenInitAt(a.cl.Credentials, tkt, key, t, a.bindings, a.flags)
+	if err != nil {
+		return "", err
+	}
+	a.sent, a.key, a.sentAt = true, key, t.UTC()
+	return encodeToken("Negotiate", token), nil
+}
+
+// VerifyFinal checks that the AP-REP returned by the proxy echoes the authenticator time
+// of the AP-REQ, which only a holder of the session key can do. It succeeds without
+// checking anything if mutual authentication was not requested.
+func (a *negotiateAuth) VerifyFinal(challenge string) error {
+	if a.flags&FlagMutual == 0 {
+		return nil
+	}
+	if !a.sent || challenge == "" {
+		return ErrMutualAuthFailed
+	}
+	b, err := decodeChallenge("Negotiate", challenge)
+	if err != nil {
+		return ErrMutualAuthFailed
+	}
+	// the AP-REP is usually wrapped in a NegTokenResp, but may be sent alone
+	var resp spnego.NegTokenResp
+	if err := resp.Unmarshal(b); err == nil {
+		if resp.State() != spnego.NegStateAcceptCompleted {
+			return ErrMutualAuthFailed
+		}
+		b = resp.ResponseToken
+	}
+	var mt spnego.KRB5Token
+	if err := mt.Unmarshal(b); err != nil || !mt.IsAPRep() {
+		return ErrMutualAuthFailed
+	}
+	plain, err := crypto.DecryptEncPart(mt.APRep.EncPart, a.key, keyusage.AP_REP_ENCPART)
+	if err != nil {
+		return ErrMutualAuthFailed
+	}
+	var part messages.EncAPRepPart
+	if err := part.Unmarshal(plain); err != nil {
+		return ErrMutualAuthFailed
+	}
+	if !part.CTime.Equal(a.sentAt.Truncate(time.Second)) || part.Cusec != a.sentAt.Nanosecond()/int(time.Microsecond) {
+		return ErrMutualAuthFailed
+	}
+	return nil
+}
+
+// serviceTicket returns a ticket for the proxy from the TicketStore, or else from the KDC.
+func (a *negotiateAuth) serviceTicket() (messages.Ticket, types.EncryptionKey, error) {
+	var st storedTicket
+	var tkt messages.Ticket
+	if a.tickets != nil {
+		if b := a.tickets.LoadTicket(a.spn); b != nil && json.Unmarshal(b, &st) == nil && tkt.Unmarshal(st.Ticket) == nil {
+			return tkt, st.Key, nil
+		}
+	}
+	if err := a.cl.AffirmLogin(); err != nil {
+		return tkt, st.Key, err
+	}
+	tkt, key, err := a.cl.GetServiceTicket(a.spn)
+	if err != nil || a.tickets == nil {
+		return tkt, key, err
+	}
+	if b, err := tkt.Marshal(); err == nil {
+		if b, err = json.Marshal(storedTicket{Ticket: b, Key: key}); err == nil {
+			if s, ok := a.tickets.(ticketExpiryStore); ok {
+				if end, ok := serviceTicketEnd(a.cl, a.spn); ok {
+					s.StoreTicketUntil(a.spn, b, end)
+					return tkt, key, nil
+				}
+			}
+			a.tickets.StoreTicket(a.spn, b)
+		}
+	}
+	return tkt, key, nil
+}
+
+// serviceTicketEnd returns the end time of the ticket for spn in the service ticket cache
+// of cl, which gokrb5 only exposes through Client.Print.
+func serviceTicketEnd(cl *client.Client, spn string) (time.Time, bool) {
+	var b bytes.Buffer
+	cl.Print(&b)
+	const start, end = "Service ticket cache:\n", "\nSettings:\n"
+	s := b.String()
+	i := strings.Index(s, start)
+	if i < 0 {
+		return time.Time{}, false
+	}
+	s = s[i+len(start):]
+	if i = strings.Index(s, end); i < 0 {
+		return time.Time{}, false
+	}
+	var entries []struct {
+		SPN     string
+		EndTime time.Time
+	}
+	if json.Unmarshal([]byte(s[:i]), &entries) != nil {
+		return time.Time{}, false
+	}
+	for _, e := range entries {
+		if e.SPN == spn && !e.EndTime.IsZero() {
+			return e.EndTime, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// negTokenInitAt returns an SPNEGO NegTokenInit like spnego.InitSecContext, carrying an
+// AP-REQ for tkt with the authenticator timestamped t, requesting flags and bound to the
+// channel bindings hash, if any.
+func negTokenInitAt(creds *credentials.Credentials, tkt messages.Ticket, key types.EncryptionKey, t time.Time, bindings []byte, flags ContextFlags) ([]byte, error) {
+	auth, err := types.NewAuthenticator(creds.Domain(), creds.CName())
+	if err != nil {
+		return nil, err
+	}
+	t = t.UTC()
+	auth.CTime = t.Truncate(time.Second)
+	auth.Cusec = t.Nanosecond() / int(time.Microsecond)
+	// GSS-API checksum (RFC 4121 4.1.1) carrying the channel bindings hash and the
+	// requested flags
+	cksum := make([]byte, 24)
+	binary.LittleEndian.PutUint32(cksum, 16)
+	copy(cksum[4:20], bindings)
+	binary.LittleEndian.PutUint32(cksum[20:], uint32(flags))
+	auth.Cksum = types.Checksum{CksumType: chksumtype.GSSAPI, Checksum: cksum}
+
+	apReq, err := messages.NewAPReq(tkt, key, auth)
+	if err != nil {
+		return nil, err
+	}
+	if flags&FlagMutual != 0 {
+		types.SetFlag(&apReq.APOptions, krbflags.APOptionMutualRequired)
+	}
+	b, err := apReq.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	oid, err := asn1.Marshal(asn1.ObjectIdentifier(gssapi.OIDKRB5.OID()))
+	if err != nil {
+		return nil, err
+	}
+	mech := append(append(oid, 0x01, 0x00), b...) // TOK_ID of KRB_AP_REQ
+	init := spnego.SPNEGOToken{
+		Init: true,
+		NegTokenInit: spnego.NegTokenInit{
+			MechTypes:      []gasn1.ObjectIdentifier{gssapi.OIDKRB5.OID()},
+			MechTokenBytes: asn1tools.AddASNAppTag(mech, 0),
+		},
+	}
+	return init.Marshal()
+}
+
+func (a *negotiateAuth) SetChannelBinding(appData []byte) {
+	a.bindings = channelBindingHash(appData)
+}
+
+func (a *negotiateAuth) Release() error {
+	if !a.shared {
+		a.cl.Destroy()
+	}
+	return nil
+}
+
+// loadKrb5Config loads path, $KRB5_CONFIG or /etc/krb5.conf.
+func loadKrb5Config(path string) (*config.Config, error) {
+	if path == "" {
+		path = os.Getenv("KRB5_CONFIG")
+	}
+	if path == "" {
+		path = "/etc/krb5.conf"
+	}
+	return config.Load(path)
+}
+
+// ccachePath returns path, $KRB5CCNAME or the default credential cache of the user.
+// Only file caches are supported.
+func ccachePath(path string) string {
+	if path == "" {
+		path = os.Getenv("KRB5CCNAME")
+	}
+	if path == "" {
+		return fmt.Sprintf("/tmp/krb5cc_%d", os.Getuid())
+	}
+	return strings.TrimPrefix(path, "FILE:")
+}
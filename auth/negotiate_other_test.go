@@ -0,0 +1,40 @@
+//go:build !windows
+// +build !windows
+
+package auth
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/test/testdata"
+)
+
+func TestServiceTicketEnd(t *testing.T) {
+	b, err := hex.DecodeString(testdata.CCACHE_TEST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := new(credentials.CCache)
+	if err := cc.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	cl, err := client.NewFromCCache(cc, config.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the end time of the ticket in the credential cache
+	want := time.Unix(0x5967044e, 0)
+	end, ok := serviceTicketEnd(cl, "HTTP/host.test.gokrb5")
+	if !ok || !end.Equal(want) {
+		t.Errorf("serviceTicketEnd = %s, %v, want %s", end, ok, want)
+	}
+	if _, ok := serviceTicketEnd(cl, "HTTP/other.test.gokrb5"); ok {
+		t.Error("serviceTicketEnd found a ticket for an SPN not in the cache")
+	}
+}
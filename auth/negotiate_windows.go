@@ -0,0 +1,128 @@
+// +build windows
+
+package auth
+
+import (
+	"github.com/alexbrainman/sspi"
+	"github.com/alexbrainman/sspi/negotiate"
+)
+
+type negotiateAuth struct {
+	spn      string
+	cred     *sspi.Credentials
+	flags    ContextFlags
+	secctx   *sspi.Context
+	bindings []byte
+	done     bool
+}
+
+// NewNegotiate returns an Authenticator for Negotiate (SPNEGO) targeting the service
+// principal spn, ex: "HTTP/proxy.example.com". If username and password are not both
+// supplied, the current user's credentials, ex: the Kerberos tickets of a domain-joined
+// machine, are acquired from SSPI. The username may be given as "DOMAIN\user" or
+// "user@domain" instead of setting domain. SSPI falls back to NTLM within SPNEGO when
+// Kerberos is not available, ex: when the proxy has no SPN registered.
+func NewNegotiate(spn, domain, username, password string) (Authenticator, error) {
+	return NewKerberosNegotiate(spn, domain, username, password, KerberosOptions{})
+}
+
+// NewKerberosNegotiate returns an Authenticator for Negotiate (SPNEGO). On Windows, SSPI
+// provides the Kerberos configuration and credentials, so only o.Flags is used.
+func NewKerberosNegotiate(spn, realm, username, password string, o KerberosOptions) (Authenticator, error) {
+	cred, err := acquireCredentials(realm, username, password, negotiate.AcquireUserCredentials, negotiate.AcquireCurrentUserCredentials)
+	if err != nil {
+		return nil, err
+	}
+	return &negotiateAuth{spn: spn, cred: cred, flags: o.Flags}, nil
+}
+
+func (a *negotiateAuth) Scheme() string {
+	return "Negotiate"
+}
+
+func (a *negotiateAuth) Next(challenge string) (string, error) {
+	target, err := targetName(a.spn)
+	if err != nil {
+		return "", err
+	}
+	if a.secctx == nil {
+		secctx := sspi.NewClientContext(a.cred, iscReq(a.flags))
+		done, token, err := updateContext(secctx, nil, target, a.bindings, negotiate.PackageInfo.MaxToken)
+		if err != nil {
+			return "", err
+		}
+		a.secctx, a.done = secctx, done
+		return encodeToken("Negotiate", token), nil
+	}
+	if a.done {
+		return "", ErrMalformedChallenge
+	}
+
+	c, err := decodeChallenge("Negotiate", challenge)
+	if err != nil {
+		return "", err
+	}
+	done, token, err := updateContext(a.secctx, c, target, a.bindings, negotiate.PackageInfo.MaxToken)
+	if err != nil {
+		return "", err
+	}
+	a.done = done
+	return encodeToken("Negotiate", token), nil
+}
+
+// VerifyFinal completes the security context with the token the proxy returned with its
+// success response. SSPI fails it if the proxy did not authenticate itself as requested
+// by FlagMutual. It succeeds without checking anything if mutual authentication was not
+// requested.
+func (a *negotiateAuth) VerifyFinal(challenge string) error {
+	if a.flags&FlagMutual == 0 || a.done {
+		return nil
+	}
+	if a.secctx == nil || challenge == "" {
+		return ErrMutualAuthFailed
+	}
+	target, err := targetName(a.spn)
+	if err != nil {
+		return err
+	}
+	c, err := decodeChallenge("Negotiate", challenge)
+	if err != nil {
+		return ErrMutualAuthFailed
+	}
+	done, _, err := updateContext(a.secctx, c, target, a.bindings, negotiate.PackageInfo.MaxToken)
+	if err != nil || !done {
+		return ErrMutualAuthFailed
+	}
+	a.done = true
+	return nil
+}
+
+// iscReq returns the ISC_REQ flags requesting flags.
+func iscReq(flags ContextFlags) uint32 {
+	req := uint32(sspi.ISC_REQ_CONNECTION)
+	for _, f := range []struct {
+		flag ContextFlags
+		req  uint32
+	}{
+		{FlagDelegate, sspi.ISC_REQ_DELEGATE},
+		{FlagMutual, sspi.ISC_REQ_MUTUAL_AUTH},
+		{FlagConfidentiality, sspi.ISC_REQ_CONFIDENTIALITY},
+		{FlagIntegrity, sspi.ISC_REQ_INTEGRITY},
+	} {
+		if flags&f.flag != 0 {
+			req |= f.req
+		}
+	}
+	return req
+}
+
+func (a *negotiateAuth) SetChannelBinding(appData []byte) {
+	a.bindings = secChannelBindings(appData)
+}
+
+func (a *negotiateAuth) Release() error {
+	if a.secctx != nil {
+		a.secctx.Release()
+	}
+	return a.cred.Release()
+}
@@ -0,0 +1,41 @@
+package auth
+
+// NTLMOptions configure the pure Go NTLMv2 implementation, used on platforms other than
+// Windows and with NT hashes, for proxies rejecting its defaults. On Windows, SSPI
+// follows the LAN Manager authentication level of the host and only the NTLMSign and
+// NTLMSeal Flags are used.
+type NTLMOptions struct {
+	Workstation string    // Workstation name sent to the proxy. Defaults to the host name, up to its first dot.
+	Flags       NTLMFlags // Negotiate flags requested in place of NTLMDefaultFlags if not zero, ex: NTLMDefaultFlags|NTLMSign|NTLMSeal. Unicode, NTLM and extended session security are always requested.
+	// V2Only sends no LMv2 response, as Windows hosts with LmCompatibilityLevel 5 do, and
+	// refuses challenges without target info, which only servers unable to verify NTLMv2
+	// responses send.
+	V2Only bool
+	// ValidateTargetInfo refuses challenges whose target info is malformed or lacks the
+	// NetBIOS computer and domain names MS-NLMP requires, ex: because it was tampered with.
+	ValidateTargetInfo bool
+}
+
+// NTLMFlags are NTLM negotiate flags (MS-NLMP 2.2.2.5).
+type NTLMFlags uint32
+
+const (
+	// NTLMSign requests session security with message integrity.
+	NTLMSign NTLMFlags = ntlmNegotiateSign
+	// NTLMSeal requests session security with message confidentiality.
+	NTLMSeal NTLMFlags = ntlmNegotiateSeal
+	// NTLMAlwaysSign requests a signature even when no session security was negotiated.
+	NTLMAlwaysSign NTLMFlags = ntlmNegotiateAlwaysSign
+	// NTLMKeyExchange requests a random session key, sent encrypted.
+	NTLMKeyExchange NTLMFlags = ntlmNegotiateKeyExch
+	// NTLMDefaultFlags are the flags requested when NTLMOptions.Flags is zero.
+	NTLMDefaultFlags NTLMFlags = ntlmClientFlags
+)
+
+// flags returns the negotiate flags requested with o.
+func (o NTLMOptions) flags() uint32 {
+	if o.Flags == 0 {
+		return ntlmClientFlags
+	}
+	return uint32(o.Flags) | ntlmNegotiateUnicode | ntlmNegotiateNTLM | ntlmNegotiateExtendedSecurity
+}
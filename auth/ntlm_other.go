@@ -0,0 +1,47 @@
+// +build !windows
+
+package auth
+
+import "errors"
+
+type ntlmAuth struct {
+	domain, username, password string
+	options                    NTLMOptions
+	bindings                   []byte
+	negotiated                 bool
+}
+
+// NewNTLM returns an Authenticator for NTLMv2 using the supplied credentials. The
+// username may be given as "DOMAIN\user" or "user@domain" instead of setting domain.
+func NewNTLM(domain, username, password string) (Authenticator, error) {
+	return NewNTLMWithOptions(domain, username, password, NTLMOptions{})
+}
+
+// NewNTLMWithOptions is like NewNTLM, configured by o.
+func NewNTLMWithOptions(domain, username, password string, o NTLMOptions) (Authenticator, error) {
+	return &ntlmAuth{domain: domain, username: username, password: password, options: o}, nil
+}
+
+func (a *ntlmAuth) Scheme() string {
+	return "NTLM"
+}
+
+func (a *ntlmAuth) Next(challenge string) (string, error) {
+	if !a.negotiated {
+		a.negotiated = true
+		return encodeToken("NTLM", ntlmNegotiateMessage(a.options.flags())), nil
+	}
+
+	if a.username == "" && a.password == "" {
+		return "", errors.New("NTLM requires a username and password on this platform")
+	}
+	return ntlmAuthenticate(challenge, a.domain, a.username, ntHash(a.password), a.options, a.bindings)
+}
+
+func (a *ntlmAuth) SetChannelBinding(appData []byte) {
+	a.bindings = channelBindingHash(appData)
+}
+
+func (a *ntlmAuth) Release() error {
+	return nil
+}
@@ -0,0 +1,76 @@
+// +build windows
+
+package auth
+
+import (
+	"github.com/alexbrainman/sspi"
+	"github.com/alexbrainman/sspi/ntlm"
+)
+
+type ntlmAuth struct {
+	cred     *sspi.Credentials
+	flags    NTLMFlags
+	secctx   *sspi.Context
+	bindings []byte
+}
+
+// NewNTLM returns an Authenticator for NTLM. If username and password are not both
+// supplied, the current user's credentials are acquired from SSPI. The username may be
+// given as "DOMAIN\user" or "user@domain" instead of setting domain.
+func NewNTLM(domain, username, password string) (Authenticator, error) {
+	return NewNTLMWithOptions(domain, username, password, NTLMOptions{})
+}
+
+// NewNTLMWithOptions is like NewNTLM, requesting the session security of o.Flags. The
+// other options are left to SSPI.
+func NewNTLMWithOptions(domain, username, password string, o NTLMOptions) (Authenticator, error) {
+	cred, err := acquireCredentials(domain, username, password, ntlm.AcquireUserCredentials, ntlm.AcquireCurrentUserCredentials)
+	if err != nil {
+		return nil, err
+	}
+	return &ntlmAuth{cred: cred, flags: o.Flags}, nil
+}
+
+func (a *ntlmAuth) Scheme() string {
+	return "NTLM"
+}
+
+func (a *ntlmAuth) Next(challenge string) (string, error) {
+	if a.secctx == nil {
+		req := uint32(sspi.ISC_REQ_CONNECTION)
+		if a.flags&NTLMSign != 0 {
+			req |= sspi.ISC_REQ_INTEGRITY
+		}
+		if a.flags&NTLMSeal != 0 {
+			req |= sspi.ISC_REQ_CONFIDENTIALITY
+		}
+		secctx := sspi.NewClientContext(a.cred, req)
+		_, negotiate, err := updateContext(secctx, nil, nil, a.bindings, ntlm.PackageInfo.MaxToken)
+		if err != nil {
+			return "", err
+		}
+		a.secctx = secctx
+		return encodeToken("NTLM", negotiate), nil
+	}
+
+	c, err := decodeChallenge("NTLM", challenge)
+	if err != nil {
+		return "", err
+	}
+	_, authenticate, err := updateContext(a.secctx, c, nil, a.bindings, ntlm.PackageInfo.MaxToken)
+	if err != nil {
+		return "", err
+	}
+	return encodeToken("NTLM", authenticate), nil
+}
+
+func (a *ntlmAuth) SetChannelBinding(appData []byte) {
+	a.bindings = secChannelBindings(appData)
+}
+
+func (a *ntlmAuth) Release() error {
+	if a.secctx != nil {
+		a.secctx.Release()
+	}
+	return a.cred.Release()
+}
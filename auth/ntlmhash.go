@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+)
+
+type ntlmHashAuth struct {
+	domain, username string
+	hash             []byte
+	options          NTLMOptions
+	bindings         []byte
+	negotiated       bool
+}
+
+// NewNTLMHash returns an Authenticator for NTLMv2 using the NT hash of the password,
+// hex encoded, instead of the password itself, ex: for service accounts whose password
+// is only stored hashed. It uses the pure Go implementation on every platform, since SSPI
+// does not accept hashes. The username may be given as "DOMAIN\user" or "user@domain"
+// instead of setting domain.
+func NewNTLMHash(domain, username, ntHash string) (Authenticator, error) {
+	return NewNTLMHashWithOptions(domain, username, ntHash, NTLMOptions{})
+}
+
+// NewNTLMHashWithOptions is like NewNTLMHash, configured by o.
+func NewNTLMHashWithOptions(domain, username, ntHash string, o NTLMOptions) (Authenticator, error) {
+	hash, err := hex.DecodeString(strings.TrimSpace(ntHash))
+	if err != nil || len(hash) != 16 {
+		return nil, errors.New("NT hash must be 32 hexadecimal characters")
+	}
+	if username == "" {
+		return nil, errors.New("NTLM with an NT hash requires a username")
+	}
+	return &ntlmHashAuth{domain: domain, username: username, hash: hash, options: o}, nil
+}
+
+func (a *ntlmHashAuth) Scheme() string {
+	return "NTLM"
+}
+
+func (a *ntlmHashAuth) Next(challenge string) (string, error) {
+	if !a.negotiated {
+		a.negotiated = true
+		return encodeToken("NTLM", ntlmNegotiateMessage(a.options.flags())), nil
+	}
+	return ntlmAuthenticate(challenge, a.domain, a.username, a.hash, a.options, a.bindings)
+}
+
+func (a *ntlmHashAuth) SetChannelBinding(appData []byte) {
+	a.bindings = channelBindingHash(appData)
+}
+
+func (a *ntlmHashAuth) Release() error {
+	return nil
+}
+
+// ntlmAuthenticate returns the Proxy-Authorization value answering the NTLM challenge
+// header value with the NT hash of the password and the channel bindings hash, if any.
+func ntlmAuthenticate(challenge, domain, username string, ntHash []byte, o NTLMOptions, bindings []byte) (string, error) {
+	c, err := decodeChallenge("NTLM", challenge)
+	if err != nil {
+		return "", err
+	}
+	if o.Workstation == "" {
+		o.Workstation, _ = os.Hostname()
+		if i := strings.IndexByte(o.Workstation, '.'); i > 0 {
+			o.Workstation = o.Workstation[:i]
+		}
+	}
+	authenticate, err := ntlmAuthenticateMessage(c, domain, username, ntHash, o, bindings)
+	if err != nil {
+		return "", err
+	}
+	return encodeToken("NTLM", authenticate), nil
+}
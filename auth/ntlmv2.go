@@ -0,0 +1,296 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// NTLM negotiate flags (MS-NLMP 2.2.2.5) used by the pure Go implementation.
+const (
+	ntlmNegotiateUnicode          = 0x00000001
+	ntlmNegotiateOEM              = 0x00000002
+	ntlmRequestTarget             = 0x00000004
+	ntlmNegotiateSign             = 0x00000010
+	ntlmNegotiateSeal             = 0x00000020
+	ntlmNegotiateNTLM             = 0x00000200
+	ntlmNegotiateAlwaysSign       = 0x00008000
+	ntlmNegotiateExtendedSecurity = 0x00080000
+	ntlmNegotiateTargetInfo       = 0x00800000
+	ntlmNegotiate128              = 0x20000000
+	ntlmNegotiateKeyExch          = 0x40000000
+	ntlmNegotiate56               = 0x80000000
+
+	ntlmClientFlags = ntlmNegotiateUnicode | ntlmNegotiateOEM | ntlmRequestTarget | ntlmNegotiateNTLM |
+		ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSecurity | ntlmNegotiateTargetInfo |
+		ntlmNegotiate128 | ntlmNegotiateKeyExch | ntlmNegotiate56
+)
+
+// AV_PAIR IDs (MS-NLMP 2.2.2.1) of the challenge target info.
+const (
+	ntlmAvEOL             = 0
+	ntlmAvNbComputerName  = 1
+	ntlmAvNbDomainName    = 2
+	ntlmAvTimestamp       = 7
+	ntlmAvChannelBindings = 10
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// ntlmChallenge is the content of an NTLM CHALLENGE message used to compute the response.
+type ntlmChallenge struct {
+	flags      uint32
+	target     string
+	challenge  []byte
+	targetInfo []byte
+}
+
+// ntlmNegotiateMessage returns an NTLM NEGOTIATE message requesting flags, without domain
+// or workstation.
+func ntlmNegotiateMessage(flags uint32) []byte {
+	b := make([]byte, 32)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 1)
+	binary.LittleEndian.PutUint32(b[12:], flags)
+	// empty domain and workstation fields point at the end of the message
+	binary.LittleEndian.PutUint32(b[20:], 32)
+	binary.LittleEndian.PutUint32(b[28:], 32)
+	return b
+}
+
+// parseNTLMChallenge decodes an NTLM CHALLENGE message.
+func parseNTLMChallenge(b []byte) (*ntlmChallenge, error) {
+	if len(b) < 32 || !bytes.Equal(b[:8], ntlmSignature) || binary.LittleEndian.Uint32(b[8:]) != 2 {
+		return nil, ErrMalformedChallenge
+	}
+	c := &ntlmChallenge{
+		flags:     binary.LittleEndian.Uint32(b[20:]),
+		challenge: b[24:32],
+	}
+	target, ok := ntlmField(b, 12)
+	if !ok {
+		return nil, ErrMalformedChallenge
+	}
+	if c.flags&ntlmNegotiateUnicode != 0 {
+		c.target = fromUTF16(target)
+	} else {
+		c.target = string(target)
+	}
+	if len(b) >= 48 {
+		if c.targetInfo, ok = ntlmField(b, 40); !ok {
+			return nil, ErrMalformedChallenge
+		}
+	}
+	return c, nil
+}
+
+// ntlmField returns the payload referenced by the length/offset field at off.
+func ntlmField(b []byte, off int) ([]byte, bool) {
+	n := int(binary.LittleEndian.Uint16(b[off:]))
+	start := int(binary.LittleEndian.Uint32(b[off+4:]))
+	if n == 0 {
+		return nil, true
+	}
+	if start < 0 || start+n > len(b) {
+		return nil, false
+	}
+	return b[start : start+n], true
+}
+
+// ntlmAuthenticateMessage returns the NTLMv2 AUTHENTICATE message answering challenge,
+// computed from the NT hash of the password. If domain is empty, it is taken from a
+// "DOMAIN\user" username, then from the challenge. bindings is the hash of the channel
+// bindings, if any.
+func ntlmAuthenticateMessage(challenge []byte, domain, username string, ntHash []byte, o NTLMOptions, bindings []byte) ([]byte, error) {
+	c, err := parseNTLMChallenge(challenge)
+	if err != nil {
+		return nil, err
+	}
+	if c.flags&ntlmNegotiateUnicode == 0 {
+		return nil, errors.New("NTLM proxy does not support unicode")
+	}
+	if o.V2Only && len(c.targetInfo) == 0 {
+		return nil, errors.New("NTLM proxy sent no target info, required for NTLMv2 only")
+	}
+	if o.ValidateTargetInfo {
+		if err := validateTargetInfo(c.targetInfo); err != nil {
+			return nil, err
+		}
+	}
+	if i := strings.IndexByte(username, '\\'); i >= 0 && domain == "" {
+		domain, username = username[:i], username[i+1:]
+	}
+	if domain == "" && !strings.Contains(username, "@") {
+		domain = c.target
+	}
+
+	hash := ntowfv2(domain, username, ntHash)
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+	timestamp, fromServer := ntlmTimestamp(c.targetInfo)
+	targetInfo := c.targetInfo
+	if bindings != nil {
+		targetInfo = withAvPair(targetInfo, ntlmAvChannelBindings, bindings)
+	}
+
+	// NTLMv2_CLIENT_CHALLENGE (MS-NLMP 2.2.2.7)
+	temp := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	temp = append(temp, timestamp...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	proof := hmacMD5(hash, c.challenge, temp)
+	nt := append(proof, temp...)
+	// the LMv2 response is omitted when the server provides its time
+	lm := make([]byte, 24)
+	if !fromServer && !o.V2Only {
+		lm = append(hmacMD5(hash, c.challenge, clientChallenge), clientChallenge...)
+	}
+
+	flags := c.flags & o.flags()
+	var sessionKey []byte
+	if flags&ntlmNegotiateKeyExch != 0 {
+		exported := make([]byte, 16)
+		if _, err := rand.Read(exported); err != nil {
+			return nil, err
+		}
+		cipher, err := rc4.NewCipher(hmacMD5(hash, proof))
+		if err != nil {
+			return nil, err
+		}
+		sessionKey = make([]byte, 16)
+		cipher.XORKeyStream(sessionKey, exported)
+	}
+
+	payloads := [][]byte{lm, nt, toUTF16(domain), toUTF16(username), toUTF16(strings.ToUpper(o.Workstation)), sessionKey}
+	b := make([]byte, 64)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 3)
+	off := len(b)
+	for i, p := range payloads {
+		field := 12 + i*8
+		binary.LittleEndian.PutUint16(b[field:], uint16(len(p)))
+		binary.LittleEndian.PutUint16(b[field+2:], uint16(len(p)))
+		binary.LittleEndian.PutUint32(b[field+4:], uint32(off))
+		off += len(p)
+	}
+	binary.LittleEndian.PutUint32(b[60:], flags)
+	for _, p := range payloads {
+		b = append(b, p...)
+	}
+	return b, nil
+}
+
+// ntowfv2 returns the NTLMv2 one-way function of the credentials (MS-NLMP 3.3.2).
+func ntowfv2(domain, username string, ntHash []byte) []byte {
+	return hmacMD5(ntHash, toUTF16(strings.ToUpper(username)+domain))
+}
+
+// ntHash returns the NT hash of password: MD4 of its UTF-16 encoding.
+func ntHash(password string) []byte {
+	h := md4.New()
+	h.Write(toUTF16(password))
+	return h.Sum(nil)
+}
+
+// ntlmTimestamp returns the server time from targetInfo, or the current time, as a
+// little-endian FILETIME. It reports whether the time came from the server.
+func ntlmTimestamp(targetInfo []byte) ([]byte, bool) {
+	for b := targetInfo; len(b) >= 4; {
+		id, n := binary.LittleEndian.Uint16(b), int(binary.LittleEndian.Uint16(b[2:]))
+		if id == ntlmAvEOL || len(b) < 4+n {
+			break
+		}
+		if id == ntlmAvTimestamp && n == 8 {
+			return b[4:12], true
+		}
+		b = b[4+n:]
+	}
+	ts := make([]byte, 8)
+	// 100ns intervals since January 1, 1601
+	binary.LittleEndian.PutUint64(ts, uint64(time.Now().UnixNano()/100+116444736000000000))
+	return ts, false
+}
+
+// validateTargetInfo returns an error if targetInfo is not a well-formed AV_PAIR list
+// including the NetBIOS computer and domain names (MS-NLMP 2.2.2.1).
+func validateTargetInfo(targetInfo []byte) error {
+	seen := map[uint16]bool{}
+	for b := targetInfo; ; {
+		if len(b) < 4 {
+			return errors.New("NTLM challenge target info is malformed")
+		}
+		id, n := binary.LittleEndian.Uint16(b), int(binary.LittleEndian.Uint16(b[2:]))
+		if id == ntlmAvEOL {
+			break
+		}
+		if len(b) < 4+n {
+			return errors.New("NTLM challenge target info is malformed")
+		}
+		seen[id] = true
+		b = b[4+n:]
+	}
+	if !seen[ntlmAvNbComputerName] || !seen[ntlmAvNbDomainName] {
+		return errors.New("NTLM challenge target info lacks the NetBIOS computer or domain name")
+	}
+	return nil
+}
+
+// withAvPair returns a copy of targetInfo with the AV_PAIR id set to value, before the
+// terminating MsvAvEOL.
+func withAvPair(targetInfo []byte, id uint16, value []byte) []byte {
+	var b []byte
+	for rest := targetInfo; len(rest) >= 4; {
+		pid, n := binary.LittleEndian.Uint16(rest), int(binary.LittleEndian.Uint16(rest[2:]))
+		if pid == ntlmAvEOL || len(rest) < 4+n {
+			break
+		}
+		if pid != id {
+			b = append(b, rest[:4+n]...)
+		}
+		rest = rest[4+n:]
+	}
+	pair := make([]byte, 4, 4+len(value))
+	binary.LittleEndian.PutUint16(pair, id)
+	binary.LittleEndian.PutUint16(pair[2:], uint16(len(value)))
+	b = append(b, append(pair, value...)...)
+	return append(b, 0, 0, 0, 0)
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	h := hmac.New(md5.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func toUTF16(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, r := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], r)
+	}
+	return b
+}
+
+func fromUTF16(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
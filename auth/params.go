@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"strings"
+)
+
+// parseParams parses the comma separated auth-params of a challenge, such as
+// `realm="proxy", nonce="abc", qop="auth,auth-int"`. Parameter names are lowercased.
+func parseParams(s string) map[string]string {
+	params := map[string]string{}
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return params
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			value = b.String()
+			if i < len(s) {
+				i++
+			}
+			s = s[i:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		params[name] = value
+	}
+}
+
+// SplitChallenges returns the challenges of Proxy-Authenticate header values, one per
+// element. Proxies may send several challenges in one header, separated by commas, ex:
+// `Negotiate, NTLM, Basic realm="corp"`, as well as one per header.
+func SplitChallenges(values []string) []string {
+	var challenges []string
+	for _, v := range values {
+		for _, elem := range splitList(v) {
+			elem = strings.TrimSpace(elem)
+			if elem == "" {
+				continue
+			}
+			if len(challenges) > 0 && isAuthParam(elem) {
+				// a parameter of the previous challenge
+				challenges[len(challenges)-1] += ", " + elem
+				continue
+			}
+			challenges = append(challenges, elem)
+		}
+	}
+	return challenges
+}
+
+// ChallengeParams returns the auth-params of a challenge, ex: "realm" for
+// `Basic realm="corp"`. Parameter names are lowercased. Challenges carrying a token
+// instead, ex: NTLM, have none.
+func ChallengeParams(challenge string) map[string]string {
+	_, rest := splitScheme(challenge)
+	if rest == "" || isToken68(rest) {
+		return map[string]string{}
+	}
+	return parseParams(rest)
+}
+
+// ChallengeScheme returns the auth-scheme of a challenge as sent, ex: "NTLM" for
+// "NTLM TlRMTVNTUAACAAAA". Schemes are case-insensitive.
+func ChallengeScheme(challenge string) string {
+	scheme, _ := splitScheme(challenge)
+	return scheme
+}
+
+// challengeToken returns the token68 of challenge if its scheme is scheme, ex: the
+// base64 NTLM message of "NTLM TlRMTVNTUAACAAAA". ok is false for other schemes.
+func challengeToken(challenge, scheme string) (token string, ok bool) {
+	s, rest := splitScheme(challenge)
+	if !strings.EqualFold(s, scheme) {
+		return "", false
+	}
+	return rest, true
+}
+
+// splitScheme splits challenge into its auth-scheme and the token68 or auth-params
+// following it, separated by spaces or tabs.
+func splitScheme(challenge string) (scheme, rest string) {
+	challenge = strings.TrimSpace(challenge)
+	i := strings.IndexAny(challenge, " \t")
+	if i < 0 {
+		return challenge, ""
+	}
+	return challenge[:i], strings.TrimSpace(challenge[i+1:])
+}
+
+// isToken68 reports whether s is a token68 (RFC 7235), ex: base64 data.
+func isToken68(s string) bool {
+	t := strings.TrimRight(s, "=")
+	if t == "" {
+		return false
+	}
+	for i := 0; i < len(t); i++ {
+		c := t[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~+/", c) >= 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitList splits s at the commas outside of quoted strings.
+func splitList(s string) []string {
+	var elems []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == ',' && !quoted:
+			elems = append(elems, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(elems, s[start:])
+}
+
+// isAuthParam reports whether a list element is an auth-param, `name=value`, rather than
+// the start of a challenge, a scheme optionally followed by a space.
+func isAuthParam(elem string) bool {
+	i := strings.IndexAny(elem, " \t=")
+	return i > 0 && strings.HasPrefix(strings.TrimLeft(elem[i:], " \t"), "=")
+}
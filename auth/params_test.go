@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitChallenges(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   []string
+	}{
+		{[]string{"Negotiate, NTLM"}, []string{"Negotiate", "NTLM"}},
+		{[]string{"Negotiate", "NTLM"}, []string{"Negotiate", "NTLM"}},
+		{[]string{`Negotiate, NTLM, Basic realm="corp"`}, []string{"Negotiate", "NTLM", `Basic realm="corp"`}},
+		{[]string{"NTLM TlRMTVNTUAACAAAA==, Basic realm=x"}, []string{"NTLM TlRMTVNTUAACAAAA==", "Basic realm=x"}},
+		{
+			[]string{`Digest realm="a, b", nonce="n", qop="auth,auth-int", Basic realm="corp"`},
+			[]string{`Digest realm="a, b", nonce="n", qop="auth,auth-int"`, `Basic realm="corp"`},
+		},
+		{
+			[]string{`Digest realm="say \"hi\", ok", nonce="n"`, "NTLM"},
+			[]string{`Digest realm="say \"hi\", ok", nonce="n"`, "NTLM"},
+		},
+		{[]string{" , Basic realm=corp ,, "}, []string{"Basic realm=corp"}},
+		{[]string{""}, nil},
+		{nil, nil},
+	}
+	for _, tt := range tests {
+		if got := SplitChallenges(tt.values); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitChallenges(%q) = %q, want %q", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestChallengeParams(t *testing.T) {
+	tests := []struct {
+		challenge string
+		want      map[string]string
+	}{
+		{`Basic realm="corp"`, map[string]string{"realm": "corp"}},
+		{
+			`Digest Realm="a, b", nonce="n", qop="auth,auth-int", algorithm=MD5`,
+			map[string]string{"realm": "a, b", "nonce": "n", "qop": "auth,auth-int", "algorithm": "MD5"},
+		},
+		{`Digest realm="say \"hi\""`, map[string]string{"realm": `say "hi"`}},
+		{`Digest realm="unterminated`, map[string]string{"realm": "unterminated"}},
+		{"NTLM TlRMTVNTUAACAAAA==", map[string]string{}},
+		{"Negotiate", map[string]string{}},
+	}
+	for _, tt := range tests {
+		if got := ChallengeParams(tt.challenge); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ChallengeParams(%q) = %q, want %q", tt.challenge, got, tt.want)
+		}
+	}
+}
+
+func FuzzSplitChallenges(f *testing.F) {
+	for _, s := range []string{
+		"Negotiate, NTLM",
+		`Basic realm="corp"`,
+		`Digest realm="a, b", nonce="n", qop="auth,auth-int", algorithm=MD5-sess`,
+		`Digest realm="say \"hi\", ok", nonce="n", Basic realm=x`,
+		"NTLM TlRMTVNTUAACAAAA==",
+		`Digest realm="unterminated, NTLM`,
+		`=, "=,\`,
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		for _, c := range SplitChallenges([]string{value}) {
+			if c == "" || strings.TrimSpace(c) != c {
+				t.Fatalf("SplitChallenges(%q) returned challenge %q, not trimmed or empty", value, c)
+			}
+			if ChallengeScheme(c) == "" {
+				t.Fatalf("SplitChallenges(%q) returned challenge %q without a scheme", value, c)
+			}
+			for name := range ChallengeParams(c) {
+				if name != strings.ToLower(name) {
+					t.Fatalf("ChallengeParams(%q) returned parameter %q, not lowercased", c, name)
+				}
+			}
+		}
+	})
+}
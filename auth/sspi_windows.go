@@ -0,0 +1,81 @@
+// +build windows
+
+package auth
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"syscall"
+
+	"github.com/alexbrainman/sspi"
+)
+
+// secbufferChannelBindings is the SecBuffer type of SEC_CHANNEL_BINDINGS.
+const secbufferChannelBindings = 14
+
+// secChannelBindings returns a SEC_CHANNEL_BINDINGS structure carrying appData without
+// addresses.
+func secChannelBindings(appData []byte) []byte {
+	b := make([]byte, 32, 32+len(appData))
+	binary.LittleEndian.PutUint32(b[24:], uint32(len(appData)))
+	binary.LittleEndian.PutUint32(b[28:], 32)
+	return append(b, appData...)
+}
+
+// updateContext advances the client context c with the input token in, like the sspi
+// packages do, also passing the SEC_CHANNEL_BINDINGS bindings if set. It returns whether
+// authentication completed and the output token of at most maxToken bytes.
+func updateContext(c *sspi.Context, in []byte, targetName *uint16, bindings []byte, maxToken uint32) (bool, []byte, error) {
+	out := make([]byte, maxToken)
+	var inBuf [2]sspi.SecBuffer
+	var outBuf [1]sspi.SecBuffer
+	inBuf[0].Set(sspi.SECBUFFER_TOKEN, in)
+	n := uint32(1)
+	if bindings != nil {
+		inBuf[1].Set(secbufferChannelBindings, bindings)
+		n++
+	}
+	inBufs := &sspi.SecBufferDesc{Version: sspi.SECBUFFER_VERSION, BuffersCount: n, Buffers: &inBuf[0]}
+	outBuf[0].Set(sspi.SECBUFFER_TOKEN, out)
+	outBufs := &sspi.SecBufferDesc{Version: sspi.SECBUFFER_VERSION, BuffersCount: 1, Buffers: &outBuf[0]}
+
+	done := false
+	switch ret := c.Update(targetName, outBufs, inBufs); ret {
+	case sspi.SEC_E_OK:
+		done = true
+	case sspi.SEC_I_COMPLETE_NEEDED, sspi.SEC_I_COMPLETE_AND_CONTINUE:
+		if ret := sspi.CompleteAuthToken(c.Handle, outBufs); ret != sspi.SEC_E_OK {
+			return false, nil, ret
+		}
+	case sspi.SEC_I_CONTINUE_NEEDED:
+	default:
+		return false, nil, ret
+	}
+	out = out[:outBuf[0].BufferSize]
+	if len(out) == 0 && !done {
+		return false, nil, errors.New("SSPI returned an empty token")
+	}
+	return done, out, nil
+}
+
+// acquireCredentials returns the SSPI credentials of username with user, or those of the
+// current user with current if username or password is empty. The username may be given
+// as "DOMAIN\user" or "user@domain" instead of setting domain.
+func acquireCredentials(domain, username, password string, user func(domain, username, password string) (*sspi.Credentials, error), current func() (*sspi.Credentials, error)) (*sspi.Credentials, error) {
+	if username == "" || password == "" {
+		return current()
+	}
+	if i := strings.IndexByte(username, '\\'); i >= 0 && domain == "" {
+		domain, username = username[:i], username[i+1:]
+	}
+	return user(domain, username, password)
+}
+
+// targetName returns the UTF-16 form of spn passed to SSPI, or nil if spn is empty.
+func targetName(spn string) (*uint16, error) {
+	if spn == "" {
+		return nil, nil
+	}
+	return syscall.UTF16PtrFromString(spn)
+}
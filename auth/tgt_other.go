@@ -0,0 +1,145 @@
+//go:build !windows
+// +build !windows
+
+package auth
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+)
+
+// tgtCheckInterval is how often a TGTManager checks its TGT.
+const tgtCheckInterval = time.Minute
+
+// TGTManager keeps a Kerberos login for Negotiate across authentications, for long running
+// services: the TGT is obtained when it is created, then renewed before it expires, or
+// obtained again with the keytab or password once it can no longer be renewed. Logins
+// from a credential cache are reloaded when the cache is replaced, ex: by k5start or a
+// kinit cron job. Service tickets are shared by the authentications using it.
+type TGTManager struct {
+	realm, username, password string
+	o                         KerberosOptions
+
+	mu      sync.Mutex
+	cl      *client.Client
+	ccache  string    // credential cache the login was loaded from, if any
+	modTime time.Time // modification time of ccache when loaded
+	err     error     // error of the last check
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewTGTManager logs in with the credentials NewKerberosNegotiate would use and keeps
+// the login valid in the background until Close.
+func NewTGTManager(realm, username, password string, o KerberosOptions) (*TGTManager, error) {
+	m := &TGTManager{realm: realm, username: username, password: password, o: o, stop: make(chan struct{})}
+	if err := m.Renew(); err != nil {
+		return nil, err
+	}
+	go m.run()
+	return m, nil
+}
+
+// Renew logs in again, discarding the TGT and the service tickets obtained so far, ex:
+// after a proxy rejected a ticket issued before its key changed.
+func (m *TGTManager) Renew() error {
+	o := m.o
+	o.TGT = nil
+	cl, err := newKerberosClient(m.realm, m.username, m.password, o)
+	if err != nil {
+		return err
+	}
+	if err := cl.AffirmLogin(); err != nil {
+		cl.Destroy()
+		return err
+	}
+	var modTime time.Time
+	ccache := ""
+	if o.KeytabPath == "" && (m.username == "" || m.password == "") {
+		ccache = ccachePath(o.CCachePath)
+		if fi, err := os.Stat(ccache); err == nil {
+			modTime = fi.ModTime()
+		}
+	}
+
+	m.mu.Lock()
+	old := m.cl
+	m.cl, m.ccache, m.modTime, m.err = cl, ccache, modTime, nil
+	m.mu.Unlock()
+	if old != nil {
+		// authentications in progress may still use the previous login
+		time.AfterFunc(tgtCheckInterval, old.Destroy)
+	}
+	return nil
+}
+
+// Err returns the error of the last background check of the TGT, or nil if it is valid.
+func (m *TGTManager) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// Close stops renewing the TGT and destroys the login.
+func (m *TGTManager) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.stop)
+		m.mu.Lock()
+		m.cl.Destroy()
+		m.mu.Unlock()
+	})
+	return nil
+}
+
+// client returns the current login.
+func (m *TGTManager) client() (*client.Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	select {
+	case <-m.stop:
+		return nil, errors.New("the TGT manager is closed")
+	default:
+	}
+	return m.cl, nil
+}
+
+// run checks the TGT every tgtCheckInterval until Close.
+func (m *TGTManager) run() {
+	t := time.NewTicker(tgtCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-t.C:
+		}
+		m.check()
+	}
+}
+
+// check reloads a replaced credential cache, or else has the client renew its TGT when
+// due. gokrb5 renews it in the background, but gives up when the KDC is unreachable at
+// that time, so an expired TGT is obtained again here.
+func (m *TGTManager) check() {
+	m.mu.Lock()
+	cl, ccache, modTime := m.cl, m.ccache, m.modTime
+	m.mu.Unlock()
+	if ccache != "" {
+		if fi, err := os.Stat(ccache); err == nil && !fi.ModTime().Equal(modTime) {
+			m.setErr(m.Renew())
+			return
+		}
+	}
+	m.setErr(cl.AffirmLogin())
+}
+
+func (m *TGTManager) setErr(err error) {
+	m.mu.Lock()
+	m.err = err
+	m.mu.Unlock()
+}
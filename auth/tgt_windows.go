@@ -0,0 +1,30 @@
+//go:build windows
+// +build windows
+
+package auth
+
+// TGTManager keeps a Kerberos login for Negotiate across authentications, for long running
+// services. On Windows, the LSA obtains and renews the tickets SSPI uses, so it does
+// nothing.
+type TGTManager struct{}
+
+// NewTGTManager returns a TGTManager. On Windows, SSPI provides the credentials, so the
+// arguments are ignored.
+func NewTGTManager(realm, username, password string, o KerberosOptions) (*TGTManager, error) {
+	return &TGTManager{}, nil
+}
+
+// Renew does nothing on Windows.
+func (m *TGTManager) Renew() error {
+	return nil
+}
+
+// Err returns nil on Windows.
+func (m *TGTManager) Err() error {
+	return nil
+}
+
+// Close does nothing on Windows.
+func (m *TGTManager) Close() error {
+	return nil
+}
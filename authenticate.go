@@ -0,0 +1,117 @@
+package proxyplease
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// ErrConnectionUsed is returned by Authenticate when the handshake needs another
+// connection to the proxy, ex: because the proxy closed the connection after a 407.
+var ErrConnectionUsed = errors.New("handshake needs another connection to the proxy; use AuthenticateDial")
+
+// Authenticate performs the handshake of a dial through the proxy at p.URL over conn, a
+// connection to the proxy established by the caller, and returns the tunnel to addr. The
+// CONNECT exchange or SOCKS negotiation and the authentication are those of
+// NewDialContext, so custom transports, ex: uTLS or SSH-tunneled sockets, can reuse them.
+// For https:// proxies, conn must already carry TLS. When the proxy challenges, the
+// authentication continues on conn if the proxy keeps it open, and fails with
+// ErrConnectionUsed otherwise; use AuthenticateDial to reconnect instead.
+func Authenticate(ctx context.Context, conn net.Conn, p Proxy, addr string) (net.Conn, error) {
+	p.ReuseAuthConnection = true
+	used := false
+	return AuthenticateDial(ctx, func(ctx context.Context) (net.Conn, error) {
+		if used {
+			return nil, ErrConnectionUsed
+		}
+		used = true
+		return conn, nil
+	}, p, addr)
+}
+
+// AuthenticateDial is like Authenticate, calling dial for each connection to the proxy the
+// handshake needs.
+func AuthenticateDial(ctx context.Context, dial func(ctx context.Context) (net.Conn, error), p Proxy, addr string) (net.Conn, error) {
+	if p.URL == nil || p.URL.String() == "" {
+		return nil, errors.New("Proxy.URL is required to authenticate")
+	}
+	p.Headers = snapshotHeaders(p.Headers)
+	if p.TargetURL == nil {
+		p.TargetURL = defaultTargetURL()
+	}
+	p.TargetURL = toASCIIURL(p.TargetURL)
+	p = withProxyURL(p, p.URL)
+	// the caller connects to the proxy, so its scheme cannot be probed
+	p.DetectScheme = false
+	return handshake(ctx, p, addr, func(ctx context.Context, p Proxy) (net.Conn, error) {
+		return dial(ctx)
+	})
+}
+
+// authConns provides the connections to the proxy of the authentication attempts of a
+// handshake. With Proxy.ReuseAuthConnection, a connection the proxy keeps open after
+// rejecting a CONNECT is drained and handed to the next attempt; otherwise it is closed,
+// so rejected connections are not left half-read.
+type authConns struct {
+	p    Proxy
+	dial func() (net.Conn, error)
+	idle net.Conn // kept open for the next attempt
+}
+
+// next returns the connection kept for the next attempt, or a new connection.
+func (a *authConns) next() (net.Conn, error) {
+	if a.idle == nil {
+		return a.dial()
+	}
+	conn := a.idle
+	a.idle = nil
+	return conn, nil
+}
+
+// rejected keeps conn for the next attempt, or closes it, after the proxy answered resp.
+func (a *authConns) rejected(conn net.Conn, resp *http.Response) {
+	// proxies announcing more body than they send would block the drain
+	if a.p.ReuseAuthConnection && !resp.Close && !a.p.Quirks.NoBodyDrain {
+		if err := resp.Body.Close(); err == nil {
+			a.p.debugf("connect> Keeping the connection open for the next authentication attempt")
+			a.close()
+			a.idle = conn
+			return
+		}
+	}
+	conn.Close()
+}
+
+// failed keeps conn for the next attempt, or closes it, after an attempt failed with err.
+func (a *authConns) failed(conn net.Conn, err error) {
+	if conn == nil {
+		return
+	}
+	var se *StatusError
+	if errors.As(err, &se) && se.resp != nil {
+		a.rejected(conn, se.resp)
+		return
+	}
+	conn.Close()
+}
+
+// close closes the connection kept for an attempt that was not made.
+func (a *authConns) close() {
+	if a.idle != nil {
+		a.idle.Close()
+		a.idle = nil
+	}
+}
+
+// firstConn returns baseDial, returning conn on its first call.
+func firstConn(conn net.Conn, baseDial func() (net.Conn, error)) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		if conn == nil {
+			return baseDial()
+		}
+		c := conn
+		conn = nil
+		return c, nil
+	}
+}
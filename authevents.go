@@ -0,0 +1,56 @@
+package proxyplease
+
+import (
+	"net"
+	"time"
+
+	"github.com/bdwyertech/proxyplease/auth"
+)
+
+// AuthStartFunc is called when the proxy requires authentication for a dial to addr,
+// before any scheme is attempted.
+type AuthStartFunc func(addr string)
+
+// ChallengeFunc is called with each challenge of a proxy requiring authentication: its
+// scheme as named by the proxy, ex: "NTLM", and its realm, empty if it has none.
+type ChallengeFunc func(scheme, realm string)
+
+// AuthSuccessFunc is called when the proxy accepted the credentials of scheme, with the
+// time authentication took since the proxy required it.
+type AuthSuccessFunc func(scheme string, d time.Duration)
+
+// AuthFailureFunc is called with the error of a dial the proxy required authentication
+// for, usually an *AuthError, when no scheme succeeded.
+type AuthFailureFunc func(err error)
+
+// authStarted reports to p.OnAuthStart and p.OnChallenge that the proxy answered a dial
+// to addr with challenges, and returns when authentication started.
+func (p Proxy) authStarted(addr string, challenges []string) time.Time {
+	if p.OnAuthStart != nil {
+		p.OnAuthStart(addr)
+	}
+	if p.OnChallenge != nil {
+		for _, c := range challenges {
+			p.OnChallenge(auth.ChallengeScheme(c), auth.ChallengeParams(c)["realm"])
+		}
+	}
+	return time.Now()
+}
+
+// authEnded reports the result of authentication started at started to p.OnAuthSuccess
+// or p.OnAuthFailure. scheme is the scheme accepted, or empty to read it from conn.
+func (p Proxy) authEnded(conn net.Conn, scheme string, err error, started time.Time) {
+	if err != nil {
+		if p.OnAuthFailure != nil {
+			p.OnAuthFailure(err)
+		}
+		return
+	}
+	if p.OnAuthSuccess == nil {
+		return
+	}
+	if c, ok := conn.(*Conn); ok && scheme == "" {
+		scheme = c.info.AuthScheme
+	}
+	p.OnAuthSuccess(scheme, time.Since(started))
+}
@@ -0,0 +1,105 @@
+package proxyplease
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// AuthorityOptions control how the CONNECT authority is formed from the dialed address.
+// Some strict proxies reject authorities that are not normalized. Internationalized
+// hostnames are always converted to their ASCII (punycode) form.
+type AuthorityOptions struct {
+	DefaultPort string // Port appended when the dialed address has none. If empty, the address is used as is.
+	Lowercase   bool   // Lowercase the hostname.
+	IDNA        bool   // Deprecated: internationalized hostnames are always converted, so IDNA has no effect.
+	Host        string // Host header of HTTP/1.1 CONNECT requests, instead of the authority, ex: the fronting domain a proxy routes on while the tunnel reaches another host.
+}
+
+// normalizeAuthority returns addr rewritten according to o.
+func normalizeAuthority(addr string, o AuthorityOptions) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// no port present
+		host, port = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), ""
+	}
+	if port == "" {
+		port = o.DefaultPort
+	}
+
+	if host, err = toASCIIHost(host); err != nil {
+		return addr, err
+	}
+	if o.Lowercase {
+		host = strings.ToLower(host)
+	}
+
+	if port == "" {
+		if strings.Contains(host, ":") {
+			return "[" + host + "]", nil
+		}
+		return host, nil
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// connectAuthority returns addr as sent in CONNECT requests: IPv6 literals are bracketed,
+// even without a port, and their zone, meaningless to the proxy, is removed.
+func connectAuthority(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), ""
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 && net.ParseIP(host[:i]) != nil {
+		host = host[:i]
+	}
+	if !strings.Contains(host, ":") {
+		return addr
+	}
+	if port == "" {
+		return "[" + host + "]"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// toASCIIHost converts a unicode hostname to its A-label form so it can be placed in
+// CONNECT and SOCKS requests or used for proxy lookups. ASCII hostnames and IP literals
+// are returned unchanged.
+func toASCIIHost(host string) (string, error) {
+	if !hasNonASCII(host) {
+		return host, nil
+	}
+	a, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		debugf("authority> Could not convert '%s' to ASCII: %s", host, err)
+		return host, err
+	}
+	return a, nil
+}
+
+func hasNonASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return true
+		}
+	}
+	return false
+}
+
+// toASCIIURL returns a copy of u with its hostname converted by toASCIIHost.
+func toASCIIURL(u *url.URL) *url.URL {
+	host, err := toASCIIHost(u.Hostname())
+	if err != nil || host == u.Hostname() {
+		return u
+	}
+	c := *u
+	if port := u.Port(); port != "" {
+		c.Host = net.JoinHostPort(host, port)
+	} else {
+		c.Host = host
+	}
+	return &c
+}
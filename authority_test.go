@@ -0,0 +1,85 @@
+package proxyplease
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestNormalizeAuthority(t *testing.T) {
+	tests := []struct {
+		addr string
+		o    AuthorityOptions
+		want string
+	}{
+		{"bücher.example:443", AuthorityOptions{}, "xn--bcher-kva.example:443"},
+		{"bücher.example", AuthorityOptions{DefaultPort: "443"}, "xn--bcher-kva.example:443"},
+		// IDNA is deprecated: conversion does not depend on it
+		{"bücher.example:443", AuthorityOptions{IDNA: true}, "xn--bcher-kva.example:443"},
+		{"Bücher.Example:443", AuthorityOptions{}, "xn--bcher-kva.example:443"},
+		// ASCII hostnames are not changed, unless lowercased
+		{"Example.COM:443", AuthorityOptions{}, "Example.COM:443"},
+		{"Example.COM:443", AuthorityOptions{Lowercase: true}, "example.com:443"},
+		{"example.com", AuthorityOptions{}, "example.com"},
+		{"192.0.2.1", AuthorityOptions{DefaultPort: "80"}, "192.0.2.1:80"},
+		{"[2001:db8::1]:443", AuthorityOptions{}, "[2001:db8::1]:443"},
+		{"2001:db8::1", AuthorityOptions{}, "[2001:db8::1]"},
+	}
+	for _, tt := range tests {
+		got, err := normalizeAuthority(tt.addr, tt.o)
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeAuthority(%q, %+v) = %q, %v; want %q", tt.addr, tt.o, got, err, tt.want)
+		}
+	}
+
+	if _, err := normalizeAuthority("a\u00adb\u200d.example:443", AuthorityOptions{}); err == nil {
+		t.Error("normalizeAuthority accepted a hostname that is not valid IDNA")
+	}
+}
+
+func TestToASCIIHost(t *testing.T) {
+	tests := []struct {
+		host, want string
+	}{
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"例え.テスト", "xn--r8jz45g.xn--zckzah"},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example"},
+		// without non-ASCII characters, hosts are returned as is, not mapped by IDNA
+		{"Example.COM", "Example.COM"},
+		{"under_score.example", "under_score.example"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got, err := toASCIIHost(tt.host); err != nil || got != tt.want {
+			t.Errorf("toASCIIHost(%q) = %q, %v; want %q", tt.host, got, err, tt.want)
+		}
+	}
+	for _, s := range []string{"", "example.com", "Example.COM:443"} {
+		if hasNonASCII(s) {
+			t.Errorf("hasNonASCII(%q) = true", s)
+		}
+	}
+	if !hasNonASCII("bücher") {
+		t.Error(`hasNonASCII("bücher") = false`)
+	}
+}
+
+func TestToASCIIURL(t *testing.T) {
+	u := &url.URL{Scheme: "https", Host: "bücher.example:8443", Path: "/wpad.dat"}
+	if got := toASCIIURL(u).String(); got != "https://xn--bcher-kva.example:8443/wpad.dat" {
+		t.Errorf("toASCIIURL = %s", got)
+	}
+	if u.Host != "bücher.example:8443" {
+		t.Errorf("toASCIIURL changed its argument: %s", u.Host)
+	}
+	u = &url.URL{Scheme: "https", Host: "bücher.example"}
+	if got := toASCIIURL(u).Host; got != "xn--bcher-kva.example" {
+		t.Errorf("toASCIIURL without port: host %s", got)
+	}
+
+	// ASCII URLs are returned as is
+	u = &url.URL{Scheme: "https", Host: "Example.COM:443"}
+	if got := toASCIIURL(u); got != u {
+		t.Errorf("toASCIIURL(%s) returned a copy: %s", u, got)
+	}
+}
@@ -0,0 +1,61 @@
+package proxyplease
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// AutoLogonPolicy selects the proxies the credentials of the current Windows user are
+// sent to by NTLM and Negotiate when a Proxy has no Username or Password, like the
+// WinHTTP autologon security levels. Other platforms have no such credentials.
+type AutoLogonPolicy int
+
+const (
+	// AutoLogonIntranet sends them only to proxies in the Local intranet security zone:
+	// host names without a dot, hosts matching Proxy.Bypass or the system proxy bypass
+	// list, and hosts assigned to the zone in the Internet Settings ZoneMap, including by
+	// group policy. It is the default, as WINHTTP_AUTOLOGON_SECURITY_LEVEL_MEDIUM.
+	AutoLogonIntranet AutoLogonPolicy = iota
+	// AutoLogonAlways sends them to any proxy, as WINHTTP_AUTOLOGON_SECURITY_LEVEL_LOW.
+	AutoLogonAlways
+	// AutoLogonNever never sends them, as WINHTTP_AUTOLOGON_SECURITY_LEVEL_HIGH.
+	AutoLogonNever
+)
+
+// ErrAutoLogonDenied is returned instead of authenticating with the credentials of the
+// current user to a proxy Proxy.AutoLogon does not allow them to be sent to.
+var ErrAutoLogonDenied = errors.New("the credentials of the current user are not sent to this proxy; see Proxy.AutoLogon")
+
+// checkAutoLogon returns ErrAutoLogonDenied if authenticating with scheme would send the
+// credentials of the current user to a proxy p.AutoLogon does not allow, or the error of
+// checkMachineAccount if p.MachineAccount is set.
+func (p Proxy) checkAutoLogon(scheme string) error {
+	if p.MachineAccount {
+		return p.checkMachineAccount(scheme)
+	}
+	if !currentUserLogon || p.Username != "" && p.Password != "" {
+		return nil
+	}
+	switch p.AutoLogon {
+	case AutoLogonAlways:
+		return nil
+	case AutoLogonIntranet:
+		if p.intranetProxy() {
+			return nil
+		}
+		p.debugf("%s> %s is not in the Local intranet zone. Not sending the credentials of the current user.", strings.ToLower(scheme), p.URL.Hostname())
+	default:
+		p.debugf("%s> AutoLogon policy forbids sending the credentials of the current user", strings.ToLower(scheme))
+	}
+	return ErrAutoLogonDenied
+}
+
+// intranetProxy reports whether the proxy at p.URL is in the Local intranet zone.
+func (p Proxy) intranetProxy() bool {
+	host := strings.TrimSuffix(p.URL.Hostname(), ".")
+	if net.ParseIP(host) == nil && !strings.Contains(host, ".") {
+		return true
+	}
+	return bypassMatch(host, p.Bypass) || intranetZone(p.URL.Scheme, host)
+}
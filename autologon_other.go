@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package proxyplease
+
+// currentUserLogon is false as only Windows authenticates with the credentials of the
+// current user when none are configured.
+const currentUserLogon = false
+
+// intranetZone reports false, since this platform has no security zones.
+func intranetZone(scheme, host string) bool {
+	return false
+}
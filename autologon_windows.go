@@ -0,0 +1,186 @@
+//go:build windows
+// +build windows
+
+package proxyplease
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// currentUserLogon is true as SSPI authenticates with the credentials of the current
+// user when none are configured.
+const currentUserLogon = true
+
+// zoneIntranet is URLZONE_INTRANET, the Local intranet security zone.
+const zoneIntranet = 1
+
+const (
+	// zoneMapKey holds the sites assigned to security zones in Internet Options.
+	zoneMapKey = internetSettingsKey + `\ZoneMap`
+	// zoneMapPolicyKey holds the Site to Zone Assignment List of group policy, which takes
+	// precedence.
+	zoneMapPolicyKey = `Software\Policies\Microsoft\Windows\CurrentVersion\Internet Settings\ZoneMapKey`
+)
+
+// intranetZone reports whether host, a proxy reached with scheme, is in the Local
+// intranet zone: assigned to it by group policy or the ZoneMap, or bypassing the system
+// proxy settings.
+func intranetZone(scheme, host string) bool {
+	for _, root := range []registry.Key{registry.LOCAL_MACHINE, registry.CURRENT_USER} {
+		if zone, ok := policyZone(root, host); ok {
+			return zone == zoneIntranet
+		}
+	}
+	for _, root := range []registry.Key{registry.CURRENT_USER, registry.LOCAL_MACHINE} {
+		if zone, ok := zoneMapZone(root, scheme, host); ok {
+			return zone == zoneIntranet
+		}
+	}
+	s, err := platformSettings()
+	return err == nil && bypassMatch(host, s.Bypass)
+}
+
+// policyZone returns the zone the Site to Zone Assignment List of root assigns to host.
+// Entries are host names, optionally with a scheme or a leading "*." for subdomains, or
+// IP addresses.
+func policyZone(root registry.Key, host string) (int, bool) {
+	k, err := registry.OpenKey(root, zoneMapPolicyKey, registry.QUERY_VALUE)
+	if err != nil {
+		return 0, false
+	}
+	defer k.Close()
+	names, err := k.ReadValueNames(-1)
+	if err != nil {
+		return 0, false
+	}
+	best, zone := -1, 0
+	for _, name := range names {
+		site := strings.ToLower(name)
+		if i := strings.Index(site, "://"); i >= 0 {
+			site = site[i+3:]
+		}
+		site = strings.TrimSuffix(site, "/")
+		if h, _, err := net.SplitHostPort(site); err == nil {
+			site = h
+		}
+		matched := site == host
+		if strings.HasPrefix(site, "*.") {
+			matched = strings.HasSuffix(host, site[1:])
+		}
+		if !matched || len(site) <= best {
+			continue
+		}
+		v, _, err := k.GetStringValue(name)
+		if err != nil {
+			continue
+		}
+		if z, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			best, zone = len(site), z
+		}
+	}
+	return zone, best >= 0
+}
+
+// zoneMapZone returns the zone the ZoneMap of root assigns to host, under Domains for
+// names, ex: Domains\corp.example.com\proxy, or Ranges for IP addresses.
+func zoneMapZone(root registry.Key, scheme, host string) (int, bool) {
+	if ip := net.ParseIP(host); ip != nil {
+		return rangeZone(root, scheme, ip)
+	}
+	labels := strings.Split(strings.ToLower(host), ".")
+	for i := 0; i < len(labels)-1; i++ {
+		k, err := registry.OpenKey(root, zoneMapKey+`\Domains\`+strings.Join(labels[i:], "."), registry.QUERY_VALUE)
+		if err != nil {
+			continue
+		}
+		zone, ok := 0, false
+		if i > 0 {
+			for _, sub := range []string{strings.Join(labels[:i], "."), "*"} {
+				if s, err := registry.OpenKey(k, sub, registry.QUERY_VALUE); err == nil {
+					zone, ok = schemeZone(s, scheme)
+					s.Close()
+					if ok {
+						break
+					}
+				}
+			}
+		}
+		if !ok {
+			zone, ok = schemeZone(k, scheme)
+		}
+		k.Close()
+		if ok {
+			return zone, true
+		}
+	}
+	return 0, false
+}
+
+// rangeZone returns the zone the ZoneMap of root assigns to ip in Ranges, whose :Range
+// values match addresses octet by octet, ex: "10.1.*.*" or "192.168.0.1-50".
+func rangeZone(root registry.Key, scheme string, ip net.IP) (int, bool) {
+	k, err := registry.OpenKey(root, zoneMapKey+`\Ranges`, registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		return 0, false
+	}
+	defer k.Close()
+	names, err := k.ReadSubKeyNames(-1)
+	if err != nil {
+		return 0, false
+	}
+	for _, name := range names {
+		r, err := registry.OpenKey(k, name, registry.QUERY_VALUE)
+		if err != nil {
+			continue
+		}
+		pattern, _, err := r.GetStringValue(":Range")
+		zone, ok := 0, false
+		if err == nil && rangeMatch(pattern, ip) {
+			zone, ok = schemeZone(r, scheme)
+		}
+		r.Close()
+		if ok {
+			return zone, true
+		}
+	}
+	return 0, false
+}
+
+// rangeMatch reports whether ip matches pattern, an IPv4 address whose octets may be "*"
+// or ranges, ex: "10.1.*.1-50".
+func rangeMatch(pattern string, ip net.IP) bool {
+	v4 := ip.To4()
+	octets := strings.Split(pattern, ".")
+	if v4 == nil || len(octets) != 4 {
+		return false
+	}
+	for i, o := range octets {
+		if o == "*" {
+			continue
+		}
+		lo, hi := o, o
+		if j := strings.IndexByte(o, '-'); j >= 0 {
+			lo, hi = o[:j], o[j+1:]
+		}
+		l, err1 := strconv.Atoi(lo)
+		h, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || int(v4[i]) < l || int(v4[i]) > h {
+			return false
+		}
+	}
+	return true
+}
+
+// schemeZone returns the zone of a ZoneMap entry for scheme, or for all schemes ("*").
+func schemeZone(k registry.Key, scheme string) (int, bool) {
+	for _, name := range []string{scheme, "*"} {
+		if zone, _, err := k.GetIntegerValue(name); err == nil {
+			return int(zone), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,205 @@
+package proxyplease
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// awsIMDS is the EC2 instance metadata service.
+const awsIMDS = "http://169.254.169.254"
+
+// awsIMDSTimeout bounds requests to the metadata service, which is unreachable off EC2.
+const awsIMDSTimeout = 2 * time.Second
+
+// AWSSecret is a SecretStore reading proxy credentials from AWS Secrets Manager. Requests
+// are signed with the static credentials of its fields, or else those of the
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables,
+// or else those of the instance role from the EC2 metadata service (IMDSv2).
+type AWSSecret struct {
+	SecretID        string       // Name or ARN of the secret.
+	Region          string       // Region of the secret. Defaults to that of an ARN SecretID, then $AWS_REGION and $AWS_DEFAULT_REGION.
+	VersionStage    string       // Staging label of the version read. Defaults to "AWSCURRENT".
+	Endpoint        string       // URL of Secrets Manager, ex: a VPC endpoint. Defaults to the regional endpoint.
+	AccessKeyID     string       // Static credentials, for hosts without an instance role.
+	SecretAccessKey string       // Secret of AccessKeyID.
+	SessionToken    string       // Session token of temporary AccessKeyID credentials.
+	Client          *http.Client // Client for Secrets Manager and the metadata service. Defaults to http.DefaultClient.
+}
+
+// awsCredentials are the credentials signing requests to AWS.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	Token           string
+}
+
+// Fetch reads the current version of the secret.
+func (s *AWSSecret) Fetch(ctx context.Context) (Credentials, error) {
+	region := s.Region
+	if region == "" && strings.HasPrefix(s.SecretID, "arn:") {
+		if parts := strings.SplitN(s.SecretID, ":", 5); len(parts) == 5 {
+			region = parts[3]
+		}
+	}
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region == "" {
+			region = os.Getenv(name)
+		}
+	}
+	if region == "" || s.SecretID == "" {
+		return Credentials{}, errors.New("aws: region and secret ID are required")
+	}
+	creds, err := s.credentials(ctx)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + region + ".amazonaws.com"
+	}
+	stage := s.VersionStage
+	if stage == "" {
+		stage = "AWSCURRENT"
+	}
+	body, _ := json.Marshal(map[string]string{"SecretId": s.SecretID, "VersionStage": stage})
+	req, err := http.NewRequest("POST", strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return Credentials{}, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWS(req, body, creds, region, "secretsmanager", time.Now())
+	var resp struct {
+		SecretString string
+	}
+	if err := doSecretRequest(s.Client, req, "aws", &resp); err != nil {
+		return Credentials{}, err
+	}
+	debugf("secrets> Fetched credentials from AWS Secrets Manager secret %s", s.SecretID)
+	return secretCredentials([]byte(resp.SecretString))
+}
+
+// credentials returns the credentials signing the requests of s.
+func (s *AWSSecret) credentials(ctx context.Context) (awsCredentials, error) {
+	if s.AccessKeyID != "" {
+		return awsCredentials{s.AccessKeyID, s.SecretAccessKey, s.SessionToken}, nil
+	}
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return awsCredentials{id, os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	return instanceRoleCredentials(ctx, s.Client)
+}
+
+// instanceRoleCredentials returns the credentials of the instance role from the EC2
+// metadata service.
+func instanceRoleCredentials(ctx context.Context, client *http.Client) (awsCredentials, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	ctx, cancel := context.WithTimeout(ctx, awsIMDSTimeout)
+	defer cancel()
+	get := func(method, path string, header http.Header) ([]byte, error) {
+		req, err := http.NewRequest(method, awsIMDS+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header = header
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("aws: instance metadata %s: %s", path, resp.Status)
+		}
+		return ioutil.ReadAll(resp.Body)
+	}
+
+	token, err := get("PUT", "/latest/api/token", http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {"60"}})
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("aws: no credentials in the environment, and no instance metadata: %s", err)
+	}
+	h := http.Header{"X-Aws-Ec2-Metadata-Token": {string(token)}}
+	role, err := get("GET", "/latest/meta-data/iam/security-credentials/", h)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	name := strings.TrimSpace(strings.SplitN(string(role), "\n", 2)[0])
+	b, err := get("GET", "/latest/meta-data/iam/security-credentials/"+url.PathEscape(name), h)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	var c awsCredentials
+	if err := json.Unmarshal(b, &c); err != nil {
+		return awsCredentials{}, err
+	}
+	return c, nil
+}
+
+// signAWS signs req, whose body is body, with AWS Signature Version 4.
+func signAWS(req *http.Request, body []byte, c awsCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if c.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.Token)
+	}
+
+	// the signed headers, sorted
+	names := []string{"content-type", "host", "x-amz-date", "x-amz-security-token", "x-amz-target"}
+	var headers strings.Builder
+	var signed []string
+	for _, name := range names {
+		v := req.Header.Get(name)
+		if name == "host" {
+			v = req.URL.Host
+		}
+		if v == "" {
+			continue
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(v) + "\n")
+		signed = append(signed, name)
+	}
+	signedHeaders := strings.Join(signed, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{req.Method, path, req.URL.RawQuery, headers.String(), signedHeaders, sha256Hex(body)}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretAccessKey), date)
+	for _, s := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.AccessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(s))
+	return m.Sum(nil)
+}
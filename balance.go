@@ -0,0 +1,213 @@
+package proxyplease
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BalanceStrategy selects how dials are distributed across Proxy.Upstreams.
+type BalanceStrategy int
+
+const (
+	// RoundRobin cycles through the upstreams in order.
+	RoundRobin BalanceStrategy = iota
+	// WeightedRandom picks an upstream at random, proportionally to its Weight.
+	WeightedRandom
+	// ConsistentHash pins each target host to an upstream using a consistent hash ring,
+	// so stateful inspection devices see consistent flows. When an upstream fails, its
+	// hosts are re-pinned to the next upstream on the ring until it recovers.
+	ConsistentHash
+	// Failover uses the upstreams in order, moving on to the next one within a dial when
+	// an upstream cannot be reached. Unreachable upstreams are quarantined for
+	// Proxy.Quarantine and probed every Proxy.ProbeInterval, returning to service as soon
+	// as they accept connections.
+	Failover
+)
+
+// hashReplicas is the number of points each unit of weight places on the hash ring.
+const hashReplicas = 64
+
+// upstreamRetryAfter is how long a failed upstream is skipped by default.
+const upstreamRetryAfter = 30 * time.Second
+
+// maxStickyTargets bounds the number of target hosts remembered for sticky selection.
+// The table is reset when it grows beyond this size.
+const maxStickyTargets = 4096
+
+// Upstream is one of several equivalent proxies, such as the nodes of a proxy farm.
+type Upstream struct {
+	URL    *url.URL // URL of the proxy. Credentials in the URL apply to this upstream only.
+	Weight int      // Relative weight used by WeightedRandom. Defaults to 1.
+}
+
+type balancer struct {
+	proxies    []Proxy
+	weights    []int
+	total      int
+	strategy   BalanceStrategy
+	sticky     bool
+	clock      Clock
+	quarantine time.Duration // how long a failed upstream is skipped
+	probe      time.Duration // interval of probes of quarantined upstreams, with Failover
+
+	mu   sync.Mutex
+	next int
+	rnd  *rand.Rand
+	pins map[string]int
+	ring []ringPoint
+	down []time.Time
+}
+
+type ringPoint struct {
+	hash     uint32
+	upstream int
+}
+
+func newBalancer(p Proxy) *balancer {
+	b := &balancer{
+		strategy: p.Balance,
+		sticky:   p.StickyTargets,
+		clock:    clockOr(p.Clock),
+		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		pins:     map[string]int{},
+	}
+	b.quarantine, b.probe = p.quarantinePeriods()
+	for _, u := range p.Upstreams {
+		w := u.Weight
+		if w < 1 {
+			w = 1
+		}
+		b.proxies = append(b.proxies, withProxyURL(p, u.URL))
+		b.weights = append(b.weights, w)
+		b.total += w
+	}
+	b.down = make([]time.Time, len(b.proxies))
+	if b.strategy == ConsistentHash {
+		for i, p := range b.proxies {
+			for r := 0; r < hashReplicas*b.weights[i]; r++ {
+				b.ring = append(b.ring, ringPoint{hash: hashKey(p.URL.Host + "#" + strconv.Itoa(r)), upstream: i})
+			}
+		}
+		sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+	}
+	return b
+}
+
+// pick returns the index of the upstream proxy to use for a dial to addr.
+func (b *balancer) pick(addr string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	if b.sticky {
+		if i, ok := b.pins[host]; ok {
+			return i
+		}
+	}
+
+	var i int
+	switch b.strategy {
+	case ConsistentHash:
+		i = b.lookup(host)
+	case Failover:
+		i = b.firstUp()
+	case WeightedRandom:
+		n := b.rnd.Intn(b.total)
+		for i = range b.weights {
+			if n < b.weights[i] {
+				break
+			}
+			n -= b.weights[i]
+		}
+	default:
+		i = b.next
+		b.next = (b.next + 1) % len(b.proxies)
+	}
+
+	if b.sticky {
+		if len(b.pins) >= maxStickyTargets {
+			b.pins = map[string]int{}
+		}
+		b.pins[host] = i
+	}
+	b.proxies[i].debugf("balance> Selected %s for %s", b.proxies[i].URL.Host, host)
+	return i
+}
+
+// lookup returns the first healthy upstream at or after host's position on the ring.
+// If every upstream is down, the host's primary upstream is returned.
+func (b *balancer) lookup(host string) int {
+	h := hashKey(host)
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+	now := b.clock.Now()
+	for n := 0; n < len(b.ring); n++ {
+		pt := b.ring[(start+n)%len(b.ring)]
+		if now.After(b.down[pt.upstream]) {
+			return pt.upstream
+		}
+	}
+	return b.ring[start%len(b.ring)].upstream
+}
+
+// fail records a failed dial through upstream i. Hosts pinned to it are unpinned, so
+// their next dial picks an upstream again. With ConsistentHash and Failover, the upstream
+// is also skipped for b.quarantine, and with Failover, it is probed meanwhile.
+func (b *balancer) fail(i int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for host, pinned := range b.pins {
+		if pinned == i {
+			delete(b.pins, host)
+		}
+	}
+	if b.strategy != ConsistentHash && b.strategy != Failover {
+		return
+	}
+	now := b.clock.Now()
+	probing := b.down[i].After(now)
+	b.proxies[i].debugf("balance> Marking %s as down for %s", b.proxies[i].URL.Host, b.quarantine)
+	b.proxies[i].event(EventProxySwitched, "Upstream %s is down for %s, using the next upstream", b.proxies[i].URL.Host, b.quarantine)
+	b.down[i] = now.Add(b.quarantine)
+	if b.strategy == Failover && !probing {
+		go probeProxy(b.proxies[i], b.probe, b.down[i], func() { b.up(i) })
+	}
+}
+
+func hashKey(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// downUntil returns the upstreams currently marked down, by host.
+func (b *balancer) downUntil(now time.Time) map[string]time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	down := map[string]time.Time{}
+	for i, t := range b.down {
+		if t.After(now) {
+			down[b.proxies[i].URL.Host] = t
+		}
+	}
+	return down
+}
+
+// restore marks the upstreams in down as down until the recorded time.
+func (b *balancer) restore(down map[string]time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, p := range b.proxies {
+		if t, ok := down[p.URL.Host]; ok {
+			b.down[i] = t
+		}
+	}
+}
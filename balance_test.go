@@ -0,0 +1,93 @@
+package proxyplease
+
+import (
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bdwyertech/proxyplease/proxytest"
+)
+
+func TestBalanceFailUnreachable(t *testing.T) {
+	target := newEchoServer(t)
+	defer target.Close()
+	s := newTestServer("user", "secret", "Basic")
+	defer s.Close()
+	// a port nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+
+	tests := []struct {
+		name     string
+		upstream *url.URL
+		password string
+		down     bool
+	}{
+		{"Rejected", s.URL, "wrong", false},
+		{"Unreachable", &url.URL{Scheme: "http", Host: closed}, "secret", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testProxy(t, s, "user", tt.password)
+			p.URL = nil
+			p.Upstreams = []Upstream{{URL: tt.upstream}}
+			p.Balance = ConsistentHash
+			d := NewDialer(p)
+			defer d.Close()
+			if _, err := dialEcho(d.DialContext, target.Addr().String()); err == nil {
+				t.Fatal("dial succeeded")
+			}
+			if _, down := d.State().Down[tt.upstream.Host]; down != tt.down {
+				t.Errorf("upstream marked down: %v, want %v", down, tt.down)
+			}
+		})
+	}
+}
+
+func TestBalanceFailUnpins(t *testing.T) {
+	for _, strategy := range []BalanceStrategy{RoundRobin, WeightedRandom, ConsistentHash, Failover} {
+		p := Proxy{StickyTargets: true, Balance: strategy, Debugf: t.Logf}
+		for _, host := range []string{"a:8080", "b:8080", "c:8080"} {
+			p.Upstreams = append(p.Upstreams, Upstream{URL: &url.URL{Scheme: "http", Host: host}})
+		}
+		b := newBalancer(p)
+		i := b.pick("example.com:443")
+		b.fail(i)
+		if _, ok := b.pins["example.com"]; ok {
+			t.Errorf("strategy %d: example.com still pinned to the failed upstream", strategy)
+		}
+	}
+}
+
+func TestBalanceQuarantineExpires(t *testing.T) {
+	clock := proxytest.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	p := Proxy{Balance: ConsistentHash, Quarantine: time.Minute, Clock: clock, Debugf: t.Logf}
+	for _, host := range []string{"a:8080", "b:8080", "c:8080"} {
+		p.Upstreams = append(p.Upstreams, Upstream{URL: &url.URL{Scheme: "http", Host: host}})
+	}
+	b := newBalancer(p)
+	primary := b.pick("example.com:443")
+	b.fail(primary)
+
+	for _, step := range []struct {
+		advance time.Duration
+		down    bool
+	}{
+		{0, true},
+		{59 * time.Second, true},
+		{2 * time.Second, false},
+	} {
+		clock.Advance(step.advance)
+		if got := b.pick("example.com:443"); (got != primary) != step.down {
+			t.Errorf("at %s: picked upstream %d, primary %d quarantined: %v", clock.Now().Format("15:04:05"), got, primary, step.down)
+		}
+		if _, down := b.downUntil(clock.Now())[b.proxies[primary].URL.Host]; down != step.down {
+			t.Errorf("at %s: primary reported down: %v, want %v", clock.Now().Format("15:04:05"), down, step.down)
+		}
+	}
+}
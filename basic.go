@@ -1,51 +1,89 @@
 package proxyplease
 
 import (
-	"bufio"
-	"encoding/base64"
 	"errors"
-	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bdwyertech/proxyplease/auth"
 )
 
-func dialBasic(p Proxy, addr string, baseDial func() (net.Conn, error)) (net.Conn, error) {
-	debugf("basic> Attempting to authenticate")
+// errBasicUsername is returned instead of sending Basic credentials whose username
+// contains a colon, which separates it from the password (RFC 7617).
+var errBasicUsername = errors.New("basic: username contains ':', which Basic authentication cannot carry")
+
+// dialBasic authenticates with the Basic challenge. Credentials are sent in UTF-8 and,
+// when they are not ASCII and the proxy announced no charset, once more in ISO-8859-1 if
+// rejected, as many proxies decode them so.
+func dialBasic(p Proxy, addr, challenge string, baseDial func() (net.Conn, error)) (net.Conn, error) {
+	p.debugf("basic> Attempting to authenticate")
+	if strings.Contains(p.Username, ":") {
+		p.debugf("basic> Username contains ':', which Basic authentication cannot carry")
+		return nil, errBasicUsername
+	}
+
+	conn, err := connectBasic(p, addr, baseDial, auth.Basic(p.Username, p.Password))
+	var se *StatusError
+	if errors.As(err, &se) && se.StatusCode == http.StatusProxyAuthRequired && !isASCII(p.Username+p.Password) && !strings.EqualFold(auth.BasicCharset(challenge), "UTF-8") {
+		if latin1, ok := auth.BasicLatin1(p.Username, p.Password); ok {
+			p.debugf("basic> Retrying with the credentials encoded in ISO-8859-1")
+			if conn != nil {
+				conn.Close()
+			}
+			return connectBasic(p, addr, baseDial, latin1)
+		}
+	}
+	return conn, err
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
 
+// connectBasic establishes a tunnel authenticated with authorization, a Basic
+// Proxy-Authorization value.
+func connectBasic(p Proxy, addr string, baseDial func() (net.Conn, error), authorization string) (net.Conn, error) {
 	conn, err := baseDial()
 	if err != nil {
-		debugf("basic> Could not call dial context with proxy: %s", err)
+		p.debugf("basic> Could not call dial context with proxy: %s", err)
 		return conn, err
 	}
 
-	u := fmt.Sprintf("%s:%s", p.Username, p.Password)
-	h := p.Headers.Clone()
-	h.Set("Proxy-Authorization", fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(u))))
-	h.Set("Proxy-Connection", "Keep-Alive")
+	h := p.connectHeader(addr)
+	h.Set("Proxy-Authorization", authorization)
+	p.setKeepAlive(h)
 	connect := &http.Request{
 		Method: "CONNECT",
 		URL:    &url.URL{Opaque: addr},
 		Host:   addr,
 		Header: h,
 	}
-	if err := connect.Write(conn); err != nil {
-		debugf("basic> Could not write authorization message to proxy: %s", err)
+	if err := writeConnect(p, conn, connect); err != nil {
+		p.debugf("basic> Could not write authorization message to proxy: %s", err)
 		return conn, err
 	}
-	br := bufio.NewReader(conn)
-	resp, err := http.ReadResponse(br, connect)
+	br := newResponseReader(p, conn)
+	resp, err := br.read(connect)
 	if err != nil {
-		debugf("basic> Could not read response from proxy: %s", err)
+		p.debugf("basic> Could not read response from proxy: %s", err)
 		return conn, err
 	}
+	p.saveCookies(resp)
 
 	if resp.StatusCode == http.StatusOK {
 		// Succussfully authorized with Basic
-		debugf("basic> Successfully injected Basic to connection")
-		return conn, nil
+		p.debugf("basic> Successfully injected Basic to connection")
+		return newConn(conn, p, resp, br.Reader, "Basic"), nil
 	}
 
-	debugf("basic> Expected %d as return status, got: %d", http.StatusOK, resp.StatusCode)
-	return conn, errors.New(http.StatusText(resp.StatusCode))
+	p.debugf("basic> Expected %d as return status, got: %d", http.StatusOK, resp.StatusCode)
+	return conn, newStatusError(resp)
 }
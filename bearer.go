@@ -0,0 +1,158 @@
+package proxyplease
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bdwyertech/proxyplease/auth"
+)
+
+// TokenSource supplies access tokens for proxies, such as cloud secure web gateways, that
+// accept Bearer authentication. Implementations should cache tokens and refresh them
+// before they expire; DeviceFlow is one.
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// tokenExpiry is implemented by TokenSources that know when their token expires, so it is
+// not kept longer in a CredentialCache.
+type tokenExpiry interface {
+	Expiry() time.Time
+}
+
+// tokenInvalidator is implemented by TokenSources that drop their token once a proxy
+// rejected it, so the next dial fetches a new one.
+type tokenInvalidator interface {
+	invalidate(token string)
+}
+
+// RefreshingTokenSource returns a TokenSource caching the token fetch returns until a
+// minute before its expiry, then fetching a new one, so proxies are not sent expired
+// tokens. A zero expiry never expires. A token the proxy rejects is fetched again on the
+// next dial. To use an oauth2.TokenSource:
+//
+//	proxyplease.RefreshingTokenSource(func() (string, time.Time, error) {
+//		t, err := ts.Token()
+//		if err != nil {
+//			return "", time.Time{}, err
+//		}
+//		return t.AccessToken, t.Expiry, nil
+//	})
+func RefreshingTokenSource(fetch func() (token string, expiry time.Time, err error)) TokenSource {
+	return &refreshingTokenSource{fetch: fetch}
+}
+
+type refreshingTokenSource struct {
+	fetch  func() (string, time.Time, error)
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// Token returns the cached token, or fetches one if it is missing or about to expire.
+func (s *refreshingTokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && (s.expiry.IsZero() || time.Now().Add(tokenExpiryMargin).Before(s.expiry)) {
+		return s.token, nil
+	}
+	token, expiry, err := s.fetch()
+	if err != nil {
+		return "", err
+	}
+	s.token, s.expiry = token, expiry
+	return token, nil
+}
+
+// Expiry returns the expiry of the cached token.
+func (s *refreshingTokenSource) Expiry() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expiry
+}
+
+func (s *refreshingTokenSource) invalidate(token string) {
+	s.mu.Lock()
+	if s.token == token {
+		s.token = ""
+	}
+	s.mu.Unlock()
+}
+
+func dialBearer(p Proxy, addr string, baseDial func() (net.Conn, error)) (net.Conn, error) {
+	p.debugf("bearer> Attempting to authenticate")
+
+	if p.CredentialCache != nil {
+		if b, ok := p.CredentialCache.Get(credentialKey(p, "bearer")); ok {
+			p.debugf("bearer> Using cached token")
+			conn, err := dialBearerToken(p, addr, baseDial, string(b))
+			if err == nil || Classify(err) != AuthFailed {
+				return conn, err
+			}
+			if conn != nil {
+				conn.Close()
+			}
+			p.CredentialCache.Delete(credentialKey(p, "bearer"))
+		}
+	}
+
+	token, err := p.TokenSource.Token()
+	if err != nil {
+		p.debugf("bearer> Could not obtain token: %s", err)
+		return nil, err
+	}
+	if p.CredentialCache != nil {
+		expires := time.Now().Add(cachedTokenTTL)
+		if te, ok := p.TokenSource.(tokenExpiry); ok && !te.Expiry().IsZero() {
+			expires = te.Expiry()
+		}
+		if err := p.CredentialCache.Put(credentialKey(p, "bearer"), []byte(token), expires); err != nil {
+			p.debugf("bearer> Could not cache token: %s", err)
+		}
+	}
+	return dialBearerToken(p, addr, baseDial, token)
+}
+
+// dialBearerToken establishes a tunnel authenticated with token.
+func dialBearerToken(p Proxy, addr string, baseDial func() (net.Conn, error), token string) (net.Conn, error) {
+	conn, err := baseDial()
+	if err != nil {
+		p.debugf("bearer> Could not call dial context with proxy: %s", err)
+		return conn, err
+	}
+
+	h := p.connectHeader(addr)
+	h.Set("Proxy-Authorization", auth.Bearer(token))
+	p.setKeepAlive(h)
+	connect := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: h,
+	}
+	if err := writeConnect(p, conn, connect); err != nil {
+		p.debugf("bearer> Could not write authorization message to proxy: %s", err)
+		return conn, err
+	}
+	br := newResponseReader(p, conn)
+	resp, err := br.read(connect)
+	if err != nil {
+		p.debugf("bearer> Could not read response from proxy: %s", err)
+		return conn, err
+	}
+	p.saveCookies(resp)
+
+	if resp.StatusCode == http.StatusOK {
+		p.debugf("bearer> Successfully injected Bearer to connection")
+		return newConn(conn, p, resp, br.Reader, "Bearer"), nil
+	}
+
+	p.debugf("bearer> Expected %d as return status, got: %d", http.StatusOK, resp.StatusCode)
+	if ti, ok := p.TokenSource.(tokenInvalidator); ok && resp.StatusCode == http.StatusProxyAuthRequired {
+		ti.invalidate(token)
+	}
+	return conn, newStatusError(resp)
+}
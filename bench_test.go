@@ -0,0 +1,34 @@
+package proxyplease
+
+import (
+	"context"
+	"testing"
+)
+
+// benchmarkDial measures handshakes with a proxytest.Server requiring scheme.
+func benchmarkDial(b *testing.B, scheme string) {
+	target := newEchoServer(b)
+	defer target.Close()
+	s := newTestServer("user", "secret", scheme)
+	defer s.Close()
+	p := testProxy(b, s, "user", "secret")
+	p.Debugf = func(string, ...interface{}) {}
+	// every dial negotiates from the initial 407
+	p.DisablePreemptiveAuth = true
+	dial := NewDialContext(p)
+	addr := target.Addr().String()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, err := dial(context.Background(), "tcp", addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		conn.Close()
+	}
+}
+
+func BenchmarkDialBasic(b *testing.B) { benchmarkDial(b, "Basic") }
+
+func BenchmarkDialNTLM(b *testing.B) { benchmarkDial(b, "NTLM") }
@@ -0,0 +1,61 @@
+package proxyplease
+
+import (
+	"net"
+	"strings"
+)
+
+// BypassFunc reports whether connections to host are made directly instead of through
+// the proxy.
+type BypassFunc func(host string) bool
+
+// bypassed reports whether the dial to addr (host:port) bypasses the proxy according to
+// p.Bypass and p.BypassFunc.
+func (p Proxy) bypassed(addr string) bool {
+	if p.Bypass == nil && p.BypassFunc == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = strings.Trim(addr, "[]")
+	}
+	if bypassMatch(host, p.Bypass) {
+		return true
+	}
+	return p.BypassFunc != nil && p.BypassFunc(host)
+}
+
+// bypassMatch reports whether host matches an entry of list. Entries may themselves be
+// lists separated by commas or semicolons, such as NO_PROXY or Windows ProxyOverride
+// values. They match the host itself and its subdomains, with an optional leading "*" or
+// "."; CIDRs match IP addresses; "*" matches everything and "<local>" matches names
+// without a dot.
+func bypassMatch(host string, list []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	for _, entry := range list {
+		for _, e := range splitList(strings.ToLower(entry), ",;") {
+			if h, _, err := net.SplitHostPort(e); err == nil {
+				e = h
+			}
+			switch {
+			case e == "*":
+				return true
+			case e == "<local>":
+				if !strings.Contains(host, ".") && ip == nil {
+					return true
+				}
+			case strings.Contains(e, "/"):
+				if _, n, err := net.ParseCIDR(e); err == nil && ip != nil && n.Contains(ip) {
+					return true
+				}
+			default:
+				e = strings.TrimPrefix(strings.TrimPrefix(e, "*"), ".")
+				if host == e || strings.HasSuffix(host, "."+e) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package proxyplease
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// rootPools caches the pools built by extendRoots, as https:// proxies are dialed for
+// every handshake.
+var rootPools = struct {
+	sync.Mutex
+	m map[rootPoolKey]*x509.CertPool
+}{m: map[rootPoolKey]*x509.CertPool{}}
+
+type rootPoolKey struct {
+	base  *x509.CertPool
+	paths string
+}
+
+// LoadRoots returns the system roots with the certificates found in paths added, ex: the
+// CA a TLS-inspecting proxy uses to re-sign certificates. paths lists PEM or DER files and
+// directories, separated by os.PathListSeparator as in SSL_CERT_DIR. Files in directories
+// are read if they end in .pem, .crt, .cer or .der. An error is returned if a path cannot
+// be read or no certificate is found. On Windows and macOS, the system roots are those of
+// the OS certificate store.
+func LoadRoots(paths string) (*x509.CertPool, error) {
+	return loadRoots(nil, paths)
+}
+
+// NewTargetTLSConfig returns the TLS configuration for a handshake with the target at addr
+// through a tunnel, as made by NewDialTLSContext: a copy of p.TargetTLSConfig trusting the
+// roots in p.TargetCAFile, with ServerName defaulting to the host of addr. Use it for
+// TLS clients that take a *tls.Config rather than a dial function.
+func NewTargetTLSConfig(p Proxy, addr string) (*tls.Config, error) {
+	config, err := targetTLSConfig(p)
+	if err != nil {
+		return nil, err
+	}
+	if config.ServerName == "" {
+		config.ServerName = addr
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			config.ServerName = host
+		}
+	}
+	return config, nil
+}
+
+// extendRoots returns config, or a copy of it trusting the roots in paths as well as its
+// RootCAs, or the system roots if nil.
+func extendRoots(p Proxy, config *tls.Config, paths string) (*tls.Config, error) {
+	if paths == "" {
+		return config, nil
+	}
+	rootPools.Lock()
+	defer rootPools.Unlock()
+	key := rootPoolKey{config.RootCAs, paths}
+	roots := rootPools.m[key]
+	if roots == nil {
+		var err error
+		if roots, err = loadRoots(config.RootCAs, paths); err != nil {
+			p.debugf("tls> Could not load CA bundle: %s", err)
+			return nil, err
+		}
+		rootPools.m[key] = roots
+	}
+	config = config.Clone()
+	config.RootCAs = roots
+	return config, nil
+}
+
+// loadRoots returns a copy of base, or the system roots if nil, with the certificates
+// found in paths added.
+func loadRoots(base *x509.CertPool, paths string) (*x509.CertPool, error) {
+	var roots *x509.CertPool
+	if base != nil {
+		roots = base.Clone()
+	} else if sys, err := x509.SystemCertPool(); err == nil {
+		roots = sys
+	} else {
+		debugf("tls> Could not load system roots, using only the CA bundle: %s", err)
+		roots = x509.NewCertPool()
+	}
+	for _, path := range filepath.SplitList(paths) {
+		if path == "" {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			if err := addCertFile(roots, path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, e := range entries {
+			switch strings.ToLower(filepath.Ext(e.Name())) {
+			case ".pem", ".crt", ".cer", ".der":
+			default:
+				continue
+			}
+			if e.IsDir() {
+				continue
+			}
+			if err := addCertFile(roots, filepath.Join(path, e.Name())); err != nil {
+				debugf("tls> Skipping %s", err)
+				continue
+			}
+			found = true
+		}
+		if !found {
+			return nil, errors.New("no certificates found in " + path)
+		}
+	}
+	return roots, nil
+}
+
+// addCertFile adds the certificates of the PEM or DER file at path to roots.
+func addCertFile(roots *x509.CertPool, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		if !roots.AppendCertsFromPEM(data) {
+			return errors.New("no certificates found in " + path)
+		}
+		return nil
+	}
+	cert, err := x509.ParseCertificate(data)
+	if err != nil {
+		return errors.New("no certificates found in " + path)
+	}
+	roots.AddCert(cert)
+	return nil
+}
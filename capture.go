@@ -0,0 +1,266 @@
+package proxyplease
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WireMessage is a CONNECT request written to a proxy, or a proxy response read during a
+// handshake, as it crossed the wire.
+type WireMessage struct {
+	Proxy    *url.URL  // Proxy the message was exchanged with. Credentials are removed.
+	Local    string    // Local address of the connection to the proxy, identifying the connection.
+	Time     time.Time // When the message was sent or received.
+	Outgoing bool      // The message is a request sent to the proxy rather than a response.
+	Raw      []byte    // Start line and headers, with credentials and cookies redacted. Responses that could not be parsed hold the bytes received.
+}
+
+// CaptureFunc receives the WireMessages of handshakes. It is called synchronously and
+// should not block.
+type CaptureFunc func(WireMessage)
+
+// redactedHeaders are the headers whose values are hidden from captures, mapped to
+// whether the authentication scheme is kept.
+var redactedHeaders = map[string]bool{
+	"proxy-authorization": true,
+	"authorization":       true,
+	"cookie":              false,
+	"set-cookie":          false,
+}
+
+// capture sends raw, exchanged on conn, to p.Capture, if set.
+func (p Proxy) capture(conn net.Conn, outgoing bool, raw []byte) {
+	if p.Capture == nil {
+		return
+	}
+	m := WireMessage{Time: clockOr(p.Clock).Now(), Outgoing: outgoing, Raw: redactHead(raw)}
+	if p.URL != nil {
+		u := *p.URL
+		u.User = nil
+		m.Proxy = &u
+	}
+	if conn != nil && conn.LocalAddr() != nil {
+		m.Local = conn.LocalAddr().String()
+	}
+	p.Capture(m)
+}
+
+// redactHead returns the start line and headers of raw, the bytes of an HTTP message,
+// with the values of redactedHeaders hidden.
+func redactHead(raw []byte) []byte {
+	if end := bytes.Index(raw, []byte("\n\r\n")); end >= 0 {
+		raw = raw[:end+3]
+	} else if end := bytes.Index(raw, []byte("\n\n")); end >= 0 {
+		raw = raw[:end+2]
+	}
+	var b bytes.Buffer
+	for i, line := range bytes.SplitAfter(raw, []byte("\n")) {
+		colon := bytes.IndexByte(line, ':')
+		if i == 0 || colon <= 0 {
+			b.Write(line)
+			continue
+		}
+		keepScheme, redact := redactedHeaders[strings.ToLower(string(bytes.TrimSpace(line[:colon])))]
+		if !redact {
+			b.Write(line)
+			continue
+		}
+		eol := line[len(bytes.TrimRight(line, "\r\n")):]
+		value := bytes.TrimSpace(line[colon+1:])
+		b.Write(line[:colon+1])
+		b.WriteByte(' ')
+		if sp := bytes.IndexByte(value, ' '); keepScheme && sp > 0 {
+			b.Write(value[:sp+1])
+		}
+		b.WriteString("[redacted]")
+		b.Write(eol)
+	}
+	return b.Bytes()
+}
+
+// WireDump returns a CaptureFunc writing messages to w in the style of curl -v, so they
+// can be compared with the exchange of a client the proxy accepts: lines of requests
+// start with "> " and lines of responses with "< ".
+func WireDump(w io.Writer) CaptureFunc {
+	var mu sync.Mutex
+	return func(m WireMessage) {
+		prefix, peer := "< ", "from"
+		if m.Outgoing {
+			prefix, peer = "> ", "to"
+		}
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "* %s %s %s", m.Time.Format(time.RFC3339Nano), m.Local, peer)
+		if m.Proxy != nil {
+			fmt.Fprintf(&b, " %s", m.Proxy.Host)
+		}
+		b.WriteByte('\n')
+		for _, line := range strings.SplitAfter(string(m.Raw), "\n") {
+			if line != "" {
+				b.WriteString(prefix + strings.TrimRight(line, "\r\n") + "\n")
+			}
+		}
+		mu.Lock()
+		w.Write(b.Bytes())
+		mu.Unlock()
+	}
+}
+
+// HAR collects captured exchanges as entries of an HTTP Archive, which browser developer
+// tools and HAR viewers can open. Set Proxy.Capture to its Capture method. The zero value
+// is ready to use.
+type HAR struct {
+	mu      sync.Mutex
+	entries []harEntry
+	pending map[string]int // index of the entry awaiting a response, per connection
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Connection      string      `json:"connection,omitempty"`
+
+	started time.Time
+}
+
+type harRequest struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []harHeader `json:"cookies"`
+	Headers     []harHeader `json:"headers"`
+	QueryString []harHeader `json:"queryString"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []harHeader `json:"cookies"`
+	Headers     []harHeader `json:"headers"`
+	Content     harContent  `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// Capture records m. Responses complete the entry of the last request sent on their
+// connection.
+func (h *HAR) Capture(m WireMessage) {
+	start, headers := parseHead(m.Raw)
+	fields := strings.SplitN(start, " ", 3)
+	for len(fields) < 3 {
+		fields = append(fields, "")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.pending == nil {
+		h.pending = map[string]int{}
+	}
+	if m.Outgoing {
+		h.pending[m.Local] = len(h.entries)
+		h.entries = append(h.entries, harEntry{
+			StartedDateTime: m.Time.Format(time.RFC3339Nano),
+			Request: harRequest{
+				Method:      fields[0],
+				URL:         fields[1], // the authority of a CONNECT
+				HTTPVersion: fields[2],
+				Cookies:     []harHeader{},
+				Headers:     headers,
+				QueryString: []harHeader{},
+				HeadersSize: -1,
+			},
+			Response:   harResponse{Cookies: []harHeader{}, Headers: []harHeader{}, HeadersSize: -1, BodySize: -1},
+			started:    m.Time,
+			Connection: m.Local,
+		})
+		return
+	}
+	i, ok := h.pending[m.Local]
+	if !ok {
+		return
+	}
+	delete(h.pending, m.Local)
+	e := &h.entries[i]
+	status, _ := strconv.Atoi(fields[1])
+	e.Response = harResponse{
+		Status:      status,
+		StatusText:  fields[2],
+		HTTPVersion: fields[0],
+		Cookies:     []harHeader{},
+		Headers:     headers,
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+	wait := float64(m.Time.Sub(e.started)) / float64(time.Millisecond)
+	e.Time, e.Timings = wait, harTimings{Wait: wait}
+}
+
+// WriteTo writes the entries collected so far to w as an HTTP Archive (HAR 1.2) in JSON.
+func (h *HAR) WriteTo(w io.Writer) (int64, error) {
+	h.mu.Lock()
+	entries := append([]harEntry{}, h.entries...)
+	h.mu.Unlock()
+	var log struct {
+		Log struct {
+			Version string `json:"version"`
+			Creator struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"creator"`
+			Entries []harEntry `json:"entries"`
+		} `json:"log"`
+	}
+	log.Log.Version = "1.2"
+	log.Log.Creator.Name, log.Log.Creator.Version = "proxyplease", moduleVersion()
+	log.Log.Entries = entries
+	b, err := json.MarshalIndent(log, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(append(b, '\n'))
+	return int64(n), err
+}
+
+// parseHead returns the start line and the headers, in order, of the head of an HTTP
+// message.
+func parseHead(raw []byte) (string, []harHeader) {
+	lines := strings.Split(strings.TrimRight(string(raw), "\r\n"), "\n")
+	headers := []harHeader{}
+	for _, line := range lines[1:] {
+		line = strings.TrimRight(line, "\r")
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			headers = append(headers, harHeader{Name: line[:i], Value: strings.TrimSpace(line[i+1:])})
+		}
+	}
+	return strings.TrimRight(lines[0], "\r"), headers
+}
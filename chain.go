@@ -0,0 +1,100 @@
+package proxyplease
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// HopError identifies the proxy of a Chain that failed.
+type HopError struct {
+	Hop   int      // Position of the proxy in the chain, 0 being the one closest to the client.
+	Proxy *url.URL // URL of the proxy, without credentials.
+	Err   error
+}
+
+func (e *HopError) Error() string {
+	return fmt.Sprintf("proxy hop %d (%s): %s", e.Hop, e.Proxy, e.Err)
+}
+
+func (e *HopError) Unwrap() error {
+	return e.Err
+}
+
+// ChainDialer returns a DialContext tunneling through proxies in order, the first being
+// the one closest to the client. It is equivalent to setting Chain on the last proxy.
+func ChainDialer(proxies ...Proxy) DialContext {
+	if len(proxies) == 0 {
+		return NewDialContext(Proxy{})
+	}
+	last := proxies[len(proxies)-1]
+	last.Chain = append(append([]Proxy(nil), proxies[:len(proxies)-1]...), last.Chain...)
+	return NewDialContext(last)
+}
+
+// chainHops returns the proxies of p.Chain followed by p itself, or nil if p has no
+// chain.
+func chainHops(p Proxy) []Proxy {
+	if len(p.Chain) == 0 {
+		return nil
+	}
+	hops := make([]Proxy, 0, len(p.Chain)+1)
+	for _, h := range p.Chain {
+		h.Headers = snapshotHeaders(h.Headers)
+		h.source = SourceStatic
+		hops = append(hops, withProxyURL(h, h.URL))
+	}
+	p.Chain = nil
+	return append(hops, p)
+}
+
+// dialHop connects to addr through hops[i], which is reached through the hops before it.
+// Every call of its base dial builds a new tunnel through the earlier hops, since some
+// authentication schemes open several connections.
+func dialHop(ctx context.Context, hops []Proxy, i int, network, addr string) (net.Conn, error) {
+	p := hops[i]
+	if i == 0 {
+		conn, err := dialProxy(ctx, p, network, addr)
+		return conn, hopError(0, p, err)
+	}
+	p.logf, p.started, p.connects = contextDebugf(ctx), time.Now(), new(int32)
+	ctx, cancel := handshakeContext(ctx, p)
+	defer cancel()
+	if s := p.URL.Scheme; s == "socks4" || s == "socks4a" {
+		return nil, hopError(i, p, errors.New(s+" proxies can only be the first hop of a chain"))
+	}
+
+	p, span := p.startDialSpan(ctx, addr)
+	baseDial := func() (net.Conn, error) {
+		conn, err := dialHop(p.trace, hops, i-1, network, p.URL.Host)
+		if err != nil || p.URL.Scheme != "https" {
+			return conn, err
+		}
+		tc, err := proxyTLS(ctx, p, conn)
+		return tc, hopError(i, p, err)
+	}
+	p.debugf("chain> Connecting to %s through hop %d (%s)", addr, i, p.URL.Host)
+	conn, err := getProxyConn(ctx, addr, p, baseDial)
+	if err == nil {
+		handshakeDone(p, conn)
+	}
+	endSpan(span, conn, err)
+	return conn, hopError(i, p, err)
+}
+
+// hopError wraps err with the hop that produced it, unless an earlier hop already did.
+func hopError(i int, p Proxy, err error) error {
+	if err == nil {
+		return nil
+	}
+	var he *HopError
+	if errors.As(err, &he) {
+		return err
+	}
+	u := *p.URL
+	u.User = nil
+	return &HopError{Hop: i, Proxy: &u, Err: err}
+}
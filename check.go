@@ -0,0 +1,172 @@
+package proxyplease
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bdwyertech/proxyplease/auth"
+)
+
+// CheckReport is the result of Proxy.Check.
+type CheckReport struct {
+	Proxy          string        `json:"proxy,omitempty"` // URL of the proxy checked, empty for a direct connection. Credentials are removed.
+	Source         Source        `json:"source"`          // Where the proxy configuration came from.
+	Target         string        `json:"target"`          // Authority the test CONNECT was sent for.
+	Reachable      bool          `json:"reachable"`       // A connection to the proxy, including TLS for https:// proxies, was established.
+	ConnectLatency time.Duration `json:"connect_latency"` // Time to establish the connection to the proxy.
+	AuthRequired   bool          `json:"auth_required"`   // The proxy answered a CONNECT without credentials with a 407.
+	Schemes        []string      `json:"schemes"`         // Proxy-Authenticate challenges of the 407, in order, ex: "NTLM", `Basic realm="corp"`.
+	Authenticated  bool          `json:"authenticated"`   // The test CONNECT succeeded, with credentials if required.
+	AuthScheme     string        `json:"auth_scheme"`     // Scheme the test CONNECT succeeded with, empty if none was required.
+	TunnelLatency  time.Duration `json:"tunnel_latency"`  // Time to establish the test tunnel, including authentication.
+	Error          string        `json:"error,omitempty"` // Error of the failed step, if any.
+}
+
+// Check verifies that the proxy selected for p.TargetURL (https://www.google.com by
+// default) is reachable, lists the authentication schemes it offers in answer to a
+// CONNECT without credentials, and validates the credentials of p with a test CONNECT
+// to the authority of p.TargetURL, measuring the latency of each step. The report is
+// returned even if a step fails, along with the error of that step. Unlike SelfTest, no
+// TLS handshake is made with the target. Use it in setup wizards and at startup.
+func (p Proxy) Check(ctx context.Context) (*CheckReport, error) {
+	if p.TargetURL == nil {
+		p.TargetURL = defaultTargetURL()
+	}
+	r := &CheckReport{Target: targetAuthority(p.TargetURL)}
+	fail := func(err error) (*CheckReport, error) {
+		r.Error = err.Error()
+		return r, err
+	}
+
+	d := Decide(p)
+	r.Source = d.Source
+	if d.URL == nil {
+		p.debugf("check> No proxy is used for %s", r.Target)
+		return r, nil
+	}
+	q := withProxyURL(p, d.URL)
+	u := *q.URL
+	u.User = nil
+	r.Proxy = u.String()
+
+	start := time.Now()
+	conn, err := q.baseDial(ctx, "tcp", q.URL.Host)
+	r.ConnectLatency = time.Since(start)
+	if err != nil {
+		return fail(err)
+	}
+	r.Reachable = true
+
+	switch q.URL.Scheme {
+	case "http", "https":
+		resp, err := probeConnect(ctx, q, conn, r.Target)
+		conn.Close()
+		if err != nil {
+			return fail(err)
+		}
+		if resp.StatusCode == http.StatusOK {
+			r.Authenticated = true
+			r.TunnelLatency = time.Since(start)
+			return r, nil
+		}
+		if resp.StatusCode == http.StatusProxyAuthRequired {
+			r.AuthRequired = true
+			r.Schemes = auth.SplitChallenges(resp.Header["Proxy-Authenticate"])
+		}
+	default:
+		conn.Close()
+	}
+
+	start = time.Now()
+	dialer := NewDialer(p)
+	defer dialer.Close()
+	tunnel, err := dialer.DialContext(ctx, "tcp", r.Target)
+	r.TunnelLatency = time.Since(start)
+	if err != nil {
+		return fail(err)
+	}
+	defer tunnel.Close()
+	r.Authenticated = true
+	if c, ok := tunnel.(*Conn); ok {
+		r.AuthScheme = c.info.AuthScheme
+	}
+	return r, nil
+}
+
+// AdvertisedScheme is an authentication scheme offered by a proxy.
+type AdvertisedScheme struct {
+	Scheme    string // Name of the scheme as sent by the proxy, ex: "Negotiate".
+	Realm     string // Realm parameter of the challenge, if any.
+	Challenge string // Whole challenge, ex: `Basic realm="corp"`.
+}
+
+// DetectSchemes sends a CONNECT without credentials to the HTTP or HTTPS proxy at
+// proxyURL and returns the authentication schemes of its 407 answer in the order offered,
+// whether the proxy sends each challenge in its own Proxy-Authenticate header or several
+// in one, separated by commas. It returns no schemes if the proxy established the tunnel
+// without authentication, and a *StatusError if it answered otherwise. Dials parse
+// challenges the same way before selecting an authentication scheme.
+func DetectSchemes(ctx context.Context, proxyURL *url.URL) ([]AdvertisedScheme, error) {
+	if proxyURL == nil {
+		return nil, errors.New("proxy URL is required to detect schemes")
+	}
+	p := withProxyURL(Proxy{}, proxyURL)
+	if p.URL.Scheme != "http" && p.URL.Scheme != "https" {
+		return nil, fmt.Errorf("cannot detect the authentication schemes of %s proxies", p.URL.Scheme)
+	}
+	conn, err := p.baseDial(ctx, "tcp", p.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	resp, err := probeConnect(ctx, p, conn, targetAuthority(defaultTargetURL()))
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil, nil
+	case http.StatusProxyAuthRequired:
+	default:
+		return nil, newStatusError(resp)
+	}
+	var schemes []AdvertisedScheme
+	for _, c := range auth.SplitChallenges(resp.Header["Proxy-Authenticate"]) {
+		schemes = append(schemes, AdvertisedScheme{
+			Scheme:    auth.ChallengeScheme(c),
+			Realm:     auth.ChallengeParams(c)["realm"],
+			Challenge: c,
+		})
+	}
+	return schemes, nil
+}
+
+// probeConnect sends a CONNECT for addr without credentials on conn, a connection to the
+// proxy of p, and returns the response of the proxy.
+func probeConnect(ctx context.Context, p Proxy, conn net.Conn, addr string) (*http.Response, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	h := p.connectHeader(addr)
+	connect := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: h,
+	}
+	if err := writeConnect(p, conn, connect); err != nil {
+		return nil, err
+	}
+	resp, err := newResponseReader(p, conn).read(connect)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	p.debugf("check> Proxy answered a CONNECT without credentials with %d", resp.StatusCode)
+	return resp, nil
+}
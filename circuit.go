@@ -0,0 +1,187 @@
+package proxyplease
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Defaults of a CircuitBreaker.
+const (
+	defaultCircuitThreshold = 5
+	defaultCircuitCoolDown  = 30 * time.Second
+)
+
+// ErrCircuitOpen is wrapped in the *ErrProxyUnreachable returned by dials failing fast
+// because the circuit of their proxy is open, so dials fail over or fall back as if the
+// proxy could not be reached.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitState is the state of the circuit of a proxy in a CircuitBreaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets dials through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails dials at once until the cool-down ends.
+	CircuitOpen
+	// CircuitHalfOpen lets probe dials through, closing the circuit when one succeeds and
+	// opening it again when one fails.
+	CircuitHalfOpen
+)
+
+var circuitStateNames = []string{"closed", "open", "half-open"}
+
+func (s CircuitState) String() string {
+	if int(s) < len(circuitStateNames) {
+		return circuitStateNames[s]
+	}
+	return "unknown"
+}
+
+// CircuitBreaker stops dialing a proxy that keeps failing, so retries of every dial of the
+// application do not each wait for a dead proxy. After Threshold consecutive failures of
+// handshakes with a proxy (it could not be reached, timed out or answered with a 5xx
+// status other than 502 and 504, which report the target), its circuit opens and dials
+// fail at once with ErrCircuitOpen for CoolDown. Then up to Probes dials at a time are let
+// through: the circuit closes when one succeeds and opens again when one fails. Any other
+// answer of the proxy, ex: a 407, shows it is up and resets the count.
+//
+// Circuits are kept per proxy host and port, so a breaker may be shared by Proxies and
+// Dialers. Its zero value is ready for use, and it is safe for concurrent use.
+type CircuitBreaker struct {
+	Threshold int           // Consecutive failures opening the circuit of a proxy. Defaults to 5.
+	CoolDown  time.Duration // How long dials fail fast once the circuit opens. Defaults to 30s.
+	Probes    int           // Dials let through at a time once the cool-down ends. Defaults to 1.
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	state    CircuitState
+	failures int       // consecutive failures while closed
+	until    time.Time // end of the cool-down while open
+	probes   int       // probe dials in progress while half-open
+	clock    Clock
+}
+
+// State returns the state of the circuit of the proxy at host, ex: "proxy:8080".
+func (b *CircuitBreaker) State(host string) CircuitState {
+	if b == nil {
+		return CircuitClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuits[host]
+	if c == nil {
+		return CircuitClosed
+	}
+	if c.state == CircuitOpen && !clockOr(c.clock).Now().Before(c.until) {
+		return CircuitHalfOpen
+	}
+	return c.state
+}
+
+// Reset closes every circuit, ex: after the network changed.
+func (b *CircuitBreaker) Reset() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.circuits = nil
+	b.mu.Unlock()
+}
+
+// allow returns whether a handshake with the proxy of p may be attempted, and the function
+// recording its result.
+func (b *CircuitBreaker) allow(p Proxy) (func(ctx context.Context, err error), error) {
+	if b == nil {
+		return func(context.Context, error) {}, nil
+	}
+	host := p.URL.Host
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.circuits == nil {
+		b.circuits = map[string]*circuit{}
+	}
+	c := b.circuits[host]
+	if c == nil {
+		c = &circuit{clock: p.Clock}
+		b.circuits[host] = c
+	}
+	probes := b.Probes
+	if probes <= 0 {
+		probes = 1
+	}
+	probe := false
+	switch c.state {
+	case CircuitOpen:
+		if clockOr(c.clock).Now().Before(c.until) {
+			return nil, &ErrProxyUnreachable{Proxy: host, Err: ErrCircuitOpen}
+		}
+		p.debugf("circuit> Cool-down of %s ended, probing it", host)
+		c.state, c.probes = CircuitHalfOpen, 0
+		fallthrough
+	case CircuitHalfOpen:
+		if c.probes >= probes {
+			return nil, &ErrProxyUnreachable{Proxy: host, Err: ErrCircuitOpen}
+		}
+		c.probes++
+		probe = true
+	}
+	return func(ctx context.Context, err error) { b.record(ctx, p, c, probe, err) }, nil
+}
+
+// record updates c with the result of a handshake with the proxy of p.
+func (b *CircuitBreaker) record(ctx context.Context, p Proxy, c *circuit, probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe && c.state == CircuitHalfOpen {
+		c.probes--
+	}
+	if err != nil && ctx.Err() != nil {
+		// the dial was canceled: nothing was learned about the proxy
+		return
+	}
+	if !proxyFailed(ctx, err) {
+		if c.state != CircuitClosed {
+			p.debugf("circuit> %s answered, closing its circuit", p.URL.Host)
+			p.event(EventCircuitClosed, "Proxy %s is answering again", p.URL.Host)
+		}
+		c.state, c.failures = CircuitClosed, 0
+		return
+	}
+	threshold, coolDown := b.Threshold, b.CoolDown
+	if threshold <= 0 {
+		threshold = defaultCircuitThreshold
+	}
+	if coolDown <= 0 {
+		coolDown = defaultCircuitCoolDown
+	}
+	if c.state == CircuitClosed {
+		if c.failures++; c.failures < threshold {
+			return
+		}
+	} else if c.state == CircuitOpen {
+		// a dial let through before the circuit opened
+		return
+	}
+	p.debugf("circuit> Opening the circuit of %s for %s: %s", p.URL.Host, coolDown, err)
+	p.event(EventCircuitOpened, "Dials through %s fail fast for %s after it failed: %s", p.URL.Host, coolDown, err)
+	c.state, c.failures, c.until = CircuitOpen, 0, clockOr(c.clock).Now().Add(coolDown)
+}
+
+// proxyFailed reports whether a handshake failing with err shows the proxy is down or
+// failing: it could not be reached, timed out, or answered with a 5xx status other than
+// 502 and 504, which report a target the proxy could not reach.
+func proxyFailed(ctx context.Context, err error) bool {
+	if unreachable(ctx, err) {
+		return true
+	}
+	var se *StatusError
+	return errors.As(err, &se) && se.StatusCode >= 500 &&
+		se.StatusCode != http.StatusBadGateway && se.StatusCode != http.StatusGatewayTimeout
+}
@@ -0,0 +1,25 @@
+package proxyplease
+
+import "time"
+
+// Clock provides the current time and timers to expiry, retry and backoff logic. Set
+// Proxy.Clock or DeviceFlow.Clock to a fake clock, such as proxytest.Clock, to make tests
+// of that logic deterministic.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the Clock used when none is set.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// clockOr returns c, or the system clock if c is nil.
+func clockOr(c Clock) Clock {
+	if c == nil {
+		return systemClock{}
+	}
+	return c
+}
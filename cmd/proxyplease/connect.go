@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	proxyplease "github.com/bdwyertech/proxyplease"
+)
+
+func connect(args []string) {
+	fs, o := newFlagSet("connect")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: proxyplease connect [flags] HOST:PORT")
+		os.Exit(2)
+	}
+	addr := fs.Arg(0)
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid address: %s\n", err)
+		os.Exit(2)
+	}
+	p := o.proxy()
+
+	dialer := proxyplease.NewDialer(p)
+	defer dialer.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), *o.timeout)
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	cancel()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "* Connection to %s failed: %s\n", addr, err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+	fmt.Fprintln(os.Stderr, describeTunnel(conn, addr, time.Since(start)))
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(os.Stdout, conn)
+		close(done)
+	}()
+	io.Copy(conn, os.Stdin)
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		<-done
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"time"
+
+	proxyplease "github.com/bdwyertech/proxyplease"
+)
+
+func get(args []string) {
+	fs, o := newFlagSet("get")
+	include := fs.Bool("i", false, "write the response status and headers before the body")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: proxyplease get [flags] [-i] URL")
+		os.Exit(2)
+	}
+	p := o.proxy()
+
+	dialer := proxyplease.NewDialer(p)
+	defer dialer.Close()
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			start := time.Now()
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintln(os.Stderr, describeTunnel(conn, addr, time.Since(start)))
+			return conn, nil
+		},
+		ForceAttemptHTTP2: true,
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *o.timeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", fs.Arg(0), nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid URL: %s\n", err)
+		os.Exit(2)
+	}
+
+	start := time.Now()
+	var tlsStart time.Time
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone: func(s tls.ConnectionState, err error) {
+			if err == nil {
+				fmt.Fprintf(os.Stderr, "* TLS handshake with %s completed in %s (%s)\n", s.ServerName, time.Since(tlsStart).Round(time.Millisecond), tls.VersionName(s.Version))
+			}
+		},
+		GotFirstResponseByte: func() {
+			fmt.Fprintf(os.Stderr, "* First response byte after %s\n", time.Since(start).Round(time.Millisecond))
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "* Request failed: %s\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	if *include {
+		fmt.Printf("%s %s\r\n", resp.Proto, resp.Status)
+		resp.Header.Write(os.Stdout)
+		fmt.Print("\r\n")
+	}
+	n, err := io.Copy(os.Stdout, resp.Body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "* Reading the response failed: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "* %s, %d bytes received in %s\n", resp.Status, n, time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,115 @@
+// Command proxyplease diagnoses proxy configuration and connectivity, and reproduces
+// proxy authentication issues outside of applications.
+//
+//	proxyplease selftest [flags] [-json] [URL]
+//	proxyplease get [flags] [-i] URL
+//	proxyplease connect [flags] HOST:PORT
+//
+// selftest discovers the proxy for URL (default https://www.google.com), connects and
+// authenticates to it, establishes TLS with the target and reports each stage. The exit
+// status is 1 if a stage failed.
+//
+// get fetches URL through the proxy, like curl. The body is written to stdout, preceded
+// by the response headers with -i; the proxy, the authentication scheme and the time
+// taken by the tunnel, the TLS handshake and the response are written to stderr.
+//
+// connect establishes a tunnel to HOST:PORT, reports it on stderr, then relays stdin and
+// stdout through it, ex: as an ssh ProxyCommand.
+//
+// All commands accept -proxy (defaults to the system settings), -user, -domain, -timeout
+// and -debug; -v writes the CONNECT requests and responses to stderr, with credentials
+// redacted. The password is read from $PROXYPLEASE_PASSWORD.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	proxyplease "github.com/bdwyertech/proxyplease"
+)
+
+const usage = `usage: proxyplease selftest [flags] [-json] [URL]
+       proxyplease get [flags] [-i] URL
+       proxyplease connect [flags] HOST:PORT`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "selftest":
+		selftest(os.Args[2:])
+	case "get":
+		get(os.Args[2:])
+	case "connect":
+		connect(os.Args[2:])
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// options are the flags common to all commands.
+type options struct {
+	proxyURL *string
+	user     *string
+	domain   *string
+	timeout  *time.Duration
+	debug    *bool
+	verbose  *bool
+}
+
+func newFlagSet(name string) (*flag.FlagSet, options) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	return fs, options{
+		proxyURL: fs.String("proxy", "", "proxy URL, ex: http://proxy:8080. Defaults to the system settings"),
+		user:     fs.String("user", "", "username for proxy authentication, ex: DOMAIN\\user"),
+		domain:   fs.String("domain", "", "Windows domain for NTLM"),
+		timeout:  fs.Duration("timeout", 30*time.Second, "limit on the whole command, or on establishing the tunnel for connect"),
+		debug:    fs.Bool("debug", false, "print the debug output of the handshake"),
+		verbose:  fs.Bool("v", false, "print the CONNECT requests and responses, with credentials redacted"),
+	}
+}
+
+// proxy returns the Proxy configured by the flags.
+func (o options) proxy() proxyplease.Proxy {
+	p := proxyplease.Proxy{
+		Username: *o.user,
+		Password: os.Getenv("PROXYPLEASE_PASSWORD"),
+		Domain:   *o.domain,
+	}
+	if *o.proxyURL != "" {
+		u, err := proxyplease.ParseProxyURL(*o.proxyURL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid proxy URL: %s\n", err)
+			os.Exit(2)
+		}
+		p.URL = u
+	}
+	if !*o.debug {
+		quiet := func(string, ...interface{}) {}
+		p.Debugf = quiet
+		proxyplease.SetDebugf(quiet)
+	}
+	if *o.verbose {
+		p.Capture = proxyplease.WireDump(os.Stderr)
+	}
+	return p
+}
+
+// describeTunnel returns how conn reached addr, for stderr.
+func describeTunnel(conn interface{}, addr string, d time.Duration) string {
+	c, ok := conn.(*proxyplease.Conn)
+	if !ok || c.TunnelInfo().Proxy == nil {
+		return fmt.Sprintf("* Connected directly to %s in %s", addr, d.Round(time.Millisecond))
+	}
+	info := c.TunnelInfo()
+	s := fmt.Sprintf("* Tunnel to %s through %s (%s) established in %s", addr, info.Proxy.Redacted(), info.Source, d.Round(time.Millisecond))
+	if info.AuthScheme != "" {
+		s += " with " + info.AuthScheme + " authentication"
+	}
+	return s
+}
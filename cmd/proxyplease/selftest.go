@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	proxyplease "github.com/bdwyertech/proxyplease"
+)
+
+func selftest(args []string) {
+	fs, o := newFlagSet("selftest")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Parse(args)
+
+	target := "https://www.google.com"
+	if fs.NArg() > 0 {
+		target = fs.Arg(0)
+	}
+	p := o.proxy()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *o.timeout)
+	defer cancel()
+	r := proxyplease.SelfTest(ctx, p, target)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(r)
+	} else {
+		fmt.Printf("Self-test of %s\n", r.Target)
+		for _, s := range r.Stages {
+			status := "PASS"
+			switch {
+			case s.Skipped:
+				status = "SKIP"
+			case !s.Passed:
+				status = "FAIL"
+			}
+			line := fmt.Sprintf("  %-4s %-10s %8s", status, s.Name, s.Duration.Round(time.Millisecond))
+			if s.Detail != "" {
+				line += "  " + s.Detail
+			}
+			if s.Error != "" {
+				line += "  " + s.Error
+			}
+			fmt.Println(line)
+		}
+	}
+	if !r.Passed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,45 @@
+package proxyplease
+
+import (
+	"context"
+	"strconv"
+	"sync"
+)
+
+// proxySlots holds the semaphores enforcing Proxy.MaxConcurrentDials and
+// Proxy.MaxConcurrentTunnels, by kind, proxy host and limit, so every Dialer of the
+// process shares them.
+var proxySlots = struct {
+	sync.Mutex
+	m map[string]chan struct{}
+}{m: map[string]chan struct{}{}}
+
+// acquireSlot waits until fewer than limit slots of kind are held for the proxy of p,
+// or ctx is done, and returns the function releasing the slot taken. It returns a no-op
+// if limit is not positive.
+func (p Proxy) acquireSlot(ctx context.Context, kind string, limit int) (func(), error) {
+	if limit <= 0 {
+		return func() {}, nil
+	}
+	key := kind + "|" + p.URL.Host + "|" + strconv.Itoa(limit)
+	proxySlots.Lock()
+	sem := proxySlots.m[key]
+	if sem == nil {
+		sem = make(chan struct{}, limit)
+		proxySlots.m[key] = sem
+	}
+	proxySlots.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+	default:
+		p.debugf("proxy> Limit of %d concurrent %s with the proxy reached. Waiting for one to end.", limit, kind)
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-sem }) }, nil
+}
@@ -0,0 +1,215 @@
+package proxyplease
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Config is the declarative configuration of a Proxy, read from JSON, YAML or TOML by
+// LoadConfig and ParseConfig, so tools embedding proxyplease can share one file format.
+// Durations are in time.ParseDuration syntax, ex: "10s".
+type Config struct {
+	URL              string      `json:"url,omitempty"`               // Proxy URL, ex: "http://proxy.example.com:8080". Empty uses the system settings.
+	Upstreams        []string    `json:"upstreams,omitempty"`         // URLs of equivalent proxies to distribute dials across, see Proxy.Upstreams.
+	ProxyList        string      `json:"proxy_list,omitempty"`        // Proxies tried in order, in PAC result syntax, see Proxy.ProxyList.
+	PACURL           string      `json:"pac_url,omitempty"`           // PAC script used instead of the system settings.
+	DisableWPAD      bool        `json:"disable_wpad,omitempty"`      // Connect directly instead of discovering a PAC script when no proxy is found.
+	Username         string      `json:"username,omitempty"`          // Username for authentication.
+	Domain           string      `json:"domain,omitempty"`            // Domain of Username for NTLM and realm for Negotiate.
+	Password         string      `json:"password,omitempty"`          // Password in clear text. Prefer PasswordEnv or PasswordFile.
+	PasswordEnv      string      `json:"password_env,omitempty"`      // Environment variable holding the password.
+	PasswordFile     string      `json:"password_file,omitempty"`     // File holding the password, ex: a mounted secret. A trailing newline is ignored.
+	MachineAccount   bool        `json:"machine_account,omitempty"`   // Authenticate as the machine account of a Windows service, see Proxy.MachineAccount.
+	AuthSchemes      []string    `json:"auth_schemes,omitempty"`      // Authentication schemes attempted, see Proxy.AuthSchemeFilter. Empty attempts all.
+	Bypass           []string    `json:"bypass,omitempty"`            // Destinations dialed directly, see Proxy.Bypass.
+	Routes           []string    `json:"routes,omitempty"`            // Routing rules, one per entry, in ParseRoutes syntax, ex: "*:22 PROXY socks5h://127.0.0.1:1080".
+	CAFile           string      `json:"ca_file,omitempty"`           // Extra roots trusted for https:// proxies, see Proxy.CAFile.
+	DialTimeout      string      `json:"dial_timeout,omitempty"`      // See Proxy.DialTimeout.
+	AuthTimeout      string      `json:"auth_timeout,omitempty"`      // See Proxy.AuthTimeout.
+	HandshakeTimeout string      `json:"handshake_timeout,omitempty"` // See Proxy.HandshakeTimeout.
+	ReadTimeout      string      `json:"read_timeout,omitempty"`      // See Proxy.ReadTimeout.
+	WriteTimeout     string      `json:"write_timeout,omitempty"`     // See Proxy.WriteTimeout.
+	KeepAlive        string      `json:"keep_alive,omitempty"`        // See Proxy.KeepAlive.
+	Retry            ConfigRetry `json:"retry"`                       // See Proxy.RetryPolicy.
+}
+
+// ConfigRetry is the retry policy of a Config.
+type ConfigRetry struct {
+	MaxAttempts    int    `json:"max_attempts,omitempty"`
+	InitialBackoff string `json:"initial_backoff,omitempty"`
+	MaxBackoff     string `json:"max_backoff,omitempty"`
+}
+
+// LoadConfig reads the configuration file at path and returns its Proxy. The format is
+// that of the extension: .json, .yaml, .yml or .toml. Relative PasswordFile and CAFile
+// paths are relative to the directory of the file.
+func LoadConfig(path string) (Proxy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Proxy{}, err
+	}
+	defer f.Close()
+	c, err := ParseConfig(f, strings.TrimPrefix(filepath.Ext(path), "."))
+	if err != nil {
+		return Proxy{}, err
+	}
+	dir := filepath.Dir(path)
+	if c.PasswordFile != "" && !filepath.IsAbs(c.PasswordFile) {
+		c.PasswordFile = filepath.Join(dir, c.PasswordFile)
+	}
+	if c.CAFile != "" {
+		paths := filepath.SplitList(c.CAFile)
+		for i := range paths {
+			if !filepath.IsAbs(paths[i]) {
+				paths[i] = filepath.Join(dir, paths[i])
+			}
+		}
+		c.CAFile = strings.Join(paths, string(os.PathListSeparator))
+	}
+	return c.Proxy()
+}
+
+// ParseConfig reads a Config in format: "json", "yaml" (or "yml") or "toml". Keys are those
+// of the JSON tags of Config; unknown keys are an error. YAML and TOML are read without
+// external dependencies, so only the subset needed by Config is supported: mappings or
+// tables, with TOML dotted keys, lists of scalars and scalars.
+//
+//	url: http://proxy.example.com:8080
+//	username: jdoe
+//	password_env: PROXY_PASSWORD
+//	bypass: ["*.corp.example.com", "10.0.0.0/8"]
+//	routes:
+//	  - "*:22 PROXY socks5h://127.0.0.1:1080"
+//	dial_timeout: 10s
+//	retry:
+//	  max_attempts: 3
+func ParseConfig(r io.Reader, format string) (*Config, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	switch strings.ToLower(format) {
+	case "json":
+	case "yaml", "yml":
+		m, err = parseYAML(b)
+	case "toml":
+		m, err = parseTOML(b)
+	default:
+		return nil, fmt.Errorf("unsupported config format '%s'", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m != nil {
+		if b, err = json.Marshal(m); err != nil {
+			return nil, err
+		}
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	c := &Config{}
+	if err := d.Decode(c); err != nil {
+		return nil, fmt.Errorf("config: %s", err)
+	}
+	return c, nil
+}
+
+// Proxy returns the Proxy configured by c, reading the password from its environment
+// variable or file.
+func (c *Config) Proxy() (Proxy, error) {
+	var p Proxy
+	var err error
+	if c.URL != "" {
+		if p.URL, err = ParseProxyURL(c.URL); err != nil {
+			return Proxy{}, fmt.Errorf("config url: %s", err)
+		}
+	}
+	for _, s := range c.Upstreams {
+		u, err := ParseProxyURL(s)
+		if err != nil {
+			return Proxy{}, fmt.Errorf("config upstreams: %s", err)
+		}
+		p.Upstreams = append(p.Upstreams, Upstream{URL: u})
+	}
+	p.ProxyList = c.ProxyList
+	if c.PACURL != "" {
+		if p.PACURL, err = url.Parse(c.PACURL); err != nil {
+			return Proxy{}, fmt.Errorf("config pac_url: %s", err)
+		}
+	}
+	p.DisableWPAD = c.DisableWPAD
+
+	p.Username, p.Domain = c.Username, c.Domain
+	p.MachineAccount = c.MachineAccount
+	if p.Password, err = c.password(); err != nil {
+		return Proxy{}, err
+	}
+	p.AuthSchemeFilter = c.AuthSchemes
+	p.Bypass = c.Bypass
+	if len(c.Routes) > 0 {
+		if p.Routes, err = ParseRoutes(strings.NewReader(strings.Join(c.Routes, "\n"))); err != nil {
+			return Proxy{}, fmt.Errorf("config %s", err)
+		}
+	}
+	p.CAFile = c.CAFile
+
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"dial_timeout", c.DialTimeout, &p.DialTimeout},
+		{"auth_timeout", c.AuthTimeout, &p.AuthTimeout},
+		{"handshake_timeout", c.HandshakeTimeout, &p.HandshakeTimeout},
+		{"read_timeout", c.ReadTimeout, &p.ReadTimeout},
+		{"write_timeout", c.WriteTimeout, &p.WriteTimeout},
+		{"keep_alive", c.KeepAlive, &p.KeepAlive},
+		{"retry.initial_backoff", c.Retry.InitialBackoff, &p.RetryPolicy.InitialBackoff},
+		{"retry.max_backoff", c.Retry.MaxBackoff, &p.RetryPolicy.MaxBackoff},
+	} {
+		if d.value == "" {
+			continue
+		}
+		if *d.dst, err = time.ParseDuration(d.value); err != nil {
+			return Proxy{}, fmt.Errorf("config %s: %s", d.name, err)
+		}
+	}
+	p.RetryPolicy.MaxAttempts = c.Retry.MaxAttempts
+	return p, nil
+}
+
+// password returns the password set inline, in an environment variable or in a file.
+func (c *Config) password() (string, error) {
+	set := 0
+	for _, s := range []string{c.Password, c.PasswordEnv, c.PasswordFile} {
+		if s != "" {
+			set++
+		}
+	}
+	switch {
+	case set > 1:
+		return "", fmt.Errorf("config: only one of password, password_env and password_file may be set")
+	case c.PasswordEnv != "":
+		v, ok := os.LookupEnv(c.PasswordEnv)
+		if !ok {
+			return "", fmt.Errorf("config password_env: %s is not set", c.PasswordEnv)
+		}
+		return v, nil
+	case c.PasswordFile != "":
+		b, err := ioutil.ReadFile(c.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("config password_file: %s", err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	return c.Password, nil
+}
@@ -0,0 +1,386 @@
+package proxyplease
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// configLine is a line of a YAML or TOML config, without its comment.
+type configLine struct {
+	n      int // line number
+	indent int
+	text   string
+}
+
+// configLines splits b into lines without comments, skipping blank ones.
+func configLines(b []byte) []configLine {
+	var lines []configLine
+	for i, s := range strings.Split(string(b), "\n") {
+		s = strings.TrimRight(stripConfigComment(s), " \t\r")
+		text := strings.TrimLeft(s, " \t")
+		if text == "" {
+			continue
+		}
+		lines = append(lines, configLine{n: i + 1, indent: len(s) - len(text), text: text})
+	}
+	return lines
+}
+
+// stripConfigComment removes a comment starting with '#' outside quotes, at the start of
+// s or after a space.
+func stripConfigComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// indexUnquoted returns the index of the first sep in s outside quotes, or -1.
+func indexUnquoted(s, sep string) int {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case strings.HasPrefix(s[i:], sep):
+			return i
+		}
+	}
+	return -1
+}
+
+// unquoteConfig returns the value of the quoted string s: double-quoted with escapes, or
+// single-quoted, where YAML escapes a quote by doubling it and TOML has no escapes.
+func unquoteConfig(s string, yaml bool) (string, bool) {
+	if len(s) < 2 || s[0] != s[len(s)-1] {
+		return "", false
+	}
+	switch s[0] {
+	case '"':
+		v, err := strconv.Unquote(s)
+		return v, err == nil
+	case '\'':
+		v := s[1 : len(s)-1]
+		if yaml {
+			v = strings.Replace(v, "''", "'", -1)
+		}
+		return v, true
+	}
+	return "", false
+}
+
+// splitFlowList splits the inside of a bracketed list at the commas outside quotes. A
+// trailing comma is allowed, an empty item is an error.
+func splitFlowList(s string) ([]string, error) {
+	var items []string
+	for {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return items, nil
+		}
+		i := indexUnquoted(s, ",")
+		if i < 0 {
+			return append(items, s), nil
+		}
+		item := strings.TrimSpace(s[:i])
+		if item == "" {
+			return nil, fmt.Errorf("empty list item")
+		}
+		items = append(items, item)
+		s = s[i+1:]
+	}
+}
+
+// parseYAML reads the block mappings, block and flow sequences, and scalars of a YAML
+// document. Anchors, tags, multi-line scalars and flow mappings are not supported.
+func parseYAML(b []byte) (map[string]interface{}, error) {
+	var lines []configLine
+	for _, l := range configLines(b) {
+		if l.indent == 0 && (l.text == "---" || l.text == "...") {
+			continue
+		}
+		lines = append(lines, l)
+	}
+	if len(lines) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	v, rest, err := yamlBlock(lines, lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("config line %d: unexpected indentation", rest[0].n)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config line %d: expected a mapping", lines[0].n)
+	}
+	return m, nil
+}
+
+// yamlBlock reads the mapping or sequence at indent starting at lines[0], and returns the
+// lines after it.
+func yamlBlock(lines []configLine, indent int) (interface{}, []configLine, error) {
+	if isYAMLItem(lines[0].text) {
+		var seq []interface{}
+		for len(lines) > 0 && lines[0].indent == indent && isYAMLItem(lines[0].text) {
+			l := lines[0]
+			lines = lines[1:]
+			item := strings.TrimSpace(l.text[1:])
+			if item == "" || yamlKey(item) >= 0 {
+				return nil, nil, fmt.Errorf("config line %d: only scalars are supported in lists", l.n)
+			}
+			v, err := yamlScalar(item)
+			if err != nil {
+				return nil, nil, fmt.Errorf("config line %d: %s", l.n, err)
+			}
+			seq = append(seq, v)
+		}
+		return seq, lines, nil
+	}
+
+	m := map[string]interface{}{}
+	for len(lines) > 0 && lines[0].indent == indent {
+		l := lines[0]
+		lines = lines[1:]
+		i := yamlKey(l.text)
+		if i < 0 || isYAMLItem(l.text) {
+			return nil, nil, fmt.Errorf("config line %d: expected 'key: value'", l.n)
+		}
+		key := strings.TrimSpace(l.text[:i])
+		if k, ok := unquoteConfig(key, true); ok {
+			key = k
+		}
+		if _, ok := m[key]; ok {
+			return nil, nil, fmt.Errorf("config line %d: duplicate key '%s'", l.n, key)
+		}
+		value := strings.TrimSpace(l.text[i+1:])
+		switch {
+		case value != "":
+			v, err := yamlScalar(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("config line %d: %s", l.n, err)
+			}
+			m[key] = v
+		case len(lines) > 0 && (lines[0].indent > indent || lines[0].indent == indent && isYAMLItem(lines[0].text)):
+			// sequences may be indented as much as their key
+			v, rest, err := yamlBlock(lines, lines[0].indent)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key], lines = v, rest
+		default:
+			m[key] = nil
+		}
+	}
+	if len(lines) > 0 && lines[0].indent > indent {
+		return nil, nil, fmt.Errorf("config line %d: unexpected indentation", lines[0].n)
+	}
+	return m, lines, nil
+}
+
+func isYAMLItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// yamlKey returns the index of the colon ending the key of a mapping entry, or -1.
+func yamlKey(text string) int {
+	if strings.HasSuffix(text, ":") && indexUnquoted(text, ": ") < 0 {
+		return len(text) - 1
+	}
+	return indexUnquoted(text, ": ")
+}
+
+// yamlScalar returns the value of a scalar or flow sequence of scalars.
+func yamlScalar(s string) (interface{}, error) {
+	if strings.HasPrefix(s, "[") {
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("unterminated list")
+		}
+		seq := []interface{}{}
+		items, err := splitFlowList(s[1 : len(s)-1])
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			v, err := yamlScalar(item)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+		}
+		return seq, nil
+	}
+	if v, ok := unquoteConfig(s, true); ok {
+		return v, nil
+	}
+	if s == "" {
+		return nil, fmt.Errorf("empty value")
+	}
+	switch s[0] {
+	case '"', '\'', '{', '&', '*', '!', '|', '>':
+		return nil, fmt.Errorf("unsupported value '%s', quote strings starting with '%c'", s, s[0])
+	}
+	switch s {
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	case "null", "Null", "NULL", "~":
+		return nil, nil
+	}
+	if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return json.Number(s), nil
+	}
+	return s, nil
+}
+
+// parseTOML reads the tables, key/value pairs with bare, quoted or dotted keys, arrays, strings, integers and booleans of a
+// TOML document. Arrays of tables, inline tables and dates are not supported.
+func parseTOML(b []byte) (map[string]interface{}, error) {
+	root := map[string]interface{}{}
+	table := root
+	lines := configLines(b)
+	for len(lines) > 0 {
+		l := lines[0]
+		lines = lines[1:]
+		if strings.HasPrefix(l.text, "[") {
+			if strings.HasPrefix(l.text, "[[") || !strings.HasSuffix(l.text, "]") {
+				return nil, fmt.Errorf("config line %d: unsupported table header", l.n)
+			}
+			names, err := tomlKey(l.text[1 : len(l.text)-1])
+			if err != nil {
+				return nil, fmt.Errorf("config line %d: %s", l.n, err)
+			}
+			if table, err = tomlTable(root, names); err != nil {
+				return nil, fmt.Errorf("config line %d: %s", l.n, err)
+			}
+			continue
+		}
+		i := indexUnquoted(l.text, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("config line %d: expected 'key = value'", l.n)
+		}
+		// dotted keys define the key in nested tables, ex: "retry.max_attempts = 3"
+		names, err := tomlKey(l.text[:i])
+		if err != nil {
+			return nil, fmt.Errorf("config line %d: %s", l.n, err)
+		}
+		t, err := tomlTable(table, names[:len(names)-1])
+		if err != nil {
+			return nil, fmt.Errorf("config line %d: %s", l.n, err)
+		}
+		key := names[len(names)-1]
+		if _, ok := t[key]; ok {
+			return nil, fmt.Errorf("config line %d: duplicate key '%s'", l.n, key)
+		}
+		value := strings.TrimSpace(l.text[i+1:])
+		// arrays may span lines
+		for strings.HasPrefix(value, "[") && !strings.HasSuffix(value, "]") && len(lines) > 0 {
+			value += " " + lines[0].text
+			lines = lines[1:]
+		}
+		v, err := tomlValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("config line %d: %s", l.n, err)
+		}
+		t[key] = v
+	}
+	return root, nil
+}
+
+// tomlKey splits the bare, quoted or dotted key s into its names.
+func tomlKey(s string) ([]string, error) {
+	var names []string
+	for {
+		i := indexUnquoted(s, ".")
+		name := s
+		if i >= 0 {
+			name = s[:i]
+		}
+		name = strings.TrimSpace(name)
+		if k, ok := unquoteConfig(name, false); ok {
+			name = k
+		} else if name == "" {
+			return nil, fmt.Errorf("empty key")
+		}
+		names = append(names, name)
+		if i < 0 {
+			return names, nil
+		}
+		s = s[i+1:]
+	}
+}
+
+// tomlTable returns the table at names under table, creating the missing ones.
+func tomlTable(table map[string]interface{}, names []string) (map[string]interface{}, error) {
+	for _, name := range names {
+		next, ok := table[name].(map[string]interface{})
+		if !ok {
+			if _, exists := table[name]; exists {
+				return nil, fmt.Errorf("'%s' is not a table", name)
+			}
+			next = map[string]interface{}{}
+			table[name] = next
+		}
+		table = next
+	}
+	return table, nil
+}
+
+// tomlValue returns the value of a string, integer, boolean or array.
+func tomlValue(s string) (interface{}, error) {
+	if strings.HasPrefix(s, "[") {
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		array := []interface{}{}
+		items, err := splitFlowList(s[1 : len(s)-1])
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			v, err := tomlValue(item)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, v)
+		}
+		return array, nil
+	}
+	if v, ok := unquoteConfig(s, false); ok {
+		return v, nil
+	}
+	switch s {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if n := strings.Replace(s, "_", "", -1); n != "" {
+		if _, err := strconv.ParseInt(n, 10, 64); err == nil {
+			return json.Number(n), nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported value '%s'", s)
+}
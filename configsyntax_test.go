@@ -0,0 +1,176 @@
+package proxyplease
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// configMap and configList shorten the expected results of the parsers.
+type configMap = map[string]interface{}
+type configList = []interface{}
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		in   string
+		want configMap
+	}{
+		{"", configMap{}},
+		{"---\nurl: http://proxy:8080\n...", configMap{"url": "http://proxy:8080"}},
+		{"username: jdoe # comment\n# comment\n\ndisable_wpad: true", configMap{"username": "jdoe", "disable_wpad": true}},
+		{`password: "p#ss: \"w\""`, configMap{"password": `p#ss: "w"`}},
+		{`password: 'it''s'`, configMap{"password": "it's"}},
+		{`"url": x`, configMap{"url": "x"}},
+		{"url:", configMap{"url": nil}},
+		{"url: ~", configMap{"url": nil}},
+		{"retry:\n  max_attempts: 3\n  initial_backoff: 1s", configMap{"retry": configMap{"max_attempts": json.Number("3"), "initial_backoff": "1s"}}},
+		{`bypass: ["*.corp.example.com", '10.0.0.0/8', localhost]`, configMap{"bypass": configList{"*.corp.example.com", "10.0.0.0/8", "localhost"}}},
+		{"bypass: [a, b,]", configMap{"bypass": configList{"a", "b"}}},
+		{"bypass: []", configMap{"bypass": configList{}}},
+		{"routes:\n  - \"*:22 DIRECT\"\n  - '* BLOCK'", configMap{"routes": configList{"*:22 DIRECT", "* BLOCK"}}},
+		// sequences may be indented as much as their key
+		{"routes:\n- a\n- b\nurl: x", configMap{"routes": configList{"a", "b"}, "url": "x"}},
+	}
+	for _, tt := range tests {
+		got, err := parseYAML([]byte(tt.in))
+		if err != nil {
+			t.Errorf("parseYAML(%q): %s", tt.in, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseYAML(%q) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	for _, in := range []string{
+		"bypass: [a, , b]",
+		"bypass: [, a]",
+		"bypass: [a, b",
+		"url: x\nurl: y",
+		"url: x\n  username: y",
+		"- a\n- b",
+		"routes:\n  - a: b",
+		"routes:\n  -",
+		"url",
+		"url: &anchor x",
+		"url: *alias",
+		"url: |",
+		"url: {a: b}",
+		`url: "unterminated`,
+	} {
+		if got, err := parseYAML([]byte(in)); err == nil {
+			t.Errorf("parseYAML(%q) = %#v, want an error", in, got)
+		}
+	}
+}
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		in   string
+		want configMap
+	}{
+		{"", configMap{}},
+		{"url = \"http://proxy:8080\" # comment\n# comment\n\ndisable_wpad = true", configMap{"url": "http://proxy:8080", "disable_wpad": true}},
+		{`password = 'C:\no\escapes'`, configMap{"password": `C:\no\escapes`}},
+		{`"url" = "x"`, configMap{"url": "x"}},
+		{"n = 1_000", configMap{"n": json.Number("1000")}},
+		{"[retry]\nmax_attempts = 3\ninitial_backoff = \"1s\"", configMap{"retry": configMap{"max_attempts": json.Number("3"), "initial_backoff": "1s"}}},
+		{"[a.\"b.c\"]\nd = 1", configMap{"a": configMap{"b.c": configMap{"d": json.Number("1")}}}},
+		{"retry.max_attempts = 3\nretry.max_backoff = \"1m\"", configMap{"retry": configMap{"max_attempts": json.Number("3"), "max_backoff": "1m"}}},
+		{"[a]\nb.c = true", configMap{"a": configMap{"b": configMap{"c": true}}}},
+		{`"a.b" = 1`, configMap{"a.b": json.Number("1")}},
+		{`bypass = ["*.corp.example.com", '10.0.0.0/8']`, configMap{"bypass": configList{"*.corp.example.com", "10.0.0.0/8"}}},
+		{"routes = [\n  \"*:22 DIRECT\",\n  \"* BLOCK\",\n]", configMap{"routes": configList{"*:22 DIRECT", "* BLOCK"}}},
+	}
+	for _, tt := range tests {
+		got, err := parseTOML([]byte(tt.in))
+		if err != nil {
+			t.Errorf("parseTOML(%q): %s", tt.in, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseTOML(%q) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	for _, in := range []string{
+		`bypass = ["a", , "b"]`,
+		`bypass = ["a", "b"`,
+		"url = \"x\"\nurl = \"y\"",
+		"retry.max_attempts = 1\nretry.max_attempts = 2",
+		"url = \"x\"\n[url]",
+		"url = \"x\"\nurl.host = \"y\"",
+		"[[upstreams]]",
+		"[retry",
+		"[]",
+		"a..b = 1",
+		". = 1",
+		"url",
+		"url = ",
+		"url = bare",
+		"url = {a = 1}",
+		"when = 1979-05-27",
+	} {
+		if got, err := parseTOML([]byte(in)); err == nil {
+			t.Errorf("parseTOML(%q) = %#v, want an error", in, got)
+		}
+	}
+}
+
+func TestParseConfigFormats(t *testing.T) {
+	want := &Config{
+		URL:         "http://proxy.example.com:8080",
+		Username:    "jdoe",
+		PasswordEnv: "PROXY_PASSWORD",
+		Bypass:      []string{"*.corp.example.com", "10.0.0.0/8"},
+		Routes:      []string{"*:22 PROXY socks5h://127.0.0.1:1080"},
+		DialTimeout: "10s",
+		Retry:       ConfigRetry{MaxAttempts: 3, InitialBackoff: "1s"},
+	}
+	// the example of the README in each format
+	for format, in := range map[string]string{
+		"json": `{"url": "http://proxy.example.com:8080", "username": "jdoe", "password_env": "PROXY_PASSWORD",
+			"bypass": ["*.corp.example.com", "10.0.0.0/8"], "routes": ["*:22 PROXY socks5h://127.0.0.1:1080"],
+			"dial_timeout": "10s", "retry": {"max_attempts": 3, "initial_backoff": "1s"}}`,
+		"yaml": `url: http://proxy.example.com:8080
+username: jdoe
+password_env: PROXY_PASSWORD
+bypass: ["*.corp.example.com", "10.0.0.0/8"]
+routes:
+  - "*:22 PROXY socks5h://127.0.0.1:1080"
+dial_timeout: 10s
+retry:
+  max_attempts: 3
+  initial_backoff: 1s
+`,
+		"toml": `url = "http://proxy.example.com:8080"
+username = "jdoe"
+password_env = "PROXY_PASSWORD"
+bypass = ["*.corp.example.com", "10.0.0.0/8"]
+routes = ["*:22 PROXY socks5h://127.0.0.1:1080"]
+dial_timeout = "10s"
+retry.max_attempts = 3
+
+[retry]
+initial_backoff = "1s"
+`,
+	} {
+		got, err := ParseConfig(strings.NewReader(in), format)
+		if err != nil {
+			t.Errorf("%s: %s", format, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", format, got, want)
+		}
+	}
+
+	for format, in := range map[string]string{
+		"yaml": "unknown: 1",
+		"toml": "retry.unknown = 1",
+		"ini":  "url = x",
+	} {
+		if _, err := ParseConfig(strings.NewReader(in), format); err == nil {
+			t.Errorf("%s: ParseConfig(%q) succeeded, want an error", format, in)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package proxyplease
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Conn is the net.Conn returned by a DialContext. Use a type assertion to access metadata
+// about the proxy and the handshake. Deadlines are set on the underlying connection; with
+// Proxy.ReadTimeout or Proxy.WriteTimeout, each Read or Write is limited by the earlier of
+// the deadline and the timeout.
+type Conn struct {
+	sent, received int64 // bytes transferred, first for atomic access on 32-bit platforms
+
+	net.Conn
+	info    TunnelInfo
+	pending []byte // tunnel data read ahead while parsing the CONNECT response
+
+	readTimeout, writeTimeout   time.Duration // Proxy.ReadTimeout and Proxy.WriteTimeout
+	deadlineMu                  sync.Mutex    // serializes deadline updates when timeouts are set
+	readDeadline, writeDeadline time.Time     // deadlines set by the caller
+
+	onClose   func() // set by the Dialer tracking the tunnel
+	release   func() // frees the Proxy.MaxConcurrentTunnels slot of the tunnel
+	closeOnce sync.Once
+
+	metrics      Metrics // receives the bytes transferred when the tunnel is closed
+	metricsProxy string
+	transfers    []*transferCounter // counters of the Proxy.Transfers aggregates the tunnel is part of
+}
+
+// TunnelInfo describes an established proxy tunnel.
+type TunnelInfo struct {
+	Proxy      *url.URL      // Proxy the tunnel was established through, or nil for direct connections.
+	Source     Source        // Where the proxy configuration came from.
+	Headers    http.Header   // CONNECT response headers selected by Proxy.ResponseHeaders.
+	AuthScheme string        // HTTP authentication scheme the CONNECT succeeded with, ex: "NTLM", or empty if none was required.
+	ProxyAddr  string        // Network address of the proxy as connected to, ex: "10.0.0.8:8080".
+	RoundTrips int           // CONNECT requests sent during the handshake, including authentication legs and retries.
+	Duration   time.Duration // Time the handshake took, from the start of the dial to the established tunnel.
+	Status     string        // Status of the proxy's CONNECT response, ex: "200 Connection established", or empty for SOCKS.
+}
+
+// TunnelInfo returns metadata about the tunnel handshake.
+func (c *Conn) TunnelInfo() TunnelInfo {
+	return c.info
+}
+
+// handshakeDone records the round trips and duration of the handshake through p in the
+// TunnelInfo of conn.
+func handshakeDone(p Proxy, conn net.Conn) {
+	c, ok := conn.(*Conn)
+	if !ok {
+		return
+	}
+	if p.connects != nil {
+		c.info.RoundTrips = int(atomic.LoadInt32(p.connects))
+	}
+	c.info.Duration = time.Since(p.started)
+}
+
+// newConn wraps an established tunnel, keeping the allowed headers of the successful
+// CONNECT response, the authentication scheme used and any tunnel data br read past it.
+// br is released to the pool of handshake readers. resp and br are nil for SOCKS tunnels.
+func newConn(conn net.Conn, p Proxy, resp *http.Response, br *bufio.Reader, scheme string) *Conn {
+	c := &Conn{
+		Conn: conn,
+		info: TunnelInfo{Proxy: p.URL, Source: p.source, Headers: http.Header{}, AuthScheme: scheme},
+	}
+	if addr := conn.RemoteAddr(); addr != nil {
+		c.info.ProxyAddr = addr.String()
+	}
+	if br != nil {
+		if n := br.Buffered(); n > 0 {
+			buffered, _ := br.Peek(n)
+			c.pending = append([]byte(nil), buffered...)
+		}
+		releaseReader(br)
+	}
+	if resp == nil {
+		return c
+	}
+	c.info.Status = resp.Status
+	for _, name := range p.ResponseHeaders {
+		if v := resp.Header.Values(name); len(v) > 0 {
+			c.info.Headers[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+	return c
+}
+
+// Read reads data from the tunnel, starting with any data received along with the
+// CONNECT response. Like reads from the underlying connection, reads of that data fail
+// once the read deadline passed.
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		c.deadlineMu.Lock()
+		deadline := c.readDeadline
+		c.deadlineMu.Unlock()
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		c.count(&c.received, n)
+		return n, nil
+	}
+	if c.readTimeout > 0 {
+		c.deadlineMu.Lock()
+		c.Conn.SetReadDeadline(ioDeadline(c.readTimeout, c.readDeadline))
+		c.deadlineMu.Unlock()
+	}
+	n, err := c.Conn.Read(b)
+	c.count(&c.received, n)
+	return n, err
+}
+
+// Write writes data to the tunnel.
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		c.deadlineMu.Lock()
+		c.Conn.SetWriteDeadline(ioDeadline(c.writeTimeout, c.writeDeadline))
+		c.deadlineMu.Unlock()
+	}
+	n, err := c.Conn.Write(b)
+	c.count(&c.sent, n)
+	return n, err
+}
+
+// Close closes the tunnel.
+func (c *Conn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		if c.onClose != nil {
+			c.onClose()
+		}
+		if c.release != nil {
+			c.release()
+		}
+		if c.metrics != nil {
+			c.metrics.Transferred(c.metricsProxy, atomic.LoadInt64(&c.sent), atomic.LoadInt64(&c.received))
+		}
+	})
+	return err
+}
+
+// CloseWrite shuts down the writing side of the tunnel if the underlying connection
+// supports half-close, as TCP connections do. Protocols that signal the end of a request
+// with EOF, and STARTTLS upgrades that shut down cleanly, rely on it.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("underlying connection does not support half-close")
+}
+
+// SetDeadline sets the read and write deadlines of the tunnel.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the tunnel.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the tunnel.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.writeDeadline = t
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// ioDeadline returns the deadline of an I/O operation starting now, limited to timeout,
+// or to deadline if set and earlier.
+func ioDeadline(timeout time.Duration, deadline time.Time) time.Time {
+	d := time.Now().Add(timeout)
+	if !deadline.IsZero() && deadline.Before(d) {
+		return deadline
+	}
+	return d
+}
+
+// setIOTimeouts applies p.ReadTimeout and p.WriteTimeout to conn, an established tunnel.
+func setIOTimeouts(p Proxy, conn net.Conn) {
+	if c, ok := conn.(*Conn); ok {
+		c.readTimeout, c.writeTimeout = p.ReadTimeout, p.WriteTimeout
+	}
+}
@@ -0,0 +1,120 @@
+package proxyplease
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newPendingConn returns a Conn over one end of a pipe whose CONNECT response was read
+// along with pending, tunnel data sent ahead by the target, and the other end of the pipe.
+func newPendingConn(t *testing.T, pending string) (*Conn, net.Conn) {
+	client, server := net.Pipe()
+	br := bufio.NewReader(strings.NewReader("HTTP/1.1 200 Connection established\r\n\r\n" + pending))
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newConn(client, Proxy{}, resp, br, ""), server
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func TestConnReadPending(t *testing.T) {
+	c, server := newPendingConn(t, "ahead")
+	defer c.Close()
+	defer server.Close()
+	go server.Write([]byte("after"))
+
+	b := make([]byte, 10)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "aheadafter" {
+		t.Fatalf("read %q, %v; want the pending data then the tunnel data", b, err)
+	}
+}
+
+func TestConnDeadlinePending(t *testing.T) {
+	for _, set := range []func(*Conn, time.Time) error{(*Conn).SetDeadline, (*Conn).SetReadDeadline} {
+		c, server := newPendingConn(t, "ahead")
+		if err := set(c, time.Now().Add(-time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := c.Read(make([]byte, 10))
+		if n != 0 || !isTimeout(err) {
+			t.Errorf("read of pending data after the deadline: %d, %v; want a timeout", n, err)
+		}
+
+		// clearing the deadline serves the pending data
+		set(c, time.Time{})
+		b := make([]byte, 10)
+		if n, err := c.Read(b); err != nil || string(b[:n]) != "ahead" {
+			t.Errorf("read of pending data without deadline: %q, %v", b[:n], err)
+		}
+		c.Close()
+		server.Close()
+	}
+}
+
+func TestConnDeadlineAfterPending(t *testing.T) {
+	c, server := newPendingConn(t, "ahead")
+	defer c.Close()
+	defer server.Close()
+
+	// the deadline is forwarded to the pipe, which times out once the pending data is read
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	b := make([]byte, 10)
+	if n, err := c.Read(b); err != nil || string(b[:n]) != "ahead" {
+		t.Fatalf("read of pending data: %q, %v", b[:n], err)
+	}
+	start := time.Now()
+	if _, err := c.Read(b); !isTimeout(err) {
+		t.Fatalf("read past the pending data: %v; want a timeout", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("read timed out after %s", d)
+	}
+}
+
+func TestConnReadTimeoutPending(t *testing.T) {
+	c, server := newPendingConn(t, "ahead")
+	defer c.Close()
+	defer server.Close()
+	c.readTimeout = 50 * time.Millisecond
+
+	b := make([]byte, 10)
+	if n, err := c.Read(b); err != nil || string(b[:n]) != "ahead" {
+		t.Fatalf("read of pending data: %q, %v", b[:n], err)
+	}
+	if _, err := c.Read(b); !isTimeout(err) {
+		t.Fatalf("read with Proxy.ReadTimeout: %v; want a timeout", err)
+	}
+
+	// a deadline earlier than the timeout applies, and the timeout does not extend it
+	c.readTimeout = time.Minute
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	if _, err := c.Read(b); !isTimeout(err) {
+		t.Fatalf("read with a deadline earlier than Proxy.ReadTimeout: %v; want a timeout", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("read timed out after %s, past the deadline", d)
+	}
+}
+
+func TestConnWriteDeadline(t *testing.T) {
+	c, server := newPendingConn(t, "")
+	defer c.Close()
+	defer server.Close()
+
+	// nothing reads the other end of the pipe
+	c.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := c.Write([]byte("blocked")); !isTimeout(err) {
+		t.Fatalf("write past the deadline: %v; want a timeout", err)
+	}
+}
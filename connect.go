@@ -1,115 +1,316 @@
 package proxyplease
 
 import (
-	"bufio"
-	"errors"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bdwyertech/proxyplease/auth"
 )
 
-func dialAndNegotiateHTTP(p Proxy, addr string, baseDial func() (net.Conn, error)) (net.Conn, error) {
+func dialAndNegotiateHTTP(ctx context.Context, p Proxy, addr string, baseDial func() (net.Conn, error)) (net.Conn, error) {
+	orig := p
+	p = withQuirks(p)
+	p = p.withCookies()
+	if scheme := p.flightScheme(); scheme != "" {
+		return dialFlightScheme(ctx, p, addr, scheme, baseDial)
+	}
+
 	// establish TCP with proxy. baseDial will negoiate TLS if needed.
 	conn, err := baseDial()
 	if err != nil {
-		debugf("connect> Could not call dial context with proxy: %s", err)
+		p.debugf("connect> Could not call dial context with proxy: %s", err)
 		return conn, err
 	}
 
 	// build and write first CONNECT request
-	h := p.Headers.Clone()
-	h.Set("Proxy-Connection", "Keep-Alive")
+	h := p.connectHeader(addr)
+	p.setKeepAlive(h)
+	scheme := ""
+	if scheme = p.everyRequestScheme(); scheme != "" {
+		if err := setProxyAuthorization(p, h, scheme, "CONNECT", addr); err != nil {
+			return conn, err
+		}
+		p.debugf("connect> Sending %s credentials with the initial CONNECT", scheme)
+	} else {
+		scheme = p.preemptive(h, addr)
+	}
 	connect := &http.Request{
 		Method: "CONNECT",
 		URL:    &url.URL{Opaque: addr},
 		Host:   addr,
 		Header: h,
 	}
-	if err := connect.Write(conn); err != nil {
-		debugf("connect> CONNECT to proxy failed: %s", err)
+	if err := writeConnect(p, conn, connect); err != nil {
+		p.debugf("connect> CONNECT to proxy failed: %s", err)
 		return conn, err
 	}
 
 	// read first response
-	br := bufio.NewReader(conn)
-	resp, err := http.ReadResponse(br, connect)
+	br := newResponseReader(p, conn)
+	resp, err := br.read(connect)
 	if err != nil {
-		debugf("connect> Could not read response from proxy: %s", err)
+		p.debugf("connect> Could not read response from proxy: %s", err)
 		return conn, err
 	}
+	p.saveCookies(resp)
 
 	// if StatusOK, no auth is required and proxy is established
 	if resp.StatusCode == http.StatusOK {
-		debugf("connect> Proxy successfully established. No authentication was required.")
-		return conn, nil
+		p.debugf("connect> Proxy successfully established. No authentication was required.")
+		if scheme != "" {
+			p.authorized(scheme)
+		}
+		return newConn(conn, p, resp, br.Reader, scheme), nil
 	}
 
 	// if authentication is required
+	// credentials are only acquired (from SSPI, Kerberos or a TokenSource) once the proxy
+	// challenges, so anonymous proxies never cause LSA or KDC round trips
 	if resp.StatusCode == http.StatusProxyAuthRequired {
-		debugf("connect> Proxy authentication is required. Attempting to select a authentication scheme.")
-
-		// read authentication scheme options
-		schemes := resp.Header["Proxy-Authenticate"]
-		for _, s := range schemes {
-			// only test for first word in scheme
-			trimmed := strings.Split(s, " ")[0]
-			switch trimmed {
-			case "NTLM":
+		p.debugf("connect> Proxy authentication is required. Attempting to select a authentication scheme.")
+		if scheme != "" {
+			// a stale Digest nonce is renewed by the negotiation below
+			p.debugf("connect> Proxy rejected the %s credentials sent with the initial CONNECT", scheme)
+			p.forgetScheme()
+		}
+
+		conns := &authConns{p: p, dial: baseDial}
+		defer conns.close()
+		conns.rejected(conn, resp)
+		baseDial = conns.next
+
+		// read authentication scheme options, strongest first
+		schemes := auth.SplitChallenges(resp.Header["Proxy-Authenticate"])
+		started := p.authStarted(addr, schemes)
+		defer func() { p.authEnded(conn, "", err, started) }()
+		var negotiation Span
+		p, negotiation = p.traceNegotiation(schemes)
+		// every return below returns conn and err
+		defer func() { endSpan(negotiation, conn, err) }()
+		var attempts []AuthAttempt
+		digested := false
+		dialed := map[string]bool{}
+		for _, s := range orderChallenges(p, schemes) {
+			// only test for first word in scheme, case-insensitively
+			trimmed := auth.ChallengeScheme(s)
+			switch strings.ToLower(trimmed) {
+			case "ntlm":
 				if !contains(p.AuthSchemeFilter, "NTLM") {
-					debugf("connect> Skipping NTLM due to AuthSchemeFilter")
+					p.debugf("connect> Skipping NTLM due to AuthSchemeFilter")
 					continue
 				}
-				conn, err = dialNTLM(p, addr, baseDial)
+				conn, err = withCredentials(ctx, p, "NTLM", func(p Proxy) (net.Conn, error) {
+					return dialNTLM(p, addr, baseDial)
+				})
 				if err != nil {
-					debugf("connect> NTLM authentication failed. Trying next available scheme.")
+					p.debugf("connect> NTLM authentication failed. Trying next available scheme.")
+					conns.failed(conn, err)
+					attempts = append(attempts, p.authAttempt("NTLM", err))
 					continue
 				}
 				return conn, err
-			case "Basic", "BASIC":
+			case "basic":
 				if !contains(p.AuthSchemeFilter, "Basic") {
-					debugf("connect> Skipping Basic due to AuthSchemeFilter")
+					p.debugf("connect> Skipping Basic due to AuthSchemeFilter")
 					continue
 				}
-				conn, err = dialBasic(p, addr, baseDial)
+				conn, err = withCredentials(ctx, p, "Basic", func(p Proxy) (net.Conn, error) {
+					return dialBasic(p, addr, s, baseDial)
+				})
 				if err != nil {
-					debugf("connect> Basic authentication failed. Trying next available scheme.")
+					p.debugf("connect> Basic authentication failed. Trying next available scheme.")
+					conns.failed(conn, err)
+					attempts = append(attempts, p.authAttempt("Basic", err))
 					continue
 				}
+				p.authorized("Basic")
 				return conn, err
 
-			case "Negotiate", "NEGOTIATE":
+			case "negotiate":
 				if !contains(p.AuthSchemeFilter, "Negotiate") {
-					debugf("connect> Skipping Negotiate due to AuthSchemeFilter")
+					p.debugf("connect> Skipping Negotiate due to AuthSchemeFilter")
 					continue
 				}
-				conn, err = dialNegotiate(p, addr, baseDial)
+				conn, err = withCredentials(ctx, p, "Negotiate", func(p Proxy) (net.Conn, error) {
+					return dialNegotiate(p, addr, baseDial)
+				})
 				if err != nil {
-					debugf("connect> Negotiate authentication failed. Trying next available scheme.")
+					p.debugf("connect> Negotiate authentication failed. Trying next available scheme.")
+					conns.failed(conn, err)
+					attempts = append(attempts, p.authAttempt("Negotiate", err))
 					continue
 				}
 				return conn, err
 
-			case "Kerberos":
-				debugf("connect> Kerberos not implemented yet. Trying next available scheme.")
-				continue
+			case "bearer":
+				if !contains(p.AuthSchemeFilter, "Bearer") {
+					p.debugf("connect> Skipping Bearer due to AuthSchemeFilter")
+					continue
+				}
+				if p.TokenSource == nil {
+					p.debugf("connect> Skipping Bearer as no TokenSource is set")
+					continue
+				}
+				conn, err = traceAuth(p, "Bearer", func(p Proxy) (net.Conn, error) {
+					return dialBearer(p, addr, baseDial)
+				})
+				if err != nil {
+					p.debugf("connect> Bearer authentication failed. Trying next available scheme.")
+					conns.failed(conn, err)
+					attempts = append(attempts, p.authAttempt("Bearer", err))
+					continue
+				}
+				return conn, err
 
-			case "Digest":
-				debugf("connect> Digest not implemented yet. Trying next available scheme.")
+			case "kerberos":
+				p.debugf("connect> Kerberos not implemented yet. Trying next available scheme.")
 				continue
 
+			case "digest":
+				if !contains(p.AuthSchemeFilter, "Digest") {
+					p.debugf("connect> Skipping Digest due to AuthSchemeFilter")
+					continue
+				}
+				if digested {
+					// proxies send one challenge per algorithm, all answered by one attempt
+					continue
+				}
+				digested = true
+				conn, err = withCredentials(ctx, p, "Digest", func(p Proxy) (net.Conn, error) {
+					return dialDigest(p, addr, baseDial, schemes)
+				})
+				if err != nil {
+					p.debugf("connect> Digest authentication failed. Trying next available scheme.")
+					conns.failed(conn, err)
+					attempts = append(attempts, p.authAttempt("Digest", err))
+					continue
+				}
+				p.authorized("Digest")
+				return conn, err
+
 			default:
-				debugf("connect> Unsupported proxy authentication scheme: '%s'. Trying next available scheme.", trimmed)
-				continue
+				registered, ok := lookupScheme(s)
+				if !ok {
+					p.debugf("connect> Unsupported proxy authentication scheme: '%s'. Trying next available scheme.", trimmed)
+					continue
+				}
+				if !contains(p.AuthSchemeFilter, registered.name) {
+					p.debugf("connect> Skipping %s due to AuthSchemeFilter", registered.name)
+					continue
+				}
+				if dialed[registered.name] {
+					// all the challenges of the scheme are answered by one attempt
+					continue
+				}
+				dialed[registered.name] = true
+				conn, err = withCredentials(ctx, p, registered.name, func(p Proxy) (net.Conn, error) {
+					return dialRegistered(ctx, p, addr, registered, schemes, baseDial)
+				})
+				if err != nil {
+					p.debugf("connect> %s authentication failed. Trying next available scheme.", registered.name)
+					conns.failed(conn, err)
+					attempts = append(attempts, p.authAttempt(registered.name, err))
+					continue
+				}
+				return conn, err
 			}
 		}
 
-		debugf("connect> No proxy authentication completed successfully")
+		p.debugf("connect> No proxy authentication completed successfully")
+		if err == nil {
+			// no scheme offered by the proxy could be attempted
+			err = newStatusError(resp)
+		} else {
+			last := attempts[len(attempts)-1]
+			err = &ErrAuthFailed{Scheme: last.Scheme, Status: last.StatusCode, Err: err}
+		}
+		err = &AuthError{Offered: schemes, Attempts: attempts, Err: err}
+		p.event(EventAuthFailed, "Authentication to the proxy failed for %s: %s", addr, err)
 		return conn, err
 	}
 
-	debugf("connect> Unhandled HTTP status, got: %d", resp.StatusCode)
-	return conn, errors.New(http.StatusText(resp.StatusCode))
+	// some filtering proxies send clients to a login page instead
+	if p.FormAuth != nil && !p.formLogin && isLoginResponse(resp) {
+		p.debugf("connect> Proxy requires form login, got: %d", resp.StatusCode)
+		conn.Close()
+		return dialFormAuth(ctx, orig, addr, baseDial)
+	}
+
+	p.debugf("connect> Unhandled HTTP status, got: %d", resp.StatusCode)
+	err = newStatusError(resp)
+	conn.Close()
+	return conn, err
+}
+
+// ConnectWriter writes a CONNECT request to the proxy. It may be set on Proxy to
+// interoperate with devices that expect nonstandard framing on CONNECT.
+type ConnectWriter func(w io.Writer, req *http.Request) error
+
+// WriteConnectChunked is a ConnectWriter for gateways that expect CONNECT to carry an
+// empty chunked body.
+func WriteConnectChunked(w io.Writer, req *http.Request) error {
+	r := *req
+	r.TransferEncoding = []string{"chunked"}
+	r.ContentLength = -1
+	r.Body = ioutil.NopCloser(strings.NewReader(""))
+	return r.Write(w)
+}
+
+// maxPooledConnectBuffer bounds the buffers kept in connectBuffers, so a request with a
+// large body does not stay in memory.
+const maxPooledConnectBuffer = 64 << 10
+
+// connectBuffers holds the buffers CONNECT requests are serialized into, so each request
+// is sent with one write, without allocating the bufio.Writer of http.Request.Write.
+var connectBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// writeConnect writes req to conn using p.ConnectWriter if one is set, and captures the
+// bytes written if p.Capture is set. The Host header is replaced by p.Authority.Host.
+func writeConnect(p Proxy, conn net.Conn, req *http.Request) error {
+	if p.Authority.Host != "" {
+		req.Host = p.Authority.Host
+	}
+	if p.connects != nil {
+		atomic.AddInt32(p.connects, 1)
+	}
+	if p.ConnectWriter != nil {
+		// custom writers decide how the request is framed and flushed
+		var w io.Writer = conn
+		if p.Capture != nil {
+			var raw bytes.Buffer
+			w = io.MultiWriter(conn, &raw)
+			defer func() { p.capture(conn, true, raw.Bytes()) }()
+		}
+		return p.ConnectWriter(w, req)
+	}
+
+	buf := connectBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooledConnectBuffer {
+			connectBuffers.Put(buf)
+		}
+	}()
+	var err error
+	if p.Quirks.LowercaseHeaders {
+		err = writeLowercaseHeaders(buf, req)
+	} else {
+		err = req.Write(buf)
+	}
+	if err != nil {
+		return err
+	}
+	n, err := conn.Write(buf.Bytes())
+	p.capture(conn, true, buf.Bytes()[:n])
+	return err
 }
 
 func contains(s []string, e string) bool {
@@ -0,0 +1,46 @@
+package proxyplease
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// cookieURL is the URL proxy session cookies are stored under.
+func (p Proxy) cookieURL() *url.URL {
+	return &url.URL{Scheme: p.URL.Scheme, Host: p.URL.Host, Path: "/"}
+}
+
+// saveCookies stores the cookies set by a CONNECT response in p.CookieJar.
+func (p Proxy) saveCookies(resp *http.Response) {
+	if p.CookieJar == nil {
+		return
+	}
+	if cookies := resp.Cookies(); len(cookies) > 0 {
+		p.debugf("cookies> Proxy set %d session cookies", len(cookies))
+		p.CookieJar.SetCookies(p.cookieURL(), cookies)
+	}
+}
+
+// withCookies returns p with the session cookies of p.CookieJar and p.FormAuth added to
+// the CONNECT headers.
+func (p Proxy) withCookies() Proxy {
+	var cookies []*http.Cookie
+	if p.CookieJar != nil {
+		cookies = p.CookieJar.Cookies(p.cookieURL())
+	}
+	if p.FormAuth != nil && p.FormAuth.LoginURL != nil {
+		cookies = append(cookies, p.FormAuth.cookieJar().Cookies(p.FormAuth.LoginURL)...)
+	}
+	if len(cookies) == 0 {
+		return p
+	}
+	s := make([]string, len(cookies))
+	for i, c := range cookies {
+		s[i] = c.Name + "=" + c.Value
+	}
+	h := snapshotHeaders(p.Headers)
+	h.Set("Cookie", strings.Join(s, "; "))
+	p.Headers = h
+	return p
+}
@@ -0,0 +1,205 @@
+package proxyplease
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Lifetimes of cached credentials whose expiry is not known. Proxies rejecting a cached
+// credential cause it to be dropped and acquired again.
+const (
+	cachedTicketTTL = time.Hour
+	cachedTokenTTL  = 10 * time.Minute
+	cachedNonceTTL  = 10 * time.Minute
+)
+
+// CredentialCache persists authentication state, such as Bearer tokens, Kerberos service
+// tickets and Digest sessions, to an encrypted file keyed by proxy, so frequently
+// restarting tools do not contact the KDC or identity provider, or wait for a Digest
+// challenge, on every run. Set it on Proxy.CredentialCache. Kerberos tickets are only
+// cached on Linux and macOS; Windows caches them itself. Bearer tokens are cached per
+// TokenSource type, or per the value of its CacheKey() string method, ex: DeviceFlow, so
+// programs using several TokenSources of one type should implement it.
+type CredentialCache struct {
+	Path string // File holding the cache. It is created readable only by the current user.
+	Key  []byte // AES key (16, 24 or 32 bytes) encrypting the file, ex: kept in the OS keyring.
+
+	mu sync.Mutex
+}
+
+// credentialEntry is a cached credential.
+type credentialEntry struct {
+	Value   []byte    `json:"value"`
+	Expires time.Time `json:"expires"`
+}
+
+// Get returns the unexpired value stored under key.
+func (c *CredentialCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries, err := c.load()
+	if err != nil {
+		debugf("credcache> Could not read %s: %s", c.Path, err)
+		return nil, false
+	}
+	e, ok := entries[key]
+	if !ok || time.Now().After(e.Expires) {
+		return nil, false
+	}
+	return e.Value, true
+}
+
+// Put stores value under key until expires.
+func (c *CredentialCache) Put(key string, value []byte, expires time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries, err := c.load()
+	if err != nil {
+		// an unreadable cache, ex: encrypted with another key, is replaced
+		entries = map[string]credentialEntry{}
+	}
+	entries[key] = credentialEntry{Value: value, Expires: expires}
+	return c.save(entries)
+}
+
+// Delete removes the value stored under key.
+func (c *CredentialCache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries, err := c.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := entries[key]; !ok {
+		return nil
+	}
+	delete(entries, key)
+	return c.save(entries)
+}
+
+// load decrypts the cache file. A missing file is an empty cache.
+func (c *CredentialCache) load() (map[string]credentialEntry, error) {
+	entries := map[string]credentialEntry{}
+	b, err := ioutil.ReadFile(c.Path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	aead, err := c.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < aead.NonceSize() {
+		return nil, errors.New("credential cache is truncated")
+	}
+	plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(plain, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// save encrypts entries, without the expired ones, and writes them atomically.
+func (c *CredentialCache) save(entries map[string]credentialEntry) error {
+	now := time.Now()
+	for k, e := range entries {
+		if now.After(e.Expires) {
+			delete(entries, k)
+		}
+	}
+	plain, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	aead, err := c.aead()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	b := aead.Seal(nonce, nonce, plain, nil)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(c.Path), filepath.Base(c.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.Path)
+}
+
+func (c *CredentialCache) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(c.Key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// tokenCacheKey is implemented by TokenSources identifying the tokens they supply, ex: by
+// identity provider and client, so tokens of different TokenSources are cached apart.
+type tokenCacheKey interface {
+	CacheKey() string
+}
+
+// credentialKey returns the cache key of a credential of kind for the proxy and user of p.
+// Bearer tokens are also keyed by the TokenSource of p, and Digest sessions by the
+// password, hashed.
+func credentialKey(p Proxy, kind string) string {
+	switch kind {
+	case "bearer":
+		id := fmt.Sprintf("%T", p.TokenSource)
+		if k, ok := p.TokenSource.(tokenCacheKey); ok {
+			id += "|" + k.CacheKey()
+		}
+		return kind + "|" + p.URL.Host + "|" + p.Username + "|" + id
+	case "digest":
+		return kind + "|" + preemptiveKey(p)
+	}
+	return kind + "|" + p.URL.Host + "|" + p.Username
+}
+
+// ticketStore adapts a CredentialCache to auth.TicketStore for the proxy and user of p.
+type ticketStore struct {
+	c      *CredentialCache
+	prefix string
+}
+
+func (s ticketStore) LoadTicket(spn string) []byte {
+	b, _ := s.c.Get(s.prefix + spn)
+	return b
+}
+
+// StoreTicket stores a ticket whose end time is not known for cachedTicketTTL.
+func (s ticketStore) StoreTicket(spn string, ticket []byte) {
+	s.StoreTicketUntil(spn, ticket, time.Now().Add(cachedTicketTTL))
+}
+
+// StoreTicketUntil stores a ticket until end, its end time.
+func (s ticketStore) StoreTicketUntil(spn string, ticket []byte, end time.Time) {
+	if err := s.c.Put(s.prefix+spn, ticket, end); err != nil {
+		debugf("credcache> Could not save Kerberos ticket: %s", err)
+	}
+}
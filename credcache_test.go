@@ -0,0 +1,82 @@
+package proxyplease
+
+import (
+	"container/list"
+	"context"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// forgetAuthState drops what dials learned in memory, as a new process would start.
+func forgetAuthState() {
+	preemptiveSchemes.Lock()
+	preemptiveSchemes.m = map[string]string{}
+	preemptiveSchemes.Unlock()
+	digestSessions.Lock()
+	digestSessions.order, digestSessions.m = list.New(), map[string]*list.Element{}
+	digestSessions.Unlock()
+}
+
+func newTestCredentialCache(t *testing.T) *CredentialCache {
+	return &CredentialCache{Path: filepath.Join(t.TempDir(), "credentials"), Key: make([]byte, 32)}
+}
+
+func TestCredentialCacheDigest(t *testing.T) {
+	target := newEchoServer(t)
+	defer target.Close()
+	s := newTestServer("user", "secret", "Digest")
+	defer s.Close()
+
+	p := testProxy(t, s, "user", "secret")
+	p.CredentialCache = newTestCredentialCache(t)
+	// the first run answers a challenge, the next ones resume the saved session
+	for run, want := range []int{2, 1, 1} {
+		forgetAuthState()
+		conn, err := NewDialContext(p)(context.Background(), "tcp", target.Addr().String())
+		if err != nil {
+			t.Fatalf("run %d: %s", run, err)
+		}
+		if got := conn.(*Conn).TunnelInfo().RoundTrips; got != want {
+			t.Errorf("run %d: %d CONNECT requests, want %d", run, got, want)
+		}
+		conn.Close()
+	}
+
+	// a session saved with another password is not used
+	forgetAuthState()
+	p.Password = "other"
+	if restoreDigestSession(p) {
+		t.Error("restored the session of another password")
+	}
+}
+
+func TestCredentialKeyTokenSource(t *testing.T) {
+	u := &url.URL{Scheme: "http", Host: "proxy:8080"}
+	keys := map[string]TokenSource{}
+	for _, ts := range []TokenSource{
+		&DeviceFlow{TokenURL: "https://idp.example.com/token", ClientID: "a"},
+		&DeviceFlow{TokenURL: "https://idp.example.com/token", ClientID: "b"},
+		&DeviceFlow{TokenURL: "https://other.example.com/token", ClientID: "a"},
+		RefreshingTokenSource(nil),
+	} {
+		key := credentialKey(Proxy{URL: u, Username: "user", TokenSource: ts}, "bearer")
+		if other, ok := keys[key]; ok {
+			t.Errorf("%#v and %#v share the cache key %q", ts, other, key)
+		}
+		keys[key] = ts
+	}
+}
+
+func TestTicketStoreExpiry(t *testing.T) {
+	s := ticketStore{c: newTestCredentialCache(t), prefix: "negotiate|proxy|user|"}
+	s.StoreTicketUntil("HTTP/a", []byte("a"), time.Now().Add(time.Hour))
+	s.StoreTicketUntil("HTTP/b", []byte("b"), time.Now().Add(-time.Second))
+	s.StoreTicket("HTTP/c", []byte("c"))
+	for spn, want := range map[string]string{"HTTP/a": "a", "HTTP/b": "", "HTTP/c": "c"} {
+		if got := string(s.LoadTicket(spn)); got != want {
+			t.Errorf("LoadTicket(%q) = %q, want %q", spn, got, want)
+		}
+	}
+}
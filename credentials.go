@@ -0,0 +1,126 @@
+package proxyplease
+
+import (
+	"context"
+	"net"
+	"net/url"
+)
+
+// Credentials authenticate to a proxy.
+type Credentials struct {
+	Domain   string // Windows domain, used only for NTLM. Keeps Proxy.Domain if empty.
+	Username string
+	Password string
+}
+
+// CredentialProvider supplies credentials for a proxy and authentication scheme, ex: from
+// an OS keychain, a vault or an interactive prompt. scheme is the HTTP authentication
+// scheme being attempted, ex: "NTLM", or "SOCKS5". proxy has no credentials.
+type CredentialProvider interface {
+	Credentials(ctx context.Context, proxy *url.URL, scheme string) (Credentials, error)
+}
+
+// CredentialProviderFunc adapts a function to a CredentialProvider.
+type CredentialProviderFunc func(ctx context.Context, proxy *url.URL, scheme string) (Credentials, error)
+
+// Credentials calls f.
+func (f CredentialProviderFunc) Credentials(ctx context.Context, proxy *url.URL, scheme string) (Credentials, error) {
+	return f(ctx, proxy, scheme)
+}
+
+// withCredentials authenticates with dial using the credentials of p or, if it has none,
+// those of p.CredentialProvider. When the proxy rejects provided credentials, the provider
+// is asked once more, so credentials rotated in the meantime are picked up. Without a
+// provider, p.Prompt is used if set.
+func withCredentials(ctx context.Context, p Proxy, scheme string, dial func(Proxy) (net.Conn, error)) (net.Conn, error) {
+	return traceAuth(p, scheme, func(p Proxy) (net.Conn, error) {
+		if p.Prompt != nil && p.CredentialProvider == nil {
+			return withPrompt(ctx, p, scheme, dial)
+		}
+		return provideCredentials(ctx, p, scheme, dial)
+	})
+}
+
+// provideCredentials implements withCredentials within the span of the attempt.
+func provideCredentials(ctx context.Context, p Proxy, scheme string, dial func(Proxy) (net.Conn, error)) (net.Conn, error) {
+	if p.CredentialProvider == nil || p.Username != "" || p.Password != "" {
+		return dial(p)
+	}
+	u := *p.URL
+	u.User = nil
+	var rejected Credentials
+	for attempt := 0; ; attempt++ {
+		c, err := p.CredentialProvider.Credentials(ctx, &u, scheme)
+		if err != nil {
+			p.debugf("credentials> Provider failed for %s: %s", scheme, err)
+			return nil, err
+		}
+		if attempt > 0 && c == rejected {
+			p.debugf("credentials> Provider returned the rejected credentials again")
+			return nil, &StatusError{StatusCode: 407}
+		}
+		q := p
+		q.Username, q.Password = c.Username, c.Password
+		if c.Domain != "" {
+			q.Domain = c.Domain
+		}
+		conn, err := dial(q)
+		if err == nil || attempt > 0 || Classify(err) != AuthFailed {
+			return conn, err
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		if ci, ok := p.CredentialProvider.(credentialInvalidator); ok {
+			ci.invalidate(c)
+		}
+		p.debugf("credentials> Proxy rejected the provided %s credentials. Asking the provider again.", scheme)
+		rejected = c
+	}
+}
+
+// CredentialsFunc returns the credentials of the dials to addr, the dialed address, ex:
+// per tenant. Returning empty credentials keeps those of the Proxy.
+type CredentialsFunc func(addr string) Credentials
+
+type credentialsKey struct{}
+
+// WithCredentials returns a copy of ctx whose dials authenticate with c instead of the
+// credentials of the Proxy and its CredentialsFunc, so one Dialer can serve several users
+// of the same proxy.
+func WithCredentials(ctx context.Context, c Credentials) context.Context {
+	return context.WithValue(ctx, credentialsKey{}, c)
+}
+
+// DialContextWithCredentials connects to addr through the proxy, authenticating with c.
+func (d *Dialer) DialContextWithCredentials(ctx context.Context, network, addr string, c Credentials) (net.Conn, error) {
+	return d.DialContext(WithCredentials(ctx, c), network, addr)
+}
+
+func contextCredentials(ctx context.Context) (Credentials, bool) {
+	c, ok := ctx.Value(credentialsKey{}).(Credentials)
+	return c, ok
+}
+
+// dialCredentials returns p with the credentials of the dial to addr with ctx, if they
+// were overridden by WithCredentials or p.CredentialsFunc, or without credentials if
+// p.MachineAccount is set.
+func (p Proxy) dialCredentials(ctx context.Context, addr string) Proxy {
+	if p.MachineAccount {
+		return p.withMachineAccount()
+	}
+	c, ok := contextCredentials(ctx)
+	if !ok && p.CredentialsFunc != nil {
+		c = p.CredentialsFunc(addr)
+		ok = c.Username != "" || c.Password != ""
+	}
+	if !ok {
+		return p
+	}
+	p.debugf("credentials> Using the credentials selected for %s", addr)
+	p.Username, p.Password, p.NTHash = c.Username, c.Password, ""
+	if c.Domain != "" {
+		p.Domain = c.Domain
+	}
+	return p
+}
@@ -1,17 +1,65 @@
 package proxyplease
 
 import (
+	"context"
 	"log"
 	"os"
+	"sync/atomic"
 )
 
 var l = log.New(os.Stdout, "", log.LstdFlags)
 
-var debugf = func(format string, a ...interface{}) {
-	l.Printf("proxyplease."+format, a...)
+// DebugFunc receives debug output, formatted as with fmt.Sprintf.
+type DebugFunc func(format string, a ...interface{})
+
+// globalDebugf holds the DebugFunc receiving the output of dials made without Proxy.Debugf.
+var globalDebugf atomic.Value
+
+func init() {
+	globalDebugf.Store(DebugFunc(func(format string, a ...interface{}) {
+		l.Printf("proxyplease."+format, a...)
+	}))
+}
+
+func debugf(format string, a ...interface{}) {
+	globalDebugf.Load().(DebugFunc)(format, a...)
 }
 
-// SetDebugf sets a debugf function for debug output
+// SetDebugf sets a debugf function for debug output of all Proxies without a Debugf.
+//
+// Deprecated: set Proxy.Debugf instead, so independent users of this package in one
+// binary do not replace each other's logger.
 func SetDebugf(f func(format string, a ...interface{})) {
-	debugf = f
+	globalDebugf.Store(DebugFunc(f))
+}
+
+type debugfKey struct{}
+
+// WithDebugf returns a copy of ctx that additionally sends the debug output of handshakes
+// made with it to f. Use it to diagnose a single problematic destination while
+// Proxy.Debugf discards the output of all other dials.
+func WithDebugf(ctx context.Context, f func(format string, a ...interface{})) context.Context {
+	return context.WithValue(ctx, debugfKey{}, f)
+}
+
+func contextDebugf(ctx context.Context) func(format string, a ...interface{}) {
+	f, _ := ctx.Value(debugfKey{}).(func(format string, a ...interface{}))
+	return f
+}
+
+// debugf logs to p.Logger, p.Debugf, or the package debugf if neither is set, and to the
+// logger attached to the dial's context.
+func (p Proxy) debugf(format string, a ...interface{}) {
+	if p.logf != nil {
+		p.logf(format, a...)
+	}
+	if p.Logger != nil {
+		p.Logger.Log(p.logRecord(format, a...))
+		return
+	}
+	if p.Debugf != nil {
+		p.Debugf(format, a...)
+		return
+	}
+	debugf(format, a...)
 }
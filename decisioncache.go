@@ -0,0 +1,113 @@
+package proxyplease
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/bdwyertech/proxyplease/pac"
+)
+
+// defaultDecisionCacheSize is the capacity of a DecisionCache created with a size of zero.
+const defaultDecisionCacheSize = 4096
+
+// DecisionCache keeps the PAC results of recently dialed destinations, so the script is
+// not evaluated on every dial. It holds at most its size entries, evicting the least
+// recently used one, so crawlers contacting millions of hosts use bounded memory. A
+// cache must only be shared by Proxies using the same PAC script.
+type DecisionCache struct {
+	size int
+
+	mu      sync.Mutex
+	order   *list.List // of *decisionEntry, most recently used first
+	entries map[string]*list.Element
+	stats   DecisionCacheStats
+}
+
+// DecisionCacheStats are counters of a DecisionCache.
+type DecisionCacheStats struct {
+	Hits      uint64 // Lookups answered by the cache.
+	Misses    uint64 // Lookups that evaluated the PAC script.
+	Evictions uint64 // Entries dropped to stay within the size.
+	Expired   uint64 // Entries dropped because they were older than Proxy.PACCacheTTL.
+	Len       int    // Entries currently held.
+}
+
+type decisionEntry struct {
+	key        string
+	directives []pac.Directive
+	expires    time.Time // zero if the entry does not expire
+}
+
+// NewDecisionCache returns a DecisionCache holding up to size destinations, 4096 if size
+// is zero or less.
+func NewDecisionCache(size int) *DecisionCache {
+	if size <= 0 {
+		size = defaultDecisionCacheSize
+	}
+	return &DecisionCache{size: size, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// Flush removes every entry, ex: after the PAC script or the network changed. Counters
+// are kept.
+func (c *DecisionCache) Flush() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.order.Init()
+	c.entries = map[string]*list.Element{}
+	c.mu.Unlock()
+}
+
+// Stats returns the counters of the cache.
+func (c *DecisionCache) Stats() DecisionCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Len = c.order.Len()
+	return s
+}
+
+// get returns the directives cached for key unless they expired at now, and counts the
+// lookup.
+func (c *DecisionCache) get(key string, now time.Time) ([]pac.Directive, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if ok {
+		if entry := e.Value.(*decisionEntry); !entry.expires.IsZero() && !now.Before(entry.expires) {
+			c.order.Remove(e)
+			delete(c.entries, key)
+			c.stats.Expired++
+			ok = false
+		}
+	}
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.order.MoveToFront(e)
+	return e.Value.(*decisionEntry).directives, true
+}
+
+// put caches directives for key until expires, or until evicted if expires is zero,
+// evicting the least recently used entries beyond size.
+func (c *DecisionCache) put(key string, directives []pac.Directive, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*decisionEntry)
+		entry.directives, entry.expires = directives, expires
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&decisionEntry{key: key, directives: directives, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*decisionEntry).key)
+		c.stats.Evictions++
+	}
+}
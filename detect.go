@@ -0,0 +1,85 @@
+package proxyplease
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// detectTimeout bounds each probe made to detect the protocol of a proxy.
+const detectTimeout = 2 * time.Second
+
+// detectedSchemes caches the protocol detected for each proxy address.
+var detectedSchemes = struct {
+	sync.Mutex
+	m map[string]string
+}{m: map[string]string{}}
+
+// hasScheme reports whether the proxy URL u was given with an explicit scheme. WinHTTP and
+// some environments provide only "host:port".
+func hasScheme(u *url.URL) bool {
+	return u.Scheme != "" && u.Opaque == "" && strings.Contains(u.String(), "://")
+}
+
+// detectScheme returns u with the scheme spoken by the proxy at u.Host: socks5, https or
+// http. The result is cached for the life of the process.
+func detectScheme(ctx context.Context, u *url.URL) *url.URL {
+	detectedSchemes.Lock()
+	scheme, ok := detectedSchemes.m[u.Host]
+	detectedSchemes.Unlock()
+	if !ok {
+		scheme = probeScheme(ctx, u.Host)
+		debugf("detect> Proxy at %s speaks %s", u.Host, scheme)
+		detectedSchemes.Lock()
+		detectedSchemes.m[u.Host] = scheme
+		detectedSchemes.Unlock()
+	}
+	c := *u
+	c.Scheme = scheme
+	return &c
+}
+
+// probeScheme sends a SOCKS5 greeting to addr and classifies the reply. Proxies that stay
+// silent are probed with a TLS handshake. HTTP is assumed when no probe succeeds.
+func probeScheme(ctx context.Context, addr string) string {
+	dialer := &net.Dialer{Timeout: detectTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		debugf("detect> Could not connect to %s: %s", addr, err)
+		return "http"
+	}
+	conn.SetDeadline(time.Now().Add(detectTimeout))
+	reply := make([]byte, 5)
+	if _, err := conn.Write([]byte{socks5Version, 1, socks5NoAuth}); err == nil {
+		n, _ := conn.Read(reply)
+		reply = reply[:n]
+	}
+	conn.Close()
+	switch {
+	case len(reply) > 0 && reply[0] == socks5Version:
+		return "socks5"
+	case bytes.HasPrefix(reply, []byte("HTTP/")):
+		return "http"
+	case len(reply) > 0 && (reply[0] == 0x15 || reply[0] == 0x16): // TLS alert or handshake record
+		return "https"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, detectTimeout)
+	defer cancel()
+	conn, err = dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return "http"
+	}
+	defer conn.Close()
+	// only whether the proxy speaks TLS matters here, not who it is
+	tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tc.HandshakeContext(ctx); err == nil {
+		return "https"
+	}
+	return "http"
+}
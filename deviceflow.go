@@ -0,0 +1,186 @@
+package proxyplease
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenExpiryMargin is how long before expiry a cached token is refreshed.
+const tokenExpiryMargin = time.Minute
+
+// DeviceFlow is a TokenSource obtaining tokens with the OAuth 2.0 device authorization
+// grant (RFC 8628), as offered by the identity providers of cloud secure web gateways.
+// The user is shown a code to enter in a browser once; tokens are then cached and
+// refreshed with the refresh token when one is issued.
+type DeviceFlow struct {
+	DeviceAuthURL string                                 // Device authorization endpoint of the identity provider.
+	TokenURL      string                                 // Token endpoint of the identity provider.
+	ClientID      string                                 // OAuth client ID registered for the gateway.
+	Scopes        []string                               // Requested scopes, ex: "openid".
+	Prompt        func(verificationURI, userCode string) // Shows the code to the user. Defaults to printing to stderr.
+	Client        *http.Client                           // Client for the identity provider. Defaults to http.DefaultClient.
+	Clock         Clock                                  // Used for token expiry and polling. Defaults to the system clock.
+
+	mu      sync.Mutex
+	token   string
+	refresh string
+	expiry  time.Time
+}
+
+// tokenResponse is the response of the token endpoint (RFC 6749, section 5).
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+// Token returns a valid access token, running the device flow if needed.
+func (f *DeviceFlow) Token() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.token != "" && (f.expiry.IsZero() || clockOr(f.Clock).Now().Add(tokenExpiryMargin).Before(f.expiry)) {
+		return f.token, nil
+	}
+	if f.refresh != "" {
+		tr, err := f.post(f.TokenURL, url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {f.refresh},
+			"client_id":     {f.ClientID},
+		})
+		if err == nil && tr.Error == "" {
+			debugf("device> Refreshed token")
+			return f.store(tr), nil
+		}
+		debugf("device> Could not refresh token, restarting device flow: %v %s", err, tr.Error)
+	}
+	tr, err := f.authorize()
+	if err != nil {
+		return "", err
+	}
+	return f.store(tr), nil
+}
+
+// Expiry returns when the current token expires, or the zero time if unknown.
+func (f *DeviceFlow) Expiry() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.expiry
+}
+
+// CacheKey identifies the tokens of f in a CredentialCache by token endpoint, client and
+// scopes.
+func (f *DeviceFlow) CacheKey() string {
+	return f.TokenURL + " " + f.ClientID + " " + strings.Join(f.Scopes, " ")
+}
+
+func (f *DeviceFlow) store(tr tokenResponse) string {
+	f.token = tr.AccessToken
+	if tr.RefreshToken != "" {
+		f.refresh = tr.RefreshToken
+	}
+	f.expiry = time.Time{}
+	if tr.ExpiresIn > 0 {
+		f.expiry = clockOr(f.Clock).Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+	return f.token
+}
+
+// authorize runs the device authorization grant and polls until the user approved it.
+func (f *DeviceFlow) authorize() (tokenResponse, error) {
+	var da struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+	}
+	resp, err := f.client().PostForm(f.DeviceAuthURL, url.Values{
+		"client_id": {f.ClientID},
+		"scope":     {strings.Join(f.Scopes, " ")},
+	})
+	if err != nil {
+		debugf("device> Could not start device authorization: %s", err)
+		return tokenResponse{}, err
+	}
+	err = json.NewDecoder(resp.Body).Decode(&da)
+	resp.Body.Close()
+	if err != nil || da.DeviceCode == "" {
+		debugf("device> Unexpected device authorization response: %d %v", resp.StatusCode, err)
+		return tokenResponse{}, errors.New("device authorization failed: " + resp.Status)
+	}
+
+	uri := da.VerificationURI
+	if da.VerificationURIComplete != "" {
+		uri = da.VerificationURIComplete
+	}
+	if f.Prompt != nil {
+		f.Prompt(uri, da.UserCode)
+	} else {
+		fmt.Fprintf(os.Stderr, "To authenticate to the proxy, visit %s and enter the code %s\n", uri, da.UserCode)
+	}
+
+	interval := time.Duration(da.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	clock := clockOr(f.Clock)
+	deadline := clock.Now().Add(time.Duration(da.ExpiresIn) * time.Second)
+	for da.ExpiresIn <= 0 || clock.Now().Before(deadline) {
+		<-clock.After(interval)
+		tr, err := f.post(f.TokenURL, url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {da.DeviceCode},
+			"client_id":   {f.ClientID},
+		})
+		if err != nil {
+			return tr, err
+		}
+		switch tr.Error {
+		case "":
+			debugf("device> Device authorization completed")
+			return tr, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			debugf("device> Device authorization failed: %s %s", tr.Error, tr.Description)
+			return tr, errors.New("device authorization failed: " + tr.Error)
+		}
+	}
+	return tokenResponse{}, errors.New("device authorization expired before it was approved")
+}
+
+// post sends form to a token endpoint and decodes its response.
+func (f *DeviceFlow) post(endpoint string, form url.Values) (tokenResponse, error) {
+	var tr tokenResponse
+	resp, err := f.client().PostForm(endpoint, form)
+	if err != nil {
+		return tr, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return tr, err
+	}
+	if tr.Error == "" && tr.AccessToken == "" {
+		return tr, errors.New("token endpoint returned no access token: " + resp.Status)
+	}
+	return tr, nil
+}
+
+func (f *DeviceFlow) client() *http.Client {
+	if f.Client != nil {
+		return f.Client
+	}
+	return http.DefaultClient
+}
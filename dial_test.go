@@ -0,0 +1,255 @@
+package proxyplease
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bdwyertech/proxyplease/proxytest"
+)
+
+// newEchoServer starts a TCP server echoing what it reads, the target of test dials. The
+// caller should close the returned listener.
+func newEchoServer(t testing.TB) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+// newTestServer starts a proxytest.Server requiring username and password with schemes.
+func newTestServer(username, password string, schemes ...string) *proxytest.Server {
+	s := proxytest.NewServer()
+	s.Username, s.Password, s.Schemes = username, password, schemes
+	return s
+}
+
+// testProxy returns a Proxy for s authenticating with username and password, logging its
+// debug output to t.
+func testProxy(t testing.TB, s *proxytest.Server, username, password string) Proxy {
+	u := *s.URL
+	return Proxy{URL: &u, Username: username, Password: password, Debugf: t.Logf}
+}
+
+// dialEcho dials the echo server at addr with dial and checks the tunnel carries data. It
+// returns the authentication scheme of the tunnel.
+func dialEcho(dial DialContext, addr string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return "", fmt.Errorf("write through tunnel: %s", err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		return "", fmt.Errorf("read through tunnel: %q, %v", b, err)
+	}
+	if c, ok := conn.(*Conn); ok {
+		return c.TunnelInfo().AuthScheme, nil
+	}
+	return "", nil
+}
+
+func TestDialSchemes(t *testing.T) {
+	target := newEchoServer(t)
+	defer target.Close()
+
+	for _, scheme := range []string{"Basic", "Digest", "NTLM"} {
+		t.Run(scheme, func(t *testing.T) {
+			s := newTestServer("user", "secret", scheme)
+			defer s.Close()
+			dial := NewDialContext(testProxy(t, s, "user", "secret"))
+			// the second dial reuses what the first learned, ex: the Digest session
+			for i := 0; i < 2; i++ {
+				got, err := dialEcho(dial, target.Addr().String())
+				if err != nil {
+					t.Fatalf("dial %d: %s", i, err)
+				}
+				if got != scheme {
+					t.Errorf("dial %d: authenticated with %q, want %q", i, got, scheme)
+				}
+			}
+		})
+	}
+}
+
+func TestDialWrongPassword(t *testing.T) {
+	target := newEchoServer(t)
+	defer target.Close()
+
+	for _, scheme := range []string{"Basic", "Digest", "NTLM"} {
+		t.Run(scheme, func(t *testing.T) {
+			s := newTestServer("user", "secret", scheme)
+			defer s.Close()
+			dial := NewDialContext(testProxy(t, s, "user", "wrong"))
+			if _, err := dialEcho(dial, target.Addr().String()); err == nil {
+				t.Fatal("dial with a wrong password succeeded")
+			}
+		})
+	}
+}
+
+func TestDialSchemeFallback(t *testing.T) {
+	target := newEchoServer(t)
+	defer target.Close()
+	s := newTestServer("user", "secret", "NTLM", "Basic")
+	defer s.Close()
+
+	// the target info of the server lacks the computer name, so NTLM is refused
+	p := testProxy(t, s, "user", "secret")
+	p.NTLM.ValidateTargetInfo = true
+	got, err := dialEcho(NewDialContext(p), target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "Basic" {
+		t.Errorf("authenticated with %q, want Basic after NTLM failed", got)
+	}
+}
+
+func TestDialChain(t *testing.T) {
+	target := newEchoServer(t)
+	defer target.Close()
+	outer := newTestServer("outer", "outer-secret", "Basic")
+	defer outer.Close()
+	inner := newTestServer("inner", "inner-secret", "NTLM")
+	defer inner.Close()
+
+	dial := ChainDialer(testProxy(t, outer, "outer", "outer-secret"), testProxy(t, inner, "inner", "inner-secret"))
+	got, err := dialEcho(dial, target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "NTLM" {
+		t.Errorf("last hop authenticated with %q, want NTLM", got)
+	}
+
+	dial = ChainDialer(testProxy(t, outer, "outer", "outer-secret"), testProxy(t, inner, "inner", "wrong"))
+	_, err = dialEcho(dial, target.Addr().String())
+	if he, ok := err.(*HopError); !ok || he.Hop != 1 {
+		t.Errorf("dial with a wrong inner password: got %v, want a *HopError for hop 1", err)
+	}
+}
+
+func TestDialPasswordRotation(t *testing.T) {
+	target := newEchoServer(t)
+	defer target.Close()
+
+	for _, scheme := range []string{"Basic", "Digest"} {
+		t.Run(scheme, func(t *testing.T) {
+			s := newTestServer("user", "old", scheme)
+			defer s.Close()
+			if _, err := dialEcho(NewDialContext(testProxy(t, s, "user", "old")), target.Addr().String()); err != nil {
+				t.Fatalf("dial with the old password: %s", err)
+			}
+
+			s.Password = "new"
+			if _, err := dialEcho(NewDialContext(testProxy(t, s, "user", "old")), target.Addr().String()); err == nil {
+				t.Fatal("dial with the old password succeeded after it changed")
+			}
+			dial := NewDialContext(testProxy(t, s, "user", "new"))
+			for i := 0; i < 2; i++ {
+				if _, err := dialEcho(dial, target.Addr().String()); err != nil {
+					t.Fatalf("dial %d with the new password: %s", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDialSingleflightDigest(t *testing.T) {
+	target := newEchoServer(t)
+	defer target.Close()
+	s := newTestServer("user", "secret", "Digest")
+	defer s.Close()
+
+	p := testProxy(t, s, "user", "secret")
+	p.SingleflightAuth = true
+	dial := NewDialContext(p)
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := dialEcho(dial, target.Addr().String())
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDialAuthEveryRequest(t *testing.T) {
+	target := newEchoServer(t)
+	defer target.Close()
+	s := newTestServer("user", "secret", "Basic")
+	defer s.Close()
+
+	for _, every := range []bool{false, true} {
+		p := testProxy(t, s, "user", "secret")
+		p.DisablePreemptiveAuth = true
+		p.AuthEveryRequest = every
+		dial := NewDialContext(p)
+		want := 2
+		if every {
+			// credentials are sent before the proxy asks for them
+			want = 1
+		}
+		for i := 0; i < 2; i++ {
+			conn, err := dial(context.Background(), "tcp", target.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := conn.(*Conn).TunnelInfo().RoundTrips; got != want {
+				t.Errorf("AuthEveryRequest %v, dial %d: %d CONNECT requests, want %d", every, i, got, want)
+			}
+			conn.Close()
+		}
+	}
+}
+
+func TestDialAuthEveryRequestDigest(t *testing.T) {
+	target := newEchoServer(t)
+	defer target.Close()
+	s := newTestServer("user", "secret", "Digest")
+	defer s.Close()
+
+	p := testProxy(t, s, "user", "secret")
+	p.DisablePreemptiveAuth = true
+	p.AuthEveryRequest = true
+	dial := NewDialContext(p)
+	// once the proxy issued a nonce, every CONNECT carries the next nonce count
+	for i, want := range []int{2, 1, 1} {
+		conn, err := dial(context.Background(), "tcp", target.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := conn.(*Conn).TunnelInfo()
+		if info.RoundTrips != want || info.AuthScheme != "Digest" {
+			t.Errorf("dial %d: %d CONNECT requests with %s, want %d with Digest", i, info.RoundTrips, info.AuthScheme, want)
+		}
+		conn.Close()
+	}
+}
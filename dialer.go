@@ -0,0 +1,214 @@
+package proxyplease
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrDialerClosed is returned by dials made after a Dialer was drained or closed.
+var ErrDialerClosed = errors.New("dialer is closed")
+
+// Dialer establishes connections through the proxy and keeps track of them so a service
+// can shut down cleanly without leaking tunnels. Its configuration is copied when it is
+// created and cannot be changed afterwards, so a Dialer is safe for concurrent use; use
+// Clone to derive a Dialer with a different configuration.
+type Dialer struct {
+	proxy    Proxy // configuration, never changed
+	dial     DialContext
+	decision Decision
+	balancer *balancer
+	target   string
+	stats    *TransferStats // Proxy.Transfers
+
+	mu         sync.Mutex
+	stop       chan struct{} // closed to stop watching the system proxy settings
+	done       chan struct{} // closed by Close to cancel the handshakes in flight
+	closed     bool          // no new dials are accepted
+	forced     bool          // tunnels completing after Close are closed immediately
+	handshakes sync.WaitGroup
+	tunnels    sync.WaitGroup
+	conns      map[*Conn]struct{}
+}
+
+// NewDialer returns a Dialer for the proxy described by p, changed by opts. The Dialer
+// keeps its own copy of p, so p may be changed or reused afterwards. If p.WatchSystem is
+// set, the Dialer follows changes of the system proxy settings until it is drained or
+// closed.
+func NewDialer(p Proxy, opts ...Option) *Dialer {
+	p = cloneProxy(p)
+	for _, o := range opts {
+		o(&p)
+	}
+	d := &Dialer{proxy: cloneProxy(p), done: make(chan struct{}), conns: map[*Conn]struct{}{}, stats: p.Transfers}
+	if p.TargetURL == nil {
+		p.TargetURL = defaultTargetURL()
+	}
+	d.target = toASCIIURL(p.TargetURL).String()
+	d.dial, d.decision, d.balancer = newDialFunc(p)
+	d.dial = fallbackDirectFunc(p, routedDialFunc(p, d.dial))
+	if watchesSystem(p) {
+		d.stop = make(chan struct{})
+		go watchSystem(p, d.stop, func() { d.reload(p) })
+	}
+	return d
+}
+
+// Clone returns a new Dialer with the configuration of d changed by opts. It tracks its own
+// tunnels: draining or closing d does not affect it. Caches and stores set in the
+// configuration, ex: a CookieJar, are shared.
+func (d *Dialer) Clone(opts ...Option) *Dialer {
+	return NewDialer(d.proxy, opts...)
+}
+
+// Proxy returns a copy of the configuration of d.
+func (d *Dialer) Proxy() Proxy {
+	return cloneProxy(d.proxy)
+}
+
+// DialContext connects to addr through the proxy. It can be assigned to
+// http.Transport.DialContext.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil, ErrDialerClosed
+	}
+	d.handshakes.Add(1)
+	dial := d.dial
+	d.mu.Unlock()
+	defer d.handshakes.Done()
+
+	// Close cancels the handshake, which releases its authentication context on return
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-d.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	conn, err := dial(ctx, network, addr)
+	if err != nil {
+		return conn, err
+	}
+	c, ok := conn.(*Conn)
+	if !ok {
+		return conn, nil
+	}
+
+	if d.stats != nil {
+		d.stats.track(ctx, c, addr)
+	}
+	c.onClose = func() { d.untrack(c) }
+	d.mu.Lock()
+	if d.forced {
+		d.mu.Unlock()
+		c.Close()
+		return nil, ErrDialerClosed
+	}
+	d.conns[c] = struct{}{}
+	d.tunnels.Add(1)
+	d.mu.Unlock()
+	return c, nil
+}
+
+func (d *Dialer) untrack(c *Conn) {
+	d.mu.Lock()
+	if _, ok := d.conns[c]; ok {
+		delete(d.conns, c)
+		d.tunnels.Done()
+	}
+	d.mu.Unlock()
+}
+
+// Drain stops new dials, waits for in-flight handshakes to complete and then for the
+// established tunnels to be closed by their users. Close idle pooled connections first,
+// ex: with http.Transport.CloseIdleConnections. When ctx is done, the remaining handshakes
+// are canceled, the remaining tunnels are closed and ctx.Err() is returned.
+func (d *Dialer) Drain(ctx context.Context) error {
+	d.mu.Lock()
+	d.closed = true
+	d.stopWatching()
+	d.mu.Unlock()
+
+	handshakes := make(chan struct{})
+	go func() {
+		d.handshakes.Wait()
+		close(handshakes)
+	}()
+	select {
+	case <-handshakes:
+	case <-ctx.Done():
+		d.Close()
+		return ctx.Err()
+	}
+
+	debugf("dialer> Waiting for %d tunnels to close", d.Len())
+	tunnels := make(chan struct{})
+	go func() {
+		d.tunnels.Wait()
+		close(tunnels)
+	}()
+	select {
+	case <-tunnels:
+		return nil
+	case <-ctx.Done():
+		d.Close()
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops new dials and waits for in-flight handshakes to complete and then for
+// the established tunnels to be closed by their users, like Drain. When ctx is done first,
+// it closes d like Close and waits for the canceled handshakes to return, so no
+// authentication context, ex: SSPI credentials of NTLM or Negotiate, is still held when it
+// returns ctx.Err(). Services should call it before exiting.
+func (d *Dialer) Shutdown(ctx context.Context) error {
+	err := d.Drain(ctx)
+	d.handshakes.Wait()
+	return err
+}
+
+// Close stops new dials, cancels the handshakes in flight and closes all established
+// tunnels. It does not wait for the canceled handshakes to return, see Shutdown.
+func (d *Dialer) Close() error {
+	d.mu.Lock()
+	d.closed = true
+	if !d.forced {
+		d.forced = true
+		close(d.done)
+	}
+	d.stopWatching()
+	conns := make([]*Conn, 0, len(d.conns))
+	for c := range d.conns {
+		conns = append(conns, c)
+	}
+	d.mu.Unlock()
+
+	if len(conns) > 0 {
+		debugf("dialer> Closing %d tunnels", len(conns))
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+	return nil
+}
+
+// Len returns the number of established tunnels that have not been closed.
+func (d *Dialer) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.conns)
+}
+
+// stopWatching stops following the system proxy settings. d.mu must be held.
+func (d *Dialer) stopWatching() {
+	if d.stop != nil {
+		close(d.stop)
+		d.stop = nil
+	}
+}
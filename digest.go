@@ -0,0 +1,193 @@
+package proxyplease
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bdwyertech/proxyplease/auth"
+)
+
+// maxDigestSessions bounds the Digest sessions kept, the least recently used being
+// dropped beyond it.
+const maxDigestSessions = 256
+
+// digestSessions keeps the Digest session of each proxy and credentials, so later dials
+// reuse the server nonce with increasing nonce counts.
+var digestSessions = struct {
+	sync.Mutex
+	order *list.List // of *digestEntry, most recently used first
+	m     map[string]*list.Element
+}{order: list.New(), m: map[string]*list.Element{}}
+
+type digestEntry struct {
+	key     string
+	session *auth.DigestSession
+}
+
+// digestSession returns the Digest session for the credentials of p.
+func digestSession(p Proxy) *auth.DigestSession {
+	key := preemptiveKey(p)
+	digestSessions.Lock()
+	defer digestSessions.Unlock()
+	if e, ok := digestSessions.m[key]; ok {
+		digestSessions.order.MoveToFront(e)
+		return e.Value.(*digestEntry).session
+	}
+	s := auth.NewDigestSession(p.Username, p.Password)
+	digestSessions.m[key] = digestSessions.order.PushFront(&digestEntry{key: key, session: s})
+	for digestSessions.order.Len() > maxDigestSessions {
+		oldest := digestSessions.order.Back()
+		digestSessions.order.Remove(oldest)
+		delete(digestSessions.m, oldest.Value.(*digestEntry).key)
+	}
+	return s
+}
+
+// hasDigestSession reports whether a Digest session for the credentials of p received a
+// nonce from the proxy, without starting one.
+func hasDigestSession(p Proxy) bool {
+	digestSessions.Lock()
+	e, ok := digestSessions.m[preemptiveKey(p)]
+	digestSessions.Unlock()
+	return ok && e.Value.(*digestEntry).session.State().Nonce != ""
+}
+
+// dropDigestSession drops s, the Digest session for the credentials of p, once the proxy
+// rejected them, so the next dial starts a new session. A session created meanwhile by
+// another dial is kept.
+func dropDigestSession(p Proxy, s *auth.DigestSession) {
+	key := preemptiveKey(p)
+	digestSessions.Lock()
+	defer digestSessions.Unlock()
+	if e, ok := digestSessions.m[key]; ok && (s == nil || e.Value.(*digestEntry).session == s) {
+		digestSessions.order.Remove(e)
+		delete(digestSessions.m, key)
+	}
+	if p.CredentialCache != nil {
+		p.CredentialCache.Delete(credentialKey(p, "digest"))
+	}
+}
+
+// restoreDigestSession resumes the Digest session for the credentials of p saved to
+// p.CredentialCache, ex: by a previous run, unless one is already in progress, and reports
+// whether it did.
+func restoreDigestSession(p Proxy) bool {
+	if p.CredentialCache == nil {
+		return false
+	}
+	b, ok := p.CredentialCache.Get(credentialKey(p, "digest"))
+	if !ok {
+		return false
+	}
+	var st auth.DigestState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return false
+	}
+	s := digestSession(p)
+	if s.State().Nonce == "" {
+		s.Restore(st)
+	}
+	if s.State().Nonce == "" {
+		return false
+	}
+	p.debugf("digest> Resuming the session saved to the credential cache")
+	p.rememberScheme("Digest")
+	return true
+}
+
+// saveDigestSession saves the Digest session for the credentials of p, with the nonce
+// count last sent, to p.CredentialCache, after the proxy accepted it.
+func saveDigestSession(p Proxy) {
+	if p.CredentialCache == nil {
+		return
+	}
+	b, err := json.Marshal(digestSession(p).State())
+	if err == nil {
+		err = p.CredentialCache.Put(credentialKey(p, "digest"), b, time.Now().Add(cachedNonceTTL))
+	}
+	if err != nil {
+		p.debugf("digest> Could not cache the session: %s", err)
+	}
+}
+
+// dialDigest authenticates a new connection with Digest, answering challenges, the
+// Proxy-Authenticate values of the proxy's 407. The strongest algorithm offered is used.
+func dialDigest(p Proxy, addr string, baseDial func() (net.Conn, error), challenges []string) (net.Conn, error) {
+	p.debugf("digest> Attempting to authenticate")
+
+	s := digestSession(p)
+	challenge := auth.DigestChallenge(challenges)
+	if challenge == "" {
+		p.debugf("digest> Proxy offered no supported algorithm")
+		return nil, errors.New("no supported digest algorithm offered by the proxy")
+	}
+	if _, err := s.Challenge(challenge); err != nil {
+		p.debugf("digest> Could not use challenge: %s", err)
+		return nil, err
+	}
+
+	conn, err := connectDigest(p, addr, baseDial, s)
+	var se *StatusError
+	if errors.As(err, &se) && se.StatusCode == http.StatusProxyAuthRequired {
+		// a stale nonce only requires a new attempt with the nonce of the new challenge
+		stale, cerr := s.Challenge(auth.DigestChallenge(se.Header["Proxy-Authenticate"]))
+		if cerr == nil && stale {
+			p.debugf("digest> Nonce is stale. Retrying with the new nonce.")
+			conn.Close()
+			conn, err = connectDigest(p, addr, baseDial, s)
+		}
+	}
+	if errors.As(err, &se) && se.StatusCode == http.StatusProxyAuthRequired {
+		p.debugf("digest> Proxy rejected the credentials. Dropping the session.")
+		dropDigestSession(p, s)
+	}
+	return conn, err
+}
+
+// connectDigest dials the proxy and sends a CONNECT authorized with the next response of s.
+func connectDigest(p Proxy, addr string, baseDial func() (net.Conn, error), s *auth.DigestSession) (net.Conn, error) {
+	authorization, err := s.Authorization("CONNECT", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := baseDial()
+	if err != nil {
+		p.debugf("digest> Could not call dial context with proxy: %s", err)
+		return conn, err
+	}
+
+	h := p.connectHeader(addr)
+	h.Set("Proxy-Authorization", authorization)
+	p.setKeepAlive(h)
+	connect := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: h,
+	}
+	if err := writeConnect(p, conn, connect); err != nil {
+		p.debugf("digest> Could not write authorization message to proxy: %s", err)
+		return conn, err
+	}
+	br := newResponseReader(p, conn)
+	resp, err := br.read(connect)
+	if err != nil {
+		p.debugf("digest> Could not read response from proxy: %s", err)
+		return conn, err
+	}
+	p.saveCookies(resp)
+
+	if resp.StatusCode == http.StatusOK {
+		p.debugf("digest> Successfully injected Digest to connection")
+		return newConn(conn, p, resp, br.Reader, "Digest"), nil
+	}
+
+	p.debugf("digest> Expected %d as return status, got: %d", http.StatusOK, resp.StatusCode)
+	return conn, newStatusError(resp)
+}
@@ -0,0 +1,160 @@
+package proxyplease
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// dohTimeout bounds DNS over HTTPS queries made without a deadline.
+const dohTimeout = 10 * time.Second
+
+// maxDNSMessage is the largest DNS message, as framed over TCP.
+const maxDNSMessage = 65535
+
+// NewDoHResolver returns a net.Resolver sending its queries as DNS over HTTPS (RFC 8484)
+// POST requests to serverURL, ex: "https://dns.example.com/dns-query", over connections
+// made with dial, ex: the DialContext of a Dialer, so names resolve on networks where only
+// the proxy may reach the outside. The server host name is sent to the proxy unresolved.
+// Use it as Proxy.TargetResolver, or set Proxy.DoHURL.
+func NewDoHResolver(serverURL string, dial DialContext) *net.Resolver {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext:         dial,
+		TLSHandshakeTimeout: dohTimeout,
+		IdleConnTimeout:     90 * time.Second,
+		MaxIdleConnsPerHost: 2,
+	}}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return &dohConn{url: serverURL, client: client, ctx: ctx}, nil
+		},
+	}
+}
+
+// dohConn is the connection to a DNS server the Go resolver exchanges messages over,
+// framed as over TCP with a length prefix. Each query written is sent to the DoH server at
+// url, and its answer is read back.
+type dohConn struct {
+	url    string
+	client *http.Client
+	ctx    context.Context
+
+	mu       sync.Mutex
+	query    bytes.Buffer // query being written
+	answers  bytes.Buffer // answers to read
+	deadline time.Time
+	closed   bool
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	c.query.Write(b)
+	var msg []byte
+	if q := c.query.Bytes(); len(q) >= 2 && len(q) >= 2+int(binary.BigEndian.Uint16(q)) {
+		n := int(binary.BigEndian.Uint16(q))
+		msg = append([]byte(nil), q[2:2+n]...)
+		c.query.Next(2 + n)
+	}
+	deadline := c.deadline
+	c.mu.Unlock()
+	if msg == nil {
+		return len(b), nil
+	}
+
+	answer, err := c.exchange(msg, deadline)
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	var size [2]byte
+	binary.BigEndian.PutUint16(size[:], uint16(len(answer)))
+	c.answers.Write(size[:])
+	c.answers.Write(answer)
+	c.mu.Unlock()
+	return len(b), nil
+}
+
+// exchange sends msg to the DoH server and returns its answer.
+func (c *dohConn) exchange(msg []byte, deadline time.Time) ([]byte, error) {
+	if deadline.IsZero() {
+		deadline = time.Now().Add(dohTimeout)
+	}
+	ctx, cancel := context.WithDeadline(c.ctx, deadline)
+	defer cancel()
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		debugf("doh> Query to %s failed: %s", c.url, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxDNSMessage))
+		return nil, fmt.Errorf("doh: %s answered %s", c.url, resp.Status)
+	}
+	answer, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDNSMessage+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(answer) > maxDNSMessage {
+		return nil, errors.New("doh: answer is larger than a DNS message")
+	}
+	return answer, nil
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.answers.Len() == 0 {
+		if c.closed {
+			return 0, io.ErrClosedPipe
+		}
+		return 0, io.EOF
+	}
+	return c.answers.Read(b)
+}
+
+func (c *dohConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
+
+func (c *dohConn) LocalAddr() net.Addr  { return dohAddr{} }
+func (c *dohConn) RemoteAddr() net.Addr { return dohAddr{} }
+
+// dohAddr is the address of both ends of a dohConn.
+type dohAddr struct{}
+
+func (dohAddr) Network() string { return "doh" }
+func (dohAddr) String() string  { return "doh" }
@@ -0,0 +1,120 @@
+package proxyplease
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// curlDefaultProxyPort is the port curl assumes for http:// proxies without one.
+const curlDefaultProxyPort = "1080"
+
+// FromEnvironment returns a Proxy configured from the proxy environment variables as curl
+// reads them, rather than as net/http does:
+//
+//   - the proxy of a destination is that of its scheme, lowercase variable first
+//     (https_proxy, then HTTPS_PROXY), and otherwise all_proxy or ALL_PROXY. http_proxy
+//     is only read in lowercase, as HTTP_PROXY may be set by a CGI request header.
+//   - destinations listed in no_proxy, or else NO_PROXY, are reached directly. "*"
+//     matches every destination.
+//   - credentials may be embedded in proxy URLs, percent-encoded.
+//   - proxies without a scheme are http://, and http:// proxies without a port listen
+//     on 1080.
+//
+// As dials carry an address rather than a URL, the scheme is inferred from the port:
+// port 80 uses http_proxy, port 21 ftp_proxy, and others https_proxy. Destinations
+// without a proxy are reached directly, without consulting the system settings. An
+// error is returned for a variable that does not hold a valid proxy URL.
+func FromEnvironment() (Proxy, error) {
+	return fromEnvironment(os.Getenv)
+}
+
+func fromEnvironment(getenv func(string) string) (Proxy, error) {
+	var p Proxy
+	lookup := func(scheme string) (*url.URL, error) {
+		names := []string{scheme + "_proxy"}
+		if scheme != "http" {
+			names = append(names, strings.ToUpper(scheme)+"_PROXY")
+		}
+		for _, name := range append(names, "all_proxy", "ALL_PROXY") {
+			if v := strings.TrimSpace(getenv(name)); v != "" {
+				u, err := parseEnvironmentProxy(v)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %s", name, err)
+				}
+				return u, nil
+			}
+		}
+		return nil, nil
+	}
+
+	noProxy := getenv("no_proxy")
+	if noProxy == "" {
+		noProxy = getenv("NO_PROXY")
+	}
+	// the proxies of the scheme rules below inherit Bypass, so no_proxy applies to them too
+	p.Bypass = splitList(noProxy, ",")
+
+	u, err := lookup("https")
+	if err != nil {
+		return Proxy{}, err
+	}
+	for _, s := range []struct {
+		scheme string
+		port   int
+	}{{"http", 80}, {"ftp", 21}} {
+		v, err := lookup(s.scheme)
+		if err != nil {
+			return Proxy{}, err
+		}
+		if sameURL(v, u) {
+			continue
+		}
+		rule := RouteRule{Match: "*", Ports: []int{s.port}, Action: RouteDirect}
+		if v != nil {
+			rule.Action, rule.Proxy = RouteProxy, v
+		}
+		p.Routes = append(p.Routes, rule)
+	}
+
+	if u == nil {
+		p.ProxyList = "DIRECT"
+	} else {
+		p.URL = u
+	}
+	return p, nil
+}
+
+// parseEnvironmentProxy parses the value of a proxy variable as curl does.
+func parseEnvironmentProxy(v string) (*url.URL, error) {
+	if !strings.Contains(v, "://") {
+		v = "http://" + v
+	}
+	u, err := ParseProxyURL(v)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	switch u.Scheme {
+	case "http", "https", "socks4", "socks4a", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme '%s'", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no proxy host in '%s'", u.Redacted())
+	}
+	if u.Port() == "" && u.Scheme == "http" {
+		u.Host = net.JoinHostPort(u.Hostname(), curlDefaultProxyPort)
+	}
+	return u, nil
+}
+
+// sameURL reports whether a and b are both nil or equal.
+func sameURL(a, b *url.URL) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.String() == b.String()
+}
@@ -0,0 +1,49 @@
+package proxyplease
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestFromEnvironmentNoProxy(t *testing.T) {
+	env := map[string]string{
+		"https_proxy": "http://127.0.0.1:3128",
+		"http_proxy":  "http://127.0.0.1:8080",
+		"no_proxy":    "internal.example,10.0.0.0/8",
+	}
+	p, err := fromEnvironment(func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range p.Routes {
+		if rule.Action == RouteDirect && rule.Match != "*" {
+			t.Errorf("no_proxy entry %s in Routes, want it in Bypass only", rule.Match)
+		}
+	}
+	if len(p.Bypass) != 2 {
+		t.Errorf("Bypass %q, want the no_proxy entries", p.Bypass)
+	}
+
+	// port 80 matches the http_proxy rule, whose dialer still honors no_proxy
+	errDialed := errors.New("dialed")
+	tests := []struct {
+		addr, want string
+	}{
+		{"internal.example:80", "internal.example:80"},
+		{"10.1.2.3:80", "10.1.2.3:80"},
+		{"www.example.com:80", "127.0.0.1:8080"},
+	}
+	for _, tt := range tests {
+		var dialed string
+		p.BaseDial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = addr
+			return nil, errDialed
+		}
+		NewDialContext(p)(context.Background(), "tcp", tt.addr)
+		if dialed != tt.want {
+			t.Errorf("dial to %s connected to %s, want %s", tt.addr, dialed, tt.want)
+		}
+	}
+}
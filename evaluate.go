@@ -0,0 +1,45 @@
+package proxyplease
+
+import (
+	"net/url"
+	"sync"
+)
+
+// evaluateConcurrency bounds the number of targets evaluated at once by EvaluateAll.
+const evaluateConcurrency = 8
+
+// Plan is the proxy decision for a single target URL.
+type Plan struct {
+	Target   string   // Target URL as supplied.
+	Decision Decision // Proxy selected for Target.
+	Err      error    // Set if Target could not be parsed.
+}
+
+// EvaluateAll returns the proxy plan for each of urls, in the same order. Targets are
+// evaluated concurrently against the configuration in p (system settings, PAC or WPAD
+// when p.URL is not set), which is useful to pre-compute routing for a crawl or sync job.
+func (p Proxy) EvaluateAll(urls []string) []Plan {
+	plans := make([]Plan, len(urls))
+	sem := make(chan struct{}, evaluateConcurrency)
+	var wg sync.WaitGroup
+	for i, target := range urls {
+		plans[i].Target = target
+		u, err := url.Parse(target)
+		if err != nil {
+			plans[i].Err = err
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, u *url.URL) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			q := p
+			q.TargetURL = u
+			plans[i].Decision = Decide(q)
+		}(i, u)
+	}
+	wg.Wait()
+	return plans
+}
@@ -0,0 +1,20 @@
+// +build !windows
+
+package proxyplease
+
+import (
+	"errors"
+	"io"
+)
+
+// NewEventLog returns an EventFunc writing Events to the Windows Event Log. It is only
+// available on Windows.
+func NewEventLog(source string) (EventFunc, io.Closer, error) {
+	return nil, nil, errors.New("the event log is only available on Windows")
+}
+
+// InstallEventLog registers source with the Windows Event Log. It is only available on
+// Windows.
+func InstallEventLog(source string) error {
+	return errors.New("the event log is only available on Windows")
+}
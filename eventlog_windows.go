@@ -0,0 +1,38 @@
+// +build windows
+
+package proxyplease
+
+import (
+	"io"
+
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// NewEventLog returns an EventFunc writing Events to the Windows Event Log under source.
+// The source must be registered beforehand, ex: by an installer or with InstallEventLog.
+// Authentication failures and proxy switches are logged as warnings, other events as
+// information, with the EventKind as event ID. Close the returned io.Closer when done.
+func NewEventLog(source string) (EventFunc, io.Closer, error) {
+	l, err := eventlog.Open(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	return func(e Event) {
+		msg := e.Message
+		if e.Proxy != nil {
+			msg += " (proxy: " + e.Proxy.String() + ")"
+		}
+		switch e.Kind {
+		case EventAuthFailed, EventProxySwitched, EventFallbackDirect, EventCircuitOpened:
+			l.Warning(uint32(e.Kind), msg)
+		default:
+			l.Info(uint32(e.Kind), msg)
+		}
+	}, l, nil
+}
+
+// InstallEventLog registers source with the Windows Event Log, which requires
+// administrative privileges. It is typically called once by an installer.
+func InstallEventLog(source string) error {
+	return eventlog.InstallAsEventCreate(source, eventlog.Error|eventlog.Warning|eventlog.Info)
+}
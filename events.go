@@ -0,0 +1,67 @@
+package proxyplease
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// EventKind identifies an Event.
+type EventKind int
+
+const (
+	// EventAuthFailed is reported when no authentication scheme offered by the proxy succeeded.
+	EventAuthFailed EventKind = iota + 1
+	// EventProxySwitched is reported when an upstream is marked down and dials move to another.
+	EventProxySwitched
+	// EventListenerStarted is reported when a Forwarder or TransparentListener starts serving.
+	EventListenerStarted
+	// EventListenerStopped is reported when a Forwarder or TransparentListener stops serving.
+	EventListenerStopped
+	// EventFallbackDirect is reported when a dial falls back to a direct connection.
+	EventFallbackDirect
+	// EventCircuitOpened is reported when a CircuitBreaker stops dialing a failing proxy.
+	EventCircuitOpened
+	// EventCircuitClosed is reported when a proxy whose circuit was open answers again.
+	EventCircuitClosed
+)
+
+var eventKindNames = map[EventKind]string{
+	EventAuthFailed:      "auth-failed",
+	EventProxySwitched:   "proxy-switched",
+	EventListenerStarted: "listener-started",
+	EventListenerStopped: "listener-stopped",
+	EventFallbackDirect:  "fallback-direct",
+	EventCircuitOpened:   "circuit-opened",
+	EventCircuitClosed:   "circuit-closed",
+}
+
+func (k EventKind) String() string {
+	if name, ok := eventKindNames[k]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Event is a significant occurrence worth surfacing to monitoring, unlike debug output.
+type Event struct {
+	Kind    EventKind
+	Proxy   *url.URL // Proxy involved, if any. Credentials are removed.
+	Message string
+}
+
+// EventFunc receives Events. It is called synchronously and should not block.
+type EventFunc func(Event)
+
+// event reports an Event to p.OnEvent, if set.
+func (p Proxy) event(kind EventKind, format string, a ...interface{}) {
+	if p.OnEvent == nil {
+		return
+	}
+	e := Event{Kind: kind, Message: fmt.Sprintf(format, a...)}
+	if p.URL != nil {
+		u := *p.URL
+		u.User = nil
+		e.Proxy = &u
+	}
+	p.OnEvent(e)
+}
@@ -28,19 +28,19 @@ func main() {
 
 	// SOCKS with authentication example
 	//proxyURL, _ := url.Parse("socks5://localhost:8888")
-	//dialContext := proxyplease.NewDialContext(proxyplease.Proxy{Url: proxyURL, Username: "foo", Password: "bar"})
+	//wd := proxyplease.NewWebsocketDialer(proxyplease.Proxy{Url: proxyURL, Username: "foo", Password: "bar"})
 
 	// Assume proxy from environment. Try to authenticate with these credentials
-	//dialContext := proxyplease.NewDialContext(proxyplease.Proxy{Username: "foo", Password: "bar"})
+	//wd := proxyplease.NewWebsocketDialer(proxyplease.Proxy{Username: "foo", Password: "bar"})
 
 	// Specify with a domain to enable NTLM authentication
-	dialContext := proxyplease.NewDialContext(proxyplease.Proxy{Username: "foo", Password: "bar", Domain: "EXAMPLE"})
+	wd := proxyplease.NewWebsocketDialer(proxyplease.Proxy{Username: "foo", Password: "bar", Domain: "EXAMPLE"})
 
 	d := websocket.Dialer{
 		ReadBufferSize:   1024,
 		WriteBufferSize:  1024,
 		HandshakeTimeout: 45 * time.Second,
-		NetDialContext:   dialContext,
+		NetDialContext:   wd.DialContext,
 	}
 	c, _, err := d.Dial(u.String(), nil)
 
@@ -0,0 +1,153 @@
+package proxyplease
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/bdwyertech/proxyplease/pac"
+)
+
+// defaultProbeInterval is how often quarantined proxies are probed by default.
+const defaultProbeInterval = 5 * time.Second
+
+// quarantinePeriods returns how long p skips an unreachable proxy and how often it probes it.
+func (p Proxy) quarantinePeriods() (period, interval time.Duration) {
+	period, interval = p.Quarantine, p.ProbeInterval
+	if period <= 0 {
+		period = upstreamRetryAfter
+	}
+	if interval <= 0 {
+		interval = defaultProbeInterval
+	}
+	return period, interval
+}
+
+// unreachable reports whether a dial failed because the proxy could not be reached or
+// did not answer in time, rather than because of the dial's context or the proxy's answer.
+func unreachable(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	var pu *ErrProxyUnreachable
+	var ne net.Error
+	return errors.As(err, &pu) || errors.As(err, &ne) && ne.Timeout()
+}
+
+// probeProxy tries to connect to the proxy at p.URL every interval until it accepts a
+// connection, then calls up. It gives up at until, after which dials try the proxy again.
+func probeProxy(p Proxy, interval time.Duration, until time.Time, up func()) {
+	clock := clockOr(p.Clock)
+	for clock.Now().Before(until) {
+		<-clock.After(interval)
+		d, err := p.netDialer()
+		if err != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		conn, err := d.DialContext(ctx, "tcp", p.URL.Host)
+		cancel()
+		if err == nil {
+			conn.Close()
+			p.debugf("failover> %s is reachable again", p.URL.Host)
+			up()
+			return
+		}
+	}
+}
+
+// dialFailover dials addr through the upstreams in order, starting with the first one not
+// quarantined, and moves on to the next one when an upstream cannot be reached, or refuses
+// the port of addr if b.proxies allow retrying denied ports.
+func (b *balancer) dialFailover(ctx context.Context, network, addr string) (net.Conn, error) {
+	start := b.pick(addr)
+	var conn net.Conn
+	var err error
+	for i := start; i < len(b.proxies); i++ {
+		if i > start && b.isDown(i) {
+			continue
+		}
+		conn, err = dialProxy(ctx, b.proxies[i], network, addr)
+		if b.proxies[i].retriesDeniedPort(err) {
+			b.proxies[i].debugf("failover> %s refused the port of %s, trying the next upstream", b.proxies[i].URL.Host, addr)
+			continue
+		}
+		if !unreachable(ctx, err) {
+			return conn, err
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		b.fail(i)
+	}
+	return nil, err
+}
+
+// firstUp returns the first upstream not quarantined, or the first one if all are.
+func (b *balancer) firstUp() int {
+	now := b.clock.Now()
+	for i, t := range b.down {
+		if !t.After(now) {
+			return i
+		}
+	}
+	return 0
+}
+
+// isDown reports whether upstream i is quarantined.
+func (b *balancer) isDown(i int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.down[i].After(b.clock.Now())
+}
+
+// up ends the quarantine of upstream i.
+func (b *balancer) up(i int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.down[i] = time.Time{}
+}
+
+// usable returns the directives whose proxies are not quarantined, or all of them if none is.
+func (d *pacDialer) usable(directives []pac.Directive) []pac.Directive {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := clockOr(d.p.Clock).Now()
+	var up []pac.Directive
+	for _, directive := range directives {
+		if directive.Type == "DIRECT" || !d.down[directiveURL(directive).String()].After(now) {
+			up = append(up, directive)
+		}
+	}
+	if len(up) == 0 {
+		return directives
+	}
+	return up
+}
+
+// quarantine skips the proxy of directive for p.Quarantine, probing it meanwhile.
+func (d *pacDialer) quarantine(directive pac.Directive) {
+	if directive.Type == "DIRECT" {
+		return
+	}
+	period, interval := d.p.quarantinePeriods()
+	u := directiveURL(directive)
+	key := u.String()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := clockOr(d.p.Clock).Now()
+	probing := d.down[key].After(now)
+	d.down[key] = now.Add(period)
+	d.p.debugf("failover> Quarantining %s for %s", u.Host, period)
+	if !probing {
+		q := d.p
+		q.URL = u
+		go probeProxy(q, interval, d.down[key], func() {
+			d.mu.Lock()
+			delete(d.down, key)
+			d.mu.Unlock()
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package proxyplease
+
+import (
+	"context"
+	"net"
+)
+
+// FallbackPolicy selects when dials failing through the proxy are retried without it.
+type FallbackPolicy int
+
+const (
+	// FallbackNever returns the error of the proxy.
+	FallbackNever FallbackPolicy = iota
+	// FallbackOnUnreachable connects directly when the proxy cannot be reached or does
+	// not answer in time, ex: on a laptop away from the corporate network.
+	FallbackOnUnreachable
+	// FallbackOnAuthFailure also connects directly when the proxy rejects the
+	// credentials, ex: on a guest network whose proxy does not know the user.
+	FallbackOnAuthFailure
+)
+
+// FallbackFunc is called when a dial to addr falls back to a direct connection after
+// failing through the proxy with err.
+type FallbackFunc func(addr string, err error)
+
+// fallbackDirectFunc returns next, connecting directly when it fails as allowed by
+// p.FallbackDirect.
+func fallbackDirectFunc(p Proxy, next DialContext) DialContext {
+	if p.FallbackDirect == FallbackNever {
+		return next
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := next(ctx, network, addr)
+		if err == nil || !p.fallsBack(ctx, err) {
+			return conn, err
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		p.debugf("proxy> Dial to %s through the proxy failed, connecting directly: %s", addr, err)
+		p.event(EventFallbackDirect, "Connecting directly to %s after the proxy failed: %s", addr, err)
+		if p.OnFallback != nil {
+			p.OnFallback(addr, err)
+		}
+		return p.dialDirect(ctx, network, addr)
+	}
+}
+
+// fallsBack reports whether a dial failing with err is retried directly.
+func (p Proxy) fallsBack(ctx context.Context, err error) bool {
+	if unreachable(ctx, err) {
+		return true
+	}
+	return p.FallbackDirect == FallbackOnAuthFailure && ctx.Err() == nil && Classify(err) == AuthFailed
+}
@@ -0,0 +1,109 @@
+package proxyplease
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bdwyertech/proxyplease/proxytest"
+)
+
+// TestDialFaults checks how the dialer reports each fault a proxytest.Server injects.
+func TestDialFaults(t *testing.T) {
+	target := newEchoServer(t)
+	defer target.Close()
+
+	timeout := func(err error) bool {
+		var ne net.Error
+		return errors.As(err, &ne) && ne.Timeout()
+	}
+	tests := []struct {
+		name        string
+		faults      proxytest.Faults
+		check       func(error) bool // nil if the dial succeeds
+		outcome     Outcome
+		unreachable bool
+	}{
+		{
+			name:   "Reset",
+			faults: proxytest.Faults{DropAfter: 1},
+			check:  func(err error) bool { return errors.Is(err, io.ErrUnexpectedEOF) },
+		},
+		{
+			// the credentials are sent again on a new connection
+			name:   "ResetAfterChallenge",
+			faults: proxytest.Faults{DropAfter: 2},
+		},
+		{
+			// the response is cut short by Proxy.AuthTimeout, not malformed
+			name:        "Stall",
+			faults:      proxytest.Faults{SlowWrite: 20 * time.Millisecond},
+			check:       timeout,
+			unreachable: true,
+		},
+		{
+			name:   "GarbageChallenge",
+			faults: proxytest.Faults{GarbageChallenge: true},
+			check: func(err error) bool {
+				var ae *AuthError
+				return errors.As(err, &ae) && errors.Is(err, ErrProxyAuthRequired)
+			},
+			outcome: AuthFailed,
+		},
+		{
+			name:   "Forbidden",
+			faults: proxytest.Faults{Status: http.StatusForbidden},
+			check: func(err error) bool {
+				var se *StatusError
+				return errors.As(err, &se) && se.StatusCode == http.StatusForbidden
+			},
+			outcome: PolicyDenied,
+		},
+		{
+			name:    "BadGateway",
+			faults:  proxytest.Faults{Status: http.StatusBadGateway},
+			check:   func(err error) bool { var se *StatusError; return errors.As(err, &se) },
+			outcome: TargetUnreachableViaProxy,
+		},
+		{
+			name:    "Overloaded",
+			faults:  proxytest.Faults{Status: http.StatusServiceUnavailable},
+			check:   func(err error) bool { var se *StatusError; return errors.As(err, &se) },
+			outcome: ProxyOverloaded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer("user", "secret", "Basic")
+			s.Faults = tt.faults
+			defer s.Close()
+			p := testProxy(t, s, "user", "secret")
+			p.DisablePreemptiveAuth = true
+			p.AuthTimeout = 100 * time.Millisecond
+
+			_, err := dialEcho(NewDialContext(p), target.Addr().String())
+			if tt.check == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("dial succeeded")
+			}
+			if !tt.check(err) {
+				t.Errorf("unexpected error %T: %v", err, err)
+			}
+			if got := Classify(err); got != tt.outcome {
+				t.Errorf("classified as %s, want %s", got, tt.outcome)
+			}
+			if got := unreachable(context.Background(), err); got != tt.unreachable {
+				t.Errorf("proxy unreachable: %v, want %v", got, tt.unreachable)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package proxyplease
+
+import (
+	"context"
+	"net"
+	"net/url"
+)
+
+// FlowInfo maps a TCP connection made by a dialer to the destination it carries, so
+// network observability agents (ex: eBPF flow collectors) can attribute the flow, which
+// only shows the proxy as its remote end, to the logical target.
+type FlowInfo struct {
+	Local  net.Addr // Local address, including the ephemeral port.
+	Remote net.Addr // Address of the proxy, or of the target for direct connections.
+	Target string   // Logical destination (host:port) tunneled over the connection.
+	Proxy  *url.URL // Proxy the connection was made to, or nil if direct. Credentials are removed.
+	Mark   int      // Proxy.Mark applied to the socket, if any.
+}
+
+// FlowFunc receives the FlowInfo of each connection. It is called synchronously, before
+// any data is exchanged, and should not block.
+type FlowFunc func(FlowInfo)
+
+// netDialer returns the dialer of TCP connections made for p, with its keep-alive,
+// resolver, fallback delay, source address and socket mark.
+func (p Proxy) netDialer() (*net.Dialer, error) {
+	d := &net.Dialer{KeepAlive: p.KeepAlive, Resolver: p.Resolver, FallbackDelay: p.FallbackDelay}
+	if p.Mark != 0 {
+		d.Control = markControl(p.Mark)
+	}
+	ips, err := p.localIPs()
+	if err != nil {
+		p.debugf("proxy> Could not determine the source address: %s", err)
+		return nil, err
+	}
+	if len(ips) > 0 {
+		d.LocalAddr = &net.TCPAddr{IP: ips[0]}
+	}
+	return d, nil
+}
+
+// dialTagged connects to the proxy at p.URL, racing its addresses, or to target when
+// p.URL is nil, and reports the flow carrying target to p.OnFlow. p.BaseDial makes the
+// connection instead, if set.
+func (p Proxy) dialTagged(ctx context.Context, network, target string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if p.BaseDial != nil {
+		addr := target
+		if p.URL != nil {
+			addr = p.URL.Host
+		}
+		conn, err = p.BaseDial(ctx, network, addr)
+	} else {
+		var d *net.Dialer
+		if d, err = p.netDialer(); err != nil {
+			return nil, err
+		}
+		network = localNetwork(network, d.LocalAddr)
+		if p.URL != nil {
+			conn, err = p.dialHappyEyeballs(ctx, d, network, p.URL.Host)
+		} else {
+			conn, err = d.DialContext(ctx, network, target)
+		}
+	}
+	if err != nil || p.OnFlow == nil {
+		return conn, err
+	}
+	f := FlowInfo{Local: conn.LocalAddr(), Remote: conn.RemoteAddr(), Target: target, Mark: p.Mark}
+	if p.URL != nil {
+		u := *p.URL
+		u.User = nil
+		f.Proxy = &u
+	}
+	p.OnFlow(f)
+	return conn, nil
+}
@@ -0,0 +1,113 @@
+package proxyplease
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FormAuth logs in to filtering proxies that answer with an HTML login form rather than
+// a 407. When a CONNECT is redirected or refused, the credentials of the Proxy are posted
+// to LoginURL through the proxy and the CONNECT is retried once. Session cookies are sent
+// with every following CONNECT.
+type FormAuth struct {
+	LoginURL      *url.URL       // Where the login form is posted.
+	UsernameField string         // Name of the username field. Defaults to "username".
+	PasswordField string         // Name of the password field. Defaults to "password".
+	Fields        url.Values     // Additional form fields, ex: hidden inputs of the login form.
+	Jar           http.CookieJar // Persists the session cookies. If nil, cookies are kept in memory.
+
+	once sync.Once
+	jar  http.CookieJar
+}
+
+func (f *FormAuth) cookieJar() http.CookieJar {
+	f.once.Do(func() {
+		f.jar = f.Jar
+		if f.jar == nil {
+			f.jar, _ = cookiejar.New(nil)
+		}
+	})
+	return f.jar
+}
+
+// isLoginResponse reports whether a CONNECT response looks like a filtering proxy
+// sending the client to its login page.
+func isLoginResponse(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect,
+		http.StatusUnauthorized, http.StatusForbidden, http.StatusNetworkAuthenticationRequired:
+		return true
+	}
+	return false
+}
+
+// login posts the credentials of p to the login form.
+func (f *FormAuth) login(ctx context.Context, p Proxy) error {
+	if f.LoginURL == nil {
+		return errors.New("FormAuth.LoginURL is not set")
+	}
+	userField, passField := f.UsernameField, f.PasswordField
+	if userField == "" {
+		userField = "username"
+	}
+	if passField == "" {
+		passField = "password"
+	}
+	form := url.Values{}
+	for k, v := range f.Fields {
+		form[k] = v
+	}
+	form.Set(userField, p.Username)
+	form.Set(passField, p.Password)
+
+	d, err := p.netDialer()
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Jar:     f.cookieJar(),
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(p.URL),
+			DialContext:     d.DialContext,
+			TLSClientConfig: p.TLSConfig,
+		},
+	}
+	p.debugf("form> Logging in at %s", f.LoginURL)
+	req, err := http.NewRequest(http.MethodPost, f.LoginURL.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		p.debugf("form> Login failed: %s", err)
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		p.debugf("form> Login was rejected, got: %d", resp.StatusCode)
+		return errors.New("form login rejected: " + http.StatusText(resp.StatusCode))
+	}
+	return nil
+}
+
+// dialFormAuth logs in and retries the CONNECT once with the session cookies.
+func dialFormAuth(ctx context.Context, p Proxy, addr string, baseDial func() (net.Conn, error)) (net.Conn, error) {
+	f := p.FormAuth
+	if err := f.login(ctx, p); err != nil {
+		return nil, err
+	}
+	p.formLogin = true
+	return dialAndNegotiateHTTP(ctx, p, addr, baseDial)
+}
@@ -0,0 +1,260 @@
+package proxyplease
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMaxHeaderBytes caps request and response headers handled by a Forwarder.
+const defaultMaxHeaderBytes = 64 << 10
+
+// hopHeaders are hop-by-hop headers. They apply to a single connection and must not be
+// forwarded by an intermediary (RFC 7230, section 6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Forwarder is a local HTTP proxy. Clients that cannot authenticate to the upstream
+// proxy themselves point at the Forwarder, which tunnels CONNECT requests and forwards
+// plain HTTP requests through the upstream proxy described by Proxy.
+type Forwarder struct {
+	Proxy           Proxy         // Upstream proxy configuration.
+	MaxHeaderBytes  int           // Maximum size of request and response headers. Defaults to 64KB.
+	RefreshInterval time.Duration // How often to check the network interfaces while serving. When their addresses change, ex: on docking, proxy discovery is re-run. Zero disables.
+	DrainTimeout    time.Duration // How long tunnels through an upstream replaced after a network change may keep running. Defaults to 5m.
+	Routes          []RouteRule   // Evaluated in order for each destination before the upstream proxy selection, overriding it. See LoadRoutes.
+
+	mu           sync.Mutex
+	upstream     *forwarderUpstream
+	router       *router   // applies Routes, created on the first dial
+	routeDialers []*Dialer // of the proxies of RouteProxy rules
+	server       *http.Server
+	stop         chan struct{}
+}
+
+// forwarderUpstream dials and forwards requests through one proxy decision.
+type forwarderUpstream struct {
+	dialer    *Dialer
+	transport *http.Transport
+}
+
+// NewForwarder returns a Forwarder sending traffic through the proxy described by p.
+func NewForwarder(p Proxy) *Forwarder {
+	f := &Forwarder{Proxy: p, MaxHeaderBytes: defaultMaxHeaderBytes}
+	f.upstream = f.newUpstream(p)
+	return f
+}
+
+// newUpstream returns the dialer and transport for p.
+func (f *Forwarder) newUpstream(p Proxy) *forwarderUpstream {
+	// the Forwarder replaces and drains its upstream itself when the settings change
+	p.WatchSystem = false
+	u := &forwarderUpstream{dialer: NewDialer(p)}
+	u.transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return f.dialRoute(ctx, u, network, addr)
+		},
+		MaxIdleConns:           100,
+		IdleConnTimeout:        90 * time.Second,
+		MaxResponseHeaderBytes: int64(f.MaxHeaderBytes),
+	}
+	return u
+}
+
+// current returns the upstream new requests use.
+func (f *Forwarder) current() *forwarderUpstream {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.upstream
+}
+
+// ListenAndServe listens on addr and serves clients until Close is called.
+func (f *Forwarder) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return f.Serve(l)
+}
+
+// Serve accepts clients on l until Close is called.
+func (f *Forwarder) Serve(l net.Listener) error {
+	f.mu.Lock()
+	f.server = &http.Server{Handler: f, MaxHeaderBytes: f.MaxHeaderBytes}
+	f.upstream.transport.MaxResponseHeaderBytes = int64(f.MaxHeaderBytes)
+	server := f.server
+	if (f.RefreshInterval > 0 || watchesSystem(f.Proxy)) && f.stop == nil {
+		f.stop = make(chan struct{})
+		if f.RefreshInterval > 0 {
+			go f.watchNetwork(f.stop)
+		}
+		if watchesSystem(f.Proxy) {
+			go watchSystem(f.Proxy, f.stop, f.Refresh)
+		}
+	}
+	f.mu.Unlock()
+	f.Proxy.debugf("forwarder> Listening on %s", l.Addr())
+	f.Proxy.event(EventListenerStarted, "Forwarder listening on %s", l.Addr())
+	err := server.Serve(l)
+	f.Proxy.event(EventListenerStopped, "Forwarder on %s stopped", l.Addr())
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Close stops the Forwarder. Established tunnels are left running, except those through
+// the proxies of Routes, whose dialers are closed.
+func (f *Forwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.upstream.transport.CloseIdleConnections()
+	for _, d := range f.routeDialers {
+		d.Close()
+	}
+	f.routeDialers = nil
+	f.router = nil
+	if f.stop != nil {
+		close(f.stop)
+		f.stop = nil
+	}
+	if f.server == nil {
+		return nil
+	}
+	return f.server.Close()
+}
+
+// ServeHTTP handles a single proxy request.
+func (f *Forwarder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		f.tunnel(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "proxy requests must use an absolute URL", http.StatusBadRequest)
+		return
+	}
+	if rule := f.route(r.URL.Host); rule != nil && rule.Action == RouteBlock {
+		f.Proxy.debugf("forwarder> Blocking %s as it matches %s", r.URL.Host, rule.Match)
+		http.Error(w, ErrRouteBlocked.Error(), http.StatusForbidden)
+		return
+	}
+	f.forward(w, r)
+}
+
+func (f *Forwarder) tunnel(w http.ResponseWriter, r *http.Request) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "tunneling is not supported", http.StatusInternalServerError)
+		return
+	}
+	upstream, err := f.dialRoute(r.Context(), f.current(), "tcp", r.Host)
+	if err == ErrRouteBlocked {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		f.Proxy.debugf("forwarder> Could not tunnel to %s: %s", r.Host, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	client, brw, err := hj.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+	// forward anything the client sent ahead of the tunnel
+	if n := brw.Reader.Buffered(); n > 0 {
+		b, _ := brw.Reader.Peek(n)
+		upstream.Write(b)
+	}
+	relay(client, upstream)
+}
+
+func (f *Forwarder) forward(w http.ResponseWriter, r *http.Request) {
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	if r.ContentLength == 0 {
+		out.Body = nil
+	}
+	removeHopHeaders(out.Header)
+	addVia(out.Header, r.ProtoMajor, r.ProtoMinor)
+	// keep trailers announced by the client
+	if len(r.Trailer) > 0 {
+		out.Trailer = r.Trailer
+	}
+
+	resp, err := f.current().transport.RoundTrip(out)
+	if err != nil {
+		f.Proxy.debugf("forwarder> Could not forward %s %s: %s", r.Method, r.URL, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+	h := w.Header()
+	for k, v := range resp.Header {
+		h[k] = v
+	}
+	// announce trailers so they can be sent after the body
+	if len(resp.Trailer) > 0 {
+		names := make([]string, 0, len(resp.Trailer))
+		for k := range resp.Trailer {
+			names = append(names, k)
+		}
+		h.Set("Trailer", strings.Join(names, ", "))
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	for k, v := range resp.Trailer {
+		h[http.TrailerPrefix+k] = v
+	}
+}
+
+// removeHopHeaders deletes hop-by-hop headers, including those named in Connection.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// addVia appends this intermediary to the Via header.
+func addVia(h http.Header, major, minor int) {
+	via := "1.1 proxyplease"
+	if major == 1 && minor == 0 {
+		via = "1.0 proxyplease"
+	} else if major == 2 {
+		via = "2 proxyplease"
+	}
+	if prior := h.Get("Via"); prior != "" {
+		via = prior + ", " + via
+	}
+	h.Set("Via", via)
+}
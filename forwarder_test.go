@@ -0,0 +1,70 @@
+package proxyplease
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestForwarderRefreshUnchanged(t *testing.T) {
+	s := newTestServer("user", "secret", "Basic")
+	defer s.Close()
+	f := NewForwarder(testProxy(t, s, "user", "secret"))
+	defer f.Close()
+
+	prev := f.current()
+	for i := 0; i < 3; i++ {
+		f.Refresh()
+	}
+	if f.current() != prev {
+		t.Fatal("Refresh replaced the upstream although the proxy decision did not change")
+	}
+
+	// the upstream still dials after the refreshes
+	target := newEchoServer(t)
+	defer target.Close()
+	if _, err := dialEcho(prev.dialer.DialContext, target.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForwarderRouteProxy(t *testing.T) {
+	target := newEchoServer(t)
+	defer target.Close()
+	upstream := newTestServer("user", "secret", "Basic")
+	defer upstream.Close()
+	routed := newTestServer("routed", "routed-secret", "Basic")
+	defer routed.Close()
+
+	// the upstream refuses the credentials, so only the rule's proxy can reach the target
+	f := NewForwarder(testProxy(t, upstream, "user", "wrong"))
+	u := *routed.URL
+	u.User = url.UserPassword("routed", "routed-secret")
+	f.Routes = []RouteRule{{Match: "127.0.0.1", Action: RouteProxy, Proxy: &u}}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return f.dialRoute(ctx, f.current(), network, addr)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := dialEcho(dial, target.Addr().String()); err != nil {
+			t.Fatalf("dial %d: %s", i, err)
+		}
+	}
+	if n := len(f.routeDialers); n != 1 {
+		t.Errorf("%d dialers for the rule's proxy, want 1", n)
+	}
+
+	// closing the Forwarder closes the tunnels through the rule's proxy
+	conn, err := dial(context.Background(), "tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	f.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || os.IsTimeout(err) {
+		t.Errorf("read from a tunnel after Close: %v, want it closed", err)
+	}
+}
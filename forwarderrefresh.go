@@ -0,0 +1,117 @@
+package proxyplease
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultDrainTimeout is how long tunnels through a replaced upstream may keep running.
+const defaultDrainTimeout = 5 * time.Minute
+
+// Refresh re-runs proxy discovery for f.Proxy and, if the decision changed, sends new
+// tunnels and requests through the new upstream. Tunnels through the previous upstream
+// are drained: they keep running until closed by their users, or until DrainTimeout.
+// It is called when the network changes if RefreshInterval is set, and when the system
+// proxy settings change if Proxy.WatchSystem is set.
+func (f *Forwarder) Refresh() {
+	resetWPADCache()
+	f.Proxy.DecisionCache.Flush()
+	p := f.Proxy
+	// saved state describes the previous network
+	p.State = nil
+	next := f.newUpstream(p)
+
+	f.mu.Lock()
+	prev := f.upstream
+	if sameDecision(prev.dialer.decision, next.dialer.decision) {
+		f.mu.Unlock()
+		f.Proxy.debugf("forwarder> Proxy decision unchanged after refresh")
+		// nothing was dialed through next, which only needs its resources freed
+		next.transport.CloseIdleConnections()
+		next.dialer.Close()
+		return
+	}
+	f.upstream = next
+	f.mu.Unlock()
+
+	f.Proxy.debugf("forwarder> Switching upstream from %s to %s", decisionString(prev.dialer.decision), decisionString(next.dialer.decision))
+	f.Proxy.event(EventProxySwitched, "Forwarder switched from %s to %s after re-running discovery", decisionString(prev.dialer.decision), decisionString(next.dialer.decision))
+	go f.drain(prev)
+}
+
+// drain retires upstream, closing its tunnels that outlive DrainTimeout.
+func (f *Forwarder) drain(upstream *forwarderUpstream) {
+	timeout := f.DrainTimeout
+	if timeout <= 0 {
+		timeout = defaultDrainTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	upstream.transport.CloseIdleConnections()
+	if err := upstream.dialer.Drain(ctx); err != nil {
+		f.Proxy.debugf("forwarder> Closed tunnels through the previous upstream after %s", timeout)
+	}
+}
+
+// watchNetwork calls Refresh whenever the addresses of the network interfaces change,
+// until stop is closed.
+func (f *Forwarder) watchNetwork(stop chan struct{}) {
+	last := networkFingerprint()
+	clock := clockOr(f.Proxy.Clock)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-clock.After(f.RefreshInterval):
+		}
+		if fp := networkFingerprint(); fp != last {
+			f.Proxy.debugf("forwarder> Network changed. Re-running proxy discovery.")
+			last = fp
+			f.Refresh()
+		}
+	}
+}
+
+// networkFingerprint summarizes the addresses of the connected, non-loopback interfaces.
+func networkFingerprint() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	var entries []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			entries = append(entries, iface.Name+"="+a.String())
+		}
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+// sameDecision reports whether a and b select the same proxy.
+func sameDecision(a, b Decision) bool {
+	return decisionString(a) == decisionString(b) && a.Source == b.Source && a.script == b.script
+}
+
+// decisionString describes the proxy of d for logs.
+func decisionString(d Decision) string {
+	if d.script != "" {
+		return "PAC script"
+	}
+	if d.URL == nil {
+		return "direct"
+	}
+	u := *d.URL
+	u.User = nil
+	return u.String()
+}
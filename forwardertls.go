@@ -0,0 +1,92 @@
+package proxyplease
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// ListenAndServeTLS listens on addr and serves clients over TLS until Close is called,
+// for tools that require an https:// proxy URL or remote clients on a trusted network.
+// If certFile and keyFile are empty, a self-signed certificate is generated.
+func (f *Forwarder) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return f.ServeTLS(l, certFile, keyFile)
+}
+
+// ServeTLS accepts TLS clients on l until Close is called. If certFile and keyFile are
+// empty, a self-signed certificate is generated.
+func (f *Forwarder) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	var cert tls.Certificate
+	var err error
+	if certFile == "" && keyFile == "" {
+		cert, err = selfSignedCert()
+	} else {
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	}
+	if err != nil {
+		l.Close()
+		f.Proxy.debugf("forwarder> Could not load TLS certificate: %s", err)
+		return err
+	}
+	// CONNECT tunnels hijack the connection, which HTTP/2 does not allow.
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"http/1.1"},
+		MinVersion:   tls.VersionTLS12,
+	}
+	return f.Serve(tls.NewListener(l, config))
+}
+
+// selfSignedCert returns a certificate valid for the local host names and addresses.
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	names := []string{"localhost"}
+	if h, err := os.Hostname(); err == nil && h != "localhost" {
+		names = append(names, h)
+	}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() {
+				ips = append(ips, n.IP)
+			}
+		}
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "proxyplease forwarder"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              names,
+		IPAddresses:           ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	debugf("forwarder> Generated self-signed certificate for %v %v", names, ips)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,159 @@
+package proxyplease
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/bdwyertech/proxyplease/auth"
+)
+
+// GetFTP retrieves an ftp:// URL through an HTTP proxy that gateways FTP, such as Squid.
+// The proxy is looked up for the FTP URL, so FTP_PROXY and PAC rules for ftp:// apply.
+// FTP credentials included in the URL are sent to the gateway in the Authorization header.
+// Digest and Basic proxy authentication are supported, Digest first when both are offered.
+// The caller must close the response body.
+func GetFTP(ctx context.Context, p Proxy, rawurl string) (*http.Response, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ftp" {
+		return nil, fmt.Errorf("expected an ftp:// URL, got '%s'", u.Scheme)
+	}
+	p.Headers = snapshotHeaders(p.Headers)
+	p.TargetURL = toASCIIURL(u)
+	d := decide(p)
+	if d.URL == nil {
+		return nil, errors.New("no proxy could be determined for " + u.Redacted())
+	}
+	p.source = d.Source
+	p = withProxyURL(p, d.URL)
+	if p.URL.Scheme != "http" && p.URL.Scheme != "https" {
+		return nil, fmt.Errorf("FTP gatewaying requires an HTTP proxy, got '%s'", p.URL.Scheme)
+	}
+
+	var authorization string
+	if scheme := p.everyRequestScheme(); scheme != "" {
+		h := http.Header{}
+		if err := setProxyAuthorization(p, h, scheme, http.MethodGet, ftpRequestTarget(p.TargetURL)); err != nil {
+			return nil, err
+		}
+		authorization = h.Get("Proxy-Authorization")
+	}
+	resp, err := getFTP(ctx, p, p.TargetURL, authorization)
+	if err != nil || resp.StatusCode != http.StatusProxyAuthRequired || authorization != "" {
+		return resp, err
+	}
+	if p.Username != "" && contains(p.AuthSchemeFilter, "Digest") {
+		if challenge := auth.DigestChallenge(resp.Header["Proxy-Authenticate"]); challenge != "" {
+			resp.Body.Close()
+			return getFTPDigest(ctx, p, challenge)
+		}
+	}
+	if p.Username == "" || !contains(p.AuthSchemeFilter, "Basic") ||
+		auth.Challenge(resp.Header["Proxy-Authenticate"], "Basic") == "" {
+		p.debugf("ftp> Proxy requires authentication that is not supported for FTP gatewaying")
+		return resp, nil
+	}
+	resp.Body.Close()
+	p.debugf("ftp> Retrying with Basic authentication")
+	return getFTP(ctx, p, p.TargetURL, auth.Basic(p.Username, p.Password))
+}
+
+// getFTPDigest retries the GET for p.TargetURL with Digest credentials answering
+// challenge, once more if the proxy reports the nonce stale.
+func getFTPDigest(ctx context.Context, p Proxy, challenge string) (*http.Response, error) {
+	p.debugf("ftp> Retrying with Digest authentication")
+	s := digestSession(p)
+	u := p.TargetURL
+	uri := ftpRequestTarget(u)
+	get := func() (*http.Response, error) {
+		authorization, err := s.Authorization(http.MethodGet, uri)
+		if err != nil {
+			return nil, err
+		}
+		return getFTP(ctx, p, u, authorization)
+	}
+	if _, err := s.Challenge(challenge); err != nil {
+		p.debugf("ftp> Could not use Digest challenge: %s", err)
+		return nil, err
+	}
+	resp, err := get()
+	if err != nil || resp.StatusCode != http.StatusProxyAuthRequired {
+		return resp, err
+	}
+	if stale, cerr := s.Challenge(auth.DigestChallenge(resp.Header["Proxy-Authenticate"])); cerr == nil && stale {
+		p.debugf("ftp> Nonce is stale. Retrying with the new nonce.")
+		resp.Body.Close()
+		if resp, err = get(); err != nil || resp.StatusCode != http.StatusProxyAuthRequired {
+			return resp, err
+		}
+	}
+	dropDigestSession(p, s)
+	return resp, nil
+}
+
+// ftpRequestTarget returns the request-target of the absolute-form GET for u, without
+// userinfo.
+func ftpRequestTarget(u *url.URL) string {
+	return u.Scheme + "://" + u.Host + u.RequestURI()
+}
+
+// getFTP sends an absolute-form GET for u to the proxy at p.URL.
+func getFTP(ctx context.Context, p Proxy, u *url.URL, authorization string) (*http.Response, error) {
+	conn, err := p.dialTagged(ctx, "tcp", u.Host)
+	if err != nil {
+		p.debugf("ftp> Could not connect to proxy: %s", err)
+		return nil, err
+	}
+	if p.URL.Scheme == "https" {
+		if conn, err = proxyTLS(ctx, p, conn); err != nil {
+			return nil, err
+		}
+	}
+
+	req := (&http.Request{
+		Method: http.MethodGet,
+		URL:    u,
+		Host:   u.Host,
+		Header: p.connectHeader(u.Host),
+	}).WithContext(ctx)
+	if authorization != "" {
+		req.Header.Set("Proxy-Authorization", authorization)
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		req.Header.Set("Authorization", auth.Basic(u.User.Username(), pass))
+	}
+	if err := req.WriteProxy(conn); err != nil {
+		p.debugf("ftp> Could not write request to proxy: %s", err)
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		p.debugf("ftp> Could not read response from proxy: %s", err)
+		conn.Close()
+		return nil, err
+	}
+	resp.Body = &connBody{ReadCloser: resp.Body, conn: conn}
+	return resp, nil
+}
+
+// connBody closes the connection a response was read from along with its body.
+type connBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *connBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conn.Close()
+	return err
+}
@@ -0,0 +1,100 @@
+package proxyplease
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcpMetadataToken is the token endpoint of the default service account of GCE, GKE and
+// Cloud Run.
+const gcpMetadataToken = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// gcpMetadataTimeout bounds requests to the metadata server.
+const gcpMetadataTimeout = 10 * time.Second
+
+// GCPSecret is a SecretStore reading proxy credentials from GCP Secret Manager, with an
+// access token of the default service account from the metadata server unless
+// TokenSource is set.
+type GCPSecret struct {
+	Name        string       // Resource name of the secret version, ex: "projects/my-project/secrets/proxy/versions/latest". A name without version reads the latest.
+	Endpoint    string       // URL of Secret Manager, ex: a regional or Private Service Connect endpoint. Defaults to "https://secretmanager.googleapis.com".
+	TokenSource TokenSource  // Supplies OAuth access tokens, ex: a RefreshingTokenSource over an oauth2.TokenSource.
+	Client      *http.Client // Client for Secret Manager and the metadata server. Defaults to http.DefaultClient.
+
+	once     sync.Once
+	metadata TokenSource
+}
+
+// Fetch reads the secret version.
+func (s *GCPSecret) Fetch(ctx context.Context) (Credentials, error) {
+	if s.Name == "" {
+		return Credentials{}, errors.New("gcp: secret name is required")
+	}
+	name := strings.Trim(s.Name, "/")
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	ts := s.TokenSource
+	if ts == nil {
+		s.once.Do(func() {
+			s.metadata = RefreshingTokenSource(s.metadataToken)
+		})
+		ts = s.metadata
+	}
+	token, err := ts.Token()
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = "https://secretmanager.googleapis.com"
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(endpoint, "/")+"/v1/"+name+":access", nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+token)
+	var resp struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := doSecretRequest(s.Client, req, "gcp", &resp); err != nil {
+		return Credentials{}, err
+	}
+	b, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return Credentials{}, err
+	}
+	debugf("secrets> Fetched credentials from GCP Secret Manager secret %s", name)
+	return secretCredentials(b)
+}
+
+// metadataToken returns an access token of the default service account. The token is
+// shared by fetches, so it is not bound to the context of one.
+func (s *GCPSecret) metadataToken() (string, time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gcpMetadataTimeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", gcpMetadataToken, nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Metadata-Flavor", "Google")
+	var tr tokenResponse
+	if err := doSecretRequest(s.Client, req, "gcp metadata", &tr); err != nil {
+		return "", time.Time{}, err
+	}
+	var expiry time.Time
+	if tr.ExpiresIn > 0 {
+		expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+	return tr.AccessToken, expiry, nil
+}
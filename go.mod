@@ -5,8 +5,12 @@ go 1.12
 require (
 	github.com/alexbrainman/sspi v0.0.0-20210105120005-909beea2cc74
 	github.com/bdwyertech/go-get-proxied v0.0.0-20210411180753-808d00eb83c7
+	github.com/dop251/goja v0.0.0-20210406175830-1b11a6af686d
 	github.com/gorilla/websocket v1.4.2
-	github.com/launchdarkly/go-ntlmssp v1.0.1
-	golang.org/x/net v0.0.0-20210410081132-afb366fc7cd1
+	github.com/jcmturner/gofork v1.7.6
+	github.com/jcmturner/gokrb5/v8 v8.4.4
+	golang.org/x/crypto v0.6.0
+	golang.org/x/net v0.7.0
+	golang.org/x/sys v0.5.0
 	h12.io/socks v1.0.2
 )
@@ -0,0 +1,446 @@
+package proxyplease
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bdwyertech/proxyplease/auth"
+	"golang.org/x/net/http2"
+)
+
+// h2ReadIdleTimeout is how long an HTTP/2 connection to a proxy may stay silent before it
+// is health checked with a ping.
+const h2ReadIdleTimeout = 30 * time.Second
+
+// h2Conns are the HTTP/2 connections to proxies, shared by the tunnels through them.
+var h2Conns = &h2Pool{conns: map[string][]*h2Conn{}, schemes: map[string]string{}, http1: map[string]bool{}}
+
+// h2Pool keeps HTTP/2 connections to proxies, by proxy, user and TLS settings.
+type h2Pool struct {
+	mu      sync.Mutex
+	conns   map[string][]*h2Conn
+	schemes map[string]string // authentication scheme last accepted by the proxy
+	http1   map[string]bool   // proxies only offering authentication of a connection
+}
+
+// h2Conn is an HTTP/2 connection to a proxy.
+type h2Conn struct {
+	cc            *http2.ClientConn
+	local, remote net.Addr
+}
+
+// h2Key identifies the connections usable by the dials of p.
+func h2Key(p Proxy) string {
+	return fmt.Sprintf("%s %s %p %p %p", p.URL.Host, p.Username, p.TLSConfig, p.ClientCertificate, p.GetClientCertificate)
+}
+
+// get returns a connection for key able to carry another stream, or nil. Closed
+// connections are dropped.
+func (pl *h2Pool) get(key string) *h2Conn {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	var found *h2Conn
+	live := pl.conns[key][:0]
+	for _, c := range pl.conns[key] {
+		if s := c.cc.State(); s.Closed || s.Closing {
+			continue
+		}
+		live = append(live, c)
+		if found == nil && c.cc.CanTakeNewRequest() {
+			found = c
+		}
+	}
+	pl.conns[key] = live
+	return found
+}
+
+func (pl *h2Pool) put(key string, c *h2Conn) {
+	pl.mu.Lock()
+	pl.conns[key] = append(pl.conns[key], c)
+	pl.mu.Unlock()
+}
+
+func (pl *h2Pool) scheme(key string) string {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return pl.schemes[key]
+}
+
+func (pl *h2Pool) setScheme(key, scheme string) {
+	pl.mu.Lock()
+	pl.schemes[key] = scheme
+	pl.mu.Unlock()
+}
+
+// http1Only reports whether the proxy of key requires authentication only HTTP/1.1 can
+// carry, so its connections should not offer HTTP/2.
+func (pl *h2Pool) http1Only(key string) bool {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return pl.http1[key]
+}
+
+func (pl *h2Pool) setHTTP1Only(key string) {
+	pl.mu.Lock()
+	pl.http1[key] = true
+	pl.mu.Unlock()
+}
+
+// dialH2 establishes a tunnel to addr as a CONNECT stream (RFC 9113, section 8.5) over an
+// HTTP/2 connection to the proxy at p.URL, shared with the other tunnels through it. A
+// connection is made with baseDial when none can take the stream. Proxies that do not
+// negotiate HTTP/2 are used with HTTP/1.1 as usual.
+func dialH2(ctx context.Context, p Proxy, addr string, baseDial func() (net.Conn, error)) (net.Conn, error) {
+	key := h2Key(p)
+	if h2Conns.http1Only(key) {
+		p.HTTP2 = false
+		return getProxyConn(ctx, addr, p, baseDial)
+	}
+	c := h2Conns.get(key)
+	if c == nil {
+		conn, err := baseDial()
+		if err != nil {
+			p.debugf("h2> Could not call dial context with proxy: %s", err)
+			return conn, err
+		}
+		state, ok := tlsState(conn)
+		if !ok || state.NegotiatedProtocol != http2.NextProtoTLS {
+			p.debugf("h2> Proxy %s did not negotiate HTTP/2. Using HTTP/1.1.", p.URL.Host)
+			p.HTTP2 = false
+			return getProxyConn(ctx, addr, p, firstConn(conn, baseDial))
+		}
+		t := &http2.Transport{ReadIdleTimeout: h2ReadIdleTimeout}
+		cc, err := t.NewClientConn(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		p.debugf("h2> Connected to %s with HTTP/2", p.URL.Host)
+		c = &h2Conn{cc: cc, local: conn.LocalAddr(), remote: conn.RemoteAddr()}
+		h2Conns.put(key, c)
+	}
+
+	conn, err := c.stream(ctx, p, addr, h2Conns.scheme(key))
+	var se *StatusError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusProxyAuthRequired {
+		return conn, err
+	}
+	if connectionAuthOnly(p, auth.SplitChallenges(se.Header["Proxy-Authenticate"])) {
+		// new connections to the proxy only offer HTTP/1.1, see proxyTLS
+		p.debugf("h2> Proxy %s only offers authentication of a connection. Using HTTP/1.1.", p.URL.Host)
+		h2Conns.setHTTP1Only(key)
+		p.HTTP2 = false
+		return getProxyConn(ctx, addr, p, baseDial)
+	}
+	conn, scheme, err := authenticatePerRequest(ctx, p, addr, se, func(p Proxy, scheme string) (net.Conn, error) {
+		return c.stream(ctx, p, addr, scheme)
+	})
+	if err == nil {
+		h2Conns.setScheme(key, scheme)
+	}
+	return conn, err
+}
+
+// connectionAuthOnly reports whether challenges, the schemes offered by the proxy of p,
+// only include schemes authenticating a connection, NTLM or Negotiate, among those p may
+// use.
+func connectionAuthOnly(p Proxy, challenges []string) bool {
+	schemes := map[string]string{"basic": "Basic", "digest": "Digest", "bearer": "Bearer", "ntlm": "NTLM", "negotiate": "Negotiate"}
+	connection := false
+	for _, challenge := range challenges {
+		scheme, ok := schemes[challengeScheme(challenge)]
+		if !ok || !contains(p.AuthSchemeFilter, scheme) {
+			continue
+		}
+		switch scheme {
+		case "NTLM", "Negotiate":
+			connection = true
+		case "Bearer":
+			if p.TokenSource != nil {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return connection
+}
+
+// authenticatePerRequest answers the 407 se of a request for addr with the schemes whose
+// credentials are sent with every request, Basic, Bearer and Digest, calling send with
+// each until the proxy accepts one. It returns the tunnel and the accepted scheme.
+// Connection-based schemes such as NTLM cannot authenticate a single request, and are
+// skipped.
+func authenticatePerRequest(ctx context.Context, p Proxy, addr string, se *StatusError, send func(p Proxy, scheme string) (net.Conn, error)) (net.Conn, string, error) {
+	p.debugf("proxy> Proxy authentication is required. Attempting to select a authentication scheme.")
+	challenges := auth.SplitChallenges(se.Header["Proxy-Authenticate"])
+	started := p.authStarted(addr, challenges)
+	var attempts []AuthAttempt
+	var conn net.Conn
+	var err error
+	digested := false
+	for _, challenge := range orderChallenges(p, challenges) {
+		var scheme string
+		switch challengeScheme(challenge) {
+		case "basic":
+			scheme = "Basic"
+			if !contains(p.AuthSchemeFilter, scheme) {
+				continue
+			}
+			conn, err = withCredentials(ctx, p, scheme, func(p Proxy) (net.Conn, error) {
+				return send(p, scheme)
+			})
+		case "bearer":
+			scheme = "Bearer"
+			if !contains(p.AuthSchemeFilter, scheme) || p.TokenSource == nil {
+				continue
+			}
+			conn, err = traceAuth(p, scheme, func(p Proxy) (net.Conn, error) {
+				return send(p, scheme)
+			})
+		case "digest":
+			scheme = "Digest"
+			if !contains(p.AuthSchemeFilter, scheme) || digested {
+				// proxies send one challenge per algorithm, all answered by one attempt
+				continue
+			}
+			digested = true
+			conn, err = withCredentials(ctx, p, scheme, func(p Proxy) (net.Conn, error) {
+				return answerDigest(p, challenges, func() (net.Conn, error) {
+					return send(p, scheme)
+				})
+			})
+		default:
+			p.debugf("proxy> %s authentication cannot authenticate a single request. Trying next available scheme.", challengeScheme(challenge))
+			continue
+		}
+		if err == nil {
+			p.authEnded(conn, scheme, nil, started)
+			return conn, scheme, nil
+		}
+		p.debugf("proxy> %s authentication failed. Trying next available scheme.", scheme)
+		attempts = append(attempts, p.authAttempt(scheme, err))
+	}
+
+	p.debugf("proxy> No proxy authentication completed successfully")
+	if err == nil {
+		err = se
+	} else {
+		last := attempts[len(attempts)-1]
+		err = &ErrAuthFailed{Scheme: last.Scheme, Status: last.StatusCode, Err: err}
+	}
+	err = &AuthError{Offered: challenges, Attempts: attempts, Err: err}
+	p.event(EventAuthFailed, "Authentication to the proxy failed for %s: %s", addr, err)
+	p.authEnded(nil, "", err, started)
+	return nil, "", err
+}
+
+// everyRequestScheme returns the scheme whose credentials are sent with every request to
+// the proxy of p if p.AuthEveryRequest is set: the Basic or Digest scheme the proxy last
+// accepted, Digest once a session with the proxy exists, Bearer with a TokenSource, or
+// Basic. It returns "" if no credentials may be sent.
+func (p Proxy) everyRequestScheme() string {
+	if !p.AuthEveryRequest {
+		return ""
+	}
+	basic := p.Username != "" && contains(p.AuthSchemeFilter, "Basic") &&
+		!(p.DisallowPlaintextBasic && !p.encryptedProxy())
+	digest := p.Username != "" && contains(p.AuthSchemeFilter, "Digest") && hasDigestSession(p)
+	preemptiveSchemes.Lock()
+	remembered := preemptiveSchemes.m[preemptiveKey(p)]
+	preemptiveSchemes.Unlock()
+	switch {
+	case remembered == "Basic" && basic, remembered == "Digest" && digest:
+		return remembered
+	case digest:
+		return "Digest"
+	case p.TokenSource != nil && contains(p.AuthSchemeFilter, "Bearer"):
+		return "Bearer"
+	case basic:
+		return "Basic"
+	}
+	return ""
+}
+
+// answerDigest records the Digest challenge among challenges in the session for the
+// credentials of p and calls send, which authorizes its request with the session, again if
+// the proxy flags the nonce as stale. The session is dropped if the proxy rejects the
+// credentials.
+func answerDigest(p Proxy, challenges []string, send func() (net.Conn, error)) (net.Conn, error) {
+	s := digestSession(p)
+	if _, err := s.Challenge(auth.DigestChallenge(challenges)); err != nil {
+		p.debugf("digest> Could not use challenge: %s", err)
+		return nil, err
+	}
+	conn, err := send()
+	var se *StatusError
+	if errors.As(err, &se) && se.StatusCode == http.StatusProxyAuthRequired {
+		stale, cerr := s.Challenge(auth.DigestChallenge(se.Header["Proxy-Authenticate"]))
+		if cerr == nil && stale {
+			p.debugf("digest> Nonce is stale. Retrying with the new nonce.")
+			conn, err = send()
+		}
+	}
+	if errors.As(err, &se) && se.StatusCode == http.StatusProxyAuthRequired {
+		p.debugf("digest> Proxy rejected the credentials. Dropping the session.")
+		dropDigestSession(p, s)
+	}
+	return conn, err
+}
+
+// setProxyAuthorization sets the Proxy-Authorization header of h, for a request with
+// method and target, for scheme: Basic, Bearer, or Digest with the next nonce count of
+// the session for the credentials of p. Other schemes, and no scheme, set nothing.
+func setProxyAuthorization(p Proxy, h http.Header, scheme, method, target string) error {
+	switch scheme {
+	case "Digest":
+		authorization, err := digestSession(p).Authorization(method, target)
+		if err != nil {
+			return err
+		}
+		h.Set("Proxy-Authorization", authorization)
+	case "Basic":
+		h.Set("Proxy-Authorization", auth.Basic(p.Username, p.Password))
+	case "Bearer":
+		token, err := p.TokenSource.Token()
+		if err != nil {
+			p.debugf("bearer> Could not obtain token: %s", err)
+			return err
+		}
+		h.Set("Proxy-Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+// stream sends a CONNECT request for addr on c, with credentials for scheme if set, and
+// returns the tunnel it establishes. The stream is reset if ctx is done before the proxy
+// answers; afterwards, it lasts until the tunnel is closed.
+func (c *h2Conn) stream(ctx context.Context, p Proxy, addr, scheme string) (net.Conn, error) {
+	h := p.connectHeader(addr)
+	for _, name := range hopHeaders {
+		// connection-specific headers are malformed in HTTP/2
+		h.Del(name)
+	}
+	if scheme == "" {
+		// proxies authenticating each request challenge every stream otherwise
+		scheme = p.everyRequestScheme()
+	}
+	if err := setProxyAuthorization(p, h, scheme, "CONNECT", addr); err != nil {
+		return nil, err
+	}
+
+	body, w := io.Pipe()
+	streamCtx, cancel := context.WithCancel(context.Background())
+	connect := (&http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Host: addr},
+		Host:   addr,
+		Header: h,
+		Body:   body,
+	}).WithContext(streamCtx)
+	answered := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-answered:
+		}
+	}()
+	resp, err := c.cc.RoundTrip(connect)
+	close(answered)
+	if err != nil {
+		cancel()
+		w.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		p.debugf("h2> CONNECT to %s failed: %s", addr, err)
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := newStatusError(resp)
+		resp.Body.Close()
+		cancel()
+		w.Close()
+		p.debugf("h2> Expected 200 as return status, got: %d", resp.StatusCode)
+		return nil, err
+	}
+	p.debugf("h2> Tunnel to %s established", addr)
+	return newConn(newStreamConn(resp.Body, w, cancel, c.local, c.remote), p, resp, nil, scheme), nil
+}
+
+// streamConn is a tunnel carried by an HTTP/2 stream. It is the client end of a pipe
+// copied to and from the stream, which provides deadlines.
+type streamConn struct {
+	net.Conn
+	server        net.Conn // end of the pipe copied to the stream
+	local, remote net.Addr
+
+	once        sync.Once
+	writeClosed chan struct{} // closed by CloseWrite
+	closeOnce   sync.Once
+	closed      chan struct{} // closed by Close
+}
+
+// newStreamConn returns the tunnel reading from the response body of a CONNECT stream
+// and writing to its request body w. cancel resets the stream.
+func newStreamConn(body io.ReadCloser, w *io.PipeWriter, cancel func(), local, remote net.Addr) net.Conn {
+	client, server := net.Pipe()
+	c := &streamConn{
+		Conn:        client,
+		server:      server,
+		local:       local,
+		remote:      remote,
+		writeClosed: make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+	go func() {
+		io.Copy(server, body)
+		server.Close()
+	}()
+	go func() {
+		io.Copy(w, server)
+		w.Close()
+		select {
+		case <-c.writeClosed:
+			// half-closed: the response is read until the tunnel is closed
+			<-c.closed
+		default:
+		}
+		body.Close()
+		cancel()
+	}()
+	return c
+}
+
+// CloseWrite ends the request body of the stream, so the target reads EOF, while the
+// response can still be read.
+func (c *streamConn) CloseWrite() error {
+	c.once.Do(func() { close(c.writeClosed) })
+	// data written so far was read from the pipe: stop the copy once it was sent
+	return c.server.SetReadDeadline(aLongTimeAgo)
+}
+
+// Close closes the tunnel and resets the stream.
+func (c *streamConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() { close(c.closed) })
+	return err
+}
+
+// LocalAddr returns the local address of the connection to the proxy.
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the address of the proxy.
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
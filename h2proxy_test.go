@@ -0,0 +1,310 @@
+package proxyplease
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bdwyertech/proxyplease/auth"
+)
+
+// h2TestProxy is an https:// proxy accepting CONNECT streams over HTTP/2 and CONNECT
+// requests over HTTP/1.1, relaying them to their target.
+type h2TestProxy struct {
+	*httptest.Server
+	// authorize returns the challenges answering the request with a 407, or none to accept
+	// it.
+	authorize func(r *http.Request) []string
+
+	mu       sync.Mutex
+	requests map[int]int // by HTTP major version
+	headers  []string    // Proxy-Authorization of each request
+}
+
+func newH2TestProxy(t testing.TB, authorize func(r *http.Request) []string) *h2TestProxy {
+	s := &h2TestProxy{authorize: authorize, requests: map[int]int{}}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.serve))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	return s
+}
+
+// proxy returns a Proxy using s with HTTP/2, authenticating with username and password.
+func (s *h2TestProxy) proxy(t testing.TB, username, password string) Proxy {
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certificate())
+	u, _ := url.Parse(s.URL)
+	return Proxy{
+		URL:       u,
+		Username:  username,
+		Password:  password,
+		HTTP2:     true,
+		TLSConfig: &tls.Config{RootCAs: roots},
+		Debugf:    t.Logf,
+	}
+}
+
+func (s *h2TestProxy) count(major int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[major]
+}
+
+// authorizations returns the schemes of the Proxy-Authorization of the requests received
+// so far, "" for requests without one, and forgets them.
+func (s *h2TestProxy) authorizations() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	schemes := make([]string, len(s.headers))
+	for i, h := range s.headers {
+		schemes[i] = auth.ChallengeScheme(h)
+	}
+	s.headers = nil
+	return schemes
+}
+
+func (s *h2TestProxy) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests[r.ProtoMajor]++
+	s.headers = append(s.headers, r.Header.Get("Proxy-Authorization"))
+	s.mu.Unlock()
+	if r.Method != "CONNECT" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if challenges := s.authorize(r); len(challenges) > 0 {
+		w.Header()["Proxy-Authenticate"] = challenges
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	target, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+
+	if r.ProtoMajor == 1 {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go io.Copy(target, brw)
+		io.Copy(conn, target)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	go func() {
+		io.Copy(target, r.Body)
+		target.(*net.TCPConn).CloseWrite()
+	}()
+	b := make([]byte, 32<<10)
+	for {
+		n, err := target.Read(b)
+		if n > 0 {
+			w.Write(b[:n])
+			w.(http.Flusher).Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// digestAuthorize returns an authorize func for h2TestProxy checking SHA-256 Digest
+// credentials of user and password with qop=auth.
+func digestAuthorize(user, password string) func(r *http.Request) []string {
+	challenge := `Digest realm="test", nonce="0123456789abcdef", qop="auth", algorithm=SHA-256`
+	h := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	return func(r *http.Request) []string {
+		v := r.Header.Get("Proxy-Authorization")
+		params := auth.ChallengeParams(v)
+		if auth.ChallengeScheme(v) != "Digest" || params["username"] != user || params["nonce"] != "0123456789abcdef" {
+			return []string{challenge}
+		}
+		ha1 := h(user + ":test:" + password)
+		ha2 := h(r.Method + ":" + params["uri"])
+		want := h(fmt.Sprintf("%s:%s:%s:%s:auth:%s", ha1, params["nonce"], params["nc"], params["cnonce"], ha2))
+		if params["response"] != want {
+			return []string{challenge}
+		}
+		return nil
+	}
+}
+
+func TestDialH2Digest(t *testing.T) {
+	target := newEchoServer(t)
+	defer target.Close()
+	s := newH2TestProxy(t, digestAuthorize("user", "secret"))
+	defer s.Close()
+
+	dial := NewDialContext(s.proxy(t, "user", "secret"))
+	for i := 0; i < 2; i++ {
+		got, err := dialEcho(dial, target.Addr().String())
+		if err != nil {
+			t.Fatalf("dial %d: %s", i, err)
+		}
+		if got != "Digest" {
+			t.Errorf("dial %d: authenticated with %q, want Digest", i, got)
+		}
+	}
+	// the second stream is authorized with the session of the first one
+	if got := s.count(2); got != 3 {
+		t.Errorf("%d HTTP/2 requests, want 3", got)
+	}
+	if got := s.count(1); got != 0 {
+		t.Errorf("%d HTTP/1.1 requests, want 0", got)
+	}
+
+	dial = NewDialContext(s.proxy(t, "user", "wrong"))
+	if _, err := dialEcho(dial, target.Addr().String()); err == nil {
+		t.Error("dial with a wrong password succeeded")
+	}
+}
+
+func TestDialH2ConnectionAuth(t *testing.T) {
+	target := newEchoServer(t)
+	defer target.Close()
+	// NTLM is not implemented by the test proxy, which accepts HTTP/1.1 requests instead
+	s := newH2TestProxy(t, func(r *http.Request) []string {
+		if r.ProtoMajor == 2 {
+			return []string{"NTLM", "Negotiate"}
+		}
+		return nil
+	})
+	defer s.Close()
+
+	dial := NewDialContext(s.proxy(t, "user", "secret"))
+	for i := 0; i < 2; i++ {
+		if _, err := dialEcho(dial, target.Addr().String()); err != nil {
+			t.Fatalf("dial %d: %s", i, err)
+		}
+	}
+	// the proxy is only used with HTTP/1.1 after the first 407
+	if got := s.count(2); got != 1 {
+		t.Errorf("%d HTTP/2 requests, want 1", got)
+	}
+	if got := s.count(1); got != 2 {
+		t.Errorf("%d HTTP/1.1 requests, want 2", got)
+	}
+}
+
+func TestDialH2AuthEveryRequest(t *testing.T) {
+	target := newEchoServer(t)
+	defer target.Close()
+	basic := newH2TestProxy(t, func(r *http.Request) []string {
+		if r.Header.Get("Proxy-Authorization") != auth.Basic("user", "secret") {
+			return []string{`Basic realm="test"`}
+		}
+		return nil
+	})
+	defer basic.Close()
+	bearer := newH2TestProxy(t, func(r *http.Request) []string {
+		if r.Header.Get("Proxy-Authorization") != "Bearer token" {
+			return []string{`Bearer realm="test"`}
+		}
+		return nil
+	})
+	defer bearer.Close()
+	digest := newH2TestProxy(t, digestAuthorize("user", "secret"))
+	defer digest.Close()
+
+	tests := []struct {
+		name  string
+		proxy *h2TestProxy
+		setup func(p *Proxy)
+		want  []string // schemes of the requests of each dial
+	}{
+		{"Basic", basic, func(p *Proxy) {}, []string{"Basic"}},
+		{"Bearer", bearer, func(p *Proxy) {
+			p.Username, p.Password = "", ""
+			p.TokenSource = RefreshingTokenSource(func() (string, time.Time, error) {
+				return "token", time.Time{}, nil
+			})
+		}, []string{"Bearer"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 2; i++ {
+				// a new HTTP/2 connection each time, which has not authenticated yet
+				p := tt.proxy.proxy(t, "user", "secret")
+				p.AuthEveryRequest = true
+				tt.setup(&p)
+				if _, err := dialEcho(NewDialContext(p), target.Addr().String()); err != nil {
+					t.Fatalf("dial %d: %s", i, err)
+				}
+				if got := tt.proxy.authorizations(); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("dial %d: requests authorized with %q, want %q", i, got, tt.want)
+				}
+			}
+		})
+	}
+
+	t.Run("Digest", func(t *testing.T) {
+		// Basic is sent until the proxy issues a nonce, then the next nonce count
+		for i, want := range [][]string{{"Basic", "Digest"}, {"Digest"}, {"Digest"}} {
+			p := digest.proxy(t, "user", "secret")
+			p.AuthEveryRequest = true
+			if _, err := dialEcho(NewDialContext(p), target.Addr().String()); err != nil {
+				t.Fatalf("dial %d: %s", i, err)
+			}
+			if got := digest.authorizations(); !reflect.DeepEqual(got, want) {
+				t.Errorf("dial %d: requests authorized with %q, want %q", i, got, want)
+			}
+		}
+	})
+}
+
+func TestDialH2HalfClose(t *testing.T) {
+	// the target answers once it read the whole request
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		c, err := target.Accept()
+		if err != nil {
+			return
+		}
+		b, _ := io.ReadAll(c)
+		fmt.Fprintf(c, "read %d bytes", len(b))
+		c.Close()
+	}()
+	s := newH2TestProxy(t, func(*http.Request) []string { return nil })
+	defer s.Close()
+
+	conn, err := NewDialContext(s.proxy(t, "", ""))(context.Background(), "tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(*Conn).CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %s", err)
+	}
+	if b, err := io.ReadAll(conn); string(b) != "read 5 bytes" || err != nil {
+		t.Errorf("read %q, %v after the half-close, want \"read 5 bytes\"", b, err)
+	}
+}
@@ -0,0 +1,97 @@
+package proxyplease
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// handshakeGuard binds the connections opened during a handshake to its context, so
+// cancellation and deadlines abort blocked reads and writes of the CONNECT exchange and
+// authentication, which do not take a context themselves.
+type handshakeGuard struct {
+	ctx         context.Context
+	authTimeout time.Duration
+
+	mu       sync.Mutex
+	deadline time.Time // end of the authentication phase, set on the first connection
+	conns    []guardedConn
+}
+
+type guardedConn struct {
+	conn net.Conn
+	stop chan struct{}
+	done chan struct{}
+}
+
+// aLongTimeAgo is a deadline in the past, making blocked I/O return immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// handshakeContext returns the context of a handshake through p, limited by
+// p.HandshakeTimeout.
+func handshakeContext(ctx context.Context, p Proxy) (context.Context, context.CancelFunc) {
+	if p.HandshakeTimeout > 0 {
+		return context.WithTimeout(ctx, p.HandshakeTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// dial wraps baseDial so each connection it returns is bound to the handshake, and the
+// dial itself is limited by p.DialTimeout.
+func (g *handshakeGuard) dial(baseDial func() (net.Conn, error)) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		if err := g.ctx.Err(); err != nil {
+			return nil, err
+		}
+		conn, err := baseDial()
+		if err != nil {
+			if g.ctx.Err() != nil {
+				err = g.ctx.Err()
+			}
+			return conn, err
+		}
+		g.watch(conn)
+		return conn, nil
+	}
+}
+
+// watch applies the handshake deadline to conn and aborts its I/O when the handshake
+// context is done.
+func (g *handshakeGuard) watch(conn net.Conn) {
+	g.mu.Lock()
+	if g.deadline.IsZero() && g.authTimeout > 0 {
+		g.deadline = time.Now().Add(g.authTimeout)
+	}
+	deadline := g.deadline
+	if d, ok := g.ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	gc := guardedConn{conn: conn, stop: make(chan struct{}), done: make(chan struct{})}
+	g.conns = append(g.conns, gc)
+	g.mu.Unlock()
+
+	conn.SetDeadline(deadline)
+	go func() {
+		defer close(gc.done)
+		select {
+		case <-g.ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-gc.stop:
+		}
+	}()
+}
+
+// release ends the handshake: connections stop being watched and their deadlines are
+// cleared, so the established tunnel is not affected by the handshake limits.
+func (g *handshakeGuard) release() {
+	g.mu.Lock()
+	conns := g.conns
+	g.conns = nil
+	g.mu.Unlock()
+	for _, gc := range conns {
+		close(gc.stop)
+		<-gc.done
+		gc.conn.SetDeadline(time.Time{})
+	}
+}
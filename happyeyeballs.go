@@ -0,0 +1,130 @@
+package proxyplease
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// defaultFallbackDelay is the delay between connection attempts to the addresses of a
+// proxy, the Connection Attempt Delay recommended by RFC 8305.
+const defaultFallbackDelay = 250 * time.Millisecond
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialHappyEyeballs connects to addr with d, racing the addresses of its host as in RFC
+// 8305: the addresses alternate between families, IPv6 first unless p.PreferIPv4 is set,
+// and each attempt starts p.FallbackDelay after the previous one, or as soon as it fails.
+// The first connection established is returned and the other attempts are abandoned.
+func (p Proxy) dialHappyEyeballs(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.DialContext(ctx, network, addr)
+	}
+	ips, err := p.resolver().LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := sortAddresses(ips, network, p.PreferIPv4)
+	switch len(addrs) {
+	case 0:
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	case 1:
+		return d.DialContext(ctx, network, net.JoinHostPort(addrs[0], port))
+	}
+	p.debugf("proxy> Racing connections to the %d addresses of %s", len(addrs), host)
+
+	delay := p.FallbackDelay
+	if delay == 0 {
+		delay = defaultFallbackDelay
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(addrs))
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	next, pending := 0, 0
+	launch := func() {
+		a := net.JoinHostPort(addrs[next], port)
+		next++
+		pending++
+		go func() {
+			conn, err := d.DialContext(ctx, network, a)
+			results <- dialResult{conn, err}
+		}()
+		if timer != nil {
+			timer.Stop()
+		}
+		timer, timeout = nil, nil
+		if next < len(addrs) && delay > 0 {
+			timer = time.NewTimer(delay)
+			timeout = timer.C
+		}
+	}
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	launch()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go func(n int) {
+					// close the connections of the attempts that lost the race
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				launch()
+			}
+		case <-timeout:
+			launch()
+		}
+	}
+	return nil, firstErr
+}
+
+// sortAddresses returns the addresses of ips usable with network, alternating between
+// IPv6 and IPv4 and starting with IPv4 if preferIPv4 is set, and with IPv6 otherwise.
+func sortAddresses(ips []net.IPAddr, network string, preferIPv4 bool) []string {
+	var v4, v6 []string
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			if network != "tcp6" {
+				v4 = append(v4, ip.String())
+			}
+		} else if network != "tcp4" {
+			v6 = append(v6, ip.String())
+		}
+	}
+	first, second := v6, v4
+	if preferIPv4 {
+		first, second = v4, v6
+	}
+	addrs := make([]string, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			addrs = append(addrs, first[i])
+		}
+		if i < len(second) {
+			addrs = append(addrs, second[i])
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,37 @@
+package proxyplease
+
+import "net/http"
+
+// HeaderFunc returns headers to send to the proxy with the requests of a handshake for
+// addr, the dialed address.
+type HeaderFunc func(addr string) http.Header
+
+// connectHeader returns the headers of a request to the proxy for addr: a copy of
+// p.Headers, the headers p.HeaderFunc returns, replacing those of the same names, and
+// p.UserAgent. Requests are never built on p.Headers itself, which Proxy values copied
+// across concurrent dials share.
+func (p Proxy) connectHeader(addr string) http.Header {
+	h := make(http.Header, 4)
+	if p.Headers != nil && len(*p.Headers) > 0 {
+		h = p.Headers.Clone()
+	}
+	if p.HeaderFunc != nil {
+		for k, v := range p.HeaderFunc(addr) {
+			h[http.CanonicalHeaderKey(k)] = append([]string(nil), v...)
+		}
+	}
+	if p.UserAgent != "" {
+		h.Set("User-Agent", p.UserAgent)
+	}
+	return h
+}
+
+// snapshotHeaders returns a private copy of h, so a dialer is not affected by, and does
+// not race with, later changes the caller makes to the headers of its Proxy.
+func snapshotHeaders(h *http.Header) *http.Header {
+	c := http.Header{}
+	if h != nil {
+		c = h.Clone()
+	}
+	return &c
+}
@@ -0,0 +1,68 @@
+package proxyplease
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// TestConnectHeaderConcurrentDials checks, when run with -race, that concurrent dials
+// sharing a Proxy and its Headers do not race, even as the caller changes them.
+func TestConnectHeaderConcurrentDials(t *testing.T) {
+	target := newEchoServer(t)
+	defer target.Close()
+	s := newTestServer("user", "secret", "Basic", "Digest", "NTLM")
+	defer s.Close()
+
+	h := http.Header{"X-Tenant": {"a"}}
+	p := testProxy(t, s, "user", "secret")
+	p.Headers = &h
+	p.UserAgent = "proxyplease-test"
+	p.HeaderFunc = func(addr string) http.Header {
+		return http.Header{"X-Target": {addr}}
+	}
+	dial := NewDialContext(p)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := dialEcho(dial, target.Addr().String())
+			errs <- err
+		}()
+	}
+	done := make(chan struct{})
+	changed := make(chan struct{})
+	go func() {
+		defer close(changed)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				h.Set("X-Tenant", "b")
+				h.Set("X-Trace", "1")
+			}
+		}
+	}()
+	wg.Wait()
+	close(done)
+	<-changed
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	c := p.connectHeader("example.com:443")
+	c.Set("X-Tenant", "c")
+	if got := h.Get("X-Tenant"); got != "b" {
+		t.Errorf("building a request changed Proxy.Headers: X-Tenant is %q", got)
+	}
+	if got := c.Get("X-Target"); got != "example.com:443" {
+		t.Errorf("X-Target = %q, want the dialed address", got)
+	}
+}
@@ -0,0 +1,208 @@
+package proxyplease
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// defaultMaxResponseBytes is the default limit on the header and on the body of proxy
+// responses read during a handshake.
+const defaultMaxResponseBytes = 1 << 20
+
+// ResponseLimitError is returned when a proxy response read during a handshake exceeds
+// Proxy.MaxResponseHeaderBytes or Proxy.MaxResponseBodyBytes.
+type ResponseLimitError struct {
+	Part  string // "header" or "body"
+	Limit int64
+}
+
+func (e *ResponseLimitError) Error() string {
+	return fmt.Sprintf("proxy response %s exceeds %d bytes", e.Part, e.Limit)
+}
+
+// responseReader reads the proxy responses of a handshake from a connection, enforcing
+// the limits of p. The embedded bufio.Reader holds tunnel data read past the last response.
+type responseReader struct {
+	*bufio.Reader
+	lr     *limitReader
+	conn   net.Conn
+	header int64
+	body   int64
+	p      Proxy // validates responses if p.checkResponses()
+}
+
+func newResponseReader(p Proxy, conn net.Conn) *responseReader {
+	r := &responseReader{
+		lr:     &limitReader{r: conn},
+		conn:   conn,
+		header: p.MaxResponseHeaderBytes,
+		body:   p.MaxResponseBodyBytes,
+		p:      p,
+	}
+	if r.header <= 0 {
+		r.header = defaultMaxResponseBytes
+	}
+	if r.body <= 0 {
+		r.body = defaultMaxResponseBytes
+	}
+	r.Reader = newPooledReader(r.lr)
+	return r
+}
+
+// readerPool holds the bufio.Readers of handshakes that established a tunnel, which
+// newConn returns once it copied the tunnel data they read ahead.
+var readerPool sync.Pool
+
+// newPooledReader returns a bufio.Reader reading from r, from readerPool if possible.
+func newPooledReader(r io.Reader) *bufio.Reader {
+	if br, ok := readerPool.Get().(*bufio.Reader); ok {
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReader(r)
+}
+
+// releaseReader returns br to readerPool. br must not be used afterwards.
+func releaseReader(br *bufio.Reader) {
+	br.Reset(nil)
+	readerPool.Put(br)
+}
+
+// read reads the response to req. Reading its body fails once the body limit is exceeded.
+func (r *responseReader) read(req *http.Request) (*http.Response, error) {
+	_, span := r.p.startSpan(spanRoundTrip)
+	resp, err := r.readResponse(req)
+	if resp != nil {
+		span.SetAttribute("http.status_code", resp.StatusCode)
+	}
+	span.End(err)
+	return resp, err
+}
+
+// readResponse implements read.
+func (r *responseReader) readResponse(req *http.Request) (*http.Response, error) {
+	if r.lr.err != nil {
+		// the rest of an oversized body is still on the connection
+		return nil, r.lr.err
+	}
+	r.lr.limit(&ResponseLimitError{Part: "header", Limit: r.header})
+	var raw *bytes.Buffer
+	if r.p.checkResponses() || r.p.Capture != nil {
+		// the response starts with the bytes already buffered
+		buffered, _ := r.Peek(r.Buffered())
+		raw = bytes.NewBuffer(append([]byte(nil), buffered...))
+		r.lr.rec = raw
+	}
+	resp, err := http.ReadResponse(r.Reader, req)
+	if raw != nil {
+		r.lr.rec = nil
+		r.p.capture(r.conn, false, raw.Bytes())
+	}
+	if raw != nil && r.p.checkResponses() {
+		if verr := r.p.reportViolations(validateResponse(req, raw.Bytes(), resp)); verr != nil && err == nil {
+			resp.Body.Close()
+			return nil, verr
+		}
+	}
+	if err != nil {
+		if r.lr.readErr != nil {
+			// the response was cut short, ex: by the handshake deadline, and what was
+			// read of it may look malformed
+			err = r.lr.readErr
+		}
+		return nil, err
+	}
+	r.lr.limit(&ResponseLimitError{Part: "body", Limit: r.body})
+	if resp.StatusCode/100 != 2 {
+		// kept for the StatusError, ex: the block page of a filtering proxy
+		resp.Body = &recordedBody{ReadCloser: resp.Body, buffered: r.Buffered}
+	}
+	return resp, nil
+}
+
+// recordedBody records the first statusErrorBodyBytes read from a response body, including
+// when it is drained by Close.
+type recordedBody struct {
+	io.ReadCloser
+	buffered func() int // bytes received and not read yet
+	buf      bytes.Buffer
+	closed   bool
+}
+
+func (b *recordedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if room := statusErrorBodyBytes - b.buf.Len(); room > 0 {
+		if n < room {
+			room = n
+		}
+		b.buf.Write(p[:room])
+	}
+	return n, err
+}
+
+// Close drains the body, as http.Response bodies do, so it is recorded.
+func (b *recordedBody) Close() error {
+	if !b.closed {
+		b.closed = true
+		io.Copy(ioutil.Discard, b)
+	}
+	return b.ReadCloser.Close()
+}
+
+// head returns the start of the body. A body that was not read yet is read up to
+// statusErrorBodyBytes, but only as far as it was already received, so proxies announcing
+// more body than they send do not block the handshake.
+func (b *recordedBody) head() []byte {
+	if n := statusErrorBodyBytes - b.buf.Len(); !b.closed && n > 0 {
+		if avail := b.buffered(); avail < n {
+			n = avail
+		}
+		io.CopyN(ioutil.Discard, b, int64(n))
+	}
+	return b.buf.Bytes()
+}
+
+// limitReader reads from r until n bytes were read, then fails with err.
+type limitReader struct {
+	r    io.Reader
+	n    int64
+	next *ResponseLimitError
+	err  error
+	rec  *bytes.Buffer // records the bytes read, if set
+
+	readErr error // last error of r other than io.EOF
+}
+
+// limit allows e.Limit more bytes to be read before failing with e.
+func (l *limitReader) limit(e *ResponseLimitError) {
+	l.n = e.Limit
+	l.next = e
+}
+
+func (l *limitReader) Read(b []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	if l.n <= 0 {
+		l.err = l.next
+		return 0, l.err
+	}
+	if int64(len(b)) > l.n {
+		b = b[:l.n]
+	}
+	n, err := l.r.Read(b)
+	if err != nil && err != io.EOF {
+		l.readErr = err
+	}
+	l.n -= int64(n)
+	if l.rec != nil {
+		l.rec.Write(b[:n])
+	}
+	return n, err
+}
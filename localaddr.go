@@ -0,0 +1,39 @@
+package proxyplease
+
+import (
+	"fmt"
+	"net"
+)
+
+// localIPs returns the source addresses configured by p.LocalAddr or p.Interface, the
+// one connections are made from first, or nil if neither is set.
+func (p Proxy) localIPs() ([]net.IP, error) {
+	if p.LocalAddr != nil {
+		return []net.IP{p.LocalAddr}, nil
+	}
+	if p.Interface == "" {
+		return nil, nil
+	}
+	iface, err := net.InterfaceByName(p.Interface)
+	if err != nil {
+		return nil, err
+	}
+	ips := interfaceAddrs(*iface)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("interface %s has no usable address", p.Interface)
+	}
+	return ips, nil
+}
+
+// localNetwork returns network restricted to the address family of local, so addresses
+// unreachable from it are not attempted.
+func localNetwork(network string, local net.Addr) string {
+	a, ok := local.(*net.TCPAddr)
+	if !ok || network != "tcp" {
+		return network
+	}
+	if a.IP.To4() != nil {
+		return "tcp4"
+	}
+	return "tcp6"
+}
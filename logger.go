@@ -0,0 +1,56 @@
+package proxyplease
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// LogRecord is a structured debug record.
+type LogRecord struct {
+	Time    time.Time
+	Phase   string        // Handshake phase or component emitting the record, ex: "connect", "ntlm" or "socks".
+	Scheme  string        // Authentication scheme in progress, ex: "NTLM", if any.
+	Proxy   string        // Host and port of the proxy, if any.
+	Latency time.Duration // Time elapsed since the dial started, or zero outside of dials.
+	Message string
+}
+
+// Logger receives the debug output of dials as structured records, so applications can
+// route it into their logging pipeline.
+type Logger interface {
+	Log(r LogRecord)
+}
+
+// LoggerFunc adapts a function to a Logger.
+type LoggerFunc func(r LogRecord)
+
+// Log calls f.
+func (f LoggerFunc) Log(r LogRecord) {
+	f(r)
+}
+
+// phaseSchemes are the authentication schemes negotiated during handshake phases.
+var phaseSchemes = map[string]string{
+	"basic":     "Basic",
+	"bearer":    "Bearer",
+	"digest":    "Digest",
+	"negotiate": "Negotiate",
+	"ntlm":      "NTLM",
+}
+
+// logRecord returns the record of a debug message of p, formatted as "phase> message".
+func (p Proxy) logRecord(format string, a ...interface{}) LogRecord {
+	r := LogRecord{Time: time.Now(), Message: fmt.Sprintf(format, a...)}
+	if i := strings.Index(r.Message, "> "); i > 0 && !strings.ContainsAny(r.Message[:i], " \n") {
+		r.Phase, r.Message = r.Message[:i], r.Message[i+2:]
+		r.Scheme = phaseSchemes[r.Phase]
+	}
+	if p.URL != nil {
+		r.Proxy = p.URL.Host
+	}
+	if !p.started.IsZero() {
+		r.Latency = r.Time.Sub(p.started)
+	}
+	return r
+}
@@ -0,0 +1,34 @@
+//go:build go1.21
+// +build go1.21
+
+package proxyplease
+
+import (
+	"context"
+	"log/slog"
+)
+
+// SlogLogger returns a Logger sending records to h at the debug level, with the phase,
+// scheme, proxy and latency as attributes.
+func SlogLogger(h slog.Handler) Logger {
+	return LoggerFunc(func(r LogRecord) {
+		ctx := context.Background()
+		if !h.Enabled(ctx, slog.LevelDebug) {
+			return
+		}
+		rec := slog.NewRecord(r.Time, slog.LevelDebug, r.Message, 0)
+		if r.Phase != "" {
+			rec.AddAttrs(slog.String("phase", r.Phase))
+		}
+		if r.Scheme != "" {
+			rec.AddAttrs(slog.String("scheme", r.Scheme))
+		}
+		if r.Proxy != "" {
+			rec.AddAttrs(slog.String("proxy", r.Proxy))
+		}
+		if r.Latency != 0 {
+			rec.AddAttrs(slog.Duration("latency", r.Latency))
+		}
+		h.Handle(ctx, rec)
+	})
+}
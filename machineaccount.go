@@ -0,0 +1,48 @@
+package proxyplease
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// ErrNoMachineAccount is returned by dials with Proxy.MachineAccount set when the process
+// has no machine credentials to authenticate with: it does not run on Windows as
+// LocalSystem, NetworkService, a virtual service account or a group managed service
+// account (gMSA). LocalService has no network credentials either.
+var ErrNoMachineAccount = errors.New("the process does not run as a machine or service account")
+
+// withMachineAccount returns p without the configured and supplied credentials if
+// p.MachineAccount is set, so NTLM and Negotiate acquire those of the account the process
+// runs as from SSPI.
+func (p Proxy) withMachineAccount() Proxy {
+	if !p.MachineAccount {
+		return p
+	}
+	p.Username, p.Password, p.Domain, p.NTHash = "", "", "", ""
+	p.CredentialsFunc, p.CredentialProvider, p.Prompt = nil, nil, nil
+	if p.URL != nil {
+		u := *p.URL
+		u.User = nil
+		p.URL = &u
+	}
+	return p
+}
+
+// checkMachineAccount returns ErrNoMachineAccount if authenticating with scheme cannot
+// use machine credentials. The AutoLogon policy does not apply to them: setting
+// Proxy.MachineAccount sends them to the proxy.
+func (p Proxy) checkMachineAccount(scheme string) error {
+	prefix := strings.ToLower(scheme)
+	account, err := machineAccount()
+	if err != nil {
+		p.debugf("%s> Cannot authenticate as the machine account: %s", prefix, err)
+		return ErrNoMachineAccount
+	}
+	p.debugf("%s> Authenticating as the machine account %s", prefix, account)
+	if scheme == "Negotiate" && p.SPN == "" && net.ParseIP(p.URL.Hostname()) != nil {
+		// computer accounts get Kerberos tickets for names only
+		p.debugf("negotiate> %s is an IP address, so SSPI can only use NTLM. Set Proxy.SPN to the principal of the proxy to use Kerberos.", p.URL.Hostname())
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package proxyplease
+
+import "errors"
+
+// machineAccount fails, as only SSPI on Windows authenticates with machine credentials.
+func machineAccount() (string, error) {
+	return "", errors.New("machine credentials are only available on Windows")
+}
@@ -0,0 +1,55 @@
+//go:build windows
+// +build windows
+
+package proxyplease
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+// machineAccount returns the name of the account SSPI authenticates the process as on the
+// network: the computer account for LocalSystem, NetworkService and virtual accounts, or
+// the gMSA the process runs as.
+func machineAccount() (string, error) {
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return "", err
+	}
+	sid := user.User.Sid
+	if sid.IsWellKnown(windows.WinLocalSystemSid) || sid.IsWellKnown(windows.WinNetworkServiceSid) {
+		return computerAccount()
+	}
+	if sid.IsWellKnown(windows.WinLocalServiceSid) {
+		return "", errors.New("LocalService has no network credentials")
+	}
+	account, domain, _, err := sid.LookupAccount("")
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case strings.HasSuffix(account, "$"):
+		// group managed service account
+		return domain + `\` + account, nil
+	case strings.EqualFold(domain, "NT SERVICE"), strings.EqualFold(domain, "IIS APPPOOL"):
+		// virtual accounts use the computer account on the network
+		return computerAccount()
+	}
+	return "", errors.New(domain + `\` + account + " is a user account")
+}
+
+// computerAccount returns the name of the computer account, ex: "CORP\HOST$".
+func computerAccount() (string, error) {
+	name, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	name = strings.ToUpper(strings.SplitN(name, ".", 2)[0]) + "$"
+	if domain := os.Getenv("USERDOMAIN"); domain != "" {
+		return domain + `\` + name, nil
+	}
+	return name, nil
+}
@@ -0,0 +1,77 @@
+package proxyplease
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/smtp"
+)
+
+// DialMail establishes a tunnel to a mail server (SMTP, IMAP or POP3) at addr and returns
+// a connection suitable for net/smtp or IMAP client libraries. If tlsConfig is not nil,
+// TLS is negotiated immediately, as required by the implicit TLS ports (465, 993, 995).
+// Otherwise the plaintext connection is returned and may later be upgraded with STARTTLS.
+// Plaintext connections support CloseWrite for a clean half-close.
+func DialMail(ctx context.Context, p Proxy, addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	conn, err := NewDialContext(p)(ctx, "tcp", addr)
+	if err != nil {
+		p.debugf("mail> Could not establish tunnel to %s: %s", addr, err)
+		return conn, err
+	}
+	if tlsConfig == nil {
+		return conn, nil
+	}
+
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tc := tls.Client(conn, tlsConfig)
+	if err := tc.Handshake(); err != nil {
+		p.debugf("mail> TLS handshake with %s failed: %s", addr, err)
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// DialSMTP returns an smtp.Client connected to addr through the proxy. Port 465 uses
+// implicit TLS. On other ports, STARTTLS is issued when the server offers it and
+// tlsConfig is not nil.
+func DialSMTP(ctx context.Context, p Proxy, addr string, tlsConfig *tls.Config) (*smtp.Client, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil && tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+
+	implicit := tlsConfig
+	if port != "465" {
+		implicit = nil
+	} else if implicit == nil {
+		implicit = &tls.Config{ServerName: host}
+	}
+	conn, err := DialMail(ctx, p, addr, implicit)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if implicit == nil && tlsConfig != nil {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				p.debugf("mail> STARTTLS with %s failed: %s", addr, err)
+				c.Close()
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,23 @@
+// +build linux
+
+package proxyplease
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// markControl sets SO_MARK on sockets, which requires CAP_NET_ADMIN.
+func markControl(mark int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
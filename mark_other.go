@@ -0,0 +1,13 @@
+// +build !linux
+
+package proxyplease
+
+import "syscall"
+
+// markControl leaves sockets untouched: SO_MARK only exists on Linux.
+func markControl(mark int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		debugf("flow> Ignoring Mark %d: socket marks are only supported on Linux", mark)
+		return nil
+	}
+}
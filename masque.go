@@ -0,0 +1,428 @@
+package proxyplease
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// capsuleDatagram is the type of DATAGRAM capsules (RFC 9297).
+	capsuleDatagram = 0x00
+	// maxCapsule caps the length of the capsules read from a UDP tunnel.
+	maxCapsule = 1 << 16
+	// udpReadQueue is how many received datagrams a UDP tunnel keeps until they are read.
+	// Further datagrams are dropped, as by a full socket buffer.
+	udpReadQueue = 256
+)
+
+// errUDPClosed is returned by operations on a closed UDP tunnel.
+var errUDPClosed = errors.New("use of closed UDP tunnel")
+
+// UDPConn is a UDP association with a single target, returned by DialUDPContext. It is a
+// net.PacketConn, as QUIC stacks expect, and a net.Conn.
+type UDPConn interface {
+	net.PacketConn
+	Read(b []byte) (int, error)
+	Write(b []byte) (int, error)
+	RemoteAddr() net.Addr
+}
+
+// DialUDPContext associates with the UDP target addr, ex: for QUIC or WebRTC. Targets UDP
+// reaches directly, see UDPTunneling, are dialed directly. Otherwise, datagrams are
+// tunneled through the HTTP proxy selected for addr with CONNECT-UDP (RFC 9298) over
+// HTTP/1.1, at the default /.well-known/masque/udp/ path. Only Basic, Bearer and Digest
+// authentication are supported. Datagrams written with WriteTo go to addr whatever the
+// address passed. This is experimental: few proxies implement CONNECT-UDP.
+func DialUDPContext(ctx context.Context, p Proxy, addr string) (UDPConn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if rule := matchRoute(p.Routes, addr); rule != nil && rule.Action == RouteBlock {
+		p.debugf("udp> Routing rule %s blocks %s", rule.Match, addr)
+		return nil, ErrRouteBlocked
+	}
+	p.Headers = snapshotHeaders(p.Headers)
+	// QUIC targets are HTTPS origins
+	p.TargetURL = &url.URL{Scheme: "https", Host: addr}
+	d := Decide(p)
+	if d.URL == nil {
+		p.debugf("udp> Associating with %s directly", addr)
+		p.URL = nil
+		conn, err := p.dialTagged(ctx, "udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if c, ok := conn.(*net.UDPConn); ok {
+			return directUDP{c}, nil
+		}
+		// a custom DialContext may return another connection type
+		return connUDP{conn}, nil
+	}
+
+	p = withProxyURL(p, d.URL)
+	p.source = d.Source
+	if p.URL.Scheme != "http" && p.URL.Scheme != "https" {
+		return nil, fmt.Errorf("cannot tunnel UDP through a '%s' proxy", p.URL.Scheme)
+	}
+	ctx, cancel := handshakeContext(ctx, p)
+	defer cancel()
+	if p.resolvesLocally() {
+		resolved, err := resolveTarget(ctx, p, addr, 0)
+		if err != nil {
+			p.debugf("udp> Could not resolve %s: %s", addr, err)
+			return nil, err
+		}
+		host, _, _ = net.SplitHostPort(resolved)
+	}
+	conn, err := connectUDP(ctx, p, host, port, "")
+	var se *StatusError
+	if errors.As(err, &se) && se.StatusCode == http.StatusProxyAuthRequired {
+		conn, _, err = authenticatePerRequest(ctx, p, addr, se, func(p Proxy, scheme string) (net.Conn, error) {
+			return connectUDP(ctx, p, host, port, scheme)
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newUDPTunnel(conn, addr), nil
+}
+
+// connectUDP requests a UDP tunnel to host and port from the proxy at p.URL, with
+// credentials for scheme if set, and returns the connection carrying its capsules.
+func connectUDP(ctx context.Context, p Proxy, host, port, scheme string) (net.Conn, error) {
+	// the upgrade is an HTTP/1.1 mechanism, so h2 is not offered to https:// proxies
+	p.HTTP2 = false
+	conn, err := p.baseDial(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		p.debugf("udp> Could not call dial context with proxy: %s", err)
+		return conn, err
+	}
+	g := &handshakeGuard{ctx: ctx}
+	g.watch(conn)
+	defer g.release()
+
+	// the target is a path on the proxy, ':' in IPv6 addresses included being escaped
+	path := "/.well-known/masque/udp/" + strings.Replace(url.PathEscape(host), ":", "%3A", -1) + "/" + port + "/"
+	h := p.connectHeader(net.JoinHostPort(host, port))
+	if err := setProxyAuthorization(p, h, scheme, "GET", path); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", "connect-udp")
+	h.Set("Capsule-Protocol", "?1")
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Opaque: path},
+		Host:   p.URL.Host,
+		Header: h,
+	}
+	if err := req.Write(conn); err != nil {
+		p.debugf("udp> CONNECT-UDP to proxy failed: %s", err)
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		p.debugf("udp> Could not read response from proxy: %s", err)
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || !headerHasToken(resp.Header, "Upgrade", "connect-udp") {
+		err := newStatusError(resp)
+		resp.Body.Close()
+		conn.Close()
+		p.debugf("udp> Expected 101 as return status, got: %d", resp.StatusCode)
+		return nil, err
+	}
+	p.debugf("udp> UDP tunnel to %s established", net.JoinHostPort(host, port))
+	return newConn(conn, p, resp, br, scheme), nil
+}
+
+// directUDP is a UDP association with a target reached directly.
+type directUDP struct {
+	*net.UDPConn
+}
+
+// WriteTo writes b to the target, whatever addr is.
+func (c directUDP) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+// connUDP is a UDP association with a target reached directly through a connection other
+// than a *net.UDPConn.
+type connUDP struct {
+	net.Conn
+}
+
+// ReadFrom reads a datagram from the target.
+func (c connUDP) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.RemoteAddr(), err
+}
+
+// WriteTo writes b to the target, whatever addr is.
+func (c connUDP) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+// udpAddr is the address of a UDP target reached through a proxy, unresolved.
+type udpAddr string
+
+func (a udpAddr) Network() string { return "udp" }
+func (a udpAddr) String() string  { return string(a) }
+
+// udpTunnel is a UDP association carried as DATAGRAM capsules by a CONNECT-UDP tunnel.
+type udpTunnel struct {
+	conn   net.Conn
+	target udpAddr
+
+	wmu sync.Mutex // serializes capsule writes
+
+	mu         sync.Mutex
+	queue      [][]byte
+	err        error // why receiving stopped
+	closed     bool
+	readDeadln time.Time
+	readCh     chan struct{}
+}
+
+// newUDPTunnel returns the UDP association with target carried by conn, and starts
+// receiving its datagrams.
+func newUDPTunnel(conn net.Conn, target string) *udpTunnel {
+	t := &udpTunnel{conn: conn, target: udpAddr(target), readCh: make(chan struct{}, 1)}
+	go t.receive()
+	return t
+}
+
+// receive queues the datagrams of the capsules read from the tunnel until it fails.
+func (t *udpTunnel) receive() {
+	br := bufio.NewReader(t.conn)
+	for {
+		typ, payload, err := readCapsule(br)
+		if err != nil {
+			t.mu.Lock()
+			t.err = err
+			t.mu.Unlock()
+			notify(t.readCh)
+			return
+		}
+		if typ != capsuleDatagram {
+			// unknown capsules are ignored (RFC 9297, section 3.2)
+			continue
+		}
+		id, n := readVarint(payload)
+		if n == 0 || id != 0 {
+			// datagrams of unknown contexts are dropped (RFC 9298, section 4)
+			continue
+		}
+		t.mu.Lock()
+		if len(t.queue) < udpReadQueue {
+			t.queue = append(t.queue, payload[n:])
+		}
+		t.mu.Unlock()
+		notify(t.readCh)
+	}
+}
+
+// ReadFrom reads a datagram from the target. Datagrams longer than b are truncated.
+func (t *udpTunnel) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			return 0, nil, errUDPClosed
+		}
+		if len(t.queue) > 0 {
+			d := t.queue[0]
+			t.queue[0] = nil
+			t.queue = t.queue[1:]
+			t.mu.Unlock()
+			return copy(b, d), t.target, nil
+		}
+		if t.err != nil {
+			err := t.err
+			t.mu.Unlock()
+			return 0, nil, err
+		}
+		deadline := t.readDeadln
+		t.mu.Unlock()
+		if err := t.wait(deadline); err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+// wait blocks until a datagram is received, the tunnel fails or the deadline passes.
+func (t *udpTunnel) wait(deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return errMuxTimeout
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-t.readCh:
+		return nil
+	case <-timeout:
+		return errMuxTimeout
+	}
+}
+
+func (t *udpTunnel) Read(b []byte) (int, error) {
+	n, _, err := t.ReadFrom(b)
+	return n, err
+}
+
+// WriteTo writes b to the target, whatever addr is.
+func (t *udpTunnel) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return t.Write(b)
+}
+
+func (t *udpTunnel) Write(b []byte) (int, error) {
+	// the payload of a DATAGRAM capsule is the context ID, 0, and the UDP payload
+	capsule := appendVarint(nil, capsuleDatagram)
+	capsule = appendVarint(capsule, uint64(1+len(b)))
+	capsule = append(append(capsule, 0), b...)
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	if _, err := t.conn.Write(capsule); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the tunnel. Datagrams not yet read are discarded.
+func (t *udpTunnel) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	t.queue = nil
+	t.mu.Unlock()
+	notify(t.readCh)
+	return t.conn.Close()
+}
+
+// LocalAddr returns the local address of the connection to the proxy.
+func (t *udpTunnel) LocalAddr() net.Addr {
+	return t.conn.LocalAddr()
+}
+
+// RemoteAddr returns the target, as given to DialUDPContext.
+func (t *udpTunnel) RemoteAddr() net.Addr {
+	return t.target
+}
+
+func (t *udpTunnel) SetDeadline(d time.Time) error {
+	t.SetReadDeadline(d)
+	return t.SetWriteDeadline(d)
+}
+
+func (t *udpTunnel) SetReadDeadline(d time.Time) error {
+	t.mu.Lock()
+	t.readDeadln = d
+	t.mu.Unlock()
+	notify(t.readCh)
+	return nil
+}
+
+func (t *udpTunnel) SetWriteDeadline(d time.Time) error {
+	return t.conn.SetWriteDeadline(d)
+}
+
+// readCapsule reads a capsule (RFC 9297, section 3.2) from br, returning its type and
+// payload.
+func readCapsule(br *bufio.Reader) (uint64, []byte, error) {
+	typ, err := readVarintFrom(br)
+	if err != nil {
+		return 0, nil, err
+	}
+	length, err := readVarintFrom(br)
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	if length > maxCapsule {
+		return 0, nil, fmt.Errorf("capsule of %d bytes exceeds the limit of %d", length, maxCapsule)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	return typ, payload, nil
+}
+
+// unexpectedEOF returns io.ErrUnexpectedEOF for io.EOF, and err otherwise.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readVarintFrom reads a QUIC variable-length integer (RFC 9000, section 16) from br.
+func readVarintFrom(br *bufio.Reader) (uint64, error) {
+	first, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	v := uint64(first & 0x3f)
+	for i := 1; i < 1<<(first>>6); i++ {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// readVarint decodes the QUIC variable-length integer at the start of b, returning it and
+// its length, or a length of 0 if b is too short.
+func readVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0
+	}
+	v := uint64(b[0] & 0x3f)
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, n
+}
+
+// appendVarint appends v to b as a QUIC variable-length integer. v must be below 2^62.
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	}
+	return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
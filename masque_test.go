@@ -0,0 +1,86 @@
+package proxyplease
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// wrappedConn hides the type of the connection it wraps, as instrumenting dialers do.
+type wrappedConn struct {
+	net.Conn
+}
+
+func TestDialUDPDirectWrappedConn(t *testing.T) {
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		b := make([]byte, 64)
+		n, addr, err := target.ReadFrom(b)
+		if err == nil {
+			target.WriteTo(b[:n], addr)
+		}
+	}()
+
+	p := Proxy{
+		Bypass: []string{"127.0.0.1"},
+		BaseDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			return wrappedConn{c}, err
+		},
+		Debugf: t.Logf,
+	}
+	conn, err := DialUDPContext(context.Background(), p, target.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.WriteTo([]byte("ping"), nil); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 64)
+	n, addr, err := conn.ReadFrom(b)
+	if err != nil || string(b[:n]) != "ping" {
+		t.Fatalf("ReadFrom = %q, %v", b[:n], err)
+	}
+	if addr.String() != target.LocalAddr().String() {
+		t.Errorf("ReadFrom address %s, want %s", addr, target.LocalAddr())
+	}
+}
+
+func TestDialUDPOffersHTTP1Only(t *testing.T) {
+	protos := make(chan []string, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	srv.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		protos <- hello.SupportedProtos
+		return nil, nil
+	}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	p := Proxy{
+		URL:       u,
+		HTTP2:     true,
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		Debugf:    t.Logf,
+	}
+	if _, err := DialUDPContext(context.Background(), p, "192.0.2.1:443"); err == nil {
+		t.Fatal("dial succeeded through a proxy refusing CONNECT-UDP")
+	}
+	if got := <-protos; !reflect.DeepEqual(got, []string{"http/1.1"}) {
+		t.Errorf("offered %q to the proxy, want only http/1.1", got)
+	}
+}
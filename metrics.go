@@ -0,0 +1,116 @@
+package proxyplease
+
+import (
+	"expvar"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics receives measurements of dials through proxies, so operators of long-lived
+// agents can monitor proxy health. Implementations adapt them to a metrics system, ex:
+// Prometheus counters and histograms or OpenTelemetry instruments, and must be safe for
+// concurrent use. Proxies are identified by host and port.
+type Metrics interface {
+	// Handshake is called when a dial through proxy completes, with the authentication
+	// scheme the tunnel was established with, if any, its latency and error.
+	Handshake(proxy, scheme string, latency time.Duration, err error)
+	// AuthFailed is called for each authentication scheme that failed during a handshake.
+	AuthFailed(proxy, scheme string)
+	// Transferred is called when a tunnel is closed, with the bytes sent and received
+	// through it.
+	Transferred(proxy string, sent, received int64)
+}
+
+// handshakeBuckets are the upper bounds of the handshake latency histogram of
+// ExpvarMetrics, in seconds.
+var handshakeBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type expvarMetrics struct {
+	m *expvar.Map
+}
+
+// ExpvarMetrics returns Metrics published as the expvar map name, served by
+// /debug/vars. It holds the counters dials, dial_errors, auth_failures (by scheme),
+// bytes_sent and bytes_received, and a cumulative histogram of handshake latencies
+// (handshake_seconds_bucket by upper bound, handshake_seconds_sum). It panics if name is
+// already published.
+func ExpvarMetrics(name string) Metrics {
+	m := expvar.NewMap(name)
+	m.Set("auth_failures", new(expvar.Map).Init())
+	buckets := new(expvar.Map).Init()
+	for _, b := range handshakeBuckets {
+		buckets.Add(strconv.FormatFloat(b, 'f', -1, 64), 0)
+	}
+	buckets.Add("+Inf", 0)
+	m.Set("handshake_seconds_bucket", buckets)
+	m.Set("handshake_seconds_sum", new(expvar.Float))
+	return expvarMetrics{m: m}
+}
+
+func (e expvarMetrics) Handshake(proxy, scheme string, latency time.Duration, err error) {
+	e.m.Add("dials", 1)
+	if err != nil {
+		e.m.Add("dial_errors", 1)
+	}
+	s := latency.Seconds()
+	e.m.AddFloat("handshake_seconds_sum", s)
+	buckets := e.m.Get("handshake_seconds_bucket").(*expvar.Map)
+	for _, b := range handshakeBuckets {
+		if s <= b {
+			buckets.Add(strconv.FormatFloat(b, 'f', -1, 64), 1)
+		}
+	}
+	buckets.Add("+Inf", 1)
+}
+
+func (e expvarMetrics) AuthFailed(proxy, scheme string) {
+	e.m.Get("auth_failures").(*expvar.Map).Add(scheme, 1)
+}
+
+func (e expvarMetrics) Transferred(proxy string, sent, received int64) {
+	e.m.Add("bytes_sent", sent)
+	e.m.Add("bytes_received", received)
+}
+
+// measureHandshake reports a completed handshake through p to p.Metrics, and has conn
+// count the bytes transferred through it.
+func measureHandshake(p Proxy, conn net.Conn, started time.Time, err error) {
+	if p.Metrics == nil {
+		return
+	}
+	c, _ := conn.(*Conn)
+	scheme := ""
+	if c != nil && err == nil {
+		scheme = c.info.AuthScheme
+		c.metrics, c.metricsProxy = p.Metrics, p.URL.Host
+	}
+	p.Metrics.Handshake(p.URL.Host, scheme, time.Since(started), err)
+}
+
+// authAttempt records a failed attempt of scheme, reporting it to p.Metrics.
+func (p Proxy) authAttempt(scheme string, err error) AuthAttempt {
+	if p.Metrics != nil {
+		p.Metrics.AuthFailed(p.URL.Host, scheme)
+	}
+	return newAuthAttempt(scheme, err)
+}
+
+// count adds n transferred bytes to *counter if the tunnel is measured, and to the
+// TransferStats counting it.
+func (c *Conn) count(counter *int64, n int) {
+	if n <= 0 {
+		return
+	}
+	if c.metrics != nil {
+		atomic.AddInt64(counter, int64(n))
+	}
+	for _, t := range c.transfers {
+		if counter == &c.sent {
+			atomic.AddInt64(&t.sent, int64(n))
+		} else {
+			atomic.AddInt64(&t.received, int64(n))
+		}
+	}
+}
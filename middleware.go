@@ -0,0 +1,33 @@
+package proxyplease
+
+import (
+	"context"
+	"net"
+)
+
+// Handshake describes a handshake with the proxy, as seen by a Middleware.
+type Handshake struct {
+	Proxy Proxy  // Configuration of the handshake. Changes made before calling the next HandshakeFunc apply to it, ex: Headers or AuthSchemeFilter.
+	Addr  string // Address of the target of the tunnel, as sent in the CONNECT request.
+	// Dial connects to the proxy, including TLS for https:// proxies, for middleware that
+	// perform the handshake themselves, ex: with a bespoke authentication scheme. Such
+	// handshakes should stop when ctx is done.
+	Dial func(ctx context.Context) (net.Conn, error)
+}
+
+// HandshakeFunc establishes a tunnel through the proxy of h.
+type HandshakeFunc func(ctx context.Context, h Handshake) (net.Conn, error)
+
+// Middleware wraps the handshakes of the dials through a proxy, ex: to add headers,
+// record timing, implement another authentication scheme, or inspect and replace the
+// returned connection or error. It returns a HandshakeFunc calling next, or establishing
+// the tunnel itself.
+type Middleware func(next HandshakeFunc) HandshakeFunc
+
+// withMiddleware returns hs wrapped in the middleware of p, the first outermost.
+func withMiddleware(p Proxy, hs HandshakeFunc) HandshakeFunc {
+	for i := len(p.Middleware) - 1; i >= 0; i-- {
+		hs = p.Middleware[i](hs)
+	}
+	return hs
+}
@@ -0,0 +1,561 @@
+package proxyplease
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Framing of multiplexed sessions, compatible with yamux (github.com/hashicorp/yamux).
+const (
+	muxVersion    = 0
+	muxHeaderSize = 12
+
+	muxTypeData         = 0x0
+	muxTypeWindowUpdate = 0x1
+	muxTypePing         = 0x2
+	muxTypeGoAway       = 0x3
+
+	muxFlagSYN = 0x1
+	muxFlagACK = 0x2
+	muxFlagFIN = 0x4
+	muxFlagRST = 0x8
+
+	muxInitialWindow = 256 * 1024
+	muxMaxFrame      = 32 * 1024
+	muxAcceptBacklog = 256
+)
+
+var (
+	// ErrMuxClosed is returned by operations on a closed MuxSession or stream.
+	ErrMuxClosed = errors.New("multiplexed session closed")
+	// ErrMuxReset is returned by operations on a stream reset by the remote end.
+	ErrMuxReset = errors.New("multiplexed stream reset by peer")
+	// errMuxTimeout is returned when a stream deadline expires.
+	errMuxTimeout = &muxTimeoutError{}
+)
+
+type muxTimeoutError struct{}
+
+func (*muxTimeoutError) Error() string   { return "i/o timeout" }
+func (*muxTimeoutError) Timeout() bool   { return true }
+func (*muxTimeoutError) Temporary() bool { return true }
+
+// MuxSession multiplexes streams over a single connection, such as an authenticated
+// tunnel, so a cooperating endpoint can be reached many times with one proxy handshake.
+// The framing is that of yamux, so either end may use github.com/hashicorp/yamux instead.
+// A MuxSession is also a net.Listener accepting the streams opened by the remote end.
+type MuxSession struct {
+	conn net.Conn
+
+	wmu sync.Mutex // serializes frame writes
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+	err     error
+
+	accept chan *muxStream
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewMuxClient starts a session over conn as the end that dialed it.
+func NewMuxClient(conn net.Conn) *MuxSession {
+	return newMuxSession(conn, 1)
+}
+
+// NewMuxServer starts a session over conn as the end that accepted it, ex: on the
+// endpoint reached through the proxy.
+func NewMuxServer(conn net.Conn) *MuxSession {
+	return newMuxSession(conn, 2)
+}
+
+func newMuxSession(conn net.Conn, firstID uint32) *MuxSession {
+	s := &MuxSession{
+		conn:    conn,
+		streams: map[uint32]*muxStream{},
+		nextID:  firstID,
+		accept:  make(chan *muxStream, muxAcceptBacklog),
+		closed:  make(chan struct{}),
+	}
+	go s.recvLoop()
+	return s
+}
+
+// Open opens a new stream to the remote end.
+func (s *MuxSession) Open() (net.Conn, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	st := newMuxStream(s, s.nextID)
+	s.nextID += 2
+	s.streams[st.id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(muxTypeWindowUpdate, muxFlagSYN, st.id, 0, nil); err != nil {
+		s.removeStream(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the remote end to open a stream and returns it.
+func (s *MuxSession) Accept() (net.Conn, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.closed:
+		return nil, s.closeErr()
+	}
+}
+
+// Addr returns the local address of the underlying connection.
+func (s *MuxSession) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// NumStreams returns the number of open streams.
+func (s *MuxSession) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// IsClosed reports whether the session is closed, ex: because the tunnel failed.
+func (s *MuxSession) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close tells the remote end the session is over and closes it with all its streams.
+func (s *MuxSession) Close() error {
+	if !s.IsClosed() {
+		s.writeFrame(muxTypeGoAway, 0, 0, 0, nil)
+	}
+	s.shutdown(ErrMuxClosed)
+	return nil
+}
+
+// shutdown closes the session and its streams with err.
+func (s *MuxSession) shutdown(err error) {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+		close(s.closed)
+		s.conn.Close()
+	})
+}
+
+func (s *MuxSession) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *MuxSession) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// writeFrame writes a frame with payload, whose length is taken from length for frames
+// without payload.
+func (s *MuxSession) writeFrame(typ byte, flags uint16, id, length uint32, payload []byte) error {
+	b := make([]byte, muxHeaderSize, muxHeaderSize+len(payload))
+	b[0], b[1] = muxVersion, typ
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint32(b[4:], id)
+	if payload != nil {
+		length = uint32(len(payload))
+	}
+	binary.BigEndian.PutUint32(b[8:], length)
+	b = append(b, payload...)
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.IsClosed() {
+		return s.closeErr()
+	}
+	if _, err := s.conn.Write(b); err != nil {
+		s.shutdown(err)
+		return err
+	}
+	return nil
+}
+
+// recvLoop reads frames until the connection fails or the session is closed.
+func (s *MuxSession) recvLoop() {
+	var h [muxHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(s.conn, h[:]); err != nil {
+			s.shutdown(err)
+			return
+		}
+		if h[0] != muxVersion {
+			s.writeFrame(muxTypeGoAway, 0, 0, 1, nil)
+			s.shutdown(errors.New("unsupported multiplexing protocol version"))
+			return
+		}
+		typ, flags := h[1], binary.BigEndian.Uint16(h[2:])
+		id, length := binary.BigEndian.Uint32(h[4:]), binary.BigEndian.Uint32(h[8:])
+
+		switch typ {
+		case muxTypeData, muxTypeWindowUpdate:
+			if err := s.handleStreamFrame(typ, flags, id, length); err != nil {
+				s.writeFrame(muxTypeGoAway, 0, 0, 1, nil)
+				s.shutdown(err)
+				return
+			}
+		case muxTypePing:
+			if flags&muxFlagSYN != 0 {
+				go s.writeFrame(muxTypePing, muxFlagACK, 0, length, nil)
+			}
+		case muxTypeGoAway:
+			s.shutdown(ErrMuxClosed)
+			return
+		default:
+			s.shutdown(errors.New("unknown multiplexing frame type"))
+			return
+		}
+	}
+}
+
+// handleStreamFrame applies a data or window update frame to its stream.
+func (s *MuxSession) handleStreamFrame(typ byte, flags uint16, id, length uint32) error {
+	s.mu.Lock()
+	st := s.streams[id]
+	if st == nil && flags&muxFlagSYN != 0 {
+		st = newMuxStream(s, id)
+		s.streams[id] = st
+		select {
+		case s.accept <- st:
+		default:
+			// backlog full: refuse the stream
+			delete(s.streams, id)
+			s.mu.Unlock()
+			go s.writeFrame(muxTypeWindowUpdate, muxFlagRST, id, 0, nil)
+			return s.discard(typ, length)
+		}
+		go s.writeFrame(muxTypeWindowUpdate, muxFlagACK, id, 0, nil)
+	}
+	s.mu.Unlock()
+	if st == nil {
+		// the stream was closed locally
+		return s.discard(typ, length)
+	}
+
+	if typ == muxTypeData && length > 0 {
+		if err := st.receive(length); err != nil {
+			return err
+		}
+	} else if typ == muxTypeWindowUpdate {
+		st.grow(length)
+	}
+	if flags&muxFlagFIN != 0 {
+		st.remoteClose(nil)
+	}
+	if flags&muxFlagRST != 0 {
+		st.remoteClose(ErrMuxReset)
+		s.removeStream(id)
+	}
+	return nil
+}
+
+// discard skips the payload of a data frame for an unknown stream.
+func (s *MuxSession) discard(typ byte, length uint32) error {
+	if typ != muxTypeData {
+		return nil
+	}
+	_, err := io.CopyN(io.Discard, s.conn, int64(length))
+	return err
+}
+
+// muxStream is a stream of a MuxSession.
+type muxStream struct {
+	s  *MuxSession
+	id uint32
+
+	mu          sync.Mutex
+	buf         bytes.Buffer
+	recvWindow  uint32 // bytes the remote end may still send
+	consumed    uint32 // bytes read since the last window update
+	sendWindow  uint32 // bytes that may still be sent
+	remoteEOF   bool
+	remoteErr   error
+	closed      bool
+	readDeadln  time.Time
+	writeDeadln time.Time
+	readCh      chan struct{}
+	writeCh     chan struct{}
+}
+
+func newMuxStream(s *MuxSession, id uint32) *muxStream {
+	return &muxStream{
+		s:          s,
+		id:         id,
+		recvWindow: muxInitialWindow,
+		sendWindow: muxInitialWindow,
+		readCh:     make(chan struct{}, 1),
+		writeCh:    make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// receive reads a data payload of length bytes for the stream from the connection.
+func (st *muxStream) receive(length uint32) error {
+	st.mu.Lock()
+	if length > st.recvWindow {
+		st.mu.Unlock()
+		return errors.New("multiplexed stream exceeded its receive window")
+	}
+	st.recvWindow -= length
+	st.mu.Unlock()
+
+	b := make([]byte, length)
+	if _, err := io.ReadFull(st.s.conn, b); err != nil {
+		return err
+	}
+	st.mu.Lock()
+	if !st.closed {
+		st.buf.Write(b)
+	}
+	st.mu.Unlock()
+	notify(st.readCh)
+	return nil
+}
+
+// grow adds delta to the send window.
+func (st *muxStream) grow(delta uint32) {
+	st.mu.Lock()
+	st.sendWindow += delta
+	st.mu.Unlock()
+	notify(st.writeCh)
+}
+
+// remoteClose records that the remote end finished sending, or reset the stream if err
+// is set.
+func (st *muxStream) remoteClose(err error) {
+	st.mu.Lock()
+	st.remoteEOF = true
+	if err != nil {
+		st.remoteErr = err
+	}
+	st.mu.Unlock()
+	notify(st.readCh)
+	notify(st.writeCh)
+}
+
+// wait blocks until ch is notified, the deadline passes or the session closes.
+func (st *muxStream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return errMuxTimeout
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return errMuxTimeout
+	case <-st.s.closed:
+		return st.s.closeErr()
+	}
+}
+
+func (st *muxStream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.closed {
+			st.mu.Unlock()
+			return 0, ErrMuxClosed
+		}
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(b)
+			st.consumed += uint32(n)
+			var delta uint32
+			if st.consumed >= muxInitialWindow/2 {
+				delta, st.consumed = st.consumed, 0
+				st.recvWindow += delta
+			}
+			st.mu.Unlock()
+			if delta > 0 {
+				st.s.writeFrame(muxTypeWindowUpdate, 0, st.id, delta, nil)
+			}
+			return n, nil
+		}
+		if st.remoteErr != nil {
+			st.mu.Unlock()
+			return 0, st.remoteErr
+		}
+		if st.remoteEOF {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadln
+		st.mu.Unlock()
+		if err := st.wait(st.readCh, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *muxStream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		st.mu.Lock()
+		switch {
+		case st.closed:
+			st.mu.Unlock()
+			return written, ErrMuxClosed
+		case st.remoteErr != nil:
+			st.mu.Unlock()
+			return written, st.remoteErr
+		case st.sendWindow == 0:
+			deadline := st.writeDeadln
+			st.mu.Unlock()
+			if err := st.wait(st.writeCh, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := uint32(len(b) - written)
+		if n > st.sendWindow {
+			n = st.sendWindow
+		}
+		if n > muxMaxFrame {
+			n = muxMaxFrame
+		}
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		if err := st.s.writeFrame(muxTypeData, 0, st.id, 0, b[written:written+int(n)]); err != nil {
+			return written, err
+		}
+		written += int(n)
+	}
+	return written, nil
+}
+
+// Close finishes the stream. Data received afterwards is discarded.
+func (st *muxStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	reset := st.remoteErr != nil
+	st.buf.Reset()
+	st.mu.Unlock()
+	notify(st.readCh)
+	notify(st.writeCh)
+
+	st.s.removeStream(st.id)
+	if reset {
+		return nil
+	}
+	return st.s.writeFrame(muxTypeWindowUpdate, muxFlagFIN, st.id, 0, nil)
+}
+
+func (st *muxStream) LocalAddr() net.Addr {
+	return st.s.conn.LocalAddr()
+}
+
+func (st *muxStream) RemoteAddr() net.Addr {
+	return st.s.conn.RemoteAddr()
+}
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadln = t
+	st.mu.Unlock()
+	notify(st.readCh)
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadln = t
+	st.mu.Unlock()
+	notify(st.writeCh)
+	return nil
+}
+
+// MuxDialer opens streams multiplexed over a single tunnel to Endpoint through Proxy, so
+// many logical connections to a cooperating endpoint cost one proxy handshake. This
+// suits slow, connection-oriented authentication such as NTLM. The endpoint serves the
+// tunnel with NewMuxServer, or yamux. The tunnel is established on first use, and again
+// once it fails.
+type MuxDialer struct {
+	Proxy    Proxy
+	Endpoint string // Address of the cooperating endpoint, ex: "relay.example.com:443".
+
+	mu      sync.Mutex
+	session *MuxSession
+}
+
+// Open returns a new stream to the endpoint.
+func (d *MuxDialer) Open(ctx context.Context) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.session != nil && !d.session.IsClosed() {
+		if conn, err := d.session.Open(); err == nil {
+			return conn, nil
+		}
+	}
+
+	conn, err := NewDialContext(d.Proxy)(ctx, "tcp", d.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	d.Proxy.debugf("mux> Established multiplexed tunnel to %s", d.Endpoint)
+	d.session = NewMuxClient(conn)
+	return d.session.Open()
+}
+
+// DialContext returns a new stream to the endpoint, whatever addr is, so MuxDialer can
+// be used as http.Transport.DialContext when the endpoint routes the streams itself.
+func (d *MuxDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.Open(ctx)
+}
+
+// Close closes the tunnel and all its streams.
+func (d *MuxDialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.session == nil {
+		return nil
+	}
+	err := d.session.Close()
+	d.session = nil
+	return err
+}
@@ -0,0 +1,293 @@
+package proxyplease
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// muxFrame is a frame read by a test peer speaking the yamux framing directly.
+type muxFrame struct {
+	typ     byte
+	flags   uint16
+	id      uint32
+	length  uint32
+	payload []byte
+}
+
+// rawMuxPeer is the remote end of a session, reading and writing frames as yamux does.
+type rawMuxPeer struct {
+	t      *testing.T
+	conn   net.Conn
+	frames chan muxFrame
+}
+
+func newRawMuxPeer(t *testing.T, conn net.Conn) *rawMuxPeer {
+	p := &rawMuxPeer{t: t, conn: conn, frames: make(chan muxFrame, 64)}
+	go func() {
+		defer close(p.frames)
+		var h [muxHeaderSize]byte
+		for {
+			if _, err := io.ReadFull(conn, h[:]); err != nil {
+				return
+			}
+			f := muxFrame{typ: h[1], flags: binary.BigEndian.Uint16(h[2:]), id: binary.BigEndian.Uint32(h[4:]), length: binary.BigEndian.Uint32(h[8:])}
+			if f.typ == muxTypeData {
+				f.payload = make([]byte, f.length)
+				if _, err := io.ReadFull(conn, f.payload); err != nil {
+					return
+				}
+			}
+			p.frames <- f
+		}
+	}()
+	return p
+}
+
+func (p *rawMuxPeer) write(typ byte, flags uint16, id, length uint32, payload []byte) {
+	b := make([]byte, muxHeaderSize, muxHeaderSize+len(payload))
+	b[0], b[1] = muxVersion, typ
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint32(b[4:], id)
+	if payload != nil {
+		length = uint32(len(payload))
+	}
+	binary.BigEndian.PutUint32(b[8:], length)
+	if _, err := p.conn.Write(append(b, payload...)); err != nil {
+		p.t.Errorf("write frame: %s", err)
+	}
+}
+
+// next returns the next frame the session sent, failing the test after a second.
+func (p *rawMuxPeer) next() muxFrame {
+	p.t.Helper()
+	select {
+	case f, ok := <-p.frames:
+		if !ok {
+			p.t.Fatal("session closed the connection")
+		}
+		return f
+	case <-time.After(time.Second):
+		p.t.Fatal("no frame from the session")
+	}
+	return muxFrame{}
+}
+
+// expect returns the next frame, which must be of typ with flags.
+func (p *rawMuxPeer) expect(typ byte, flags uint16) muxFrame {
+	p.t.Helper()
+	f := p.next()
+	if f.typ != typ || f.flags != flags {
+		p.t.Fatalf("got frame type %d flags %#x, want type %d flags %#x", f.typ, f.flags, typ, flags)
+	}
+	return f
+}
+
+func TestMuxRoundTrip(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client, server := NewMuxClient(c1), NewMuxServer(c2)
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.Close()
+			}()
+		}
+	}()
+
+	// more than the receive window, so the transfer relies on window updates
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 3*muxInitialWindow/16)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			st, err := client.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer st.Close()
+			st.SetDeadline(time.Now().Add(10 * time.Second))
+			go st.Write(payload)
+			got := make([]byte, len(payload))
+			if _, err := io.ReadFull(st, got); err != nil {
+				t.Errorf("stream %d: %s", i, err)
+			} else if !bytes.Equal(got, payload) {
+				t.Errorf("stream %d: echoed data differs", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMuxWindowUpdate(t *testing.T) {
+	c1, c2 := net.Pipe()
+	s := NewMuxClient(c1)
+	defer s.Close()
+	peer := newRawMuxPeer(t, c2)
+
+	st, err := s.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	syn := peer.expect(muxTypeWindowUpdate, muxFlagSYN)
+	peer.write(muxTypeWindowUpdate, muxFlagACK, syn.id, 0, nil)
+
+	// the send window is used up, then grown by the peer
+	payload := make([]byte, muxInitialWindow+1000)
+	written := make(chan error, 1)
+	go func() {
+		_, err := st.Write(payload)
+		written <- err
+	}()
+	received := 0
+	for received < muxInitialWindow {
+		received += len(peer.expect(muxTypeData, 0).payload)
+	}
+	select {
+	case err := <-written:
+		t.Fatalf("Write returned %v beyond the send window", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	peer.write(muxTypeWindowUpdate, 0, syn.id, 1000, nil)
+	if f := peer.expect(muxTypeData, 0); len(f.payload) != 1000 {
+		t.Errorf("got %d bytes after the window update, want 1000", len(f.payload))
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	// the receive window is granted again once half of it was read
+	peer.write(muxTypeData, 0, syn.id, 0, make([]byte, muxInitialWindow/2))
+	if _, err := io.ReadFull(st, make([]byte, muxInitialWindow/2)); err != nil {
+		t.Fatal(err)
+	}
+	if f := peer.expect(muxTypeWindowUpdate, 0); f.id != syn.id || f.length != muxInitialWindow/2 {
+		t.Errorf("window update for stream %d of %d, want stream %d of %d", f.id, f.length, syn.id, muxInitialWindow/2)
+	}
+
+	// data beyond the receive window is a protocol error ending the session: the header
+	// alone is enough for the session to refuse the frame
+	peer.write(muxTypeData, 0, syn.id, muxInitialWindow+1, nil)
+	peer.expect(muxTypeGoAway, 0)
+	select {
+	case <-s.closed:
+	case <-time.After(time.Second):
+		t.Error("session still open after its receive window was exceeded")
+	}
+}
+
+func TestMuxResetAndGoAway(t *testing.T) {
+	c1, c2 := net.Pipe()
+	s := NewMuxClient(c1)
+	defer s.Close()
+	peer := newRawMuxPeer(t, c2)
+
+	st, err := s.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	syn := peer.expect(muxTypeWindowUpdate, muxFlagSYN)
+	peer.write(muxTypeWindowUpdate, muxFlagACK|muxFlagRST, syn.id, 0, nil)
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, ErrMuxReset) {
+		t.Errorf("Read of a reset stream: %v, want ErrMuxReset", err)
+	}
+	if _, err := st.Write([]byte("x")); !errors.Is(err, ErrMuxReset) {
+		t.Errorf("Write to a reset stream: %v, want ErrMuxReset", err)
+	}
+	if n := s.NumStreams(); n != 0 {
+		t.Errorf("%d streams after a reset, want 0", n)
+	}
+
+	// the remote end half-closes the other stream: reads end, writes go on
+	st, err = s.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	syn = peer.expect(muxTypeWindowUpdate, muxFlagSYN)
+	peer.write(muxTypeData, muxFlagACK|muxFlagFIN, syn.id, 0, []byte("bye"))
+	if b, err := io.ReadAll(st); string(b) != "bye" || err != nil {
+		t.Errorf("read %q, %v from a finished stream, want \"bye\"", b, err)
+	}
+	go st.Write([]byte("ok"))
+	if f := peer.expect(muxTypeData, 0); string(f.payload) != "ok" {
+		t.Errorf("got %q after the remote end finished, want \"ok\"", f.payload)
+	}
+	st.Close()
+	peer.expect(muxTypeWindowUpdate, muxFlagFIN)
+
+	peer.write(muxTypeGoAway, 0, 0, 0, nil)
+	if _, err := s.Accept(); err != ErrMuxClosed {
+		t.Errorf("Accept after GoAway: %v, want ErrMuxClosed", err)
+	}
+	if _, err := s.Open(); err != ErrMuxClosed {
+		t.Errorf("Open after GoAway: %v, want ErrMuxClosed", err)
+	}
+}
+
+func TestMuxCloseSendsGoAway(t *testing.T) {
+	c1, c2 := net.Pipe()
+	s := NewMuxServer(c1)
+	peer := newRawMuxPeer(t, c2)
+	go s.Close()
+	peer.expect(muxTypeGoAway, 0)
+	if _, ok := <-peer.frames; ok {
+		t.Error("frames after GoAway")
+	}
+}
+
+// TestMuxInterop drives a server session with the frames a yamux client sends.
+func TestMuxInterop(t *testing.T) {
+	c1, c2 := net.Pipe()
+	s := NewMuxServer(c1)
+	defer s.Close()
+	peer := newRawMuxPeer(t, c2)
+	go func() {
+		st, err := s.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(st, st)
+		st.Close()
+	}()
+
+	// yamux opens streams with odd IDs from the client, with a window update
+	peer.write(muxTypeWindowUpdate, muxFlagSYN, 1, 0, nil)
+	if f := peer.expect(muxTypeWindowUpdate, muxFlagACK); f.id != 1 {
+		t.Fatalf("ACK for stream %d, want 1", f.id)
+	}
+	peer.write(muxTypeData, 0, 1, 0, []byte("hello"))
+	if f := peer.expect(muxTypeData, 0); f.id != 1 || string(f.payload) != "hello" {
+		t.Errorf("got %q on stream %d, want \"hello\" on stream 1", f.payload, f.id)
+	}
+	peer.write(muxTypeWindowUpdate, muxFlagFIN, 1, 0, nil)
+	if f := peer.expect(muxTypeWindowUpdate, muxFlagFIN); f.id != 1 {
+		t.Errorf("FIN for stream %d, want 1", f.id)
+	}
+
+	// pings are answered with the same opaque value
+	peer.write(muxTypePing, muxFlagSYN, 0, 42, nil)
+	if f := peer.expect(muxTypePing, muxFlagACK); f.length != 42 {
+		t.Errorf("ping answered with %d, want 42", f.length)
+	}
+
+	// an unknown version ends the session with a protocol error
+	b := make([]byte, muxHeaderSize)
+	b[0] = 1
+	c2.Write(b)
+	if f := peer.expect(muxTypeGoAway, 0); f.length != 1 {
+		t.Errorf("GoAway with code %d, want 1 (protocol error)", f.length)
+	}
+}
@@ -0,0 +1,135 @@
+package proxyplease
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bdwyertech/proxyplease/auth"
+)
+
+// maxNegotiateRounds bounds the number of SPNEGO continuation tokens exchanged with the proxy.
+const maxNegotiateRounds = 5
+
+func dialNegotiate(p Proxy, addr string, baseDial func() (net.Conn, error)) (net.Conn, error) {
+	p.debugf("negotiate> Attempting to authenticate")
+	if err := p.checkAutoLogon("Negotiate"); err != nil {
+		return nil, err
+	}
+
+	spn, err := proxySPN(p)
+	if err != nil {
+		p.debugf("negotiate> Error canonicalizing hostname: %s", err)
+		return nil, err
+	}
+
+	o := auth.KerberosOptions{
+		KeytabPath: p.KeytabPath,
+		CCachePath: p.CCachePath,
+		TGT:        p.TGTManager,
+		Flags:      p.NegotiateFlags,
+	}
+	if p.CredentialCache != nil {
+		o.Tickets = ticketStore{c: p.CredentialCache, prefix: credentialKey(p, "negotiate") + "|"}
+	}
+	if p.Clock != nil || p.skew != 0 {
+		clock := clockOr(p.Clock)
+		o.Now = func() time.Time { return clock.Now().Add(p.skew) }
+	}
+	a, err := auth.NewKerberosNegotiate(spn, p.Domain, p.Username, p.Password, o)
+	if err != nil {
+		p.debugf("negotiate> Could not acquire Kerberos credentials: %s", err)
+		return nil, err
+	}
+	defer a.Release()
+
+	conn, err := baseDial()
+	if err != nil {
+		p.debugf("negotiate> Could not call dial context with proxy: %s", err)
+		return conn, err
+	}
+	bindChannel(p, conn, a)
+
+	token, err := a.Next("")
+	if err != nil {
+		if isKerberosSkew(err) {
+			p.debugf("negotiate> The KDC reports clock skew: %s", err)
+			return conn, &ClockSkewError{Err: err}
+		}
+		return conn, err
+	}
+
+	head := p.connectHeader(addr)
+	p.setKeepAlive(head)
+	connect := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: head,
+	}
+	br := newResponseReader(p, conn)
+	for round := 0; ; round++ {
+		connect.Header.Set("Proxy-Authorization", token)
+		if err := writeConnect(p, conn, connect); err != nil {
+			p.debugf("negotiate> Could not write token message to proxy: %s", err)
+			return conn, err
+		}
+		resp, err := br.read(connect)
+		if err != nil {
+			p.debugf("negotiate> Could not read token response from proxy: %s", err)
+			return conn, err
+		}
+		p.saveCookies(resp)
+		discardAuthBody(p, br, resp)
+
+		if resp.StatusCode == http.StatusOK {
+			if v, ok := a.(auth.MutualVerifier); ok {
+				if err := v.VerifyFinal(auth.Challenge(resp.Header["Proxy-Authenticate"], "Negotiate")); err != nil {
+					p.debugf("negotiate> Could not verify the identity of the proxy: %s", err)
+					return conn, err
+				}
+			}
+			p.debugf("negotiate> Successfully injected Negotiate to connection")
+			return newConn(conn, p, resp, br.Reader, "Negotiate"), nil
+		}
+
+		// the proxy may continue the SPNEGO exchange with another token
+		challenge := auth.Challenge(resp.Header["Proxy-Authenticate"], "Negotiate")
+		if resp.StatusCode != http.StatusProxyAuthRequired || challenge == "" || challenge == "Negotiate" || round >= maxNegotiateRounds {
+			p.debugf("negotiate> Expected %d as return status, got: %d", http.StatusOK, resp.StatusCode)
+			err = newStatusError(resp)
+			if p.CredentialCache != nil && resp.StatusCode == http.StatusProxyAuthRequired {
+				// the ticket may have been cached and since expired or revoked
+				p.CredentialCache.Delete(credentialKey(p, "negotiate") + "|" + spn)
+			}
+			if offset, ok := clockOffset(resp.Header, clockOr(p.Clock).Now().Add(p.skew)); ok && skewed(offset) && resp.StatusCode == http.StatusProxyAuthRequired {
+				p.debugf("negotiate> Proxy clock differs from ours by %s", offset)
+				if p.AdjustClockSkew && p.skew == 0 {
+					conn.Close()
+					p.skew = offset
+					return dialNegotiate(p, addr, baseDial)
+				}
+				err = &ClockSkewError{Offset: offset, Err: err}
+			} else if resp.StatusCode == http.StatusProxyAuthRequired && (p.TGTManager != nil || p.CredentialCache != nil) && !p.renewed {
+				// the ticket may have rolled over since it was obtained: retry once with a
+				// fresh one instead of failing the tunnel
+				p.debugf("negotiate> Proxy rejected the Kerberos ticket. Retrying with a new one.")
+				if p.TGTManager != nil {
+					if err := p.TGTManager.Renew(); err != nil {
+						p.debugf("negotiate> Could not renew the Kerberos login: %s", err)
+						return conn, err
+					}
+				}
+				conn.Close()
+				p.renewed = true
+				return dialNegotiate(p, addr, baseDial)
+			}
+			return conn, err
+		}
+		if token, err = a.Next(challenge); err != nil {
+			p.debugf("negotiate> Could not process continuation token: %s", err)
+			return conn, err
+		}
+	}
+}
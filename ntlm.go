@@ -0,0 +1,110 @@
+package proxyplease
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/bdwyertech/proxyplease/auth"
+)
+
+// dialNTLM authenticates a new connection with NTLM. Credentials are acquired before it
+// is dialed, so a failure to acquire them does not leave a connection behind.
+func dialNTLM(p Proxy, addr string, baseDial func() (net.Conn, error)) (net.Conn, error) {
+	p.debugf("ntlm> Attempting to authenticate")
+
+	var a auth.Authenticator
+	var err error
+	if p.NTHash != "" {
+		a, err = auth.NewNTLMHashWithOptions(p.Domain, p.Username, p.NTHash, p.NTLM)
+	} else if err = p.checkAutoLogon("NTLM"); err == nil {
+		a, err = auth.NewNTLMWithOptions(p.Domain, p.Username, p.Password, p.NTLM)
+	}
+	if err != nil {
+		p.debugf("ntlm> Unable to acquire supplied or current user credentials.")
+		return nil, err
+	}
+	defer a.Release()
+
+	conn, err := baseDial()
+	if err != nil {
+		p.debugf("ntlm> Could not call dial context with proxy: %s", err)
+		return conn, err
+	}
+	bindChannel(p, conn, a)
+
+	negotiate, err := a.Next("")
+	if err != nil {
+		p.debugf("ntlm> Error creating Negotiate message")
+		return conn, err
+	}
+
+	h := p.connectHeader(addr)
+	h.Set("Proxy-Authorization", negotiate)
+	p.setKeepAlive(h)
+	connect := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: h,
+	}
+	if err := writeConnect(p, conn, connect); err != nil {
+		p.debugf("ntlm> Could not write negotiate message to proxy: %s", err)
+		return conn, err
+	}
+	br := newResponseReader(p, conn)
+	resp, err := br.read(connect)
+	if err != nil {
+		p.debugf("ntlm> Could not read negotiate response from proxy: %s", err)
+		return conn, err
+	}
+	p.saveCookies(resp)
+	if err := discardAuthBody(p, br, resp); err != nil {
+		return conn, err
+	}
+
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		p.debugf("ntlm> Expected %d as return status, got: %d", http.StatusProxyAuthRequired, resp.StatusCode)
+		return conn, newStatusError(resp)
+	}
+
+	challenge := auth.Challenge(resp.Header["Proxy-Authenticate"], "NTLM")
+	if challenge == "" {
+		p.debugf("ntlm> Proxy response carries no NTLM challenge")
+		return conn, ErrMalformedChallenge
+	}
+
+	authenticate, err := a.Next(challenge)
+	if err != nil {
+		p.debugf("ntlm> Error processing challenge message: %s", err)
+		return conn, err
+	}
+
+	// Rewind the request body, the handshake needs it
+	if connect.GetBody != nil {
+		if connect.Body, err = connect.GetBody(); err != nil {
+			return conn, err
+		}
+	}
+
+	connect.Header.Set("Proxy-Authorization", authenticate)
+	if err := writeConnect(p, conn, connect); err != nil {
+		p.debugf("ntlm> Could not write authenticate message to proxy: %s", err)
+		return conn, err
+	}
+	resp, err = br.read(connect)
+	if err != nil {
+		p.debugf("ntlm> Could not read authenticate response from proxy: %s", err)
+		return conn, err
+	}
+	p.saveCookies(resp)
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		p.debugf("ntlm> Successfully injected NTLM to connection")
+		return newConn(conn, p, resp, br.Reader, "NTLM"), nil
+	}
+
+	p.debugf("ntlm> Expected %d as return status, got: %d", http.StatusOK, resp.StatusCode)
+	return conn, newStatusError(resp)
+}
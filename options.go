@@ -0,0 +1,116 @@
+package proxyplease
+
+import (
+	"net"
+	"net/url"
+	"time"
+)
+
+// Option changes the configuration of a Dialer, see NewDialer and Dialer.Clone.
+type Option func(*Proxy)
+
+// WithTimeout limits the whole handshake of each dial, see Proxy.HandshakeTimeout.
+func WithTimeout(d time.Duration) Option {
+	return func(p *Proxy) { p.HandshakeTimeout = d }
+}
+
+// WithDialTimeout limits each connection to the proxy, see Proxy.DialTimeout.
+func WithDialTimeout(d time.Duration) Option {
+	return func(p *Proxy) { p.DialTimeout = d }
+}
+
+// WithLogger sends the debug output to l, see Proxy.Logger.
+func WithLogger(l Logger) Option {
+	return func(p *Proxy) { p.Logger = l }
+}
+
+// WithSchemes restricts authentication to schemes, ex: "NTLM", see Proxy.AuthSchemeFilter.
+func WithSchemes(schemes ...string) Option {
+	schemes = append([]string(nil), schemes...)
+	return func(p *Proxy) { p.AuthSchemeFilter = schemes }
+}
+
+// WithSchemePreference sets the order in which offered schemes are attempted, see
+// Proxy.SchemePreference.
+func WithSchemePreference(schemes ...string) Option {
+	schemes = append([]string(nil), schemes...)
+	return func(p *Proxy) { p.SchemePreference = schemes }
+}
+
+// WithUser authenticates as username with password.
+func WithUser(username, password string) Option {
+	return func(p *Proxy) { p.Username, p.Password = username, password }
+}
+
+// WithHeader sets a header of the requests to the proxy, replacing values of the same
+// name, see Proxy.Headers.
+func WithHeader(name, value string) Option {
+	return func(p *Proxy) {
+		p.Headers = snapshotHeaders(p.Headers)
+		p.Headers.Set(name, value)
+	}
+}
+
+// cloneProxy returns a copy of p sharing none of the URLs, slices, headers and TLS
+// configs of p, so changes made to either do not affect the other. Caches, stores and
+// callbacks are shared.
+func cloneProxy(p Proxy) Proxy {
+	cloneURL := func(u *url.URL) *url.URL {
+		if u == nil {
+			return nil
+		}
+		c := *u
+		if u.User != nil {
+			user := *u.User
+			c.User = &user
+		}
+		return &c
+	}
+	p.URL, p.TargetURL, p.PACURL = cloneURL(p.URL), cloneURL(p.TargetURL), cloneURL(p.PACURL)
+	if p.Headers != nil {
+		p.Headers = snapshotHeaders(p.Headers)
+	}
+	if p.TLSConfig != nil {
+		p.TLSConfig = p.TLSConfig.Clone()
+	}
+	if p.TargetTLSConfig != nil {
+		p.TargetTLSConfig = p.TargetTLSConfig.Clone()
+	}
+	for _, s := range []*[]string{&p.AuthSchemeFilter, &p.SchemePreference, &p.ResponseHeaders, &p.Bypass, &p.AllowedPorts} {
+		if *s != nil {
+			*s = append([]string(nil), *s...)
+		}
+	}
+	if p.Upstreams != nil {
+		upstreams := make([]Upstream, len(p.Upstreams))
+		for i, u := range p.Upstreams {
+			upstreams[i] = Upstream{URL: cloneURL(u.URL), Weight: u.Weight}
+		}
+		p.Upstreams = upstreams
+	}
+	if p.Routes != nil {
+		routes := make([]RouteRule, len(p.Routes))
+		for i, r := range p.Routes {
+			r.Ports = append([]int(nil), r.Ports...)
+			r.Proxy = cloneURL(r.Proxy)
+			routes[i] = r
+		}
+		p.Routes = routes
+	}
+	if p.Middleware != nil {
+		p.Middleware = append([]Middleware(nil), p.Middleware...)
+	}
+	for _, proxies := range []*[]Proxy{&p.Chain, &p.PortFallback} {
+		if *proxies != nil {
+			c := make([]Proxy, len(*proxies))
+			for i, q := range *proxies {
+				c[i] = cloneProxy(q)
+			}
+			*proxies = c
+		}
+	}
+	if p.LocalAddr != nil {
+		p.LocalAddr = append(net.IP(nil), p.LocalAddr...)
+	}
+	return p
+}
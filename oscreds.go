@@ -0,0 +1,34 @@
+package proxyplease
+
+import (
+	"context"
+	"net/url"
+)
+
+// osCredentials looks up proxy credentials in the credential store of the OS.
+type osCredentials struct{}
+
+// OSCredentials returns a CredentialProvider looking up the credentials stored for the
+// proxy host name in the Windows Credential Manager (a generic credential whose target is
+// the host, or host:port) or the macOS Keychain (an internet or generic password whose
+// server or service is the host). Proxies without stored credentials get empty ones, so
+// the current user's credentials are used as when no provider is set. Other platforms
+// have no store.
+func OSCredentials() CredentialProvider {
+	return osCredentials{}
+}
+
+func (osCredentials) Credentials(ctx context.Context, proxy *url.URL, scheme string) (Credentials, error) {
+	for _, target := range []string{proxy.Hostname(), proxy.Host} {
+		c, ok, err := storedCredentials(target)
+		if err != nil {
+			debugf("credentials> Could not read stored credentials for %s: %s", target, err)
+			return Credentials{}, nil
+		}
+		if ok {
+			debugf("credentials> Using stored credentials for %s", target)
+			return c, nil
+		}
+	}
+	return Credentials{}, nil
+}
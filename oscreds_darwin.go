@@ -0,0 +1,44 @@
+// +build darwin
+
+package proxyplease
+
+import (
+	"bufio"
+	"bytes"
+	"os/exec"
+	"strings"
+)
+
+// storedCredentials reads the Keychain internet password whose server is target, or the
+// generic password whose service is target.
+func storedCredentials(target string) (Credentials, bool, error) {
+	for _, kind := range []string{"find-internet-password", "find-generic-password"} {
+		attrs, err := exec.Command("security", kind, "-s", target).Output()
+		if err != nil {
+			// security exits with 44 when no item matches
+			continue
+		}
+		password, err := exec.Command("security", kind, "-s", target, "-w").Output()
+		if err != nil {
+			return Credentials{}, false, err
+		}
+		return Credentials{
+			Username: keychainAccount(attrs),
+			Password: strings.TrimSuffix(string(password), "\n"),
+		}, true, nil
+	}
+	return Credentials{}, false, nil
+}
+
+// keychainAccount returns the account attribute of a Keychain item printed by security,
+// ex: `    "acct"<blob>="jdoe"`.
+func keychainAccount(attrs []byte) string {
+	sc := bufio.NewScanner(bytes.NewReader(attrs))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, `"acct"<blob>="`) {
+			return strings.TrimSuffix(strings.TrimPrefix(line, `"acct"<blob>="`), `"`)
+		}
+	}
+	return ""
+}
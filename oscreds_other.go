@@ -0,0 +1,8 @@
+// +build !windows,!darwin
+
+package proxyplease
+
+// storedCredentials finds nothing, since this platform has no standard credential store.
+func storedCredentials(target string) (Credentials, bool, error) {
+	return Credentials{}, false, nil
+}
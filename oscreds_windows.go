@@ -0,0 +1,65 @@
+//go:build windows
+// +build windows
+
+package proxyplease
+
+import (
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const credTypeGeneric = 1 // CRED_TYPE_GENERIC
+
+var (
+	advapi32     = windows.NewLazySystemDLL("advapi32.dll")
+	procCredRead = advapi32.NewProc("CredReadW")
+	procCredFree = advapi32.NewProc("CredFree")
+)
+
+// credential mirrors CREDENTIALW.
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        windows.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// storedCredentials reads the generic credential named target from the Credential
+// Manager. The user name may be given as "DOMAIN\user".
+func storedCredentials(target string) (Credentials, bool, error) {
+	name, err := windows.UTF16PtrFromString(target)
+	if err != nil {
+		return Credentials{}, false, err
+	}
+	var cred *credential
+	r, _, e := procCredRead.Call(uintptr(unsafe.Pointer(name)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if r == 0 {
+		if e == windows.ERROR_NOT_FOUND {
+			return Credentials{}, false, nil
+		}
+		return Credentials{}, false, e
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+
+	c := Credentials{Username: windows.UTF16PtrToString(cred.UserName)}
+	if cred.CredentialBlobSize > 0 {
+		// the password is stored as UTF-16 without terminator
+		blob := (*[1 << 20]uint16)(unsafe.Pointer(cred.CredentialBlob))[: cred.CredentialBlobSize/2 : cred.CredentialBlobSize/2]
+		c.Password = syscall.UTF16ToString(blob)
+	}
+	if i := strings.IndexByte(c.Username, '\\'); i > 0 {
+		c.Domain, c.Username = c.Username[:i], c.Username[i+1:]
+	}
+	return c, true, nil
+}
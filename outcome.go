@@ -0,0 +1,269 @@
+package proxyplease
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/bdwyertech/proxyplease/auth"
+)
+
+// Outcome is a stable category of handshake failure, for deciding whether to retry,
+// prompt for credentials or alert.
+type Outcome int
+
+const (
+	// Unclassified errors are not proxy responses, ex: the proxy could not be reached.
+	Unclassified Outcome = iota
+	// AuthFailed means the proxy rejected or could not be offered credentials.
+	AuthFailed
+	// PolicyDenied means the proxy refuses the destination, ex: by URL filtering.
+	PolicyDenied
+	// TargetUnreachableViaProxy means the proxy could not resolve or connect to the target.
+	TargetUnreachableViaProxy
+	// ProxyOverloaded means the proxy is temporarily unable to serve. Retry later.
+	ProxyOverloaded
+	// ProtocolError means the proxy response was malformed, oversized or unexpected.
+	ProtocolError
+)
+
+var outcomeNames = []string{"unclassified", "auth-failed", "policy-denied", "target-unreachable", "proxy-overloaded", "protocol-error"}
+
+func (o Outcome) String() string {
+	if int(o) < len(outcomeNames) {
+		return outcomeNames[o]
+	}
+	return "unknown"
+}
+
+// StatusError is returned when the proxy answers a CONNECT with an unexpected status.
+type StatusError struct {
+	StatusCode int
+	Header     http.Header // Headers of the proxy response.
+	Body       []byte      // Start of the response body, ex: the block page of a filtering proxy, up to 4 KiB.
+
+	resp *http.Response // drained before the connection is reused
+}
+
+// Error returns the status text, followed by the title of an HTML body or the first line
+// of a text body, ex: "Forbidden: Access Denied (content_filter_denied)".
+func (e *StatusError) Error() string {
+	msg := http.StatusText(e.StatusCode)
+	if msg == "" {
+		msg = fmt.Sprintf("status %d", e.StatusCode)
+	}
+	if s := bodySummary(e.Header.Get("Content-Type"), e.Body); s != "" {
+		msg += ": " + s
+	}
+	return msg
+}
+
+// Is reports whether e is a 407 answer, which errors.Is matches with ErrProxyAuthRequired.
+func (e *StatusError) Is(target error) bool {
+	return target == ErrProxyAuthRequired && e.StatusCode == http.StatusProxyAuthRequired
+}
+
+var (
+	// ErrProxyAuthRequired is matched by errors.Is when the proxy answered 407, ex: because
+	// no scheme it offers could be attempted or it rejected the credentials.
+	ErrProxyAuthRequired = errors.New("proxy authentication required")
+	// ErrMalformedChallenge is returned when a Proxy-Authenticate challenge is missing or
+	// cannot be used to continue authentication.
+	ErrMalformedChallenge = auth.ErrMalformedChallenge
+)
+
+// ErrAuthFailed is returned when authentication with a scheme failed, ex: because the
+// proxy rejected the credentials. It is the last attempt of an *AuthError.
+type ErrAuthFailed struct {
+	Scheme string // Scheme as named by the proxy, ex: "NTLM".
+	Status int    // Status of the proxy's final response to the attempt, or 0 if none was read.
+	Err    error
+}
+
+func (e *ErrAuthFailed) Error() string {
+	if e.Status != 0 {
+		return fmt.Sprintf("%s authentication failed with status %d", e.Scheme, e.Status)
+	}
+	return fmt.Sprintf("%s authentication failed: %s", e.Scheme, e.Err)
+}
+
+func (e *ErrAuthFailed) Unwrap() error {
+	return e.Err
+}
+
+// ErrProxyUnreachable is returned when no connection to the proxy could be established,
+// telling network failures from rejections by the proxy.
+type ErrProxyUnreachable struct {
+	Proxy string // Host and port of the proxy.
+	Err   error
+}
+
+func (e *ErrProxyUnreachable) Error() string {
+	return "proxy " + e.Proxy + " is unreachable: " + e.Err.Error()
+}
+
+func (e *ErrProxyUnreachable) Unwrap() error {
+	return e.Err
+}
+
+// AuthAttempt is an authentication scheme tried during a handshake, and how it failed.
+type AuthAttempt struct {
+	Scheme     string // Scheme as named by the proxy, ex: "NTLM".
+	StatusCode int    // Status of the proxy's final response to the attempt, or 0 if none was read.
+	Err        error
+}
+
+// AuthError is returned when proxy authentication fails. It lists the schemes offered by
+// the proxy and those attempted, telling wrong credentials (every attempt answered with
+// 407) from missing scheme support (nothing attempted).
+type AuthError struct {
+	Offered  []string      // Proxy-Authenticate challenges of the proxy, in order.
+	Attempts []AuthAttempt // Schemes attempted, in order.
+	Err      error         // *ErrAuthFailed of the last attempt, or the proxy response if nothing was attempted.
+}
+
+func (e *AuthError) Error() string {
+	var offered, attempted []string
+	for _, s := range e.Offered {
+		offered = append(offered, strings.Split(s, " ")[0])
+	}
+	for _, a := range e.Attempts {
+		var se *StatusError
+		var page string
+		if errors.As(a.Err, &se) && se.StatusCode != http.StatusProxyAuthRequired {
+			// ex: the block page of a proxy refusing the destination once authenticated
+			page = bodySummary(se.Header.Get("Content-Type"), se.Body)
+		}
+		if page != "" {
+			attempted = append(attempted, fmt.Sprintf("%s (%d: %s)", a.Scheme, se.StatusCode, page))
+		} else if a.StatusCode != 0 {
+			attempted = append(attempted, fmt.Sprintf("%s (%d)", a.Scheme, a.StatusCode))
+		} else {
+			attempted = append(attempted, fmt.Sprintf("%s (%s)", a.Scheme, a.Err))
+		}
+	}
+	if len(attempted) == 0 {
+		attempted = []string{"none"}
+	}
+	return "proxy authentication failed: offered " + strings.Join(offered, ", ") + "; attempted " + strings.Join(attempted, ", ")
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// newAuthAttempt records a failed attempt of scheme.
+func newAuthAttempt(scheme string, err error) AuthAttempt {
+	a := AuthAttempt{Scheme: scheme, Err: err}
+	var se *StatusError
+	if errors.As(err, &se) {
+		a.StatusCode = se.StatusCode
+	}
+	return a
+}
+
+// Classify returns the Outcome of an error returned by a DialContext.
+func Classify(err error) Outcome {
+	var se *StatusError
+	var le *ResponseLimitError
+	var ae *AuthError
+	var soe *SOCKSError
+	var ve *ViolationError
+	switch {
+	case errors.As(err, &ae):
+		if o := Classify(ae.Err); o != Unclassified {
+			return o
+		}
+		return AuthFailed
+	case errors.As(err, &se):
+		return ClassifyStatus(se.StatusCode, se.Header)
+	case errors.As(err, &le), errors.As(err, &ve):
+		return ProtocolError
+	case errors.As(err, &soe):
+		return soe.outcome()
+	}
+	return Unclassified
+}
+
+// ClassifyStatus returns the Outcome of a proxy response status code and headers.
+// Successful responses are Unclassified.
+func ClassifyStatus(code int, h http.Header) Outcome {
+	// Squid explains its error pages, ex: "ERR_DNS_FAIL 0"
+	squid := strings.Fields(h.Get("X-Squid-Error"))
+	if len(squid) > 0 {
+		switch squid[0] {
+		case "ERR_DNS_FAIL", "ERR_CONNECT_FAIL", "ERR_READ_TIMEOUT", "ERR_CONNECT_TIMEOUT":
+			return TargetUnreachableViaProxy
+		case "ERR_ACCESS_DENIED", "ERR_CACHE_ACCESS_DENIED", "ERR_FORWARDING_DENIED":
+			if code == http.StatusProxyAuthRequired {
+				return AuthFailed
+			}
+			return PolicyDenied
+		}
+	}
+
+	switch {
+	case code < 300:
+		return Unclassified
+	case code == http.StatusProxyAuthRequired, code == http.StatusUnauthorized:
+		return AuthFailed
+	case code == http.StatusForbidden, code == http.StatusUnavailableForLegalReasons:
+		return PolicyDenied
+	case code == http.StatusBadGateway, code == http.StatusGatewayTimeout:
+		return TargetUnreachableViaProxy
+	case code == http.StatusTooManyRequests, code == http.StatusServiceUnavailable:
+		return ProxyOverloaded
+	}
+	return ProtocolError
+}
+
+// statusErrorBodyBytes is how much of the body of an unexpected response StatusError keeps.
+const statusErrorBodyBytes = 4 << 10
+
+// maxBodySummary bounds the part of the body quoted by StatusError.Error.
+const maxBodySummary = 200
+
+// newStatusError returns the StatusError for resp, with the start of its body. The body
+// is read up to statusErrorBodyBytes if it was not read yet.
+func newStatusError(resp *http.Response) *StatusError {
+	e := &StatusError{StatusCode: resp.StatusCode, Header: resp.Header, resp: resp}
+	if rb, ok := resp.Body.(*recordedBody); ok {
+		e.Body = rb.head()
+	} else if resp.Body != nil {
+		e.Body, _ = ioutil.ReadAll(io.LimitReader(resp.Body, statusErrorBodyBytes))
+	}
+	return e
+}
+
+// bodySummary returns the title of an HTML body or the first line of a text body, for
+// error messages.
+func bodySummary(contentType string, body []byte) string {
+	s := string(body)
+	var summary string
+	if i := strings.Index(strings.ToLower(s), "<title"); i >= 0 {
+		s = s[i:]
+		if j := strings.IndexByte(s, '>'); j >= 0 {
+			s = s[j+1:]
+			if k := strings.Index(strings.ToLower(s), "</title"); k >= 0 {
+				s = s[:k]
+			}
+			summary = html.UnescapeString(s)
+		}
+	} else if strings.HasPrefix(contentType, "text/plain") {
+		for _, line := range strings.Split(s, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				summary = line
+				break
+			}
+		}
+	}
+	summary = strings.Join(strings.Fields(summary), " ")
+	if len(summary) > maxBodySummary {
+		summary = summary[:maxBodySummary] + "..."
+	}
+	return summary
+}
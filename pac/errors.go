@@ -0,0 +1,177 @@
+package pac
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/dop251/goja"
+	"github.com/dop251/goja/parser"
+)
+
+// ErrorKind classifies PAC script failures.
+type ErrorKind int
+
+const (
+	// SyntaxError means the script could not be parsed.
+	SyntaxError ErrorKind = iota + 1
+	// RuntimeError means the script threw an exception.
+	RuntimeError
+	// Timeout means FindProxyForURL did not return in time.
+	Timeout
+	// BadResult means FindProxyForURL returned a value that is not a valid PAC result.
+	BadResult
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case SyntaxError:
+		return "syntax error"
+	case RuntimeError:
+		return "runtime error"
+	case Timeout:
+		return "timeout"
+	case BadResult:
+		return "bad result"
+	}
+	return "unknown error"
+}
+
+// Error describes a failure to compile or evaluate a PAC script.
+type Error struct {
+	Kind    ErrorKind
+	Message string // JavaScript error message, or the offending result for BadResult.
+	Line    int    // Line in the script, if known.
+	Column  int    // Column in the script, if known.
+	Err     error  // Underlying error, if any.
+}
+
+func (e *Error) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("pac: %s at line %d, column %d: %s", e.Kind, e.Line, e.Column, e.Message)
+	}
+	return fmt.Sprintf("pac: %s: %s", e.Kind, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Metrics are cumulative counters of PAC evaluations since the process started.
+type Metrics struct {
+	Evaluations   uint64 // FindProxyForURL calls.
+	SyntaxErrors  uint64 // Scripts that failed to compile.
+	RuntimeErrors uint64 // Evaluations that threw an exception.
+	Timeouts      uint64 // Evaluations that timed out.
+	BadResults    uint64 // Evaluations that returned an invalid result.
+}
+
+var metrics Metrics
+
+// ReadMetrics returns a snapshot of the PAC evaluation counters.
+func ReadMetrics() Metrics {
+	return Metrics{
+		Evaluations:   atomic.LoadUint64(&metrics.Evaluations),
+		SyntaxErrors:  atomic.LoadUint64(&metrics.SyntaxErrors),
+		RuntimeErrors: atomic.LoadUint64(&metrics.RuntimeErrors),
+		Timeouts:      atomic.LoadUint64(&metrics.Timeouts),
+		BadResults:    atomic.LoadUint64(&metrics.BadResults),
+	}
+}
+
+// record counts err, which may be nil, and returns it.
+func record(err error) error {
+	var e *Error
+	if !errors.As(err, &e) {
+		return err
+	}
+	switch e.Kind {
+	case SyntaxError:
+		atomic.AddUint64(&metrics.SyntaxErrors, 1)
+	case RuntimeError:
+		atomic.AddUint64(&metrics.RuntimeErrors, 1)
+	case Timeout:
+		atomic.AddUint64(&metrics.Timeouts, 1)
+	case BadResult:
+		atomic.AddUint64(&metrics.BadResults, 1)
+	}
+	return err
+}
+
+// stackPosition matches the innermost script position in a goja stack trace.
+var stackPosition = regexp.MustCompile(`pac\.js:(\d+):(\d+)`)
+
+// convertError turns an error returned by goja into an *Error.
+func convertError(err error) error {
+	switch e := err.(type) {
+	case parser.ErrorList:
+		pe := &Error{Kind: SyntaxError, Message: e.Error(), Err: err}
+		if len(e) > 0 {
+			pe.Message, pe.Line, pe.Column = e[0].Message, e[0].Position.Line, e[0].Position.Column
+		}
+		return pe
+	case *goja.CompilerSyntaxError:
+		return &Error{Kind: SyntaxError, Message: e.Message, Err: err}
+	case *goja.InterruptedError:
+		pe := &Error{Kind: Timeout, Message: "FindProxyForURL did not return in time", Err: err}
+		if cause, ok := e.Value().(error); ok {
+			pe.Err = cause
+		}
+		pe.Line, pe.Column = position(e.String())
+		return pe
+	case *goja.Exception:
+		pe := &Error{Kind: RuntimeError, Message: e.Value().String(), Err: err}
+		pe.Line, pe.Column = position(e.String())
+		return pe
+	}
+	return err
+}
+
+func position(stack string) (line, column int) {
+	m := stackPosition.FindStringSubmatch(stack)
+	if m == nil {
+		return 0, 0
+	}
+	line, _ = strconv.Atoi(m[1])
+	column, _ = strconv.Atoi(m[2])
+	return line, column
+}
+
+// Directive is a single entry of a FindProxyForURL result.
+type Directive struct {
+	Type string // One of DIRECT, PROXY, HTTP, HTTPS, SOCKS, SOCKS4 or SOCKS5.
+	Host string // host:port of the proxy. Empty for DIRECT.
+}
+
+// ParseResult parses a FindProxyForURL result such as "PROXY a:8080; SOCKS b:1080; DIRECT".
+func ParseResult(result string) ([]Directive, error) {
+	var ds []Directive
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		d := Directive{Type: strings.ToUpper(fields[0])}
+		switch d.Type {
+		case "DIRECT":
+			if len(fields) != 1 {
+				return nil, &Error{Kind: BadResult, Message: result}
+			}
+		case "PROXY", "HTTP", "HTTPS", "SOCKS", "SOCKS4", "SOCKS5":
+			if len(fields) != 2 {
+				return nil, &Error{Kind: BadResult, Message: result}
+			}
+			d.Host = fields[1]
+		default:
+			return nil, &Error{Kind: BadResult, Message: result}
+		}
+		ds = append(ds, d)
+	}
+	if len(ds) == 0 {
+		return nil, &Error{Kind: BadResult, Message: result}
+	}
+	return ds, nil
+}
@@ -0,0 +1,91 @@
+package pac
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// External is an Engine that evaluates scripts by running an external program once per
+// lookup, such as pactester from pacparser. The placeholders {script}, {url} and {host}
+// in Args are replaced with the path of a file containing the PAC script, the target URL
+// and the target host. The trimmed standard output of the program is the result.
+//
+//	pac.External{Command: "pactester", Args: []string{"-p", "{script}", "-u", "{url}"}}
+type External struct {
+	Command string
+	Args    []string
+}
+
+type externalEvaluator struct {
+	External
+	path   string
+	remove sync.Once
+}
+
+// Compile writes script to a temporary file for use by the external program. The file
+// is removed when the Evaluator is closed, with its Close method, or garbage collected.
+func (e External) Compile(script string) (Evaluator, error) {
+	if e.Command == "" {
+		return nil, errors.New("pac: external engine requires a command")
+	}
+	f, err := ioutil.TempFile("", "proxyplease-*.pac")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(script); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	ev := &externalEvaluator{External: e, path: f.Name()}
+	runtime.SetFinalizer(ev, (*externalEvaluator).Close)
+	return ev, nil
+}
+
+// Close removes the file holding the script. The Evaluator must not be used afterwards.
+func (e *externalEvaluator) Close() error {
+	var err error
+	e.remove.Do(func() {
+		runtime.SetFinalizer(e, nil)
+		err = os.Remove(e.path)
+	})
+	return err
+}
+
+// FindProxyForURL runs the external program. Invalid results are reported as an *Error.
+func (e *externalEvaluator) FindProxyForURL(ctx context.Context, rawurl, host string) (string, error) {
+	atomic.AddUint64(&metrics.Evaluations, 1)
+	r := strings.NewReplacer("{script}", e.path, "{url}", rawurl, "{host}", host)
+	args := make([]string, len(e.Args))
+	for i, a := range e.Args {
+		args[i] = r.Replace(a)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, e.Command, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", record(&Error{Kind: Timeout, Message: e.Command + " did not return in time", Err: ctx.Err()})
+		}
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return "", record(&Error{Kind: RuntimeError, Message: e.Command + ": " + msg, Err: err})
+	}
+	result := strings.TrimSpace(stdout.String())
+	if _, err := ParseResult(result); err != nil {
+		return "", record(err)
+	}
+	return result, nil
+}
@@ -0,0 +1,59 @@
+package pac
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// catEngine returns an External engine printing the script as its result.
+func catEngine(t *testing.T) External {
+	if _, err := exec.LookPath("cat"); err != nil {
+		t.Skip("cat is not available")
+	}
+	return External{Command: "cat", Args: []string{"{script}"}}
+}
+
+func TestExternalClose(t *testing.T) {
+	ev, err := catEngine(t).Compile("PROXY proxy.example:8080; DIRECT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := ev.(*externalEvaluator).path
+	got, err := ev.FindProxyForURL(context.Background(), "https://example.com/", "example.com")
+	if err != nil || got != "PROXY proxy.example:8080; DIRECT" {
+		t.Fatalf("FindProxyForURL = %q, %v", got, err)
+	}
+
+	if err := ev.(interface{ Close() error }).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("%s still exists after Close: %v", path, err)
+	}
+	// closing again does nothing
+	if err := ev.(interface{ Close() error }).Close(); err != nil {
+		t.Errorf("second Close: %s", err)
+	}
+}
+
+func TestExternalReleased(t *testing.T) {
+	ev, err := catEngine(t).Compile("DIRECT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := ev.(*externalEvaluator).path
+	ev = nil
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		runtime.GC()
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return
+		}
+	}
+	os.Remove(path)
+	t.Errorf("%s still exists after the evaluator was released", path)
+}
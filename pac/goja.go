@@ -0,0 +1,123 @@
+package pac
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/dop251/goja/parser"
+)
+
+// defaultTimeout bounds a single FindProxyForURL call when Goja.Timeout is not set.
+const defaultTimeout = 5 * time.Second
+
+// Goja is the default Engine. It evaluates scripts with the embedded goja JavaScript
+// interpreter and provides the standard PAC helper functions.
+type Goja struct {
+	Timeout     time.Duration   // Maximum duration of a single FindProxyForURL call. Defaults to 5 seconds.
+	Resolver    *net.Resolver   // Resolver of dnsResolve and the other DNS helper functions. Defaults to net.DefaultResolver.
+	MyIPAddress func() []net.IP // Addresses returned by myIpAddress (the first) and myIpAddressEx, ex: those of the interface in use on multi-homed hosts. Defaults to the source addresses of the default routes.
+}
+
+type gojaEvaluator struct {
+	program  *goja.Program
+	timeout  time.Duration
+	resolver *net.Resolver
+	myIP     func() []net.IP
+	pool     sync.Pool
+}
+
+// Compile parses script and verifies that it defines FindProxyForURL. Failures are
+// reported as an *Error.
+func (g Goja) Compile(script string) (Evaluator, error) {
+	ast, err := parser.ParseFile(nil, "pac.js", script, 0)
+	if err != nil {
+		return nil, record(convertError(err))
+	}
+	program, err := goja.CompileAST(ast, false)
+	if err != nil {
+		return nil, record(convertError(err))
+	}
+	e := &gojaEvaluator{program: program, timeout: g.Timeout, resolver: g.Resolver, myIP: g.MyIPAddress}
+	if e.timeout <= 0 {
+		e.timeout = defaultTimeout
+	}
+	if e.resolver == nil {
+		e.resolver = net.DefaultResolver
+	}
+
+	// run the script once to surface top-level errors and keep the runtime for reuse
+	vm, err := e.newRuntime()
+	if err != nil {
+		return nil, record(convertError(err))
+	}
+	if _, ok := goja.AssertFunction(vm.Get("FindProxyForURL")); !ok {
+		return nil, record(&Error{Kind: RuntimeError, Message: "script does not define FindProxyForURL"})
+	}
+	e.pool.Put(vm)
+	return e, nil
+}
+
+func (e *gojaEvaluator) newRuntime() (*goja.Runtime, error) {
+	vm := goja.New()
+	registerNatives(vm, e.resolver, e.myIP)
+	if _, err := vm.RunProgram(utilsProgram); err != nil {
+		return nil, err
+	}
+	if _, err := vm.RunProgram(e.program); err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
+// FindProxyForURL evaluates the script. Failures are reported as an *Error.
+func (e *gojaEvaluator) FindProxyForURL(ctx context.Context, rawurl, host string) (string, error) {
+	atomic.AddUint64(&metrics.Evaluations, 1)
+	vm, _ := e.pool.Get().(*goja.Runtime)
+	if vm == nil {
+		var err error
+		if vm, err = e.newRuntime(); err != nil {
+			return "", record(convertError(err))
+		}
+	}
+
+	fn, ok := goja.AssertFunction(vm.Get("FindProxyForURL"))
+	if !ok {
+		return "", record(&Error{Kind: RuntimeError, Message: "script does not define FindProxyForURL"})
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			vm.Interrupt(ctx.Err())
+		case <-stop:
+		}
+	}()
+	v, err := fn(goja.Undefined(), vm.ToValue(rawurl), vm.ToValue(host))
+	close(stop)
+	<-stopped
+	if err != nil {
+		return "", record(convertError(err))
+	}
+	// an interrupted runtime cannot be reused safely
+	if ctx.Err() == nil {
+		e.pool.Put(vm)
+	}
+
+	if _, ok := v.Export().(string); !ok {
+		return "", record(&Error{Kind: BadResult, Message: v.String()})
+	}
+	if _, err := ParseResult(v.String()); err != nil {
+		return "", record(err)
+	}
+	return v.String(), nil
+}
+
+var utilsProgram = goja.MustCompile("pac_utils.js", utilsJS, false)
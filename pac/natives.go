@@ -0,0 +1,113 @@
+package pac
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// dnsTimeout bounds each name resolution performed by a PAC script.
+const dnsTimeout = 2 * time.Second
+
+func registerNatives(vm *goja.Runtime, r *net.Resolver, myIP func() []net.IP) {
+	vm.Set("dnsResolve", func(host string) goja.Value {
+		if ips := lookup(r, host, false); len(ips) > 0 {
+			return vm.ToValue(ips[0])
+		}
+		return goja.Null()
+	})
+	vm.Set("dnsResolveEx", func(host string) string {
+		return strings.Join(lookup(r, host, true), ";")
+	})
+	vm.Set("isResolvable", func(host string) bool {
+		return len(lookup(r, host, false)) > 0
+	})
+	vm.Set("isResolvableEx", func(host string) bool {
+		return len(lookup(r, host, true)) > 0
+	})
+	vm.Set("isInNetEx", func(host, prefix string) bool {
+		_, n, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return false
+		}
+		for _, s := range lookup(r, host, true) {
+			if n.Contains(net.ParseIP(s)) {
+				return true
+			}
+		}
+		return false
+	})
+	vm.Set("myIpAddress", func() string {
+		if myIP != nil {
+			if ips := myIP(); len(ips) > 0 {
+				return ips[0].String()
+			}
+		}
+		// on IPv6-only networks, the IPv6 address is better than loopback
+		for _, t := range [][2]string{{"udp4", "198.51.100.1:80"}, {"udp6", "[2001:db8::1]:80"}} {
+			if ip := localIP(t[0], t[1]); ip != "" {
+				return ip
+			}
+		}
+		return "127.0.0.1"
+	})
+	vm.Set("myIpAddressEx", func() string {
+		var ips []string
+		if myIP != nil {
+			for _, ip := range myIP() {
+				ips = append(ips, ip.String())
+			}
+			if len(ips) > 0 {
+				return strings.Join(ips, ";")
+			}
+		}
+		for _, t := range [][2]string{{"udp6", "[2001:db8::1]:80"}, {"udp4", "198.51.100.1:80"}} {
+			if ip := localIP(t[0], t[1]); ip != "" {
+				ips = append(ips, ip)
+			}
+		}
+		return strings.Join(ips, ";")
+	})
+}
+
+// lookup resolves host with r. Unless all is set, only IPv4 addresses are returned if host has
+// any, so hosts on IPv6-only networks still resolve.
+func lookup(r *net.Resolver, host string, all bool) []string {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{ip.String()}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	addrs, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+	var v4, v6 []string
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			v4 = append(v4, a.IP.String())
+		} else {
+			v6 = append(v6, a.IP.String())
+		}
+	}
+	if all {
+		return append(v4, v6...)
+	}
+	if len(v4) == 0 {
+		return v6
+	}
+	return v4
+}
+
+// localIP returns the source address the host would use to reach addr. No packets are sent.
+func localIP(network, addr string) string {
+	c, err := net.Dial(network, addr)
+	if err != nil {
+		return ""
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP.String()
+}
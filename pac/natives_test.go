@@ -0,0 +1,130 @@
+package pac
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ipv6OnlyResolver returns a resolver answering AAAA queries for the names of hosts, as
+// on IPv6-only networks. A queries get no answer, and other names do not exist.
+func ipv6OnlyResolver(hosts map[string][]string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go serveDNS(server, hosts)
+			return client, nil
+		},
+	}
+}
+
+// serveDNS answers the queries, framed as over TCP, read from conn.
+func serveDNS(conn net.Conn, hosts map[string][]string) {
+	defer conn.Close()
+	for {
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+			return
+		}
+		q := msg.Questions[0]
+		msg.Header.Response, msg.Header.RecursionAvailable = true, true
+		ips, ok := hosts[strings.TrimSuffix(q.Name.String(), ".")]
+		if !ok {
+			msg.Header.RCode = dnsmessage.RCodeNameError
+		}
+		if q.Type == dnsmessage.TypeAAAA {
+			for _, s := range ips {
+				var aaaa dnsmessage.AAAAResource
+				copy(aaaa.AAAA[:], net.ParseIP(s))
+				msg.Answers = append(msg.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+					Body:   &aaaa,
+				})
+			}
+		}
+		answer, err := msg.Pack()
+		if err != nil {
+			return
+		}
+		binary.BigEndian.PutUint16(size[:], uint16(len(answer)))
+		if _, err := conn.Write(append(size[:], answer...)); err != nil {
+			return
+		}
+	}
+}
+
+// evaluate evaluates expr in a runtime of g, where host is defined.
+func evaluate(t *testing.T, g Goja, expr, host string) string {
+	e, err := g.Compile(`function FindProxyForURL(url, host) { return "DIRECT"; }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm, err := e.(*gojaEvaluator).newRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.Set("host", host)
+	v, err := vm.RunString(expr)
+	if err != nil {
+		t.Fatalf("%s: %s", expr, err)
+	}
+	return v.String()
+}
+
+func TestNativesIPv6Only(t *testing.T) {
+	g := Goja{
+		Resolver: ipv6OnlyResolver(map[string][]string{
+			"v6.example.test": {"2001:db8::10", "2001:db8::11"},
+		}),
+		MyIPAddress: func() []net.IP {
+			return []net.IP{net.ParseIP("2001:db8::5"), net.ParseIP("2001:db8:1::5")}
+		},
+	}
+	tests := []struct {
+		expr, host, want string
+	}{
+		{"dnsResolve(host)", "v6.example.test", "2001:db8::10"},
+		{"dnsResolveEx(host)", "v6.example.test", "2001:db8::10;2001:db8::11"},
+		{"isResolvable(host)", "v6.example.test", "true"},
+		{"isResolvableEx(host)", "v6.example.test", "true"},
+		{"isInNetEx(host, '2001:db8::/64')", "v6.example.test", "true"},
+		{"isInNetEx(host, '2001:db8:1::/48')", "v6.example.test", "false"},
+		{"dnsResolve(host)", "missing.example.test", "null"},
+		{"dnsResolveEx(host)", "missing.example.test", ""},
+		{"isResolvable(host)", "missing.example.test", "false"},
+		{"dnsResolveEx(host)", "2001:db8::20", "2001:db8::20"},
+		{"myIpAddress()", "v6.example.test", "2001:db8::5"},
+		{"myIpAddressEx()", "v6.example.test", "2001:db8::5;2001:db8:1::5"},
+		{"isInNetEx(myIpAddress(), '2001:db8::/64')", "v6.example.test", "true"},
+	}
+	for _, tt := range tests {
+		if got := evaluate(t, g, tt.expr, tt.host); got != tt.want {
+			t.Errorf("%s for %s = %q, want %q", tt.expr, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestLookupPrefersIPv4(t *testing.T) {
+	r := ipv6OnlyResolver(map[string][]string{"v6.example.test": {"2001:db8::10"}})
+	// without A records, IPv6 addresses are returned rather than none
+	if got := lookup(r, "v6.example.test", false); len(got) != 1 || got[0] != "2001:db8::10" {
+		t.Errorf("lookup = %v, want [2001:db8::10]", got)
+	}
+	if got := lookup(r, "2001:DB8::1", false); len(got) != 1 || got[0] != "2001:db8::1" {
+		t.Errorf("lookup of an IPv6 literal = %v", got)
+	}
+}
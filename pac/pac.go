@@ -0,0 +1,24 @@
+// Package pac evaluates proxy auto-config (PAC) scripts. The JavaScript engine is
+// pluggable: the default Goja engine embeds a pure Go interpreter, and External delegates
+// evaluation to another process for environments with strict supply-chain policies.
+package pac
+
+import (
+	"context"
+)
+
+// Evaluator runs FindProxyForURL of a compiled PAC script. Implementations must be safe
+// for concurrent use.
+type Evaluator interface {
+	// FindProxyForURL returns the raw result of the script for rawurl and host,
+	// ex: "PROXY proxy.example.com:8080; DIRECT".
+	FindProxyForURL(ctx context.Context, rawurl, host string) (string, error)
+}
+
+// Engine compiles PAC scripts into Evaluators.
+type Engine interface {
+	Compile(script string) (Evaluator, error)
+}
+
+// DefaultEngine is the Engine used when none is specified.
+var DefaultEngine Engine = Goja{}
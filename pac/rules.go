@@ -0,0 +1,125 @@
+package pac
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// defaultProbe is a host no PAC script special-cases, used to find the default result.
+const defaultProbe = "proxyplease-probe.invalid"
+
+// Rule maps destinations to the result of a PAC script for them.
+type Rule struct {
+	Match  string `json:"match"`  // Host name, domain pattern such as "*.example.com", or CIDR.
+	Result string `json:"result"` // Normalized FindProxyForURL result, ex: "DIRECT" or "PROXY proxy:8080; DIRECT".
+}
+
+// RuleSet is a static approximation of a PAC script and bypass list, for components that
+// cannot evaluate PAC themselves, such as firewalls or VPN split-tunnel configuration.
+// Destinations matching no rule use Default.
+type RuleSet struct {
+	Rules   []Rule `json:"rules"`
+	Default string `json:"default"`
+}
+
+// RuleOptions select the destinations compiled into a RuleSet.
+type RuleOptions struct {
+	// Probes are evaluated against the script: host names, domain patterns such as
+	// "*.example.com", or CIDRs such as "10.0.0.0/8". Since a PAC script can contain
+	// arbitrary logic, only probed destinations are guaranteed to be represented.
+	Probes []string
+	// Bypass entries are always DIRECT, ex: the entries of NO_PROXY.
+	Bypass []string
+}
+
+// BuildRules evaluates ev for the destinations of o and returns the resulting RuleSet.
+// Rules with the default result are omitted.
+func BuildRules(ctx context.Context, ev Evaluator, o RuleOptions) (RuleSet, error) {
+	def, err := evaluateNormalized(ctx, ev, defaultProbe)
+	if err != nil {
+		return RuleSet{}, err
+	}
+	rs := RuleSet{Default: def, Rules: []Rule{}}
+	for _, b := range o.Bypass {
+		if b = strings.TrimSpace(b); b != "" {
+			rs.Rules = append(rs.Rules, Rule{Match: b, Result: "DIRECT"})
+		}
+	}
+	for _, probe := range o.Probes {
+		result, err := evaluateNormalized(ctx, ev, probeHost(probe))
+		if err != nil {
+			return RuleSet{}, err
+		}
+		if result != def {
+			rs.Rules = append(rs.Rules, Rule{Match: probe, Result: result})
+		}
+	}
+	return rs, nil
+}
+
+// probeHost returns the host evaluated for a probe.
+func probeHost(probe string) string {
+	if _, n, err := net.ParseCIDR(probe); err == nil {
+		// evaluate the first host address of the network
+		ip := append(net.IP(nil), n.IP...)
+		if ones, bits := n.Mask.Size(); bits-ones > 1 {
+			ip[len(ip)-1]++
+		}
+		return ip.String()
+	}
+	if strings.HasPrefix(probe, "*.") {
+		return "proxyplease-probe" + probe[1:]
+	}
+	return probe
+}
+
+// evaluateNormalized evaluates ev for host and returns the parsed result re-serialized,
+// so equivalent results compare equal.
+func evaluateNormalized(ctx context.Context, ev Evaluator, host string) (string, error) {
+	result, err := ev.FindProxyForURL(ctx, "https://"+host+"/", host)
+	if err != nil {
+		return "", err
+	}
+	ds, err := ParseResult(result)
+	if err != nil {
+		return "", err
+	}
+	s := make([]string, len(ds))
+	for i, d := range ds {
+		s[i] = d.Type
+		if d.Host != "" {
+			s[i] += " " + d.Host
+		}
+	}
+	return strings.Join(s, "; "), nil
+}
+
+// WatchRules rebuilds the RuleSet every interval until ctx is done, and calls onChange
+// with the first RuleSet and whenever it changes. compile returns the Evaluator of the
+// current script, ex: by downloading and compiling it, so script updates are picked up.
+// Errors are passed to onError, if set, and the previous RuleSet is kept.
+func WatchRules(ctx context.Context, interval time.Duration, compile func(context.Context) (Evaluator, error), o RuleOptions, onChange func(RuleSet), onError func(error)) {
+	var last *RuleSet
+	for {
+		ev, err := compile(ctx)
+		if err == nil {
+			var rs RuleSet
+			if rs, err = BuildRules(ctx, ev, o); err == nil && (last == nil || !reflect.DeepEqual(*last, rs)) {
+				last = &rs
+				onChange(rs)
+			}
+		}
+		if err != nil && onError != nil && ctx.Err() == nil {
+			onError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
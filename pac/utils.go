@@ -0,0 +1,188 @@
+package pac
+
+// utilsJS implements the standard PAC helper functions in JavaScript. Functions needing
+// network access (dnsResolve, myIpAddress, ...) or IPv6 support (isInNetEx) are provided
+// natively.
+const utilsJS = `
+function dnsDomainIs(host, domain) {
+	host = String(host).toLowerCase();
+	domain = String(domain).toLowerCase();
+	return host.length >= domain.length &&
+		host.substring(host.length - domain.length) == domain;
+}
+
+function dnsDomainLevels(host) {
+	return String(host).split('.').length - 1;
+}
+
+function isPlainHostName(host) {
+	return String(host).indexOf('.') < 0 && String(host).indexOf(':') < 0;
+}
+
+function localHostOrDomainIs(host, hostdom) {
+	host = String(host).toLowerCase();
+	hostdom = String(hostdom).toLowerCase();
+	return host == hostdom || hostdom.lastIndexOf(host + '.', 0) == 0;
+}
+
+function _ipv4ToInt(ip) {
+	var m = /^(\d{1,3})\.(\d{1,3})\.(\d{1,3})\.(\d{1,3})$/.exec(String(ip));
+	if (!m) {
+		return null;
+	}
+	var n = 0;
+	for (var i = 1; i <= 4; i++) {
+		var o = parseInt(m[i], 10);
+		if (o > 255) {
+			return null;
+		}
+		n = n * 256 + o;
+	}
+	return n;
+}
+
+function isInNet(host, pattern, mask) {
+	var ip = _ipv4ToInt(host);
+	if (ip === null) {
+		var resolved = dnsResolve(host);
+		if (resolved === null) {
+			return false;
+		}
+		ip = _ipv4ToInt(resolved);
+	}
+	var p = _ipv4ToInt(pattern), m = _ipv4ToInt(mask);
+	if (ip === null || p === null || m === null) {
+		return false;
+	}
+	for (var i = 0; i < 4; i++) {
+		var d = Math.pow(256, 3 - i);
+		var a = Math.floor(ip / d) % 256, b = Math.floor(p / d) % 256, c = Math.floor(m / d) % 256;
+		if ((a & c) != (b & c)) {
+			return false;
+		}
+	}
+	return true;
+}
+
+function shExpMatch(str, shexp) {
+	var re = String(shexp)
+		.replace(/[.+^${}()|[\]\\\/]/g, '\\$&')
+		.replace(/\*/g, '.*')
+		.replace(/\?/g, '.');
+	return new RegExp('^' + re + '$').test(String(str));
+}
+
+var _days = ['SUN', 'MON', 'TUE', 'WED', 'THU', 'FRI', 'SAT'];
+var _months = ['JAN', 'FEB', 'MAR', 'APR', 'MAY', 'JUN', 'JUL', 'AUG', 'SEP', 'OCT', 'NOV', 'DEC'];
+
+function _gmt(args) {
+	return args.length > 0 && args[args.length - 1] === 'GMT';
+}
+
+function weekdayRange(wd1, wd2, gmt) {
+	var args = Array.prototype.slice.call(arguments);
+	var utc = _gmt(args);
+	if (utc) {
+		args.pop();
+	}
+	var now = new Date();
+	var today = utc ? now.getUTCDay() : now.getDay();
+	var d1 = _days.indexOf(String(args[0]).toUpperCase());
+	if (d1 < 0) {
+		return false;
+	}
+	if (args.length < 2) {
+		return today == d1;
+	}
+	var d2 = _days.indexOf(String(args[1]).toUpperCase());
+	if (d2 < 0) {
+		return false;
+	}
+	return d1 <= d2 ? (today >= d1 && today <= d2) : (today >= d1 || today <= d2);
+}
+
+function _inRange(v, lo, hi) {
+	return lo <= hi ? (v >= lo && v <= hi) : (v >= lo || v <= hi);
+}
+
+function dateRange() {
+	var args = Array.prototype.slice.call(arguments);
+	var utc = _gmt(args);
+	if (utc) {
+		args.pop();
+	}
+	var now = new Date();
+	var date = utc ? now.getUTCDate() : now.getDate();
+	var month = utc ? now.getUTCMonth() : now.getMonth();
+	var year = utc ? now.getUTCFullYear() : now.getFullYear();
+
+	// normalize each argument to a date, month or year component
+	var parts = [];
+	for (var i = 0; i < args.length; i++) {
+		var a = args[i];
+		var m = _months.indexOf(String(a).toUpperCase());
+		if (m >= 0) {
+			parts.push({k: 'm', v: m});
+		} else if (typeof a === 'number' && a > 31) {
+			parts.push({k: 'y', v: a});
+		} else {
+			parts.push({k: 'd', v: Number(a)});
+		}
+	}
+	var value = function(p) {
+		return p.k == 'm' ? month : (p.k == 'y' ? year : date);
+	};
+	if (parts.length == 1) {
+		return value(parts[0]) == parts[0].v;
+	}
+	if (parts.length % 2 != 0) {
+		return false;
+	}
+	// compare composite values, most significant component first
+	var half = parts.length / 2;
+	var order = {y: 0, m: 1, d: 2};
+	var key = function(ps, current) {
+		var sorted = ps.slice().sort(function(a, b) { return order[a.k] - order[b.k]; });
+		var n = 0;
+		for (var i = 0; i < sorted.length; i++) {
+			var v = current ? value(sorted[i]) : sorted[i].v;
+			n = n * 10000 + v;
+		}
+		return n;
+	};
+	var lo = parts.slice(0, half), hi = parts.slice(half);
+	return _inRange(key(lo, true), key(lo, false), key(hi, false));
+}
+
+function timeRange() {
+	var args = Array.prototype.slice.call(arguments);
+	var utc = _gmt(args);
+	if (utc) {
+		args.pop();
+	}
+	var now = new Date();
+	var h = utc ? now.getUTCHours() : now.getHours();
+	var min = utc ? now.getUTCMinutes() : now.getMinutes();
+	var s = utc ? now.getUTCSeconds() : now.getSeconds();
+	switch (args.length) {
+	case 1:
+		return h == args[0];
+	case 2:
+		return _inRange(h, args[0], args[1]);
+	case 4:
+		return _inRange(h * 60 + min, args[0] * 60 + args[1], args[2] * 60 + args[3]);
+	case 6:
+		return _inRange(h * 3600 + min * 60 + s,
+			args[0] * 3600 + args[1] * 60 + args[2], args[3] * 3600 + args[4] * 60 + args[5]);
+	}
+	return false;
+}
+
+function sortIpAddressList(list) {
+	return String(list).split(';').sort().join(';');
+}
+
+function getClientVersion() {
+	return '1.0';
+}
+`
@@ -0,0 +1,75 @@
+package proxyplease
+
+import (
+	"context"
+	"net/url"
+	"sync"
+)
+
+// pacFetches deduplicates concurrent downloads of PAC scripts, so dials starting together
+// download each script once, even across dialers.
+var pacFetches = newFlightGroup()
+
+// flightGroup runs one call per key at a time and shares its result with the callers
+// asking for the key meanwhile.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: map[string]*flight{}}
+}
+
+// do calls fn, or waits for the call for key in flight. Results, including failures, are
+// shared with the waiting callers but not kept, so the next call for key calls fn again.
+// Waiting stops when ctx is done.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if f, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.value, f.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	f := &flight{done: make(chan struct{})}
+	g.calls[key] = f
+	g.mu.Unlock()
+
+	f.value, f.err = fn()
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(f.done)
+	return f.value, f.err
+}
+
+// fetchPAC downloads the PAC script at u with FetchPAC, sharing the download with
+// concurrent callers.
+func fetchPAC(ctx context.Context, u *url.URL) (string, error) {
+	script, err := pacFetches.do(ctx, u.String(), func() (interface{}, error) {
+		return FetchPAC(ctx, nil, u)
+	})
+	if err != nil {
+		return "", err
+	}
+	return script.(string), nil
+}
+
+// decisionCache returns the cache of PAC results of p: p.DecisionCache, or a private
+// cache if only p.PACCacheTTL is set.
+func decisionCache(p Proxy) *DecisionCache {
+	if p.DecisionCache == nil && p.PACCacheTTL > 0 {
+		return NewDecisionCache(0)
+	}
+	return p.DecisionCache
+}
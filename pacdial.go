@@ -0,0 +1,255 @@
+package proxyplease
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bdwyertech/proxyplease/pac"
+)
+
+// pacDialer consults a PAC script for each dialed destination and connects as the first
+// usable directive of its result says.
+type pacDialer struct {
+	p Proxy
+
+	cache *DecisionCache
+	evals *flightGroup // evaluations of the script in flight, by URL
+
+	mu      sync.Mutex
+	ev      pac.Evaluator
+	dialers map[string]DialContext // by proxy URL
+	down    map[string]time.Time   // end of the quarantine of unreachable proxies, by proxy URL
+}
+
+// pacDialFunc returns the DialContext selecting proxies with the PAC script of p.
+func pacDialFunc(p Proxy) DialContext {
+	pd := newPACDialer(p)
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if isPACFetch(ctx) {
+			return p.dialDirect(ctx, network, addr)
+		}
+		addr, err := normalizeAuthority(addr, p.Authority)
+		if err != nil {
+			return nil, err
+		}
+		if p.bypassed(addr) {
+			p.debugf("proxy> Connecting directly to %s as it is bypassed", addr)
+			return p.dialDirect(ctx, network, addr)
+		}
+		return pd.DialContext(ctx, network, addr)
+	}
+}
+
+// usesPAC reports whether p selects proxies per destination with a PAC script, or from
+// p.ProxyList.
+func usesPAC(p Proxy) bool {
+	return (p.URL == nil || p.URL.String() == "") && len(p.Upstreams) == 0 && (p.PACURL != nil || p.PACScript != "" || p.ProxyList != "")
+}
+
+// pacSource returns the source of the proxies selected by the pacDialer of p.
+func pacSource(p Proxy) Source {
+	if p.ProxyList != "" {
+		return SourceStatic
+	}
+	return SourcePAC
+}
+
+func newPACDialer(p Proxy) *pacDialer {
+	return &pacDialer{p: p, cache: decisionCache(p), evals: newFlightGroup(), dialers: map[string]DialContext{}, down: map[string]time.Time{}}
+}
+
+// evaluator returns the compiled PAC script, downloading it on first use. Concurrent
+// dials share the download. Failures are not cached, so the next dial tries again.
+func (d *pacDialer) evaluator(ctx context.Context) (pac.Evaluator, error) {
+	d.mu.Lock()
+	ev := d.ev
+	d.mu.Unlock()
+	if ev != nil {
+		return ev, nil
+	}
+	script := d.p.PACScript
+	if script == "" {
+		var err error
+		if script, err = fetchPAC(ctx, d.p.PACURL); err != nil {
+			d.p.debugf("pac> Could not download %s: %s", d.p.PACURL.Redacted(), err)
+			return nil, err
+		}
+	}
+	engine := d.p.PACEngine
+	if engine == nil {
+		engine = pac.DefaultEngine
+	}
+	if g, ok := engine.(pac.Goja); ok {
+		// settings of the engine itself take precedence over those of the Proxy
+		if d.p.Resolver != nil && g.Resolver == nil {
+			g.Resolver = d.p.Resolver
+		}
+		if (d.p.LocalAddr != nil || d.p.Interface != "") && g.MyIPAddress == nil {
+			g.MyIPAddress = d.myIPAddress
+		}
+		engine = g
+	}
+	ev, err := engine.Compile(script)
+	if err != nil {
+		d.p.debugf("pac> Could not compile PAC script: %s", err)
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ev == nil {
+		d.ev = ev
+	} else if c, ok := ev.(io.Closer); ok {
+		// a concurrent dial compiled the script first
+		c.Close()
+	}
+	return d.ev, nil
+}
+
+// myIPAddress returns the addresses the PAC script sees with myIpAddress, those of
+// Proxy.LocalAddr or Proxy.Interface, or none to use the default route.
+func (d *pacDialer) myIPAddress() []net.IP {
+	ips, err := d.p.localIPs()
+	if err != nil {
+		d.p.debugf("pac> Could not determine the address for myIpAddress: %s", err)
+	}
+	return ips
+}
+
+// DialContext connects to addr through the proxies the PAC script returns for it, in
+// order. The next directive is tried only when a proxy cannot be reached, as browsers do,
+// and the unreachable proxy is quarantined, or refuses the port of addr if
+// p.RetryDeniedPorts is set.
+func (d *pacDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+	}
+	directives, err := d.directives(ctx, pacTargetURL(host, port), host)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	for _, directive := range d.usable(directives) {
+		if directive.Type == "DIRECT" {
+			conn, err = d.p.dialDirect(ctx, network, addr)
+		} else if conn, err = d.dialer(directive)(ctx, network, addr); err == nil {
+			if c, ok := conn.(*Conn); ok {
+				c.info.Source = d.p.source
+			}
+		}
+		if err == nil || Classify(err) != Unclassified && !d.p.retriesDeniedPort(err) {
+			return conn, err
+		}
+		d.p.debugf("pac> %s %s failed for %s: %s", directive.Type, directive.Host, addr, err)
+		if unreachable(ctx, err) {
+			d.quarantine(directive)
+		}
+	}
+	return conn, err
+}
+
+// directives evaluates the PAC script for rawurl and host, or returns the result cached
+// in p.DecisionCache for less than p.PACCacheTTL. Concurrent dials to the same
+// destination share the evaluation. p.ProxyList is returned as is.
+func (d *pacDialer) directives(ctx context.Context, rawurl, host string) ([]pac.Directive, error) {
+	if d.p.ProxyList != "" {
+		return pac.ParseResult(d.p.ProxyList)
+	}
+	if d.cache != nil {
+		if directives, ok := d.cache.get(rawurl, clockOr(d.p.Clock).Now()); ok {
+			return directives, nil
+		}
+	}
+	directives, err := d.evals.do(ctx, rawurl, func() (interface{}, error) {
+		return d.evaluate(ctx, rawurl, host)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return directives.([]pac.Directive), nil
+}
+
+// evaluate evaluates the PAC script for rawurl and host and caches the result.
+func (d *pacDialer) evaluate(ctx context.Context, rawurl, host string) ([]pac.Directive, error) {
+	ev, err := d.evaluator(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result, err := ev.FindProxyForURL(ctx, rawurl, host)
+	if err != nil {
+		d.p.debugf("pac> FindProxyForURL failed for %s: %s", host, err)
+		return nil, err
+	}
+	d.p.debugf("pac> FindProxyForURL returned '%s' for %s", result, host)
+	directives, err := pac.ParseResult(result)
+	if err == nil && d.cache != nil {
+		var expires time.Time
+		if d.p.PACCacheTTL > 0 {
+			expires = clockOr(d.p.Clock).Now().Add(d.p.PACCacheTTL)
+		}
+		d.cache.put(rawurl, directives, expires)
+	}
+	return directives, err
+}
+
+// decision returns the first directive of the PAC script for target as a Decision.
+// Failures to evaluate the script are reported as a direct connection.
+func (d *pacDialer) decision(ctx context.Context, target *url.URL) Decision {
+	directives, err := d.directives(ctx, target.String(), target.Hostname())
+	if err != nil || directives[0].Type == "DIRECT" {
+		return Decision{Source: pacSource(d.p)}
+	}
+	return Decision{URL: directiveURL(directives[0]), Source: pacSource(d.p)}
+}
+
+// directiveURL returns the proxy URL of a PAC directive other than DIRECT. SOCKS means
+// SOCKS4, and SOCKS5 proxies resolve target names, as in browsers.
+func directiveURL(directive pac.Directive) *url.URL {
+	scheme := "http"
+	switch directive.Type {
+	case "HTTPS":
+		scheme = "https"
+	case "SOCKS", "SOCKS4":
+		scheme = "socks4"
+	case "SOCKS5":
+		scheme = "socks5h"
+	}
+	return &url.URL{Scheme: scheme, Host: directive.Host}
+}
+
+// dialer returns the DialContext of the proxy named by directive.
+func (d *pacDialer) dialer(directive pac.Directive) DialContext {
+	u := directiveURL(directive)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if dial, ok := d.dialers[u.String()]; ok {
+		return dial
+	}
+	q := d.p
+	q.URL, q.PACURL, q.PACScript = u, nil, ""
+	dial, _, _ := newDialFunc(q)
+	d.dialers[u.String()] = dial
+	return dial
+}
+
+// pacTargetURL returns the URL passed to FindProxyForURL for a dial to host:port. Only
+// the authority is known, so the scheme is inferred from the port.
+func pacTargetURL(host, port string) string {
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	switch port {
+	case "", "443":
+		return "https://" + host + "/"
+	case "80":
+		return "http://" + host + "/"
+	}
+	return "https://" + host + ":" + port + "/"
+}
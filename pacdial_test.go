@@ -0,0 +1,53 @@
+package proxyplease
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bdwyertech/proxyplease/pac"
+)
+
+// resultEngine compiles every script into an Evaluator returning result.
+type resultEngine struct {
+	result   string
+	compiled *int32
+}
+
+func (e resultEngine) Compile(script string) (pac.Evaluator, error) {
+	atomic.AddInt32(e.compiled, 1)
+	return e, nil
+}
+
+func (e resultEngine) FindProxyForURL(ctx context.Context, rawurl, host string) (string, error) {
+	return e.result, nil
+}
+
+func TestDialPACEngine(t *testing.T) {
+	target := newEchoServer(t)
+	defer target.Close()
+	s := newTestServer("user", "secret", "Basic")
+	defer s.Close()
+
+	// the script connects directly; the engine of the Proxy sends dials through s instead
+	script := `function FindProxyForURL(url, host) { return "DIRECT"; }`
+	var compiled int32
+	p := testProxy(t, s, "user", "secret")
+	p.URL, p.PACScript = nil, script
+	p.PACEngine = resultEngine{result: "PROXY " + s.URL.Host, compiled: &compiled}
+	dial := NewDialContext(p)
+	for i := 0; i < 2; i++ {
+		if got, err := dialEcho(dial, target.Addr().String()); err != nil || got != "Basic" {
+			t.Fatalf("dial %d: authenticated with %q, %v, want Basic through the proxy of the engine", i, got, err)
+		}
+	}
+	if n := atomic.LoadInt32(&compiled); n != 1 {
+		t.Errorf("script compiled %d times, want 1", n)
+	}
+
+	// other Proxies keep the default engine
+	p.PACEngine = nil
+	if got, err := dialEcho(NewDialContext(p), target.Addr().String()); err != nil || got != "" {
+		t.Errorf("dial with the default engine: authenticated with %q, %v, want a direct connection", got, err)
+	}
+}
@@ -0,0 +1,290 @@
+package proxyplease
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Bounds of the backoff between attempts to rebuild a pooled tunnel.
+const (
+	poolRetryMin = 500 * time.Millisecond
+	poolRetryMax = 30 * time.Second
+)
+
+// poolDecayDials is the number of dials after which the dial counts of targets are
+// halved, so targets no longer used stop being kept warm.
+const poolDecayDials = 1000
+
+// TunnelPool keeps tunnels to each target established ahead of use, so a dial does not
+// wait for the proxy handshake. Tunnels handed out or found closed by the proxy, ex: when
+// a proxy node restarts, are rebuilt in the background with exponential backoff rather
+// than on the critical path of the next dial, which connects on its own meanwhile. This
+// spares connection-oriented schemes such as NTLM a full authentication per dial.
+//
+// Targets passed to Warm are always kept warm. Targets dialed through the pool are learned
+// from usage: MinDials and MaxTargets restrict them to the most frequently dialed, so
+// one-off targets do not hold idle tunnels.
+//
+// IdleTimeout, MaxIdle, MinDials and MaxTargets must be set before the pool is used.
+type TunnelPool struct {
+	IdleTimeout time.Duration // Idle tunnels older than this are discarded rather than handed out, since proxies often drop them silently. Zero keeps them until the proxy closes them.
+	MaxIdle     int           // Limit on the idle tunnels kept across all targets. Zero means size per target without overall limit.
+	MinDials    int           // Dials through the pool a target needs before it is kept warm. Zero or one warms every target dialed.
+	MaxTargets  int           // Limit on the targets learned from dials kept warm, the most dialed first. Idle tunnels to targets falling out are closed. Zero means no limit.
+
+	p      Proxy
+	size   int
+	dialer *Dialer
+	clock  Clock
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	idle    map[string][]idleTunnel
+	filling map[string]bool
+	pinned  map[string]bool // targets passed to Warm
+	dials   map[string]int  // dials per target, halved every poolDecayDials
+	total   int             // dials since the counts were last halved
+}
+
+// idleTunnel is an established tunnel waiting in the pool.
+type idleTunnel struct {
+	conn  *Conn
+	since time.Time
+}
+
+// NewTunnelPool returns a TunnelPool keeping size idle tunnels, at least one, to each
+// target dialed through it or passed to Warm.
+func NewTunnelPool(p Proxy, size int) *TunnelPool {
+	if size < 1 {
+		size = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &TunnelPool{
+		p:       p,
+		size:    size,
+		dialer:  NewDialer(p),
+		clock:   clockOr(p.Clock),
+		ctx:     ctx,
+		cancel:  cancel,
+		idle:    map[string][]idleTunnel{},
+		filling: map[string]bool{},
+		pinned:  map[string]bool{},
+		dials:   map[string]int{},
+	}
+}
+
+// Warm starts establishing tunnels to addrs (host:port) in the background, and keeps
+// them warm regardless of usage.
+func (tp *TunnelPool) Warm(addrs ...string) {
+	for _, addr := range addrs {
+		tp.mu.Lock()
+		tp.pinned[addr] = true
+		tp.mu.Unlock()
+		tp.fill(addr)
+	}
+}
+
+// DialContext returns an idle tunnel to addr if one is alive, and dials a new one
+// otherwise. It can be assigned to http.Transport.DialContext.
+func (tp *TunnelPool) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if _, ok := contextCredentials(ctx); network != "tcp" || ok {
+		// pooled tunnels are not authenticated with the credentials of ctx
+		return tp.dialer.DialContext(ctx, network, addr)
+	}
+	tp.learn(addr)
+	for {
+		tp.mu.Lock()
+		conns := tp.idle[addr]
+		if len(conns) == 0 {
+			tp.mu.Unlock()
+			break
+		}
+		t := conns[len(conns)-1]
+		tp.idle[addr] = conns[:len(conns)-1]
+		tp.mu.Unlock()
+
+		tp.fill(addr)
+		if tp.IdleTimeout > 0 && tp.clock.Now().Sub(t.since) > tp.IdleTimeout {
+			tp.p.debugf("pool> Discarding tunnel to %s idle for more than %s", addr, tp.IdleTimeout)
+			t.conn.Close()
+			continue
+		}
+		if t.conn.alive() {
+			return t.conn, nil
+		}
+		tp.p.debugf("pool> Discarding closed tunnel to %s", addr)
+		t.conn.Close()
+	}
+	tp.fill(addr)
+	return tp.dialer.DialContext(ctx, network, addr)
+}
+
+// Close stops rebuilding tunnels and closes the idle ones. Tunnels already handed out
+// are left open.
+func (tp *TunnelPool) Close() error {
+	tp.cancel()
+	tp.wg.Wait()
+	tp.mu.Lock()
+	for _, conns := range tp.idle {
+		for _, t := range conns {
+			t.conn.Close()
+		}
+	}
+	tp.idle = map[string][]idleTunnel{}
+	tp.mu.Unlock()
+	return nil
+}
+
+// Shutdown closes the pool like Close, then shuts its Dialer down: it waits for the
+// tunnels handed out to be closed by their users until ctx is done, then closes them, see
+// Dialer.Shutdown.
+func (tp *TunnelPool) Shutdown(ctx context.Context) error {
+	tp.Close()
+	return tp.dialer.Shutdown(ctx)
+}
+
+// learn counts a dial of addr, and closes the idle tunnels to targets no longer among
+// the most dialed.
+func (tp *TunnelPool) learn(addr string) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.dials[addr]++
+	if tp.total++; tp.total >= poolDecayDials {
+		tp.total = 0
+		for a, n := range tp.dials {
+			if n /= 2; n == 0 {
+				delete(tp.dials, a)
+			} else {
+				tp.dials[a] = n
+			}
+		}
+	}
+	for a, conns := range tp.idle {
+		if len(conns) == 0 || tp.warm(a) {
+			continue
+		}
+		tp.p.debugf("pool> No longer keeping tunnels to %s warm", a)
+		for _, t := range conns {
+			t.conn.Close()
+		}
+		delete(tp.idle, a)
+	}
+}
+
+// warm reports whether tunnels to addr are kept ahead of use: it was passed to Warm, or
+// was dialed at least MinDials times and is among the MaxTargets most dialed targets.
+// tp.mu must be held.
+func (tp *TunnelPool) warm(addr string) bool {
+	if tp.pinned[addr] {
+		return true
+	}
+	n := tp.dials[addr]
+	if n == 0 || n < tp.MinDials {
+		return false
+	}
+	if tp.MaxTargets <= 0 {
+		return true
+	}
+	ahead := 0
+	for a, m := range tp.dials {
+		if !tp.pinned[a] && (m > n || m == n && a < addr) {
+			ahead++
+		}
+	}
+	return ahead < tp.MaxTargets
+}
+
+// fill starts topping up the idle tunnels to addr, unless it is already running or addr
+// is not kept warm.
+func (tp *TunnelPool) fill(addr string) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if tp.filling[addr] || tp.ctx.Err() != nil || !tp.warm(addr) {
+		return
+	}
+	tp.filling[addr] = true
+	tp.wg.Add(1)
+	go tp.refill(addr)
+}
+
+// refill establishes tunnels to addr until size are idle, backing off exponentially
+// while the proxy fails.
+func (tp *TunnelPool) refill(addr string) {
+	defer tp.wg.Done()
+	backoff := poolRetryMin
+	for {
+		tp.mu.Lock()
+		if len(tp.idle[addr]) >= tp.size || tp.full() || tp.ctx.Err() != nil || !tp.warm(addr) {
+			tp.filling[addr] = false
+			tp.mu.Unlock()
+			return
+		}
+		tp.mu.Unlock()
+
+		conn, err := tp.dialer.DialContext(tp.ctx, "tcp", addr)
+		if err != nil {
+			if tp.ctx.Err() != nil {
+				continue
+			}
+			tp.p.debugf("pool> Could not rebuild tunnel to %s, retrying in %s: %s", addr, backoff, err)
+			select {
+			case <-tp.clock.After(backoff):
+			case <-tp.ctx.Done():
+			}
+			if backoff *= 2; backoff > poolRetryMax {
+				backoff = poolRetryMax
+			}
+			continue
+		}
+		backoff = poolRetryMin
+
+		c, ok := conn.(*Conn)
+		if !ok {
+			c = &Conn{Conn: conn}
+		}
+		tp.mu.Lock()
+		if tp.ctx.Err() != nil || !tp.warm(addr) {
+			tp.mu.Unlock()
+			c.Close()
+			continue
+		}
+		tp.idle[addr] = append(tp.idle[addr], idleTunnel{conn: c, since: tp.clock.Now()})
+		tp.mu.Unlock()
+	}
+}
+
+// full reports whether MaxIdle tunnels are idle. tp.mu must be held.
+func (tp *TunnelPool) full() bool {
+	if tp.MaxIdle <= 0 {
+		return false
+	}
+	n := 0
+	for _, conns := range tp.idle {
+		n += len(conns)
+	}
+	return n >= tp.MaxIdle
+}
+
+// alive reports whether the peer has not closed the idle tunnel. Data the target already
+// sent, such as a server greeting, is kept for the next Read.
+func (c *Conn) alive() bool {
+	if len(c.pending) > 0 {
+		return true
+	}
+	var b [1]byte
+	c.Conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	n, err := c.Conn.Read(b[:])
+	c.Conn.SetReadDeadline(time.Time{})
+	if n > 0 {
+		c.pending = b[:n]
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,78 @@
+package proxyplease
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrPortNotAllowed is returned, without contacting the proxy, for dials to a port
+// missing from Proxy.AllowedPorts.
+var ErrPortNotAllowed = errors.New("target port is not allowed through the proxy")
+
+// ErrPortDeniedByProxy is returned when a proxy refuses a tunnel (PolicyDenied) to a port
+// other than 443, which proxies commonly restrict CONNECT to, ex: Squid's SSL_ports. It
+// wraps the *StatusError of the proxy answer.
+type ErrPortDeniedByProxy struct {
+	Proxy string // Host and port of the proxy.
+	Port  string // Target port refused.
+	Err   error
+}
+
+func (e *ErrPortDeniedByProxy) Error() string {
+	return "proxy " + e.Proxy + " refused a tunnel to port " + e.Port + ": " + e.Err.Error()
+}
+
+func (e *ErrPortDeniedByProxy) Unwrap() error {
+	return e.Err
+}
+
+// portDenied returns err as an *ErrPortDeniedByProxy if the proxy at p.URL refused the
+// tunnel to addr, whose port is not 443.
+func portDenied(p Proxy, addr string, err error) error {
+	if err == nil || Classify(err) != PolicyDenied {
+		return err
+	}
+	_, port, serr := net.SplitHostPort(addr)
+	if serr != nil || port == "443" {
+		return err
+	}
+	return &ErrPortDeniedByProxy{Proxy: p.URL.Host, Port: port, Err: err}
+}
+
+// retriesDeniedPort reports whether a dial failing with err is retried through the next
+// proxy, as p.RetryDeniedPorts allows.
+func (p Proxy) retriesDeniedPort(err error) bool {
+	var pd *ErrPortDeniedByProxy
+	return p.RetryDeniedPorts && errors.As(err, &pd)
+}
+
+// portAllowed reports whether addr may be tunneled according to p.AllowedPorts.
+func portAllowed(p Proxy, addr string) bool {
+	if p.AllowedPorts == nil {
+		return true
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range p.AllowedPorts {
+		if allowed == port {
+			return true
+		}
+	}
+	return false
+}
+
+// portFallbacks returns the DialContexts of p.PortFallback, tried in order when the proxy
+// refuses a tunnel.
+func portFallbacks(p Proxy) []DialContext {
+	var fallbacks []DialContext
+	for _, fp := range p.PortFallback {
+		if fp.TargetURL == nil {
+			fp.TargetURL = p.TargetURL
+		}
+		dial, _, _ := newDialFunc(fp)
+		fallbacks = append(fallbacks, dial)
+	}
+	return fallbacks
+}
@@ -0,0 +1,81 @@
+package proxyplease
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+)
+
+// preemptiveSchemes keeps the scheme, Basic or Digest, each proxy last accepted from each
+// user, so later dials send credentials with the first CONNECT instead of waiting for a
+// 407.
+var preemptiveSchemes = struct {
+	sync.Mutex
+	m map[string]string
+}{m: map[string]string{}}
+
+// preemptiveKey identifies the proxy of p and its credentials, for preemptive schemes,
+// Digest sessions and authentication flights. The password is hashed, so what was
+// learned with a changed password is not reused, and passwords are not kept as keys.
+func preemptiveKey(p Proxy) string {
+	sum := sha256.Sum256([]byte(p.Username + "\x00" + p.Password))
+	return p.URL.Host + "|" + p.Username + "|" + hex.EncodeToString(sum[:8])
+}
+
+// preemptive sets the Proxy-Authorization header of h, the initial CONNECT to addr, for
+// the scheme the proxy of p last accepted, and returns the scheme. Nothing is set, and ""
+// returned, when no scheme was accepted with the credentials of p or the scheme is no
+// longer allowed.
+func (p Proxy) preemptive(h http.Header, addr string) string {
+	if p.DisablePreemptiveAuth || p.Username == "" {
+		return ""
+	}
+	preemptiveSchemes.Lock()
+	scheme := preemptiveSchemes.m[preemptiveKey(p)]
+	preemptiveSchemes.Unlock()
+	if scheme == "" && contains(p.AuthSchemeFilter, "Digest") && restoreDigestSession(p) {
+		scheme = "Digest"
+	}
+	if scheme == "" || !contains(p.AuthSchemeFilter, scheme) {
+		return ""
+	}
+	if scheme == "Basic" && p.DisallowPlaintextBasic && !p.encryptedProxy() {
+		return ""
+	}
+	// a Digest session is reused with the next nonce count
+	if err := setProxyAuthorization(p, h, scheme, "CONNECT", addr); err != nil {
+		return ""
+	}
+	p.debugf("connect> Sending %s credentials with the initial CONNECT", scheme)
+	return scheme
+}
+
+// rememberScheme records that the proxy of p accepted scheme with the credentials of p.
+// Only Basic and Digest, and configured credentials, are sent preemptively.
+func (p Proxy) rememberScheme(scheme string) {
+	if p.DisablePreemptiveAuth || p.Username == "" || scheme != "Basic" && scheme != "Digest" {
+		return
+	}
+	preemptiveSchemes.Lock()
+	preemptiveSchemes.m[preemptiveKey(p)] = scheme
+	preemptiveSchemes.Unlock()
+}
+
+// authorized records that the proxy of p accepted scheme with the credentials of p: the
+// scheme is remembered and a Digest session saved with its latest nonce count.
+func (p Proxy) authorized(scheme string) {
+	p.rememberScheme(scheme)
+	if scheme == "Digest" && !p.DisablePreemptiveAuth {
+		saveDigestSession(p)
+	}
+}
+
+// forgetScheme drops the scheme, and the Digest session, remembered for the credentials
+// of p, once the proxy rejected them.
+func (p Proxy) forgetScheme() {
+	preemptiveSchemes.Lock()
+	delete(preemptiveSchemes.m, preemptiveKey(p))
+	preemptiveSchemes.Unlock()
+	dropDigestSession(p, nil)
+}
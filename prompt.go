@@ -0,0 +1,53 @@
+package proxyplease
+
+import (
+	"context"
+	"net"
+	"net/url"
+)
+
+// maxPromptAttempts limits how many times a dial prompts for credentials the proxy rejects.
+const maxPromptAttempts = 3
+
+// PromptFunc asks the user for credentials to proxy for scheme, ex: on a terminal with the
+// password masked. attempt is 1 for the first prompt of a dial and grows each time the
+// proxy rejects the entered credentials. proxy has no credentials. Returning an error, ex:
+// when the user cancels, fails the attempt.
+type PromptFunc func(ctx context.Context, proxy *url.URL, scheme string, attempt int) (username, password string, err error)
+
+// withPrompt authenticates with dial, prompting with p.Prompt when credentials are
+// missing or rejected. Credentials set on p, and those of the session for NTLM and
+// Negotiate (SSPI on Windows, the Kerberos credential cache elsewhere), are tried first.
+func withPrompt(ctx context.Context, p Proxy, scheme string, dial func(Proxy) (net.Conn, error)) (net.Conn, error) {
+	configured := p.Username != "" || p.Password != "" || p.NTHash != "" || p.KeytabPath != ""
+	if configured || scheme == "NTLM" || scheme == "Negotiate" {
+		conn, err := dial(p)
+		if err == nil || unreachable(ctx, err) || ctx.Err() != nil || configured && Classify(err) != AuthFailed {
+			return conn, err
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		p.debugf("prompt> %s authentication without prompting failed: %s", scheme, err)
+	}
+
+	u := *p.URL
+	u.User = nil
+	for attempt := 1; ; attempt++ {
+		username, password, err := p.Prompt(ctx, &u, scheme, attempt)
+		if err != nil {
+			p.debugf("prompt> No %s credentials entered: %s", scheme, err)
+			return nil, err
+		}
+		q := p
+		q.Username, q.Password, q.NTHash = username, password, ""
+		conn, err := dial(q)
+		if err == nil || attempt >= maxPromptAttempts || Classify(err) != AuthFailed {
+			return conn, err
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		p.debugf("prompt> Proxy rejected the entered %s credentials. Prompting again.", scheme)
+	}
+}
@@ -7,21 +7,140 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
-	ggp "github.com/bdwyertech/go-get-proxied/proxy"
+	"github.com/bdwyertech/proxyplease/auth"
+	"github.com/bdwyertech/proxyplease/pac"
 )
 
 // Proxy is a struct that can be passed to NewDialContext. All variables are optional. If a value is nil,
 // a default will be assigned or inferred from the local system settings.
 type Proxy struct {
-	URL              *url.URL     // URL to proxy
-	Username         string       // Username for authentication. This value is overridden if user is supplied in ProxyURL.
-	Password         string       // Password for authentication. This value is overridden if pass is supplied in Proxy.URL.
-	Domain           string       // Windows Domain. Used only for NTLM authentication.
-	TargetURL        *url.URL     // Target URL for proxy. Used to look up proxy from a PAC provided by the environment.
-	Headers          *http.Header // Add additional headers to the HTTP CONNECT request
-	TLSConfig        *tls.Config  // Provide your own TLSConfig
-	AuthSchemeFilter []string     // If nil, all authentication schemes will be attempted. Else, only the matching auth schemes will be used.
+	URL                    *url.URL           // URL to proxy
+	Username               string             // Username for authentication. This value is overridden if user is supplied in ProxyURL.
+	Password               string             // Password for authentication. This value is overridden if pass is supplied in Proxy.URL.
+	Domain                 string             // Windows Domain. Used only for NTLM authentication.
+	CredentialsFunc        CredentialsFunc    // Called with the address of each dial to select its credentials, ex: per tenant, instead of Username, Password and Domain. Overridden by WithCredentials.
+	NTHash                 string             // NT hash of the password, hex encoded, used for NTLM instead of Password on every platform. For service accounts whose password is only stored hashed.
+	NTLM                   auth.NTLMOptions   // Workstation name, session security flags and NTLMv2 only mode of NTLM, for hardened proxies rejecting the defaults. Mostly ignored by SSPI on Windows, except with NTHash.
+	AutoLogon              AutoLogonPolicy    // Proxies the credentials of the current Windows user are sent to when Username or Password is empty. Defaults to AutoLogonIntranet: only proxies in the Local intranet zone.
+	MachineAccount         bool               // Authenticate with NTLM and Negotiate as the computer account, or gMSA, a Windows service runs as (LocalSystem, NetworkService, a virtual account or a gMSA), ignoring configured and supplied credentials and AutoLogon. Fails with ErrNoMachineAccount otherwise.
+	TargetURL              *url.URL           // Target URL for proxy. Used to look up proxy from a PAC provided by the environment.
+	Headers                *http.Header       // Add additional headers to the HTTP CONNECT request. Copied when the dialer is created, so it may be changed afterwards.
+	HeaderFunc             HeaderFunc         // Called for each request of a handshake with the dialed address; the headers it returns are added to Headers, replacing those of the same names, ex: a tenant token per destination.
+	UserAgent              string             // User-Agent of the requests to the proxy, whatever the authentication scheme. Overrides one in Headers or HeaderFunc. Defaults to Go's.
+	TLSConfig              *tls.Config        // TLS config for https:// proxies: roots, client certificates and SNI (ServerName, defaults to the proxy host).
+	CAFile                 string             // Extra roots trusted for https:// proxies: PEM or DER files and directories, separated by os.PathListSeparator, as read by LoadRoots.
+	ClientCertificate      *tls.Certificate   // Certificate presented to https:// proxies authenticating clients by certificate. Its PrivateKey may be any crypto.Signer, ex: backed by a smartcard or CNG.
+	GetClientCertificate   ClientCertFunc     // Called when an https:// proxy requests a client certificate, to select one, ex: from the OS store. Takes precedence over ClientCertificate.
+	TLSClient              TLSClientFunc      // Performs TLS handshakes with https:// proxies in place of crypto/tls, ex: with a uTLS ClientHello.
+	HTTP2                  bool               // Offer HTTP/2 to https:// proxies and carry tunnels as CONNECT streams multiplexed over one connection, with Basic, Bearer or Digest credentials on each stream. Proxies choosing HTTP/1.1, or only offering NTLM or Negotiate, are used with HTTP/1.1.
+	ChannelBinding         bool               // Bind NTLM and Negotiate tokens to the TLS connection with https:// proxies (tls-server-end-point), for proxies enforcing Extended Protection for Authentication.
+	AuthSchemeFilter       []string           // If nil, all authentication schemes will be attempted. Else, only the matching auth schemes will be used.
+	SchemePreference       []string           // Order in which offered authentication schemes are attempted, ex: {"NTLM", "Negotiate"}. Unlisted schemes follow, strongest first: Negotiate, Kerberos, NTLM, Digest, Bearer, Basic.
+	DisallowPlaintextBasic bool               // Never send Basic credentials to http:// proxies, where they would cross the network in clear text.
+	Authority              AuthorityOptions   // Controls how the CONNECT authority is formed from the dialed address.
+	ResponseHeaders        []string           // CONNECT response headers (ex: Via, X-Cache) to expose via Conn.TunnelInfo.
+	ProxyProtocol          int                // Version of the PROXY protocol header, 1 (text) or 2 (binary), sent first through each tunnel for targets expecting it. The client address is the local address of the connection to the proxy. Zero sends none.
+	DefaultHTTPPort        string             // Port used for http:// proxy URLs without one. Defaults to 80. Some environments use 3128 or 8080.
+	Upstreams              []Upstream         // Equivalent proxies to distribute dials across. If set, URL is ignored.
+	Balance                BalanceStrategy    // How dials are distributed across Upstreams. Defaults to RoundRobin.
+	StickyTargets          bool               // Keep sending dials for the same target host to the same upstream. Implied by ConsistentHash.
+	Routes                 []RouteRule        // Evaluated in order for each dial before the other proxy settings, sending matching destinations DIRECT, through another proxy, or nowhere (BLOCK). Destinations matching Bypass are not sent through another proxy. See ParseRoutes.
+	ProxyList              string             // Proxies tried in order, moving on when one cannot be reached, in PAC result syntax, ex: "PROXY a:8080; PROXY b:8080; DIRECT". Used when URL and Upstreams are not set.
+	Quarantine             time.Duration      // How long an unreachable proxy is skipped by Failover and ProxyList (and a failed upstream by ConsistentHash). Defaults to 30s.
+	ProbeInterval          time.Duration      // Interval at which quarantined proxies are probed, ending their quarantine once they accept connections. Defaults to 5s.
+	DisablePreemptiveAuth  bool               // Wait for a 407 before sending credentials on every dial. By default, once a proxy accepts Basic or Digest with Username and Password, later dials send them with the first CONNECT.
+	SingleflightAuth       bool               // Let one handshake with the proxy authenticate at a time until one succeeds, so concurrent dials wait and reuse its scheme, or its failure, instead of all negotiating (and sending rejected credentials) at once.
+	AuthEveryRequest       bool               // Send credentials with every request to the proxy, for proxies that authenticate each request rather than each connection: Basic, Bearer with a TokenSource, or Digest once the proxy issued a nonce, preferring the scheme it last accepted. They are sent with the first CONNECT of each connection, every CONNECT stream of a shared HTTP/2 connection and FTP requests. Requests through established tunnels, ex: those of a Forwarder, reach the target and carry no proxy credentials.
+	Quirks                 Quirks             // Workarounds for nonstandard proxies, ex: Quirks{Profile: "bluecoat"}. See QuirkProfiles.
+	ConnectWriter          ConnectWriter      // Writes CONNECT requests to the proxy. If nil, requests are written as standard HTTP/1.1.
+	Middleware             []Middleware       // Wrap each handshake with the proxy, the first outermost, ex: to add headers, record timing or implement another authentication scheme.
+	TargetTLSConfig        *tls.Config        // TLS config for target handshakes made by NewDialTLSContext.
+	TargetTLSClient        TLSClientFunc      // Performs target handshakes made by NewDialTLSContext in place of crypto/tls.
+	TargetCAFile           string             // Extra roots (ex: a corporate TLS inspection CA) trusted by NewDialTLSContext, in the format of CAFile.
+	OnInterception         InterceptionFunc   // Called by NewDialTLSContext when the target certificate was re-signed by a CA outside the system roots.
+	CookieJar              http.CookieJar     // Persists session cookies set by the proxy so it does not require a full authentication on every connection.
+	TokenSource            TokenSource        // Supplies tokens for proxies requesting Bearer authentication, ex: a DeviceFlow.
+	CredentialProvider     CredentialProvider // Supplies credentials when Username and Password are not set, ex: from a keychain. Asked again when the proxy rejects them.
+	Prompt                 PromptFunc         // Asks the user for credentials when they are missing or rejected, ex: on a terminal. Up to 3 prompts per dial. Ignored if CredentialProvider is set.
+	CredentialCache        *CredentialCache   // Persists Bearer tokens, Kerberos service tickets and Digest sessions across processes, encrypted.
+	FormAuth               *FormAuth          // Log in to filtering proxies that answer with an HTML login form rather than a 407.
+	Clock                  Clock              // Time source for expiry, backoff and Kerberos authenticators sent to the proxy. Defaults to the system clock.
+	State                  *State             // Discovery results and upstream health saved by a previous run, used instead of discovering again until the state expires.
+	Chain                  []Proxy            // Proxies to tunnel through to reach URL, the one closest to the client first. Each hop uses its own URL, credentials and AuthSchemeFilter.
+	MaxResponseHeaderBytes int64              // Limit on the status line and headers of each proxy response read during a handshake. Defaults to 1MB.
+	MaxResponseBodyBytes   int64              // Limit on the body of each proxy response read during a handshake, such as an error page. Defaults to 1MB.
+	OnViolation            ViolationFunc      // Called with each violation of HTTP found in proxy responses, ex: invalid header bytes, to document appliance faults.
+	StrictResponses        bool               // Fail handshakes with a *ViolationError when a proxy response violates HTTP. Implies validation.
+	DetectScheme           bool               // Probe proxies configured without a scheme, ex: "proxy:8080", for whether they speak HTTP, TLS or SOCKS5 instead of assuming HTTP. Results are cached per address.
+	SPN                    string             // Service principal of the proxy for Negotiate, ex: "HTTP/proxy.corp.example.com". Defaults to HTTP/ and the canonical name of the proxy host.
+	SPNOptions             SPNOptions         // Controls how the proxy host name is canonicalized when SPN is not set, ex: CanonicalizeForward for CNAME-fronted proxy farms.
+	KeytabPath             string             // Keytab used for Negotiate on Linux and macOS, as Username in the Domain realm. For headless services.
+	CCachePath             string             // Kerberos credential cache used for Negotiate on Linux and macOS. Defaults to $KRB5CCNAME.
+	TGTManager             *auth.TGTManager   // Kerberos login shared by Negotiate dials and renewed in the background, for long running services. Takes precedence over KeytabPath, CCachePath and the credentials. See auth.NewTGTManager.
+	NegotiateFlags         auth.ContextFlags  // Context flags requested with Negotiate, ex: auth.FlagDelegate for proxies forwarding credentials, auth.FlagMutual to require the proxy to prove its identity. Zero requests the defaults of auth.KerberosOptions.Flags.
+	AdjustClockSkew        bool               // When Kerberos fails on Linux or macOS because the proxy's clock differs from Clock, retry once with the authenticator time shifted by the offset measured from the proxy's Date header.
+	OnEvent                EventFunc          // Notified of significant events, such as authentication failures, for monitoring. See NewEventLog.
+	OnAuthStart            AuthStartFunc      // Called when the proxy requires authentication for a dial, before any scheme is attempted.
+	OnChallenge            ChallengeFunc      // Called with the scheme and realm of each challenge of a proxy requiring authentication.
+	OnAuthSuccess          AuthSuccessFunc    // Called with the scheme the proxy accepted and how long authentication took.
+	OnAuthFailure          AuthFailureFunc    // Called with the error, usually an *AuthError, of a dial whose authentication failed.
+	Metrics                Metrics            // Receives dial, authentication and transfer measurements, ex: for Prometheus or OpenTelemetry. See ExpvarMetrics.
+	Transfers              *TransferStats     // Aggregates the bytes transferred through tunnels by proxy, destination and component, set with WithComponent.
+	Debugf                 DebugFunc          // Receives the debug output of dials made with this Proxy. Defaults to the logger set by SetDebugf.
+	Logger                 Logger             // Receives the debug output as structured records with phase, scheme, proxy and latency, instead of Debugf. See SlogLogger.
+	Tracer                 Tracer             // Starts spans around each dial, connection to the proxy, CONNECT round trip and authentication attempt, ex: for OpenTelemetry.
+	Capture                CaptureFunc        // Receives each CONNECT request and proxy response of HTTP/1.1 handshakes with credentials redacted, ex: WireDump(os.Stderr) or the Capture method of a HAR.
+	PACURL                 *url.URL           // PAC script downloaded and evaluated for each dialed destination when URL is not set, instead of the system settings.
+	PACScript              string             // PAC script evaluated for each dialed destination, instead of downloading PACURL.
+	PACEngine              pac.Engine         // Compiles the PAC scripts of this Proxy, ex: a pac.Goja with a timeout or pac.External. Defaults to pac.DefaultEngine.
+	DecisionCache          *DecisionCache     // Reuses PAC results per destination instead of evaluating the script on every dial. See NewDecisionCache.
+	PACCacheTTL            time.Duration      // How long PAC results are reused per destination. Zero keeps them in DecisionCache until evicted. Without DecisionCache, a positive TTL enables a private cache.
+	WPAD                   WPADOptions        // Options of the WPAD discovery made when no proxy is configured or found in the system settings.
+	WatchSystem            bool               // Follow changes of the system proxy settings and of the network, ex: on a VPN, re-running discovery for new dials. Used when URL, Upstreams and PAC settings are not set.
+	DisableWPAD            bool               // Connect directly instead of discovering a PAC script with WPAD (DHCP and DNS) when no proxy is found.
+	Bypass                 []string           // Destinations dialed directly, in NO_PROXY or Windows ProxyOverride syntax, ex: "*.corp.local", "<local>", "10.0.0.0/8".
+	BypassFunc             BypassFunc         // Called with the host of each dial not matching Bypass; dials for which it returns true are made directly.
+	AllowedPorts           []string           // Target ports that may be tunneled through the proxy, ex: "443", "22". If nil, any port is attempted; many proxies only allow 443.
+	PortFallback           []Proxy            // Proxies tried in order when the proxy refuses a tunnel (PolicyDenied), ex: one that allows SSH or SMTP submission.
+	RetryDeniedPorts       bool               // When a proxy refuses a tunnel to a port other than 443 (ErrPortDeniedByProxy), try the next proxy of Upstreams, ProxyList or the PAC result before PortFallback.
+	FallbackDirect         FallbackPolicy     // When dials failing through the proxy are retried directly: FallbackNever (the default), FallbackOnUnreachable or FallbackOnAuthFailure.
+	OnFallback             FallbackFunc       // Called when a dial falls back to a direct connection, with the error of the proxy.
+	FallbackDelay          time.Duration      // Delay between connection attempts to the addresses of a proxy host with several, ex: both A and AAAA records, as in RFC 8305 Happy Eyeballs. Defaults to 250ms. Negative tries addresses one at a time.
+	PreferIPv4             bool               // Try the IPv4 addresses of the proxy first. IPv6 addresses are tried first by default.
+	DialTimeout            time.Duration      // Limit on establishing each connection to the proxy, including TLS for https:// proxies. Zero means no limit besides the dial's context.
+	AuthTimeout            time.Duration      // Limit on the CONNECT exchange and authentication, counted from the first connection to the proxy. Zero means no limit.
+	HandshakeTimeout       time.Duration      // Limit on the whole handshake: dial, authentication and tunnel establishment. Zero means no limit.
+	ReuseAuthConnection    bool               // Continue authentication on the connection of a rejected CONNECT when the proxy keeps it open, for proxies requiring the whole exchange, ex: NTLM, on one connection. Connections are closed after each rejection otherwise.
+	MaxConcurrentDials     int                // Limit on the handshakes in progress with each proxy across the process, for proxies throttling or blocking clients sending many simultaneous CONNECTs. Further dials wait for their context. Zero means no limit.
+	MaxConcurrentTunnels   int                // Limit on the open tunnels through each proxy across the process, counted until closed. Further dials wait for their context. Zero means no limit.
+	Resolver               *net.Resolver      // Resolver of the names looked up locally: proxy hosts, targets dialed directly or resolved locally, and PAC dnsResolve. Defaults to net.DefaultResolver.
+	TargetResolution       string             // Where target names are resolved: ResolveLocal, ResolveOnProxy, or ResolveByScheme (the default).
+	TargetResolver         *net.Resolver      // Resolver of the target names resolved locally, instead of Resolver, ex: one from NewDoHResolver.
+	DoHURL                 string             // DNS over HTTPS server, ex: "https://dns.example.com/dns-query", reached through the proxy to resolve target names locally when only proxy egress is allowed. Implies ResolveLocal unless TargetResolution is set. Ignored if TargetResolver is set.
+	SOCKS                  SOCKSOptions       // Limits on the phases of SOCKS5 handshakes: target resolution, greeting, authentication and CONNECT reply.
+	RetryPolicy            RetryPolicy        // Retries of dials failing with transient proxy errors (502, 503, timeouts) with backoff, and re-prompts for credentials rejected with 407.
+	CircuitBreaker         *CircuitBreaker    // Fails dials at once, with ErrCircuitOpen, through a proxy after consecutive failures, until probe dials show it is back. May be shared by Proxies.
+	KeepAlive              time.Duration      // Interval of TCP keep-alive probes on connections to the proxy, so idle tunnels survive middlebox timeouts and dead ones are detected. Defaults to 15s. Negative disables.
+	ReadTimeout            time.Duration      // Once the tunnel is established, limit on each Read: it fails with a timeout if no data arrives for this long, detecting tunnels the proxy dropped silently. Zero means no limit.
+	WriteTimeout           time.Duration      // Once the tunnel is established, limit on each Write. Zero means no limit.
+	LocalAddr              net.IP             // Source address of the connections to the proxy and of direct connections, also returned by myIpAddress in PAC scripts, for multi-homed hosts.
+	Interface              string             // Network interface whose address is used as LocalAddr if it is not set, ex: "eth0": its first IPv4 address, or IPv6 if it has none. Looked up on each dial.
+	BaseDial               DialContext        // Makes the connections to the proxy, and to targets dialed directly, instead of dialing TCP, ex: the DialContext of an SSHJump to reach the proxy through a bastion. Mark, LocalAddr and Interface do not apply to it.
+	Mark                   int                // SO_MARK set on connections made for this Proxy (Linux, requires CAP_NET_ADMIN), so policy routing and observability agents can identify them.
+	OnFlow                 FlowFunc           // Called with the local port and logical target of each connection made, so observability agents can attribute tunneled flows.
+
+	source    Source                                // where URL came from
+	noScheme  bool                                  // URL was configured without a scheme
+	logf      func(format string, a ...interface{}) // debug logger attached to the dial's context
+	started   time.Time                             // when the dial started, for log latency
+	trace     context.Context                       // carries the current span of the dial, parent of the spans of its phases
+	formLogin bool                                  // a form login was performed for this dial
+	skew      time.Duration                         // clock offset applied to Kerberos authenticators
+	connects  *int32                                // CONNECT requests written during the handshake, for TunnelInfo
+	renewed   bool                                  // the Kerberos ticket was renewed after the proxy rejected it
 }
 
 // DialContext is the DialContext function that should be wrapped with a
@@ -29,35 +148,132 @@ type Proxy struct {
 type DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
 
 // NewDialContext returns a DialContext that can be used in a variety of network types.
-// The function accepts an optional Proxy type parameter.
+// The function accepts an optional Proxy type parameter. Use NewDialer instead to be able
+// to drain and close the connections it makes.
 func NewDialContext(p Proxy) DialContext {
-	// assign defaults
-	if p.Headers == nil {
-		p.Headers = &http.Header{}
-	}
+	return NewDialer(p).DialContext
+}
+
+// newDialFunc returns the function establishing connections as configured by p, along
+// with the proxy decision and the balancer of p.Upstreams, if any.
+func newDialFunc(p Proxy) (DialContext, Decision, *balancer) {
+	// assign defaults. The dialer keeps its own copy of the headers, so callers may reuse
+	// and change theirs afterwards.
+	p.Headers = snapshotHeaders(p.Headers)
 	if p.TargetURL == nil {
-		p.TargetURL, _ = url.Parse("https://www.google.com")
+		p.TargetURL = defaultTargetURL()
 	}
-	// if no provided Proxy.URL, infer from system settings
-	if p.URL == nil || p.URL.String() == "" {
-		debugf("proxy> No proxy provided. Attempting to infer from system.")
-		systemProxy := ggp.NewProvider("").GetProxy(p.TargetURL.Scheme, p.TargetURL.String())
+	p.TargetURL = toASCIIURL(p.TargetURL)
+	p = withDoH(p)
+	var b *balancer
+	var d Decision
+	if usesPAC(p) {
+		p.source = pacSource(p)
+		return pacDialFunc(p), Decision{Source: p.source}, nil
+	} else if len(p.Upstreams) > 0 {
+		p.source = SourceStatic
+		d = Decision{Source: SourceStatic}
+		b = newBalancer(p)
+		if p.State.usable(p) {
+			b.restore(p.State.Down)
+		}
+	} else {
+		if p.State.usable(p) {
+			p.debugf("state> Using discovery results saved at %s", p.State.Saved)
+			d = p.State.decision()
+		} else {
+			d = decide(p)
+		}
+		if d.script != "" {
+			// discovered through WPAD: select proxies per destination with the script
+			p.source, p.PACScript = d.Source, d.script
+			return pacDialFunc(p), d, nil
+		}
 		// if no Proxy.URL was provided and no URL could be determined from system,
 		// then assume connection is direct.
-		if systemProxy == nil {
-			debugf("proxy> No proxy could be determined. Assuming a direct connection.")
-			d := net.Dialer{}
-			return d.DialContext
-		} else {
-			p.URL = systemProxy.URL()
+		if d.URL == nil {
+			p.debugf("proxy> No proxy could be determined. Assuming a direct connection.")
+			return p.dialDirect, d, nil
 		}
-		// WinHTTP sometimes does not provide protocol. If nil, assume HTTP
-		if p.URL.Scheme == "" {
-			p.URL.Scheme = "http"
+		p.source = d.Source
+		p = withProxyURL(p, d.URL)
+	}
+	var hops []Proxy
+	if b == nil {
+		hops = chainHops(p)
+	}
+	fallbacks := portFallbacks(p)
+
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if len(hops) > 0 {
+			return dialHop(ctx, hops, len(hops)-1, network, addr)
+		}
+		if b == nil {
+			return dialProxy(ctx, p, network, addr)
+		}
+		if b.strategy == Failover {
+			return b.dialFailover(ctx, network, addr)
 		}
+		i := b.pick(addr)
+		conn, err := dialProxy(ctx, b.proxies[i], network, addr)
+		if unreachable(ctx, err) {
+			// the proxy's answers, ex: a 407 or a denied port, say nothing of its health
+			b.fail(i)
+		}
+		for n := 1; n < len(b.proxies) && p.retriesDeniedPort(err); n++ {
+			next := b.proxies[(i+n)%len(b.proxies)]
+			p.debugf("proxy> %s refused the port of %s, trying upstream %s", b.proxies[i].URL.Host, addr, next.URL.Host)
+			conn, err = dialProxy(ctx, next, network, addr)
+		}
+		return conn, err
+	}
 
-		debugf("proxy> Inferred proxy from system: %s", p.URL.String())
+	// return DialContext function
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if isPACFetch(ctx) {
+			p.debugf("proxy> Connecting directly to %s to fetch a PAC script", addr)
+			return p.dialDirect(ctx, network, addr)
+		}
+		addr, err := normalizeAuthority(addr, p.Authority)
+		if err != nil {
+			return nil, err
+		}
+		if p.bypassed(addr) {
+			p.debugf("proxy> Connecting directly to %s as it is bypassed", addr)
+			return p.dialDirect(ctx, network, addr)
+		}
+		if !portAllowed(p, addr) {
+			p.debugf("proxy> Port of %s is not in AllowedPorts", addr)
+			return nil, ErrPortNotAllowed
+		}
+		conn, err := dial(ctx, network, addr)
+		for i := 0; err != nil && i < len(fallbacks) && Classify(err) == PolicyDenied; i++ {
+			p.debugf("proxy> Proxy refused the tunnel to %s, trying fallback proxy %d", addr, i+1)
+			conn, err = fallbacks[i](ctx, network, addr)
+		}
+		return conn, err
+	}, d, b
+}
+
+// dialDirect connects to addr without a proxy.
+func (p Proxy) dialDirect(ctx context.Context, network, addr string) (net.Conn, error) {
+	p.URL = nil
+	conn, err := p.dialTagged(ctx, network, addr)
+	if err != nil {
+		return conn, err
 	}
+	c := &Conn{Conn: conn, info: TunnelInfo{Source: SourceDirect}}
+	setIOTimeouts(p, c)
+	return c, nil
+}
+
+// withProxyURL returns p configured to use the proxy at u. The URL is normalized and
+// credentials embedded in it take precedence over p.Username and p.Password.
+func withProxyURL(p Proxy, u *url.URL) Proxy {
+	// fill in default ports and assume HTTP if the scheme is missing. WinHTTP sometimes
+	// does not provide protocol.
+	p.URL = normalizeProxyURL(u, p.DefaultHTTPPort)
+	p.noScheme = !hasScheme(u)
 
 	// assign user:pass if defined in URL
 	if p.URL.User.Username() != "" {
@@ -66,31 +282,204 @@ func NewDialContext(p Proxy) DialContext {
 	if pass, _ := p.URL.User.Password(); pass != "" {
 		p.Password = pass
 	}
+	return p
+}
 
-	// return DialContext function
-	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+// dialProxyOnce returns a net.Conn to addr with an established and authenticated session
+// through the proxy at p.URL.
+func dialProxyOnce(ctx context.Context, p Proxy, network, addr string) (net.Conn, error) {
+	conn, err := handshake(ctx, p, addr, func(ctx context.Context, p Proxy) (net.Conn, error) {
 		// first establish TLS if https
-		dialProxy := func() (net.Conn, error) {
-			dialer := &net.Dialer{}
-			if p.URL.Scheme == "https" {
-				return tls.DialWithDialer(dialer, "tcp", p.URL.Host, p.TLSConfig)
+		return p.baseDial(ctx, network, addr)
+	})
+	return conn, portDenied(p, addr, err)
+}
+
+// handshake returns a net.Conn to addr with an established and authenticated session
+// through the proxy at p.URL, connecting to the proxy with baseDial as many times as
+// authentication requires.
+func handshake(ctx context.Context, p Proxy, addr string, baseDial func(context.Context, Proxy) (net.Conn, error)) (net.Conn, error) {
+	p.logf, p.started, p.connects = contextDebugf(ctx), time.Now(), new(int32)
+	p = p.dialCredentials(ctx, addr)
+	// queued dials wait on their own context, not on the handshake timeout
+	releaseTunnel, err := p.acquireSlot(ctx, "tunnels", p.MaxConcurrentTunnels)
+	if err != nil {
+		return nil, err
+	}
+	releaseDial, err := p.acquireSlot(ctx, "dials", p.MaxConcurrentDials)
+	if err != nil {
+		releaseTunnel()
+		return nil, err
+	}
+	defer releaseDial()
+	ctx, cancel := handshakeContext(ctx, p)
+	defer cancel()
+	if p.DetectScheme && p.noScheme {
+		p.URL = detectScheme(ctx, p.URL)
+	}
+	p, span := p.startDialSpan(ctx, addr)
+	hs := withMiddleware(p, func(ctx context.Context, h Handshake) (net.Conn, error) {
+		p := h.Proxy
+		return getProxyConn(ctx, h.Addr, p, func() (net.Conn, error) {
+			_, span := p.startSpan(spanBaseDial)
+			conn, err := baseDial(ctx, p)
+			span.End(err)
+			return conn, err
+		})
+	})
+	conn, err := hs(ctx, Handshake{Proxy: p, Addr: addr, Dial: func(ctx context.Context) (net.Conn, error) {
+		return baseDial(ctx, p)
+	}})
+	if err == nil && p.ProxyProtocol != 0 {
+		if err = sendProxyProtocol(ctx, p, conn, addr); err != nil {
+			p.debugf("proxy> Could not send the PROXY protocol header: %s", err)
+			conn.Close()
+			conn = nil
+		}
+	}
+	if c, ok := conn.(*Conn); ok && err == nil {
+		c.release = releaseTunnel
+	} else {
+		releaseTunnel()
+	}
+	if err == nil {
+		handshakeDone(p, conn)
+	}
+	measureHandshake(p, conn, p.started, err)
+	endSpan(span, conn, err)
+	setIOTimeouts(p, conn)
+	return conn, err
+}
+
+// baseDial connects to the proxy at p.URL, negotiating TLS for https:// proxies.
+func (p Proxy) baseDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if p.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.DialTimeout)
+		defer cancel()
+	}
+	conn, err := p.dialTagged(ctx, network, addr)
+	if err != nil {
+		return conn, &ErrProxyUnreachable{Proxy: p.URL.Host, Err: err}
+	}
+	if p.URL.Scheme != "https" {
+		return conn, nil
+	}
+	return proxyTLS(ctx, p, conn)
+}
+
+// proxyTLS negotiates TLS with the https proxy at p.URL over conn, using p.TLSConfig for
+// roots, client certificates and SNI, also trusting the roots in p.CAFile and presenting
+// the client certificate of p, if any. Only HTTP/1.1 is offered, since CONNECT is sent as
+// HTTP/1.1, unless p.HTTP2 is set and the proxy authenticates requests, not only
+// connections. conn is closed if the handshake fails.
+func proxyTLS(ctx context.Context, p Proxy, conn net.Conn) (net.Conn, error) {
+	config := &tls.Config{}
+	if p.TLSConfig != nil {
+		config = p.TLSConfig.Clone()
+	}
+	config, err := extendRoots(p, config, p.CAFile)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if p.ClientCertificate != nil {
+		config.Certificates = []tls.Certificate{*p.ClientCertificate}
+	}
+	if get := p.GetClientCertificate; get != nil {
+		config.GetClientCertificate = func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			p.debugf("tls> Proxy %s requested a client certificate", p.URL.Host)
+			return get(cri)
+		}
+	}
+	if config.ServerName == "" {
+		config.ServerName = p.URL.Hostname()
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"http/1.1"}
+		if p.HTTP2 && !h2Conns.http1Only(h2Key(p)) {
+			config.NextProtos = []string{"h2", "http/1.1"}
+		}
+	}
+	tc, err := tlsHandshake(ctx, p.TLSClient, conn, config)
+	if err != nil {
+		p.debugf("tls> TLS handshake with proxy %s failed: %s", p.URL.Host, err)
+		return nil, err
+	}
+	return tc, nil
+}
+
+// bindChannel binds the tokens of a to conn, if it is the TLS connection with an https://
+// proxy and p.ChannelBinding is set.
+func bindChannel(p Proxy, conn net.Conn, a auth.Authenticator) {
+	if !p.ChannelBinding {
+		return
+	}
+	state, ok := tlsState(conn)
+	binder, canBind := a.(auth.ChannelBinder)
+	if !ok || !canBind {
+		p.debugf("tls> No channel binding for %s authentication to %s", a.Scheme(), p.URL.Host)
+		return
+	}
+	if certs := state.PeerCertificates; len(certs) > 0 {
+		binder.SetChannelBinding(auth.TLSServerEndPoint(certs[0]))
+	}
+}
+
+// getProxyConn establishes a tunnel to addr through the proxy at p.URL over connections
+// made by baseDial. The handshake is aborted when ctx is done, or p.AuthTimeout after the
+// first connection.
+func getProxyConn(ctx context.Context, addr string, p Proxy, baseDial func() (net.Conn, error)) (net.Conn, error) {
+	if s := p.URL.Scheme; s == "http" || s == "https" {
+		if p.resolvesLocally() {
+			// SOCKS proxies resolve as part of their negotiation
+			resolved, err := resolveTarget(ctx, p, addr, 0)
+			if err != nil {
+				p.debugf("get> Could not resolve %s: %s", addr, err)
+				return nil, err
 			}
-			return dialer.DialContext(ctx, network, p.URL.Host)
+			addr = resolved
 		}
-		// return a net.Conn with a establish and authenticated proxy session
-		return getProxyConn(addr, p, dialProxy)
+		addr = connectAuthority(addr)
+	}
+	if p.HTTP2 && p.URL.Scheme == "https" {
+		// the connection outlives the handshake, so it is not bound to it
+		return dialH2(ctx, p, addr, baseDial)
+	}
+	g := &handshakeGuard{ctx: ctx, authTimeout: p.AuthTimeout}
+	defer g.release()
+	conn, err := negotiateProxy(ctx, addr, p, g.dial(baseDial))
+	if err != nil && ctx.Err() != nil {
+		p.debugf("get> Handshake with proxy aborted: %s", ctx.Err())
+		err = ctx.Err()
 	}
+	return conn, err
 }
 
-func getProxyConn(addr string, p Proxy, baseDial func() (net.Conn, error)) (net.Conn, error) {
+func negotiateProxy(ctx context.Context, addr string, p Proxy, baseDial func() (net.Conn, error)) (net.Conn, error) {
 	// inspect Proxy.URL.Scheme and return appropriate function
 	switch p.URL.Scheme {
 	case "socks4", "socks4a", "socks5", "socks5h", "socks":
-		return dialAndNegotiateSOCKS(p.URL, p.Username, p.Password, addr)
+		dial := func(p Proxy) (net.Conn, error) {
+			return dialAndNegotiateSOCKS(ctx, p, addr, baseDial)
+		}
+		var conn net.Conn
+		var err error
+		if strings.HasPrefix(p.URL.Scheme, "socks4") {
+			conn, err = dial(p)
+		} else {
+			conn, err = withCredentials(ctx, p, "SOCKS5", dial)
+		}
+		if err != nil {
+			return conn, err
+		}
+		return newConn(conn, p, nil, nil, ""), nil
 	case "http", "https":
-		return dialAndNegotiateHTTP(p, addr, baseDial)
+		return p.singleflightAuth(ctx, func() (net.Conn, error) {
+			return dialAndNegotiateHTTP(ctx, p, addr, baseDial)
+		})
 	default:
-		debugf("get> Unsupported proxy URL scheme '%s'", p.URL.Scheme)
+		p.debugf("get> Unsupported proxy URL scheme '%s'", p.URL.Scheme)
 		return nil, errors.New("Unsupported proxy URL scheme")
 	}
 }
@@ -0,0 +1,86 @@
+package proxyplease
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// proxyProtocolSignature starts PROXY protocol v2 headers.
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// sendProxyProtocol writes a PROXY protocol header of version p.ProxyProtocol to the
+// tunnel conn to addr, carrying the local address of the connection to the proxy as
+// the client address. Target names are resolved with the resolver of p, since the header
+// only carries addresses.
+func sendProxyProtocol(ctx context.Context, p Proxy, conn net.Conn, addr string) error {
+	src, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return errors.New("PROXY protocol requires a TCP connection to the proxy")
+	}
+	resolved, err := resolveTarget(ctx, p, addr, 0)
+	if err != nil {
+		return err
+	}
+	host, port, _ := net.SplitHostPort(resolved)
+	dport, _ := strconv.Atoi(port)
+	dst := &net.TCPAddr{IP: net.ParseIP(host), Port: dport}
+
+	var header []byte
+	switch p.ProxyProtocol {
+	case 1:
+		header = proxyProtocolV1(src, dst)
+	case 2:
+		header = proxyProtocolV2(src, dst)
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version %d", p.ProxyProtocol)
+	}
+	if c, ok := conn.(*Conn); ok {
+		// not tunnel data of the application
+		conn = c.Conn
+	}
+	_, err = conn.Write(header)
+	return err
+}
+
+// proxyProtocolV1 returns the text header (PROXY protocol 2.1) of a TCP connection from
+// src to dst. IPv4 addresses are mapped to IPv6 if the other address is IPv6.
+func proxyProtocolV1(src, dst *net.TCPAddr) []byte {
+	family := "TCP4"
+	if src.IP.To4() == nil || dst.IP.To4() == nil {
+		family = "TCP6"
+	}
+	ip := func(a *net.TCPAddr) string {
+		if family == "TCP6" && a.IP.To4() != nil {
+			return "::ffff:" + a.IP.String()
+		}
+		return a.IP.String()
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, ip(src), ip(dst), src.Port, dst.Port))
+}
+
+// proxyProtocolV2 returns the binary header (PROXY protocol 2.2) of a TCP connection
+// from src to dst.
+func proxyProtocolV2(src, dst *net.TCPAddr) []byte {
+	b := append([]byte(nil), proxyProtocolSignature...)
+	// version 2, PROXY command
+	b = append(b, 0x21)
+	var addrs []byte
+	if s, d := src.IP.To4(), dst.IP.To4(); s != nil && d != nil {
+		b = append(b, 0x11) // TCP over IPv4
+		addrs = append(append(addrs, s...), d...)
+	} else {
+		b = append(b, 0x21) // TCP over IPv6
+		addrs = append(append(addrs, src.IP.To16()...), dst.IP.To16()...)
+	}
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[:], uint16(src.Port))
+	binary.BigEndian.PutUint16(ports[2:], uint16(dst.Port))
+	addrs = append(addrs, ports[:]...)
+	var n [2]byte
+	binary.BigEndian.PutUint16(n[:], uint16(len(addrs)))
+	return append(append(b, n[:]...), addrs...)
+}
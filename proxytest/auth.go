@@ -0,0 +1,307 @@
+package proxytest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// realm is the realm of Basic and Digest challenges, and the NTLM domain of the server.
+const realm = "proxytest"
+
+// NTLM negotiate flags (MS-NLMP 2.2.2.5) of the CHALLENGE messages sent by the server.
+const ntlmChallengeFlags = 0x00000001 | // unicode
+	0x00000004 | // request target
+	0x00000200 | // NTLM
+	0x00080000 | // extended session security
+	0x00800000 | // target info
+	0x20000000 | // 128-bit
+	0x80000000 // 56-bit
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// session is the authentication state of a connection to the server.
+type session struct {
+	ntlmChallenge []byte // server challenge of the NTLM handshake in progress
+}
+
+// schemes returns the schemes the server offers, Basic by default.
+func (s *Server) schemes() []string {
+	if len(s.Schemes) == 0 {
+		return []string{"Basic"}
+	}
+	return s.Schemes
+}
+
+// authenticate reports whether req is authorized. If not, it returns the
+// Proxy-Authenticate values of the 407 answering it: the next round of an NTLM handshake
+// in progress on the connection of st, or the challenges of every offered scheme.
+func (s *Server) authenticate(req *http.Request, st *session) (bool, []string) {
+	if s.Username == "" && s.Password == "" {
+		return true, nil
+	}
+	h := req.Header.Get("Proxy-Authorization")
+	scheme, token := h, ""
+	if i := strings.IndexByte(h, ' '); i >= 0 {
+		scheme, token = h[:i], strings.TrimSpace(h[i+1:])
+	}
+	if !s.offers(scheme) {
+		return false, s.challenges()
+	}
+	switch {
+	case strings.EqualFold(scheme, "Basic"):
+		b, err := base64.StdEncoding.DecodeString(token)
+		if err == nil && string(b) == s.Username+":"+s.Password {
+			return true, nil
+		}
+	case strings.EqualFold(scheme, "Digest"):
+		if s.verifyDigest(req.Method, req.RequestURI, token) {
+			return true, nil
+		}
+	case strings.EqualFold(scheme, "NTLM"):
+		msg, err := base64.StdEncoding.DecodeString(token)
+		if err != nil || len(msg) < 12 || !bytes.Equal(msg[:8], ntlmSignature) {
+			break
+		}
+		switch binary.LittleEndian.Uint32(msg[8:]) {
+		case 1:
+			st.ntlmChallenge = make([]byte, 8)
+			rand.Read(st.ntlmChallenge)
+			return false, []string{"NTLM " + base64.StdEncoding.EncodeToString(ntlmChallengeMessage(st.ntlmChallenge))}
+		case 3:
+			challenge := st.ntlmChallenge
+			st.ntlmChallenge = nil
+			if challenge != nil && s.verifyNTLM(challenge, msg) {
+				return true, nil
+			}
+		}
+	}
+	return false, s.challenges()
+}
+
+// offers reports whether the server offers scheme.
+func (s *Server) offers(scheme string) bool {
+	for _, o := range s.schemes() {
+		if strings.EqualFold(o, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// challenges returns the initial challenges of the offered schemes.
+func (s *Server) challenges() []string {
+	var c []string
+	for _, scheme := range s.schemes() {
+		switch strings.ToLower(scheme) {
+		case "basic":
+			c = append(c, `Basic realm="`+realm+`"`)
+		case "digest":
+			c = append(c, `Digest realm="`+realm+`", nonce="`+s.digestNonce()+`", qop="auth", algorithm=MD5`)
+		case "ntlm":
+			c = append(c, "NTLM")
+		}
+	}
+	return c
+}
+
+// digestNonce returns a new nonce and records it as issued.
+func (s *Server) digestNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	nonce := hex.EncodeToString(b)
+	s.mu.Lock()
+	if s.nonces == nil {
+		s.nonces = map[string]bool{}
+	}
+	s.nonces[nonce] = true
+	s.mu.Unlock()
+	return nonce
+}
+
+// verifyDigest reports whether the Digest credentials in token answer a nonce issued by
+// the server for a request with method and uri.
+func (s *Server) verifyDigest(method, uri, token string) bool {
+	params := parseParams(token)
+	s.mu.Lock()
+	issued := s.nonces[params["nonce"]]
+	s.mu.Unlock()
+	if !issued || params["username"] != s.Username || params["realm"] != realm || params["uri"] != uri {
+		return false
+	}
+
+	var h func() hash.Hash
+	algorithm := params["algorithm"]
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "", "MD5":
+		h = md5.New
+	case "SHA-256":
+		h = sha256.New
+	default:
+		return false
+	}
+	digest := func(s string) string {
+		d := h()
+		d.Write([]byte(s))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+	ha1 := digest(s.Username + ":" + realm + ":" + s.Password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = digest(ha1 + ":" + params["nonce"] + ":" + params["cnonce"])
+	}
+	ha2 := digest(method + ":" + uri)
+	want := digest(ha1 + ":" + params["nonce"] + ":" + ha2)
+	if qop := params["qop"]; qop != "" {
+		want = digest(ha1 + ":" + params["nonce"] + ":" + params["nc"] + ":" + params["cnonce"] + ":" + qop + ":" + ha2)
+	}
+	return hmac.Equal([]byte(want), []byte(params["response"]))
+}
+
+// parseParams parses the comma separated name=value parameters of a Digest token.
+// Values may be quoted.
+func parseParams(s string) map[string]string {
+	params := map[string]string{}
+	for s != "" {
+		i := strings.IndexByte(s, '=')
+		if i < 0 {
+			break
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = strings.TrimSpace(s[i+1:])
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			j := 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				b.WriteByte(s[j])
+			}
+			value = b.String()
+			if j < len(s) {
+				j++
+			}
+			s = s[j:]
+		} else {
+			j := strings.IndexByte(s, ',')
+			if j < 0 {
+				j = len(s)
+			}
+			value = strings.TrimSpace(s[:j])
+			s = s[j:]
+		}
+		params[name] = value
+		s = strings.TrimPrefix(strings.TrimSpace(s), ",")
+		s = strings.TrimSpace(s)
+	}
+	return params
+}
+
+// ntlmChallengeMessage returns an NTLM CHALLENGE message with challenge, naming the
+// server's domain and time in its target info.
+func ntlmChallengeMessage(challenge []byte) []byte {
+	target := utf16le(strings.ToUpper(realm))
+	var info []byte
+	info = appendAvPair(info, 2, target) // MsvAvNbDomainName
+	timestamp := make([]byte, 8)
+	// FILETIME: 100ns intervals since January 1, 1601
+	binary.LittleEndian.PutUint64(timestamp, uint64(time.Now().UnixNano()/100+116444736000000000))
+	info = appendAvPair(info, 7, timestamp) // MsvAvTimestamp
+	info = appendAvPair(info, 0, nil)       // MsvAvEOL
+
+	b := make([]byte, 48)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 2)
+	putField(b[12:], len(target), 48)
+	binary.LittleEndian.PutUint32(b[20:], ntlmChallengeFlags)
+	copy(b[24:], challenge)
+	putField(b[40:], len(info), 48+len(target))
+	return append(append(b, target...), info...)
+}
+
+// verifyNTLM reports whether the NTLMv2 AUTHENTICATE message msg answers challenge with
+// the credentials of the server. The domain is that sent by the client.
+func (s *Server) verifyNTLM(challenge, msg []byte) bool {
+	if len(msg) < 64 {
+		return false
+	}
+	nt, ok1 := field(msg, 20)
+	domain, ok2 := field(msg, 28)
+	user, ok3 := field(msg, 36)
+	if !ok1 || !ok2 || !ok3 || len(nt) <= 16 {
+		return false
+	}
+	username := s.Username
+	if i := strings.IndexByte(username, '\\'); i >= 0 {
+		username = username[i+1:]
+	}
+	if !strings.EqualFold(fromUTF16LE(user), username) {
+		return false
+	}
+
+	d := md4.New()
+	d.Write(utf16le(s.Password))
+	key := hmacMD5(d.Sum(nil), utf16le(strings.ToUpper(fromUTF16LE(user))+fromUTF16LE(domain)))
+	proof := hmacMD5(key, append(append([]byte(nil), challenge...), nt[16:]...))
+	return hmac.Equal(proof, nt[:16])
+}
+
+func hmacMD5(key, data []byte) []byte {
+	m := hmac.New(md5.New, key)
+	m.Write(data)
+	return m.Sum(nil)
+}
+
+func appendAvPair(b []byte, id uint16, value []byte) []byte {
+	var h [4]byte
+	binary.LittleEndian.PutUint16(h[:], id)
+	binary.LittleEndian.PutUint16(h[2:], uint16(len(value)))
+	return append(append(b, h[:]...), value...)
+}
+
+// putField writes the length/offset field of a payload of n bytes at offset.
+func putField(b []byte, n, offset int) {
+	binary.LittleEndian.PutUint16(b, uint16(n))
+	binary.LittleEndian.PutUint16(b[2:], uint16(n))
+	binary.LittleEndian.PutUint32(b[4:], uint32(offset))
+}
+
+// field returns the payload referenced by the length/offset field of msg at off.
+func field(msg []byte, off int) ([]byte, bool) {
+	n := int(binary.LittleEndian.Uint16(msg[off:]))
+	start := int(binary.LittleEndian.Uint32(msg[off+4:]))
+	if start+n > len(msg) {
+		return nil, false
+	}
+	return msg[start : start+n], true
+}
+
+func utf16le(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
+
+func fromUTF16LE(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
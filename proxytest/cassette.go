@@ -0,0 +1,370 @@
+package proxytest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// redacted replaces credentials and the strings of Recorder.Redact in cassettes.
+const redacted = "REDACTED"
+
+// Cassette is a recording of the handshakes clients made with a real proxy, with
+// credentials removed. A ReplayServer plays it back, so tests can cover the behavior of
+// specific proxies (Squid, Blue Coat, Zscaler, ...) without live infrastructure.
+type Cassette struct {
+	Proxy       string       `json:"proxy,omitempty"` // Description of the recorded proxy, ex: "Squid 5.7".
+	Connections []Connection `json:"connections"`
+}
+
+// Connection is the sequence of exchanges made on one client connection.
+type Connection struct {
+	Exchanges []Exchange `json:"exchanges"`
+}
+
+// Exchange is a request sent to the proxy and its response.
+type Exchange struct {
+	Method   string      `json:"method"`
+	Target   string      `json:"target"`   // Request target, ex: "example.com:443" for CONNECT.
+	Header   http.Header `json:"header"`   // Request headers. Credentials are redacted, keeping the authentication scheme.
+	Response string      `json:"response"` // Response as sent by the proxy, status line, headers and body.
+}
+
+// LoadCassette reads a cassette saved with Save.
+func LoadCassette(path string) (*Cassette, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cassette{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Save writes c to path as JSON.
+func (c *Cassette) Save(path string) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// listenerGroup accepts connections on a loopback address and tracks them until Close.
+type listenerGroup struct {
+	listener net.Listener
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+func newListenerGroup() *listenerGroup {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("proxytest: failed to listen: " + err.Error())
+	}
+	return &listenerGroup{listener: ln, conns: map[net.Conn]struct{}{}}
+}
+
+// serve calls handle for each accepted connection in its own goroutine.
+func (g *listenerGroup) serve(handle func(net.Conn)) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		for {
+			conn, err := g.listener.Accept()
+			if err != nil {
+				return
+			}
+			if !g.track(conn) {
+				conn.Close()
+				return
+			}
+			g.wg.Add(1)
+			go func() {
+				defer g.wg.Done()
+				defer g.untrack(conn)
+				handle(conn)
+			}()
+		}
+	}()
+}
+
+func (g *listenerGroup) track(c net.Conn) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return false
+	}
+	g.conns[c] = struct{}{}
+	return true
+}
+
+func (g *listenerGroup) untrack(c net.Conn) {
+	g.mu.Lock()
+	delete(g.conns, c)
+	g.mu.Unlock()
+	c.Close()
+}
+
+func (g *listenerGroup) close() {
+	g.mu.Lock()
+	g.closed = true
+	for c := range g.conns {
+		c.Close()
+	}
+	g.mu.Unlock()
+	g.listener.Close()
+	g.wg.Wait()
+}
+
+// Recorder is a pass-through proxy in front of a real proxy, recording the handshakes
+// of the clients pointed at it into a Cassette. Once a tunnel is established, its data
+// is relayed but not recorded.
+type Recorder struct {
+	URL      *url.URL // Proxy URL of the form http://127.0.0.1:port
+	Upstream string   // Address (host:port) of the recorded proxy.
+	Redact   []string // Strings replaced in the recording, ex: internal host names in NTLM challenges or error pages.
+
+	g        *listenerGroup
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+// NewRecorder starts and returns a Recorder forwarding to the proxy at upstream
+// (host:port). The caller should call Close when finished.
+func NewRecorder(upstream string) *Recorder {
+	r := &Recorder{Upstream: upstream, g: newListenerGroup()}
+	r.URL = &url.URL{Scheme: "http", Host: r.g.listener.Addr().String()}
+	r.g.serve(r.handle)
+	return r
+}
+
+// Cassette returns the handshakes recorded so far.
+func (r *Recorder) Cassette() *Cassette {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := Cassette{Proxy: r.cassette.Proxy}
+	for _, conn := range r.cassette.Connections {
+		c.Connections = append(c.Connections, Connection{Exchanges: append([]Exchange(nil), conn.Exchanges...)})
+	}
+	return &c
+}
+
+// Close shuts down the recorder and closes all open connections.
+func (r *Recorder) Close() {
+	r.g.close()
+}
+
+func (r *Recorder) handle(client net.Conn) {
+	upstream, err := net.Dial("tcp", r.Upstream)
+	if err != nil {
+		writeStatus(client, http.StatusBadGateway, nil)
+		return
+	}
+	if !r.g.track(upstream) {
+		upstream.Close()
+		return
+	}
+	defer r.g.untrack(upstream)
+
+	r.mu.Lock()
+	r.cassette.Connections = append(r.cassette.Connections, Connection{})
+	index := len(r.cassette.Connections) - 1
+	r.mu.Unlock()
+
+	cbr := bufio.NewReader(client)
+	var capture bytes.Buffer
+	ubr := bufio.NewReader(io.TeeReader(upstream, &capture))
+	for {
+		req, err := http.ReadRequest(cbr)
+		if err != nil {
+			return
+		}
+		if err := req.Write(upstream); err != nil {
+			return
+		}
+		// keep only what the proxy sent past its previous response
+		leftover := append([]byte(nil), capture.Bytes()[capture.Len()-ubr.Buffered():]...)
+		capture.Reset()
+		capture.Write(leftover)
+		resp, err := http.ReadResponse(ubr, req)
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		raw := capture.Bytes()[:capture.Len()-ubr.Buffered()]
+		if _, err := client.Write(raw); err != nil {
+			return
+		}
+
+		e := Exchange{Method: req.Method, Target: requestTarget(req), Header: r.sanitizeHeader(req.Header), Response: r.sanitizeResponse(string(raw))}
+		r.mu.Lock()
+		r.cassette.Connections[index].Exchanges = append(r.cassette.Connections[index].Exchanges, e)
+		r.mu.Unlock()
+
+		if req.Method == http.MethodConnect && resp.StatusCode == http.StatusOK {
+			// stop capturing: read the tunnel from upstream directly after the buffered data
+			buffered, _ := ubr.Peek(ubr.Buffered())
+			relay(client, cbr, upstream, io.MultiReader(bytes.NewReader(buffered), upstream))
+			return
+		}
+	}
+}
+
+// sanitizeHeader returns a copy of h without credentials and redacted strings.
+func (r *Recorder) sanitizeHeader(h http.Header) http.Header {
+	s := http.Header{}
+	for k, vs := range h {
+		for _, v := range vs {
+			switch k {
+			case "Proxy-Authorization", "Authorization":
+				v = strings.SplitN(v, " ", 2)[0] + " " + redacted
+			case "Cookie":
+				v = redacted
+			}
+			s.Add(k, r.redact(v))
+		}
+	}
+	return s
+}
+
+// sanitizeResponse removes cookie values and redacted strings from a raw response.
+func (r *Recorder) sanitizeResponse(raw string) string {
+	lines := strings.SplitAfter(raw, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+		if colon := strings.IndexByte(line, ':'); colon > 0 && strings.EqualFold(line[:colon], "Set-Cookie") {
+			value := strings.TrimSpace(line[colon+1:])
+			if eq := strings.IndexByte(value, '='); eq > 0 {
+				value = value[:eq+1] + redacted
+			}
+			lines[i] = line[:colon+1] + " " + value + "\r\n"
+		}
+	}
+	return r.redact(strings.Join(lines, ""))
+}
+
+func (r *Recorder) redact(s string) string {
+	for _, secret := range r.Redact {
+		if secret != "" {
+			s = strings.Replace(s, secret, redacted, -1)
+		}
+	}
+	return s
+}
+
+// ReplayServer is a proxy answering clients with the responses of a Cassette. Client
+// connections are matched with the recorded connections in order, so dials should be
+// made one at a time. Tunnels established by a recorded 200 echo the data sent through
+// them. Requests differing from the recording are reported by Errors.
+type ReplayServer struct {
+	URL *url.URL // Proxy URL of the form http://127.0.0.1:port
+
+	g        *listenerGroup
+	cassette *Cassette
+	mu       sync.Mutex
+	next     int
+	errs     []error
+}
+
+// NewReplayServer starts and returns a ReplayServer playing back c. The caller should
+// call Close when finished.
+func NewReplayServer(c *Cassette) *ReplayServer {
+	s := &ReplayServer{cassette: c, g: newListenerGroup()}
+	s.URL = &url.URL{Scheme: "http", Host: s.g.listener.Addr().String()}
+	s.g.serve(s.handle)
+	return s
+}
+
+// Errors returns the differences between the requests received and the recording, and
+// the connections made beyond it.
+func (s *ReplayServer) Errors() []error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]error(nil), s.errs...)
+}
+
+// Close shuts down the server and closes all open connections.
+func (s *ReplayServer) Close() {
+	s.g.close()
+}
+
+func (s *ReplayServer) errorf(format string, a ...interface{}) {
+	s.mu.Lock()
+	s.errs = append(s.errs, fmt.Errorf(format, a...))
+	s.mu.Unlock()
+}
+
+func (s *ReplayServer) handle(conn net.Conn) {
+	s.mu.Lock()
+	i := s.next
+	s.next++
+	s.mu.Unlock()
+	if i >= len(s.cassette.Connections) {
+		s.errorf("connection %d: not in the cassette, which has %d", i, len(s.cassette.Connections))
+		return
+	}
+
+	br := bufio.NewReader(conn)
+	for j, e := range s.cassette.Connections[i].Exchanges {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			s.errorf("connection %d exchange %d: expected %s %s, got %s", i, j, e.Method, e.Target, err)
+			return
+		}
+		io.Copy(ioutil.Discard, req.Body)
+		req.Body.Close()
+		if req.Method != e.Method || requestTarget(req) != e.Target {
+			s.errorf("connection %d exchange %d: expected %s %s, got %s %s", i, j, e.Method, e.Target, req.Method, requestTarget(req))
+		}
+		if got, want := authScheme(req.Header), authScheme(e.Header); got != want {
+			s.errorf("connection %d exchange %d: expected authentication scheme '%s', got '%s'", i, j, want, got)
+		}
+		if _, err := io.WriteString(conn, e.Response); err != nil {
+			return
+		}
+		if e.Method == http.MethodConnect && (strings.HasPrefix(e.Response, "HTTP/1.1 200") || strings.HasPrefix(e.Response, "HTTP/1.0 200")) {
+			// echo the tunnel, starting with data sent ahead of the response
+			io.Copy(conn, br)
+			return
+		}
+	}
+}
+
+// requestTarget returns the request-target of req as sent by the client.
+func requestTarget(req *http.Request) string {
+	if req.Method == http.MethodConnect {
+		return req.Host
+	}
+	return req.RequestURI
+}
+
+// authScheme returns the scheme of the Proxy-Authorization header of h, if any.
+func authScheme(h http.Header) string {
+	return strings.SplitN(h.Get("Proxy-Authorization"), " ", 2)[0]
+}
+
+// relay copies data between the client and upstream of an established tunnel. cr and ur
+// read from the client and upstream, starting with the data already buffered.
+func relay(client net.Conn, cr io.Reader, upstream net.Conn, ur io.Reader) {
+	go func() {
+		io.Copy(upstream, cr)
+		upstream.Close()
+	}()
+	io.Copy(client, ur)
+}
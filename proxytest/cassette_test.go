@@ -0,0 +1,104 @@
+package proxytest_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bdwyertech/proxyplease"
+	"github.com/bdwyertech/proxyplease/proxytest"
+)
+
+// echo dials addr through p and checks the tunnel carries data.
+func echo(t *testing.T, p proxyplease.Proxy, addr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := proxyplease.NewDialContext(p)(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return err
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Errorf("read through tunnel: %q, %v", b, err)
+	}
+	return nil
+}
+
+func TestCassetteRoundTrip(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	addr := target.Addr().String()
+
+	s := proxytest.NewServer()
+	s.Username, s.Password, s.Schemes = "user", "secret", []string{"NTLM", "Basic"}
+	defer s.Close()
+	rec := proxytest.NewRecorder(s.URL.Host)
+	defer rec.Close()
+	p := proxyplease.Proxy{URL: rec.URL, Username: "user", Password: "secret", Debugf: t.Logf}
+	if err := echo(t, p, addr); err != nil {
+		t.Fatalf("dial through the recorder: %s", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	if err := rec.Cassette().Save(path); err != nil {
+		t.Fatal(err)
+	}
+	c, err := proxytest.LoadCassette(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the challenge, then the NTLM handshake on a new connection
+	var recorded []string
+	for _, conn := range c.Connections {
+		var exchange []string
+		for _, e := range conn.Exchanges {
+			exchange = append(exchange, e.Method+" "+e.Header.Get("Proxy-Authorization"))
+		}
+		recorded = append(recorded, strings.Join(exchange, ", "))
+	}
+	want := []string{"CONNECT ", "CONNECT NTLM REDACTED, CONNECT NTLM REDACTED"}
+	if !reflect.DeepEqual(recorded, want) {
+		t.Errorf("recorded %q, want %q", recorded, want)
+	}
+
+	replay := proxytest.NewReplayServer(c)
+	defer replay.Close()
+	p.URL = replay.URL
+	if err := echo(t, p, addr); err != nil {
+		t.Fatalf("dial through the replay: %s", err)
+	}
+	if errs := replay.Errors(); len(errs) > 0 {
+		t.Errorf("replay differs from the recording: %v", errs)
+	}
+
+	// a dial beyond the recording is reported
+	echo(t, p, addr)
+	if errs := replay.Errors(); len(errs) != 1 {
+		t.Errorf("got errors %v, want one for the connection beyond the recording", errs)
+	}
+}
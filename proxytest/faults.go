@@ -0,0 +1,67 @@
+package proxytest
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Faults configure misbehavior injected by a Server, so applications can test how they
+// cope with faulty proxies. Set them before the first request.
+type Faults struct {
+	DropAfter        int           // Close connections without answering their nth CONNECT request, mid-handshake. Zero disables.
+	SlowWrite        time.Duration // Delay between each byte of proxy responses, like a slowloris server.
+	Status           int           // Answer every CONNECT with this status code instead of establishing the tunnel.
+	GarbageChallenge bool          // Answer every CONNECT with a 407 carrying malformed Basic, NTLM and Negotiate challenges.
+	Rate             float64       // Fraction of connections affected, between 0 and 1. Defaults to 1.
+}
+
+// garbageChallenges are malformed Proxy-Authenticate values sent for GarbageChallenge.
+var garbageChallenges = []string{
+	"Basic realm=",
+	"NTLM %%%not-base64%%%",
+	"NTLM TlRMTVNTUAACAAAA",
+	"Negotiate oRQwEqADCgEBoQsGCSqGSIb3EgECAg==garbage",
+}
+
+// faulty reports whether faults are injected on a new connection.
+func (f Faults) faulty() bool {
+	if f.Rate <= 0 || f.Rate >= 1 {
+		return true
+	}
+	return rand.Float64() < f.Rate
+}
+
+// respond answers the nth CONNECT request of a connection according to f. It reports
+// whether the tunnel should be established and, if not, whether the connection stays open.
+func (f Faults) respond(w io.Writer, n int) (tunnel, open bool) {
+	switch {
+	case f.DropAfter > 0 && n >= f.DropAfter:
+		return false, false
+	case f.GarbageChallenge:
+		writeStatus(w, http.StatusProxyAuthRequired, http.Header{"Proxy-Authenticate": garbageChallenges})
+		return false, true
+	case f.Status != 0 && f.Status != http.StatusOK:
+		writeStatus(w, f.Status, nil)
+		return false, f.Status == http.StatusProxyAuthRequired
+	}
+	return true, true
+}
+
+// slowWriter writes one byte at a time, delay apart.
+type slowWriter struct {
+	conn  net.Conn
+	delay time.Duration
+}
+
+func (w slowWriter) Write(b []byte) (int, error) {
+	for i := range b {
+		time.Sleep(w.delay)
+		if _, err := w.conn.Write(b[i : i+1]); err != nil {
+			return i, err
+		}
+	}
+	return len(b), nil
+}
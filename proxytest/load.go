@@ -0,0 +1,95 @@
+package proxytest
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DialFunc dials addr, typically through a proxy. It matches proxyplease.DialContext.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// LoadResult summarizes a Load run.
+type LoadResult struct {
+	Handshakes int           // Number of successful dials.
+	Errors     int           // Number of failed dials.
+	Duration   time.Duration // Wall time of the run.
+	PerSecond  float64       // Successful handshakes per second.
+	P50        time.Duration // Median handshake latency.
+	P90        time.Duration // 90th percentile handshake latency.
+	P99        time.Duration // 99th percentile handshake latency.
+	Max        time.Duration // Slowest handshake.
+}
+
+// Load performs n dials to addr with the given concurrency and reports handshake
+// throughput and latency percentiles. Each connection is closed as soon as it is
+// established. Load stops early if ctx is done.
+func Load(ctx context.Context, dial DialFunc, addr string, concurrency, n int) LoadResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var res LoadResult
+	latencies := make([]time.Duration, 0, n)
+
+	work := make(chan struct{})
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range work {
+				t := time.Now()
+				conn, err := dial(ctx, "tcp", addr)
+				d := time.Since(t)
+				mu.Lock()
+				if err != nil {
+					res.Errors++
+				} else {
+					res.Handshakes++
+					latencies = append(latencies, d)
+				}
+				mu.Unlock()
+				if conn != nil {
+					conn.Close()
+				}
+			}
+		}()
+	}
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case work <- struct{}{}:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+	res.Duration = time.Since(start)
+
+	if res.Duration > 0 {
+		res.PerSecond = float64(res.Handshakes) / res.Duration.Seconds()
+	}
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		res.P50 = percentile(latencies, 50)
+		res.P90 = percentile(latencies, 90)
+		res.P99 = percentile(latencies, 99)
+		res.Max = latencies[len(latencies)-1]
+	}
+	return res
+}
+
+// percentile returns the pth percentile of sorted latencies using the nearest-rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
@@ -0,0 +1,58 @@
+package proxytest_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/bdwyertech/proxyplease"
+	"github.com/bdwyertech/proxyplease/proxytest"
+)
+
+// benchmarkLoad runs Load with concurrency against a Server requiring scheme, reporting
+// handshakes per second and latency percentiles.
+func benchmarkLoad(b *testing.B, scheme string, concurrency int) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, c)
+				c.Close()
+			}()
+		}
+	}()
+	s := proxytest.NewServer()
+	defer s.Close()
+	s.Username, s.Password, s.Schemes = "user", "secret", []string{scheme}
+	dial := proxyplease.NewDialContext(proxyplease.Proxy{
+		URL:      s.URL,
+		Username: "user",
+		Password: "secret",
+		Debugf:   func(string, ...interface{}) {},
+	})
+
+	b.ResetTimer()
+	res := proxytest.Load(context.Background(), proxytest.DialFunc(dial), target.Addr().String(), concurrency, b.N)
+	b.StopTimer()
+	if res.Errors > 0 {
+		b.Fatalf("%d of %d dials failed", res.Errors, b.N)
+	}
+	b.ReportMetric(res.PerSecond, "handshakes/s")
+	b.ReportMetric(float64(res.P50.Microseconds()), "p50-us")
+	b.ReportMetric(float64(res.P99.Microseconds()), "p99-us")
+}
+
+func BenchmarkLoadBasic(b *testing.B) { benchmarkLoad(b, "Basic", 8) }
+
+func BenchmarkLoadDigest(b *testing.B) { benchmarkLoad(b, "Digest", 8) }
+
+func BenchmarkLoadNTLM(b *testing.B) { benchmarkLoad(b, "NTLM", 8) }
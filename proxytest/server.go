@@ -0,0 +1,176 @@
+// Package proxytest provides an HTTP CONNECT proxy for use in tests, requiring Basic,
+// Digest or NTLM authentication as configured, along with helpers
+// to generate load against it and a fake clock. The proxy can inject faults to test how
+// clients cope with misbehaving proxies. Handshakes with real proxies can be recorded
+// with a Recorder and played back by a ReplayServer.
+package proxytest
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Server is an HTTP CONNECT proxy listening on a loopback address. If Username and
+// Password are set before the first request, authentication with one of Schemes is
+// required. NTLM handshakes take two rounds on the same connection, as with real
+// proxies. Set Faults to test the resilience of clients to misbehaving proxies.
+type Server struct {
+	URL      *url.URL // Proxy URL of the form http://127.0.0.1:port
+	Username string   // Username required for authentication. For NTLM, a DOMAIN\ prefix is ignored.
+	Password string   // Password required for authentication.
+	Schemes  []string // Schemes offered in order, among "Basic", "Digest" and "NTLM". Defaults to Basic.
+	Faults   Faults   // Misbehavior to inject, such as dropped connections or malformed challenges.
+
+	listener net.Listener
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	nonces   map[string]bool // Digest nonces issued
+	closed   bool
+}
+
+// NewServer starts and returns a new Server. The caller should call Close when finished.
+func NewServer() *Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("proxytest: failed to listen: " + err.Error())
+	}
+	s := &Server{
+		URL:      &url.URL{Scheme: "http", Host: ln.Addr().String()},
+		listener: ln,
+		conns:    map[net.Conn]struct{}{},
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Close shuts down the server and closes all open connections.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(conn)
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *Server) track(c net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(c net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+	c.Close()
+}
+
+func (s *Server) handle(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	var w io.Writer = conn
+	var faults Faults
+	var st session
+	for n := 1; ; n++ {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		if n == 1 && s.Faults.faulty() {
+			// read once a request arrived, so Faults set before it are seen
+			faults = s.Faults
+			if faults.SlowWrite > 0 {
+				w = slowWriter{conn: conn, delay: faults.SlowWrite}
+			}
+		}
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+
+		if req.Method != http.MethodConnect {
+			writeStatus(w, http.StatusMethodNotAllowed, nil)
+			return
+		}
+		if tunnel, open := faults.respond(w, n); !tunnel {
+			if open {
+				continue
+			}
+			return
+		}
+		if ok, challenges := s.authenticate(req, &st); !ok {
+			writeStatus(w, http.StatusProxyAuthRequired, http.Header{"Proxy-Authenticate": challenges})
+			continue
+		}
+
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			writeStatus(w, http.StatusBadGateway, nil)
+			return
+		}
+		if !s.track(target) {
+			target.Close()
+			return
+		}
+		defer s.untrack(target)
+
+		writeStatus(w, http.StatusOK, nil)
+		// forward anything the client sent ahead of the response
+		if n := br.Buffered(); n > 0 {
+			b, _ := br.Peek(n)
+			target.Write(b)
+		}
+		go func() {
+			io.Copy(target, conn)
+			target.Close()
+		}()
+		io.Copy(conn, target)
+		return
+	}
+}
+
+func writeStatus(w io.Writer, code int, h http.Header) {
+	resp := &http.Response{
+		StatusCode: code,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     h,
+	}
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	if code != http.StatusOK {
+		resp.ContentLength = 0
+	}
+	resp.Write(w)
+}
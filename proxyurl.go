@@ -0,0 +1,106 @@
+package proxyplease
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// defaultPorts are the ports assumed for proxy URLs without an explicit port.
+var defaultPorts = map[string]string{
+	"http":    "80",
+	"https":   "443",
+	"socks":   "1080",
+	"socks4":  "1080",
+	"socks4a": "1080",
+	"socks5":  "1080",
+	"socks5h": "1080",
+}
+
+// normalizeProxyURL returns a copy of u with a scheme, a lowercase host and an explicit
+// port. URLs without a scheme, such as "proxy.corp:8080", are assumed to be HTTP. IPv6
+// addresses are bracketed, ex: "http://[2001:db8::1]:80".
+// httpPort overrides the default port for http:// URLs when not empty.
+func normalizeProxyURL(u *url.URL, httpPort string) *url.URL {
+	c := *u
+	if c.Host == "" && (c.Opaque != "" || c.Scheme == "" || !strings.Contains(c.String(), "://")) {
+		// "proxy.corp:8080" parses as scheme "proxy.corp" with opaque "8080", and
+		// "proxy.corp" parses as a path
+		if r, err := url.Parse("http://" + u.String()); err == nil {
+			c = *r
+		}
+	}
+	if c.Scheme == "" {
+		c.Scheme = "http"
+	}
+	if ip := net.ParseIP(c.Host); ip != nil && ip.To4() == nil {
+		// an IPv6 address without brackets would be split at its last colon
+		c.Host = "[" + c.Host + "]"
+	}
+	c.Scheme = strings.ToLower(c.Scheme)
+
+	host, port := strings.ToLower(c.Hostname()), c.Port()
+	if port == "" {
+		port = defaultPorts[c.Scheme]
+		if c.Scheme == "http" && httpPort != "" {
+			port = httpPort
+		}
+	}
+	if host == "" {
+		return &c
+	}
+	if port == "" {
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		c.Host = host
+		return &c
+	}
+	c.Host = net.JoinHostPort(host, port)
+	return &c
+}
+
+// ParseProxyURL parses a proxy URL as url.Parse does, but also accepts credentials with
+// characters that should have been percent-encoded, ex: "http://user:p@ss/w0rd%@proxy:8080"
+// or non-ASCII passwords, which url.Parse rejects or splits at the wrong place. The
+// credentials extend to the last '@'. Percent-encoded credentials are decoded.
+func ParseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	i := strings.Index(raw, "://")
+	at := strings.LastIndexByte(raw, '@')
+	if i < 0 || at < i {
+		return u, err
+	}
+	userinfo := raw[i+3 : at]
+	if err == nil && u.User != nil && !strings.ContainsAny(userinfo, "@/?#") {
+		// url.Parse split the authority at the same '@'
+		return u, nil
+	}
+	r, perr := url.Parse(raw[:i+3] + raw[at+1:])
+	if perr != nil {
+		if err != nil {
+			return nil, err
+		}
+		return nil, perr
+	}
+	username, password, hasPassword := userinfo, "", false
+	if c := strings.IndexByte(userinfo, ':'); c >= 0 {
+		username, password, hasPassword = userinfo[:c], userinfo[c+1:], true
+	}
+	username, password = unescapeUserinfo(username), unescapeUserinfo(password)
+	if hasPassword {
+		r.User = url.UserPassword(username, password)
+	} else {
+		r.User = url.User(username)
+	}
+	return r, nil
+}
+
+// unescapeUserinfo decodes the percent-encoding of s, if it is valid, and returns s as is
+// otherwise.
+func unescapeUserinfo(s string) string {
+	if u, err := url.PathUnescape(s); err == nil {
+		return u
+	}
+	return s
+}
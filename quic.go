@@ -0,0 +1,92 @@
+package proxyplease
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// UDPTunneling reports whether UDP, and so QUIC and HTTP/3, can reach p.TargetURL. Only
+// direct connections carry UDP: CONNECT tunnels are TCP only, and SOCKS5 UDP ASSOCIATE is
+// not supported.
+func UDPTunneling(p Proxy) bool {
+	return Decide(p).URL == nil
+}
+
+// NewHTTP3Fallback returns a RoundTripper sending requests with h3, an HTTP/3 RoundTripper
+// such as quic-go's http3.RoundTripper, to targets UDP can reach, and through the proxy
+// over TCP and TLS otherwise. HTTP/3 Alt-Svc advertisements are removed from responses
+// received through the proxy, so clients do not attempt to upgrade.
+func NewHTTP3Fallback(p Proxy, h3 http.RoundTripper) http.RoundTripper {
+	return &http3Fallback{
+		p:  p,
+		h3: h3,
+		tcp: &http.Transport{
+			Proxy:             nil, // the dialer connects through the proxy
+			DialContext:       NewDialContext(p),
+			TLSClientConfig:   p.TargetTLSConfig,
+			ForceAttemptHTTP2: true,
+		},
+		udp: map[string]bool{},
+	}
+}
+
+type http3Fallback struct {
+	p   Proxy
+	h3  http.RoundTripper
+	tcp *http.Transport
+
+	mu  sync.Mutex
+	udp map[string]bool // whether UDP reaches each scheme://host
+}
+
+func (t *http3Fallback) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.reachable(req.URL) {
+		return t.h3.RoundTrip(req)
+	}
+	resp, err := t.tcp.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	removeHTTP3AltSvc(resp.Header)
+	return resp, nil
+}
+
+// reachable reports whether UDP reaches the target of u, deciding once per host.
+func (t *http3Fallback) reachable(u *url.URL) bool {
+	key := u.Scheme + "://" + u.Host
+	t.mu.Lock()
+	udp, ok := t.udp[key]
+	t.mu.Unlock()
+	if ok {
+		return udp
+	}
+	p := t.p
+	p.TargetURL = &url.URL{Scheme: u.Scheme, Host: u.Host}
+	udp = UDPTunneling(p)
+	if !udp {
+		t.p.debugf("quic> %s is only reachable through the proxy. Falling back from HTTP/3 to TCP.", key)
+	}
+	t.mu.Lock()
+	t.udp[key] = udp
+	t.mu.Unlock()
+	return udp
+}
+
+// removeHTTP3AltSvc removes the HTTP/3 alternatives from the Alt-Svc header of h.
+func removeHTTP3AltSvc(h http.Header) {
+	var keep []string
+	for _, v := range h.Values("Alt-Svc") {
+		for _, alt := range strings.Split(v, ",") {
+			alt = strings.TrimSpace(alt)
+			if alt != "" && !strings.HasPrefix(alt, "h3") && !strings.HasPrefix(alt, "quic") {
+				keep = append(keep, alt)
+			}
+		}
+	}
+	h.Del("Alt-Svc")
+	if len(keep) > 0 {
+		h.Set("Alt-Svc", strings.Join(keep, ", "))
+	}
+}
@@ -0,0 +1,94 @@
+package proxyplease
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Quirks toggle workarounds for proxies deviating from the HTTP specifications. Profile
+// selects the workarounds known to be needed by a product, see QuirkProfiles; the other
+// fields enable workarounds in addition to those of the profile.
+type Quirks struct {
+	Profile           string // Name of an entry of QuirkProfiles, ex: "bluecoat".
+	LowercaseHeaders  bool   // Write CONNECT header names in lowercase, for gateways matching them case-sensitively.
+	NoProxyConnection bool   // Omit the nonstandard Proxy-Connection: Keep-Alive header, which some gateways reject.
+	AuthEveryRequest  bool   // Send credentials with every request to the proxy, like Proxy.AuthEveryRequest.
+	NoBodyDrain       bool   // Do not wait for the body of 407 responses during NTLM and Negotiate, for proxies announcing more body than they send. Only the part already received is discarded.
+}
+
+// QuirkProfiles are the workarounds known to be needed by proxy products, selected with
+// Quirks.Profile. Entries may be added or changed before dialing.
+var QuirkProfiles = map[string]Quirks{
+	"squid":             {},
+	"bluecoat":          {NoBodyDrain: true},
+	"mcafee-webgateway": {AuthEveryRequest: true},
+	"zscaler":           {NoProxyConnection: true, AuthEveryRequest: true},
+}
+
+// withQuirks returns p with the workarounds of its quirk profile merged into p.Quirks and
+// the equivalent Proxy options set.
+func withQuirks(p Proxy) Proxy {
+	q := p.Quirks
+	if q.Profile != "" {
+		profile, ok := QuirkProfiles[strings.ToLower(q.Profile)]
+		if !ok {
+			p.debugf("quirks> Unknown quirk profile '%s'", q.Profile)
+		}
+		q.LowercaseHeaders = q.LowercaseHeaders || profile.LowercaseHeaders
+		q.NoProxyConnection = q.NoProxyConnection || profile.NoProxyConnection
+		q.AuthEveryRequest = q.AuthEveryRequest || profile.AuthEveryRequest
+		q.NoBodyDrain = q.NoBodyDrain || profile.NoBodyDrain
+		q.Profile = ""
+	}
+	p.Quirks = q
+	p.AuthEveryRequest = p.AuthEveryRequest || q.AuthEveryRequest
+	return p
+}
+
+// setKeepAlive asks the proxy to keep the connection open for the next handshake step,
+// unless the quirks of p forbid the Proxy-Connection header.
+func (p Proxy) setKeepAlive(h http.Header) {
+	if !p.Quirks.NoProxyConnection {
+		h.Set("Proxy-Connection", "Keep-Alive")
+	}
+}
+
+// discardAuthBody discards the body of a response before the next step of a
+// connection-oriented handshake is written.
+func discardAuthBody(p Proxy, br *responseReader, resp *http.Response) error {
+	if p.Quirks.NoBodyDrain && resp.StatusCode == http.StatusProxyAuthRequired {
+		_, err := br.Discard(br.Buffered())
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// writeLowercaseHeaders writes req like req.Write, with header names in lowercase.
+func writeLowercaseHeaders(w io.Writer, req *http.Request) error {
+	var buf bytes.Buffer
+	if err := req.Write(&buf); err != nil {
+		return err
+	}
+	b := buf.Bytes()
+	end := bytes.Index(b, []byte("\r\n\r\n"))
+	if end < 0 {
+		end = len(b)
+	}
+	// skip the request line
+	for i := bytes.Index(b, []byte("\r\n")) + 2; i < end; {
+		colon := bytes.IndexByte(b[i:end], ':')
+		if colon < 0 {
+			break
+		}
+		copy(b[i:], bytes.ToLower(b[i:i+colon]))
+		next := bytes.Index(b[i:end], []byte("\r\n"))
+		if next < 0 {
+			break
+		}
+		i += next + 2
+	}
+	_, err := w.Write(b)
+	return err
+}
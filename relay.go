@@ -0,0 +1,33 @@
+package proxyplease
+
+import (
+	"io"
+	"net"
+)
+
+// closeWriter is implemented by connections supporting a TCP half-close. *Conn always
+// implements it, failing when its underlying connection does not.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// relay copies data in both directions between a and b until both sides are done.
+// When one direction finishes, the write side of the opposite connection is half-closed
+// so protocols relying on EOF keep working, or closed if it cannot be half-closed. Both
+// connections are closed on return.
+func relay(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); !ok || cw.CloseWrite() != nil {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	<-done
+	a.Close()
+	b.Close()
+}
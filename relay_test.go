@@ -0,0 +1,36 @@
+package proxyplease
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRelayHalfCloseUnsupported(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a tunnel over a connection without half-close is closed once the client is done
+	tunnel, peer := net.Pipe()
+	defer peer.Close()
+	go relay(server, &Conn{Conn: tunnel})
+	client.Write([]byte("ping"))
+	client.(*net.TCPConn).CloseWrite()
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	if b, err := io.ReadAll(peer); string(b) != "ping" || err != nil {
+		t.Errorf("read %q, %v from the tunnel, want \"ping\" then EOF", b, err)
+	}
+}
@@ -0,0 +1,92 @@
+package proxyplease
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// Target name resolution modes.
+const (
+	ResolveByScheme = ""      // Resolve locally for socks4:// and socks5:// proxies, and on the proxy for socks4a://, socks5h://, http:// and https:// proxies.
+	ResolveLocal    = "local" // Resolve target names locally and send the proxy IP addresses.
+	ResolveOnProxy  = "proxy" // Send target names to the proxy unresolved, ex: for names only the proxy can resolve.
+)
+
+// resolver returns the resolver of local name lookups, p.Resolver or the default one.
+func (p Proxy) resolver() *net.Resolver {
+	if p.Resolver != nil {
+		return p.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// targetResolver returns the resolver of target names, p.TargetResolver or the resolver of
+// local name lookups.
+func (p Proxy) targetResolver() *net.Resolver {
+	if p.TargetResolver != nil {
+		return p.TargetResolver
+	}
+	return p.resolver()
+}
+
+// withDoH returns p resolving target names with DNS over HTTPS queries to p.DoHURL, sent
+// through a dialer of its own configuration, if p.DoHURL is set.
+func withDoH(p Proxy) Proxy {
+	if p.DoHURL == "" || p.TargetResolver != nil {
+		return p
+	}
+	q := p
+	q.DoHURL, q.TargetResolution = "", ResolveOnProxy
+	p.TargetResolver = NewDoHResolver(p.DoHURL, NewDialContext(q))
+	if p.TargetResolution == ResolveByScheme {
+		p.TargetResolution = ResolveLocal
+	}
+	return p
+}
+
+// resolvesLocally reports whether target names are resolved locally rather than by the
+// proxy at p.URL.
+func (p Proxy) resolvesLocally() bool {
+	switch p.TargetResolution {
+	case ResolveLocal:
+		return true
+	case ResolveOnProxy:
+		return false
+	}
+	s := p.URL.Scheme
+	return s == "socks4" || s == "socks5"
+}
+
+// resolveTarget replaces the host of addr with its first IP address, preferring IPv4,
+// looked up with the target resolver of p. The lookup is limited by timeout, if set.
+func resolveTarget(ctx context.Context, p Proxy, addr string, timeout time.Duration) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ips, err := p.targetResolver().LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", errors.New("no address for " + host)
+	}
+	ip := ips[0].IP
+	for _, v := range ips {
+		if v.IP.To4() != nil {
+			ip = v.IP
+			break
+		}
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
@@ -0,0 +1,117 @@
+package proxyplease
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Default bounds of the backoff between retries of a dial.
+const (
+	retryBackoffMin = 500 * time.Millisecond
+	retryBackoffMax = 30 * time.Second
+)
+
+// RetryPolicy controls how dials through a proxy are retried. Transient failures, ex: a
+// 502 or 503 answer or a timeout, are retried with exponential backoff. When the proxy
+// rejects credentials with 407, Reprompt is asked for fresh ones.
+type RetryPolicy struct {
+	MaxAttempts    int                // Limit on handshakes per dial, including the first. Zero or one disables retries.
+	InitialBackoff time.Duration      // Delay before the first retry, doubled after each one. Defaults to 500ms.
+	MaxBackoff     time.Duration      // Limit on the delay between retries, also applied to Retry-After. Defaults to 30s.
+	Reprompt       CredentialProvider // Asked for fresh credentials when the proxy rejects those of a dial, ex: an interactive prompt. Retries with them count as attempts.
+}
+
+// dialProxy returns a net.Conn to addr with an established and authenticated session
+// through the proxy at p.URL, retrying as allowed by p.RetryPolicy.
+func dialProxy(ctx context.Context, p Proxy, network, addr string) (net.Conn, error) {
+	r := p.RetryPolicy
+	backoff, max := r.InitialBackoff, r.MaxBackoff
+	if backoff <= 0 {
+		backoff = retryBackoffMin
+	}
+	if max <= 0 {
+		max = retryBackoffMax
+	}
+	for attempt := 1; ; attempt++ {
+		record, err := p.CircuitBreaker.allow(p)
+		if err != nil {
+			p.debugf("circuit> Circuit of %s is open, failing the dial to %s", p.URL.Host, addr)
+			return nil, err
+		}
+		conn, err := dialProxyOnce(ctx, p, network, addr)
+		record(ctx, err)
+		if err == nil || attempt >= r.MaxAttempts || ctx.Err() != nil {
+			return conn, err
+		}
+
+		var af *ErrAuthFailed
+		if errors.As(err, &af) && af.Status == http.StatusProxyAuthRequired {
+			if r.Reprompt == nil {
+				return conn, err
+			}
+			u := *p.URL
+			u.User = nil
+			c, perr := r.Reprompt.Credentials(ctx, &u, af.Scheme)
+			if perr != nil {
+				p.debugf("retry> Could not obtain fresh credentials for %s: %s", af.Scheme, perr)
+				return conn, err
+			}
+			p.debugf("retry> Proxy rejected the %s credentials. Retrying with fresh ones.", af.Scheme)
+			p.Username, p.Password = c.Username, c.Password
+			if c.Domain != "" {
+				p.Domain = c.Domain
+			}
+			if conn != nil {
+				conn.Close()
+			}
+			continue
+		}
+
+		wait, ok := retryDelay(err, backoff, max)
+		if !ok {
+			return conn, err
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		p.debugf("retry> Attempt %d to %s failed, retrying in %s: %s", attempt, addr, wait, err)
+		select {
+		case <-clockOr(p.Clock).After(wait):
+		case <-ctx.Done():
+			return nil, err
+		}
+		if backoff *= 2; backoff > max {
+			backoff = max
+		}
+	}
+}
+
+// retryDelay returns how long to wait before retrying a dial that failed with err, and
+// whether the failure is transient: a 502 or 503 answer, a 429, or a timeout. A
+// Retry-After header in seconds takes precedence over backoff, up to max.
+func retryDelay(err error, backoff, max time.Duration) (time.Duration, bool) {
+	var se *StatusError
+	if errors.As(err, &se) {
+		switch se.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusTooManyRequests:
+		default:
+			return 0, false
+		}
+		if s, perr := strconv.Atoi(se.Header.Get("Retry-After")); perr == nil && s >= 0 {
+			if d := time.Duration(s) * time.Second; d < max {
+				return d, true
+			}
+			return max, true
+		}
+		return backoff, true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return backoff, true
+	}
+	return 0, false
+}
@@ -0,0 +1,241 @@
+package proxyplease
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Route actions.
+const (
+	RouteDirect = "DIRECT" // Connect to the destination without a proxy.
+	RouteBlock  = "BLOCK"  // Refuse the request.
+	RouteProxy  = "PROXY"  // Connect through RouteRule.Proxy.
+)
+
+// ErrRouteBlocked is returned for destinations blocked by the Routes of a Proxy or a
+// Forwarder.
+var ErrRouteBlocked = errors.New("destination is blocked by a routing rule")
+
+// RouteRule overrides the proxy selection of a Proxy or a Forwarder for matching
+// destinations.
+type RouteRule struct {
+	Match  string   // Host name, domain such as "*.example.com", CIDR, or "*", in Proxy.Bypass syntax.
+	Ports  []int    // Destination ports the rule applies to, ex: []int{22}. Empty matches every port.
+	Action string   // RouteDirect, RouteBlock or RouteProxy.
+	Proxy  *url.URL // Proxy used by RouteProxy, ex: "socks5h://127.0.0.1:1080".
+}
+
+// matches reports whether the rule applies to host and port. port is empty if unknown.
+func (r *RouteRule) matches(host, port string) bool {
+	if !bypassMatch(host, []string{r.Match}) {
+		return false
+	}
+	if len(r.Ports) == 0 {
+		return true
+	}
+	for _, p := range r.Ports {
+		if strconv.Itoa(p) == port {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadRoutes reads the routing rules file at path. See ParseRoutes for its format.
+func LoadRoutes(path string) ([]RouteRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRoutes(f)
+}
+
+// ParseRoutes reads routing rules, one per line: a pattern followed by DIRECT, BLOCK or
+// PROXY and a proxy URL. The pattern may end with a colon and a comma-separated list of
+// ports, with IPv6 addresses and CIDRs bracketed. Blank lines and lines starting with '#'
+// are ignored.
+//
+//	*.corp.example.com  DIRECT
+//	10.0.0.0/8          DIRECT
+//	*.ads.example       BLOCK
+//	github.com          PROXY socks5h://127.0.0.1:1080
+//	*:22,2222           PROXY socks5h://127.0.0.1:1080
+//	[2001:db8::/32]:443 DIRECT
+func ParseRoutes(r io.Reader) ([]RouteRule, error) {
+	var rules []RouteRule
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("routes line %d: missing action", line)
+		}
+		rule := RouteRule{Action: strings.ToUpper(fields[1])}
+		var err error
+		if rule.Match, rule.Ports, err = splitRoutePorts(fields[0]); err != nil {
+			return nil, fmt.Errorf("routes line %d: %s", line, err)
+		}
+		switch {
+		case rule.Action == RouteProxy && len(fields) == 3:
+			u, err := ParseProxyURL(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("routes line %d: %s", line, err)
+			}
+			rule.Proxy = u
+		case (rule.Action == RouteDirect || rule.Action == RouteBlock) && len(fields) == 2:
+		default:
+			return nil, fmt.Errorf("routes line %d: expected 'pattern DIRECT|BLOCK' or 'pattern PROXY url'", line)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, s.Err()
+}
+
+// splitRoutePorts splits the ports off a routing pattern, ex: "*:22,2222". Patterns with
+// more than one colon are IPv6 and need brackets to carry ports, ex: "[::1]:22".
+func splitRoutePorts(pattern string) (string, []int, error) {
+	i := strings.LastIndexByte(pattern, ':')
+	if i < 0 || (strings.Count(pattern, ":") > 1 && !strings.HasPrefix(pattern, "[")) {
+		return pattern, nil, nil
+	}
+	if strings.HasPrefix(pattern, "[") && !strings.HasSuffix(pattern[:i], "]") {
+		return strings.Trim(pattern, "[]"), nil, nil
+	}
+	var ports []int
+	for _, s := range strings.Split(pattern[i+1:], ",") {
+		port, err := strconv.Atoi(s)
+		if err != nil || port < 1 || port > 65535 {
+			return "", nil, fmt.Errorf("invalid port '%s' in '%s'", s, pattern)
+		}
+		ports = append(ports, port)
+	}
+	return strings.Trim(pattern[:i], "[]"), ports, nil
+}
+
+// matchRoute returns the first of rules matching addr (host:port), or nil.
+func matchRoute(rules []RouteRule, addr string) *RouteRule {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = strings.Trim(addr, "[]"), ""
+	}
+	for i := range rules {
+		if rules[i].matches(host, port) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// route returns the first of f.Routes matching addr (host:port), or nil.
+func (f *Forwarder) route(addr string) *RouteRule {
+	return matchRoute(f.Routes, addr)
+}
+
+// dialRoute connects to addr as decided by f.Routes, or through upstream if no rule
+// matches.
+func (f *Forwarder) dialRoute(ctx context.Context, upstream *forwarderUpstream, network, addr string) (net.Conn, error) {
+	f.mu.Lock()
+	if f.router == nil {
+		p := f.Proxy
+		p.Routes = f.Routes
+		f.router = &router{p: p, dialers: map[string]DialContext{}, open: f.routeDialer}
+	}
+	r := f.router
+	f.mu.Unlock()
+	return r.route(ctx, network, addr, upstream.dialer.DialContext)
+}
+
+// routeDialer returns the dial func of a Dialer for the proxy of a RouteProxy rule, which
+// Close closes.
+func (f *Forwarder) routeDialer(p Proxy) DialContext {
+	// the Forwarder watches the system settings itself
+	p.WatchSystem = false
+	d := NewDialer(p)
+	f.mu.Lock()
+	f.routeDialers = append(f.routeDialers, d)
+	f.mu.Unlock()
+	return d.DialContext
+}
+
+// router dials each destination as the first of p.Routes matching it says, and the
+// others with next.
+type router struct {
+	p    Proxy
+	next DialContext
+	open func(Proxy) DialContext // returns the dial func of a RouteProxy rule. Defaults to that of newDialFunc.
+
+	mu      sync.Mutex
+	dialers map[string]DialContext // of RouteProxy rules, by proxy URL
+}
+
+// routedDialFunc returns next, evaluating p.Routes first if set.
+func routedDialFunc(p Proxy, next DialContext) DialContext {
+	if len(p.Routes) == 0 {
+		return next
+	}
+	r := &router{p: p, next: next, dialers: map[string]DialContext{}}
+	return r.DialContext
+}
+
+// DialContext connects to addr as decided by the first matching rule, or with r.next.
+func (r *router) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return r.route(ctx, network, addr, r.next)
+}
+
+// route connects to addr as decided by the first matching rule, or with next.
+func (r *router) route(ctx context.Context, network, addr string, next DialContext) (net.Conn, error) {
+	if isPACFetch(ctx) {
+		return next(ctx, network, addr)
+	}
+	rule := matchRoute(r.p.Routes, addr)
+	if rule == nil {
+		return next(ctx, network, addr)
+	}
+	switch rule.Action {
+	case RouteBlock:
+		r.p.debugf("routes> Blocking %s as it matches %s", addr, rule.Match)
+		return nil, ErrRouteBlocked
+	case RouteDirect:
+		r.p.debugf("routes> Connecting directly to %s as it matches %s", addr, rule.Match)
+		return r.p.dialDirect(ctx, network, addr)
+	case RouteProxy:
+		if rule.Proxy != nil {
+			r.p.debugf("routes> Connecting to %s through %s as it matches %s", addr, rule.Proxy.Host, rule.Match)
+			return r.dialer(rule.Proxy)(ctx, network, addr)
+		}
+	}
+	return nil, fmt.Errorf("invalid routing rule for %s: %s", rule.Match, rule.Action)
+}
+
+// dialer returns the DialContext of a RouteProxy rule, reused across dials. Other
+// settings, such as credentials, are those of r.p unless set in u.
+func (r *router) dialer(u *url.URL) DialContext {
+	key := u.String()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if dial, ok := r.dialers[key]; ok {
+		return dial
+	}
+	q := r.p
+	q.URL, q.Upstreams, q.Chain, q.PACURL, q.PACScript, q.ProxyList, q.Routes = u, nil, nil, nil, "", "", nil
+	var dial DialContext
+	if r.open != nil {
+		dial = r.open(q)
+	} else {
+		dial, _, _ = newDialFunc(q)
+	}
+	r.dialers[key] = dial
+	return dial
+}
@@ -0,0 +1,157 @@
+package proxyplease
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// SchemeDialer authenticates to proxies with a scheme registered with RegisterScheme, ex: a
+// vendor-specific session scheme.
+type SchemeDialer interface {
+	// DialScheme answers the challenges of a, sending CONNECT requests with a.Connect until
+	// the proxy establishes the tunnel, and returns it. The error of the last rejected
+	// request should be returned as is, so the attempt is reported with its status code.
+	DialScheme(ctx context.Context, a SchemeAttempt) (net.Conn, error)
+}
+
+// SchemeDialerFunc adapts a function to a SchemeDialer.
+type SchemeDialerFunc func(ctx context.Context, a SchemeAttempt) (net.Conn, error)
+
+// DialScheme calls f.
+func (f SchemeDialerFunc) DialScheme(ctx context.Context, a SchemeAttempt) (net.Conn, error) {
+	return f(ctx, a)
+}
+
+// SchemeAttempt is an attempt at authenticating with a registered scheme, in answer to a
+// 407 response of the proxy.
+type SchemeAttempt struct {
+	Proxy      Proxy    // Configuration of the dial, including its credentials.
+	Addr       string   // Address of the target of the tunnel, as sent in the CONNECT request.
+	Challenges []string // Proxy-Authenticate challenges of the scheme, as offered by the proxy.
+	// Connect sends a CONNECT request for Addr with the headers of Proxy and h, ex: a
+	// Proxy-Authorization header, and returns the tunnel if the proxy answers 200.
+	// Otherwise, it returns the response, whose body has been read, with a *StatusError to
+	// return if the attempt gives up. The response is nil if the exchange failed.
+	// Requests are sent on the connection of the previous one unless the proxy closed it,
+	// so connection-based schemes can exchange several messages.
+	Connect func(h http.Header) (net.Conn, *http.Response, error)
+}
+
+var (
+	schemesMu         sync.RWMutex
+	registeredSchemes = map[string]registeredScheme{}
+)
+
+type registeredScheme struct {
+	name   string
+	dialer SchemeDialer
+}
+
+// RegisterScheme makes a proxy authentication scheme available to all dials, answering
+// the challenges of the proxy that name, case-insensitively. Registered schemes are
+// attempted in the order of the challenges, after the built-in schemes unless ranked by
+// Proxy.SchemePreference, and can be excluded with Proxy.AuthSchemeFilter. It is meant
+// to be called from the init function of the package implementing the scheme, and
+// panics if dialer is nil or the scheme is built in or already registered.
+func RegisterScheme(name string, dialer SchemeDialer) {
+	if dialer == nil {
+		panic("proxyplease: RegisterScheme dialer is nil")
+	}
+	key := strings.ToLower(name)
+	for _, s := range defaultSchemePreference {
+		if strings.ToLower(s) == key {
+			panic("proxyplease: RegisterScheme called for built-in scheme " + name)
+		}
+	}
+	schemesMu.Lock()
+	defer schemesMu.Unlock()
+	if _, ok := registeredSchemes[key]; ok {
+		panic("proxyplease: RegisterScheme called twice for scheme " + name)
+	}
+	registeredSchemes[key] = registeredScheme{name: name, dialer: dialer}
+}
+
+// lookupScheme returns the registered scheme of a Proxy-Authenticate challenge.
+func lookupScheme(challenge string) (registeredScheme, bool) {
+	schemesMu.RLock()
+	defer schemesMu.RUnlock()
+	s, ok := registeredSchemes[challengeScheme(challenge)]
+	return s, ok
+}
+
+// dialRegistered authenticates with the registered scheme s, answering its challenges
+// among those of a 407 response.
+func dialRegistered(ctx context.Context, p Proxy, addr string, s registeredScheme, challenges []string, baseDial func() (net.Conn, error)) (net.Conn, error) {
+	p.debugf("connect> Attempting to authenticate with registered scheme %s", s.name)
+	var offered []string
+	for _, c := range challenges {
+		if challengeScheme(c) == strings.ToLower(s.name) {
+			offered = append(offered, c)
+		}
+	}
+
+	var conn net.Conn
+	var br *responseReader
+	connect := func(extra http.Header) (net.Conn, *http.Response, error) {
+		if conn == nil {
+			c, err := baseDial()
+			if err != nil {
+				p.debugf("connect> Could not call dial context with proxy: %s", err)
+				return nil, nil, err
+			}
+			conn, br = c, newResponseReader(p, c)
+		}
+		h := p.connectHeader(addr)
+		for k, v := range extra {
+			h[k] = v
+		}
+		p.setKeepAlive(h)
+		req := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: h,
+		}
+		if err := writeConnect(p, conn, req); err != nil {
+			p.debugf("connect> Could not write %s message to proxy: %s", s.name, err)
+			conn.Close()
+			conn = nil
+			return nil, nil, err
+		}
+		resp, err := br.read(req)
+		if err != nil {
+			p.debugf("connect> Could not read response from proxy: %s", err)
+			conn.Close()
+			conn = nil
+			return nil, nil, err
+		}
+		p.saveCookies(resp)
+		if resp.StatusCode == http.StatusOK {
+			p.debugf("connect> Successfully authenticated with %s", s.name)
+			tunnel := newConn(conn, p, resp, br.Reader, s.name)
+			conn = nil
+			return tunnel, resp, nil
+		}
+		p.debugf("connect> Expected %d as return status, got: %d", http.StatusOK, resp.StatusCode)
+		err = newStatusError(resp)
+		if discardAuthBody(p, br, resp) != nil || resp.Close {
+			conn.Close()
+			conn = nil
+		}
+		return nil, resp, err
+	}
+
+	tunnel, err := s.dialer.DialScheme(ctx, SchemeAttempt{Proxy: p, Addr: addr, Challenges: offered, Connect: connect})
+	if conn != nil {
+		conn.Close()
+	}
+	if err != nil && tunnel != nil {
+		tunnel.Close()
+		tunnel = nil
+	}
+	return tunnel, err
+}
@@ -0,0 +1,55 @@
+package proxyplease
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/bdwyertech/proxyplease/auth"
+)
+
+// defaultSchemePreference ranks the authentication schemes offered by a proxy from the
+// strongest to the weakest. Schemes not listed are attempted last, in the order offered.
+var defaultSchemePreference = []string{"Negotiate", "Kerberos", "NTLM", "Digest", "Bearer", "Basic"}
+
+// orderChallenges returns the Proxy-Authenticate challenges of a 407 response in the
+// order they are attempted: by p.SchemePreference, then by strength, then as offered.
+// Basic is dropped for plaintext proxies if p.DisallowPlaintextBasic is set.
+func orderChallenges(p Proxy, challenges []string) []string {
+	rank := map[string]int{}
+	for _, s := range append(append([]string(nil), p.SchemePreference...), defaultSchemePreference...) {
+		if _, ok := rank[strings.ToLower(s)]; !ok {
+			rank[strings.ToLower(s)] = len(rank)
+		}
+	}
+
+	ordered := make([]string, 0, len(challenges))
+	for _, c := range challenges {
+		if challengeScheme(c) == "basic" && p.DisallowPlaintextBasic && !p.encryptedProxy() {
+			p.debugf("connect> Skipping Basic as the connection to the proxy is not encrypted")
+			continue
+		}
+		ordered = append(ordered, c)
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		ri, ok := rank[challengeScheme(ordered[i])]
+		if !ok {
+			ri = len(rank)
+		}
+		rj, ok := rank[challengeScheme(ordered[j])]
+		if !ok {
+			rj = len(rank)
+		}
+		return ri < rj
+	})
+	return ordered
+}
+
+// challengeScheme returns the lowercased scheme of a Proxy-Authenticate challenge.
+func challengeScheme(challenge string) string {
+	return strings.ToLower(auth.ChallengeScheme(challenge))
+}
+
+// encryptedProxy reports whether the connection to the proxy is protected by TLS.
+func (p Proxy) encryptedProxy() bool {
+	return p.URL != nil && p.URL.Scheme == "https"
+}
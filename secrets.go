@@ -0,0 +1,126 @@
+package proxyplease
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSecretTTL is how long CachedSecret reuses fetched credentials by default.
+const DefaultSecretTTL = 5 * time.Minute
+
+// SecretStore fetches proxy credentials from a secrets manager, ex: a VaultSecret,
+// AWSSecret or GCPSecret. The secret holds a JSON object with "username" and "password"
+// keys, and optionally "domain".
+type SecretStore interface {
+	Fetch(ctx context.Context) (Credentials, error)
+}
+
+// credentialInvalidator is implemented by CredentialProviders that drop their credentials
+// once a proxy rejected them, so they are fetched again.
+type credentialInvalidator interface {
+	invalidate(c Credentials)
+}
+
+// CachedSecret returns a CredentialProvider for Proxy.CredentialProvider fetching the
+// credentials from store, and reusing them for ttl (DefaultSecretTTL if zero), so servers
+// need no password baked into their images. Credentials the proxy rejects are fetched again
+// at once, picking up a rotated password. While the store cannot be reached, the last
+// credentials fetched keep being used.
+func CachedSecret(store SecretStore, ttl time.Duration) CredentialProvider {
+	if ttl <= 0 {
+		ttl = DefaultSecretTTL
+	}
+	return &cachedSecret{store: store, ttl: ttl}
+}
+
+type cachedSecret struct {
+	store SecretStore
+	ttl   time.Duration
+
+	mu      sync.Mutex
+	creds   Credentials
+	fetched time.Time // zero if creds must be fetched
+}
+
+func (s *cachedSecret) Credentials(ctx context.Context, proxy *url.URL, scheme string) (Credentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.fetched.IsZero() && time.Since(s.fetched) < s.ttl {
+		return s.creds, nil
+	}
+	c, err := s.store.Fetch(ctx)
+	if err != nil {
+		if s.creds != (Credentials{}) {
+			debugf("secrets> Could not fetch credentials, using the previous ones: %s", err)
+			return s.creds, nil
+		}
+		return Credentials{}, err
+	}
+	s.creds, s.fetched = c, time.Now()
+	return c, nil
+}
+
+func (s *cachedSecret) invalidate(c Credentials) {
+	s.mu.Lock()
+	if s.creds == c {
+		s.fetched = time.Time{}
+	}
+	s.mu.Unlock()
+}
+
+// errSecretFields is returned for secrets without username and password.
+var errSecretFields = errors.New(`secret has no "username" and "password" keys`)
+
+// secretCredentials returns the credentials of a secret holding a JSON object.
+func secretCredentials(b []byte) (Credentials, error) {
+	var s struct {
+		Domain   string `json:"domain"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return Credentials{}, fmt.Errorf("secret is not a JSON object: %s", err)
+	}
+	if s.Username == "" && s.Password == "" {
+		return Credentials{}, errSecretFields
+	}
+	return Credentials{Domain: s.Domain, Username: s.Username, Password: s.Password}, nil
+}
+
+// maxSecretResponse bounds the responses read from secrets managers.
+const maxSecretResponse = 1 << 20
+
+// doSecretRequest sends req with client, or http.DefaultClient, and decodes the JSON
+// response into v. service names the secrets manager in errors.
+func doSecretRequest(client *http.Client, req *http.Request, service string, v interface{}) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSecretResponse))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// error bodies are JSON, quoted as is
+		msg := strings.Join(strings.Fields(string(b)), " ")
+		if len(msg) > maxBodySummary {
+			msg = msg[:maxBodySummary] + "..."
+		}
+		return fmt.Errorf("%s: %s: %s", service, resp.Status, msg)
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,244 @@
+package proxyplease
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// redirectClient returns a client sending every request to srv, whatever its host, as
+// for the metadata services at fixed addresses.
+func redirectClient(srv *httptest.Server) *http.Client {
+	target, _ := url.Parse(srv.URL)
+	return &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// TestSignAWS checks signatures against the examples of the AWS Signature Version 4
+// documentation and test suite.
+func TestSignAWS(t *testing.T) {
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	tests := []struct {
+		name, method, url, contentType, body, service string
+		want                                          string
+	}{
+		{
+			"iam-list-users", "GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", "application/x-www-form-urlencoded; charset=utf-8", "", "iam",
+			"Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+		},
+		{
+			"get-vanilla", "GET", "https://example.amazonaws.com/", "", "", "service",
+			"Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			"post-vanilla", "POST", "https://example.amazonaws.com/", "", "", "service",
+			"Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+		{
+			"post-x-www-form-urlencoded", "POST", "https://example.amazonaws.com/", "application/x-www-form-urlencoded", "Param1=value1", "service",
+			"Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+		},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		signAWS(req, []byte(tt.body), creds, "us-east-1", tt.service, now)
+		if got := req.Header.Get("Authorization"); got != "AWS4-HMAC-SHA256 "+tt.want {
+			t.Errorf("%s: Authorization %q, want %q", tt.name, got, "AWS4-HMAC-SHA256 "+tt.want)
+		}
+		if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+			t.Errorf("%s: X-Amz-Date %q", tt.name, got)
+		}
+	}
+}
+
+func TestAWSSecretFetch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		auth := r.Header.Get("Authorization")
+		if r.Method != "POST" || r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" ||
+			!strings.Contains(auth, "Credential=AKID/"+time.Now().UTC().Format("20060102")+"/eu-west-1/secretsmanager/aws4_request") ||
+			!strings.Contains(auth, "SignedHeaders=content-type;host;x-amz-date;x-amz-security-token;x-amz-target") ||
+			r.Header.Get("X-Amz-Security-Token") != "session" {
+			t.Errorf("unexpected request %s %s, %q", r.Method, r.Header.Get("X-Amz-Target"), auth)
+		}
+		if body["SecretId"] != "arn:aws:secretsmanager:eu-west-1:123456789012:secret:proxy" || body["VersionStage"] != "AWSPREVIOUS" {
+			t.Errorf("unexpected body %q", body)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"SecretString": `{"username":"user","password":"secret"}`})
+	}))
+	defer srv.Close()
+
+	s := &AWSSecret{
+		SecretID:        "arn:aws:secretsmanager:eu-west-1:123456789012:secret:proxy",
+		VersionStage:    "AWSPREVIOUS",
+		Endpoint:        srv.URL,
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "key",
+		SessionToken:    "session",
+	}
+	c, err := s.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Username != "user" || c.Password != "secret" {
+		t.Errorf("got %+v", c)
+	}
+}
+
+func TestAWSSecretInstanceRole(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/api/token":
+			if r.Method != "PUT" || r.Header.Get("X-Aws-Ec2-Metadata-Token-Ttl-Seconds") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte("imds-token"))
+			return
+		case "/latest/meta-data/iam/security-credentials/", "/latest/meta-data/iam/security-credentials/role":
+			if r.Header.Get("X-Aws-Ec2-Metadata-Token") != "imds-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if strings.HasSuffix(r.URL.Path, "/") {
+				w.Write([]byte("role\n"))
+			} else {
+				w.Write([]byte(`{"Code":"Success","AccessKeyId":"ASIA","SecretAccessKey":"key","Token":"role-session"}`))
+			}
+			return
+		}
+		if !strings.Contains(r.Header.Get("Authorization"), "Credential=ASIA/") || r.Header.Get("X-Amz-Security-Token") != "role-session" {
+			t.Errorf("request not signed with the instance role: %q", r.Header.Get("Authorization"))
+		}
+		json.NewEncoder(w).Encode(map[string]string{"SecretString": `{"username":"user","password":"secret"}`})
+	}))
+	defer srv.Close()
+
+	s := &AWSSecret{SecretID: "proxy", Region: "us-east-1", Client: redirectClient(srv)}
+	if c, err := s.Fetch(context.Background()); err != nil || c.Username != "user" {
+		t.Fatalf("got %+v, %v", c, err)
+	}
+}
+
+func TestAWSSecretMetadataTimeout(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	// off EC2 the metadata service never answers: give up without waiting for the caller
+	start := time.Now()
+	s := &AWSSecret{SecretID: "proxy", Region: "us-east-1", Client: redirectClient(srv)}
+	if _, err := s.Fetch(context.Background()); err == nil {
+		t.Fatal("Fetch succeeded without credentials")
+	}
+	if d := time.Since(start); d > awsIMDSTimeout+time.Second {
+		t.Errorf("gave up on the metadata service after %s, want %s", d, awsIMDSTimeout)
+	}
+}
+
+func TestVaultSecretFetch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		if r.URL.Path != "/v1/kv/data/proxy/corp" || r.Header.Get("X-Vault-Namespace") != "team" {
+			t.Errorf("unexpected request %s, namespace %q", r.URL.Path, r.Header.Get("X-Vault-Namespace"))
+		}
+		w.Write([]byte(`{"data":{"data":{"domain":"CORP","username":"user","password":"secret"},"metadata":{"version":3}}}`))
+	}))
+	defer srv.Close()
+
+	// the address, token and namespace default to those of the environment
+	t.Setenv("VAULT_ADDR", srv.URL)
+	t.Setenv("VAULT_TOKEN", "vault-token")
+	t.Setenv("VAULT_NAMESPACE", "team")
+	c, err := (&VaultSecret{Mount: "/kv/", Path: "/proxy/corp"}).Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != (Credentials{Domain: "CORP", Username: "user", Password: "secret"}) {
+		t.Errorf("got %+v", c)
+	}
+
+	_, err = (&VaultSecret{Token: "wrong", Path: "proxy/corp"}).Fetch(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "403") || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("Fetch with a wrong token: %v, want the 403 of Vault", err)
+	}
+}
+
+func TestGCPSecretFetch(t *testing.T) {
+	var metadata int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/computeMetadata/v1/instance/service-accounts/default/token" {
+			if r.Header.Get("Metadata-Flavor") != "Google" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			atomic.AddInt32(&metadata, 1)
+			w.Write([]byte(`{"access_token":"metadata-token","expires_in":3599,"token_type":"Bearer"}`))
+			return
+		}
+		if r.URL.Path != "/v1/projects/p/secrets/proxy/versions/latest:access" {
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer metadata-token" && auth != "Bearer source-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		data := base64.StdEncoding.EncodeToString([]byte(`{"username":"user","password":"secret"}`))
+		w.Write([]byte(`{"name":"projects/p/secrets/proxy/versions/1","payload":{"data":"` + data + `"}}`))
+	}))
+	defer srv.Close()
+
+	// the token of the default service account is fetched once from the metadata server
+	s := &GCPSecret{Name: "projects/p/secrets/proxy", Client: redirectClient(srv)}
+	for i := 0; i < 2; i++ {
+		if c, err := s.Fetch(context.Background()); err != nil || c.Username != "user" || c.Password != "secret" {
+			t.Fatalf("fetch %d: got %+v, %v", i, c, err)
+		}
+	}
+	if n := atomic.LoadInt32(&metadata); n != 1 {
+		t.Errorf("%d metadata token requests, want 1", n)
+	}
+
+	s = &GCPSecret{
+		Name:        "projects/p/secrets/proxy/versions/latest",
+		Endpoint:    srv.URL + "/",
+		TokenSource: RefreshingTokenSource(func() (string, time.Time, error) { return "source-token", time.Time{}, nil }),
+	}
+	if _, err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&metadata) != 1 {
+		t.Error("metadata server asked for a token despite the TokenSource")
+	}
+}
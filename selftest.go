@@ -0,0 +1,143 @@
+package proxyplease
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// SelfTestStage is the result of a step of SelfTest.
+type SelfTestStage struct {
+	Name     string        `json:"name"` // "discovery", "proxy", "handshake" or "tls".
+	Passed   bool          `json:"passed"`
+	Skipped  bool          `json:"skipped,omitempty"` // The stage does not apply, ex: "proxy" for direct connections.
+	Duration time.Duration `json:"duration"`
+	Detail   string        `json:"detail,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// SelfTestReport is the result of SelfTest. Stages after a failed one are not run.
+type SelfTestReport struct {
+	Target string          `json:"target"`
+	Passed bool            `json:"passed"`
+	Stages []SelfTestStage `json:"stages"`
+}
+
+// SelfTest checks that target, a URL such as "https://example.com", can be reached
+// through the proxy described by p, and reports each stage: discovering the proxy,
+// connecting to it, the CONNECT handshake with authentication, and TLS with the target
+// for https and wss URLs. Use it for health checks and onboarding scripts.
+func SelfTest(ctx context.Context, p Proxy, target string) *SelfTestReport {
+	r := &SelfTestReport{Target: target}
+	run := func(name string, f func() (string, error)) bool {
+		start := time.Now()
+		detail, err := f()
+		s := SelfTestStage{Name: name, Passed: err == nil, Duration: time.Since(start), Detail: detail}
+		if err != nil {
+			s.Error = err.Error()
+		}
+		r.Stages = append(r.Stages, s)
+		return err == nil
+	}
+	skip := func(name, detail string) {
+		r.Stages = append(r.Stages, SelfTestStage{Name: name, Passed: true, Skipped: true, Detail: detail})
+	}
+
+	u, err := url.Parse(target)
+	if err == nil && u.Host == "" {
+		err = fmt.Errorf("'%s' is not an absolute URL", target)
+	}
+	if err != nil {
+		r.Stages = append(r.Stages, SelfTestStage{Name: "discovery", Error: err.Error()})
+		return r
+	}
+	secure := u.Scheme == "https" || u.Scheme == "wss"
+	addr := u.Host
+	if u.Port() == "" {
+		scheme := u.Scheme
+		if secure {
+			scheme = "https"
+		}
+		addr = net.JoinHostPort(u.Hostname(), defaultPort(scheme))
+	}
+	p.TargetURL = u
+
+	var d Decision
+	run("discovery", func() (string, error) {
+		d = Decide(p)
+		if d.URL == nil {
+			return "direct connection (" + d.Source.String() + ")", nil
+		}
+		return d.URL.Redacted() + " (" + d.Source.String() + ")", nil
+	})
+
+	if d.URL == nil {
+		skip("proxy", "no proxy")
+	} else if !run("proxy", func() (string, error) {
+		dialer, err := p.netDialer()
+		if err != nil {
+			return "", err
+		}
+		conn, err := dialer.DialContext(ctx, "tcp", normalizeProxyURL(d.URL, p.DefaultHTTPPort).Host)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		return "reached " + conn.RemoteAddr().String(), nil
+	}) {
+		return r
+	}
+
+	var conn net.Conn
+	if !run("handshake", func() (string, error) {
+		dialer := NewDialer(p)
+		defer dialer.Close()
+		c, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			if o := Classify(err); o != Unclassified {
+				return o.String(), err
+			}
+			return "", err
+		}
+		conn = c
+		if tc, ok := c.(*Conn); ok && tc.info.AuthScheme != "" {
+			return "tunnel to " + addr + " established with " + tc.info.AuthScheme + " authentication", nil
+		}
+		return "connected to " + addr, nil
+	}) {
+		return r
+	}
+	defer conn.Close()
+
+	if !secure {
+		skip("tls", "not a TLS target")
+	} else if !run("tls", func() (string, error) {
+		config, err := targetTLSConfig(p)
+		if err != nil {
+			return "", err
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		tc, err := tlsHandshake(ctx, p.TargetTLSClient, conn, config)
+		if err != nil {
+			return "", err
+		}
+		state, ok := tlsState(tc)
+		if !ok || len(state.PeerCertificates) == 0 {
+			return "handshake completed", nil
+		}
+		detail := "verified " + state.PeerCertificates[0].Subject.CommonName
+		if IsIntercepted(state) {
+			detail += ", intercepted by " + state.PeerCertificates[0].Issuer.CommonName
+		}
+		return detail, nil
+	}) {
+		return r
+	}
+
+	r.Passed = true
+	return r
+}
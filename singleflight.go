@@ -0,0 +1,138 @@
+package proxyplease
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/bdwyertech/proxyplease/auth"
+)
+
+// authFlights tracks the authentication with each proxy and user of the Proxies setting
+// SingleflightAuth, by preemptiveKey.
+var authFlights = struct {
+	sync.Mutex
+	m map[string]*authFlight
+}{m: map[string]*authFlight{}}
+
+// authFlight is a handshake in progress, while done is open, or the outcome of the last
+// successful one.
+type authFlight struct {
+	done   chan struct{} // closed when the handshake in progress ends; nil once one succeeded
+	err    error         // authentication error of the handshake, set before done is closed
+	scheme string        // scheme the proxy accepted, or "" if none was required
+}
+
+// singleflightAuth runs handshake, the HTTP CONNECT handshake of p, letting a single
+// handshake with the proxy and user of p proceed until one succeeds. Concurrent dials wait
+// for its outcome: they then authenticate with the scheme it found, or fail with its
+// authentication error without sending the rejected credentials again.
+func (p Proxy) singleflightAuth(ctx context.Context, handshake func() (net.Conn, error)) (net.Conn, error) {
+	if !p.SingleflightAuth {
+		return handshake()
+	}
+	key := preemptiveKey(p)
+	for {
+		authFlights.Lock()
+		f := authFlights.m[key]
+		if f != nil && f.done == nil {
+			// a handshake succeeded: authenticate with its scheme
+			authFlights.Unlock()
+			conn, err := handshake()
+			if isAuthError(err) {
+				authFlights.Lock()
+				if authFlights.m[key] == f {
+					delete(authFlights.m, key)
+				}
+				authFlights.Unlock()
+			}
+			return conn, err
+		}
+		if f == nil {
+			f = &authFlight{done: make(chan struct{})}
+			authFlights.m[key] = f
+			authFlights.Unlock()
+			return p.leadFlight(key, f, handshake)
+		}
+		authFlights.Unlock()
+
+		p.debugf("connect> Waiting for a concurrent handshake with the proxy")
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if f.err != nil {
+			p.debugf("connect> Concurrent handshake failed to authenticate: %s", f.err)
+			return nil, f.err
+		}
+	}
+}
+
+// leadFlight runs handshake for the dials waiting on f and records its outcome.
+func (p Proxy) leadFlight(key string, f *authFlight, handshake func() (net.Conn, error)) (net.Conn, error) {
+	conn, err := handshake()
+	authFlights.Lock()
+	defer authFlights.Unlock()
+	if err == nil {
+		ok := &authFlight{}
+		if c, isConn := conn.(*Conn); isConn {
+			ok.scheme = c.info.AuthScheme
+		}
+		authFlights.m[key] = ok
+	} else {
+		// waiters retry after other failures, such as an unreachable proxy
+		if isAuthError(err) {
+			f.err = err
+		}
+		delete(authFlights.m, key)
+	}
+	close(f.done)
+	return conn, err
+}
+
+// flightScheme returns the connection-based scheme, NTLM or Negotiate, with which a
+// concurrent handshake with the proxy and user of p succeeded, so the unauthenticated
+// CONNECT answered with a 407 can be skipped. Other schemes are sent preemptively.
+func (p Proxy) flightScheme() string {
+	if !p.SingleflightAuth {
+		return ""
+	}
+	authFlights.Lock()
+	defer authFlights.Unlock()
+	if f := authFlights.m[preemptiveKey(p)]; f != nil && f.done == nil && (f.scheme == "NTLM" || f.scheme == "Negotiate") && contains(p.AuthSchemeFilter, f.scheme) {
+		return f.scheme
+	}
+	return ""
+}
+
+// dialFlightScheme authenticates with scheme, returned by flightScheme, without waiting
+// for a challenge. A rejection is returned as an *AuthError.
+func dialFlightScheme(ctx context.Context, p Proxy, addr, scheme string, baseDial func() (net.Conn, error)) (net.Conn, error) {
+	p.debugf("connect> Authenticating with %s, as accepted by the proxy for a concurrent dial", scheme)
+	started := p.authStarted(addr, nil)
+	conn, err := withCredentials(ctx, p, scheme, func(p Proxy) (net.Conn, error) {
+		if scheme == "NTLM" {
+			return dialNTLM(p, addr, baseDial)
+		}
+		return dialNegotiate(p, addr, baseDial)
+	})
+	var se *StatusError
+	if errors.As(err, &se) && se.StatusCode == http.StatusProxyAuthRequired {
+		err = &AuthError{
+			Offered:  auth.SplitChallenges(se.Header["Proxy-Authenticate"]),
+			Attempts: []AuthAttempt{p.authAttempt(scheme, err)},
+			Err:      &ErrAuthFailed{Scheme: scheme, Status: se.StatusCode, Err: err},
+		}
+		p.event(EventAuthFailed, "Authentication to the proxy failed for %s: %s", addr, err)
+	}
+	p.authEnded(conn, scheme, err, started)
+	return conn, err
+}
+
+func isAuthError(err error) bool {
+	var ae *AuthError
+	return errors.As(err, &ae)
+}
@@ -0,0 +1,49 @@
+package proxyplease
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxClockSkew is the clock difference Kerberos services tolerate by default.
+const maxClockSkew = 5 * time.Minute
+
+// ClockSkewError is returned when Kerberos authentication fails because the local clock
+// is too far from the KDC's or the proxy's, as commonly happens with drifting VM clocks.
+type ClockSkewError struct {
+	Offset time.Duration // Proxy time minus local time, measured from the proxy's Date header. Zero if unknown.
+	Err    error
+}
+
+func (e *ClockSkewError) Error() string {
+	if e.Offset == 0 {
+		return "Kerberos clock skew too great: " + e.Err.Error()
+	}
+	return fmt.Sprintf("Kerberos clock skew too great (proxy clock offset %s): %s", e.Offset, e.Err)
+}
+
+func (e *ClockSkewError) Unwrap() error {
+	return e.Err
+}
+
+// clockOffset returns the time of the Date header of a response received at now minus
+// now, and whether it could be measured. The offset has a resolution of one second.
+func clockOffset(h http.Header, now time.Time) (time.Duration, bool) {
+	date, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		return 0, false
+	}
+	return date.Sub(now.Truncate(time.Second)), true
+}
+
+// skewed reports whether offset exceeds the tolerance of Kerberos services.
+func skewed(offset time.Duration) bool {
+	return offset > maxClockSkew || offset < -maxClockSkew
+}
+
+// isKerberosSkew reports whether err is a KRB_AP_ERR_SKEW returned by the KDC.
+func isKerberosSkew(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "KRB_AP_ERR_SKEW")
+}
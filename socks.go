@@ -1,34 +1,160 @@
 package proxyplease
 
 import (
+	"context"
 	"errors"
 	"net"
-	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
 
-	"golang.org/x/net/proxy"
 	hsocks "h12.io/socks"
 )
 
-func dialAndNegotiateSOCKS(u *url.URL, user, pass, addr string) (net.Conn, error) {
-	debugf("socks> using socks proxy")
+// SOCKSOptions limit the phases of the handshake with SOCKS5 proxies, so slow gateways
+// can be diagnosed and tuned. Zero means no limit besides the dial's context.
+type SOCKSOptions struct {
+	ResolveTimeout  time.Duration // Limit on resolving the target locally for socks5:// proxies.
+	GreetingTimeout time.Duration // Limit on the negotiation of the authentication method.
+	AuthTimeout     time.Duration // Limit on the username/password sub-negotiation, which may involve a directory lookup by the proxy.
+	ReplyTimeout    time.Duration // Limit on the reply to CONNECT, which includes the proxy resolving and connecting to the target.
+}
+
+// SOCKSError is returned when a phase of a SOCKS5 handshake fails or times out.
+type SOCKSError struct {
+	Phase string // "resolve", "greeting", "auth" or "reply".
+	Reply byte   // Reply code of a failed request, ex: 5 for connection refused, or 0.
+	Err   error
+}
+
+func (e *SOCKSError) Error() string {
+	return "socks5 " + e.Phase + ": " + e.Err.Error()
+}
+
+func (e *SOCKSError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the phase timed out.
+func (e *SOCKSError) Timeout() bool {
+	var ne net.Error
+	return errors.As(e.Err, &ne) && ne.Timeout()
+}
+
+// outcome returns the Outcome of the failed phase.
+func (e *SOCKSError) outcome() Outcome {
+	switch {
+	case e.Timeout():
+		return Unclassified
+	case e.Phase == "auth", errors.Is(e.Err, errSOCKS5NoAcceptable):
+		return AuthFailed
+	}
+	switch e.Reply {
+	case 0x00:
+		return Unclassified
+	case 0x02:
+		return PolicyDenied
+	case 0x03, 0x04, 0x05, 0x06:
+		return TargetUnreachableViaProxy
+	}
+	return ProtocolError
+}
+
+func dialAndNegotiateSOCKS(ctx context.Context, p Proxy, addr string, baseDial func() (net.Conn, error)) (net.Conn, error) {
+	u := p.URL
+	p.debugf("socks> using socks proxy")
 	switch u.Scheme {
 	case "socks4", "socks4a":
-		debugf("socks> connecting via %s", u.Scheme)
+		p.debugf("socks> connecting via %s", u.Scheme)
+		if p.resolvesLocally() {
+			resolved, err := resolveTarget(ctx, p, addr, p.SOCKS.ResolveTimeout)
+			if err != nil {
+				p.debugf("socks> Could not resolve %s: %s", addr, err)
+				return nil, &SOCKSError{Phase: "resolve", Err: err}
+			}
+			addr = resolved
+		} else if u.Scheme == "socks4" {
+			// sending the name is the SOCKS4A extension
+			v := *u
+			v.Scheme = "socks4a"
+			u = &v
+		}
 		socks4Dial := hsocks.Dial(u.String())
 		conn, err := socks4Dial("tcp", addr)
 		if err != nil {
-			debugf("socks> Could not call dial socks4 context with proxy: %s", err)
+			p.debugf("socks> Could not call dial socks4 context with proxy: %s", err)
 			return conn, err
 		}
 		return conn, err
 	case "socks5", "socks5h", "socks":
-		debugf("socks> connecting via %s", u.Scheme)
-		// use golang.org/x/net/proxy SOCKS5 implementation for authentication support
-		auth := &proxy.Auth{User: user, Password: pass}
-		sp, _ := proxy.SOCKS5("tcp", u.Host, auth, proxy.Direct)
-		conn, err := sp.Dial("tcp", addr)
-		return conn, err
+		p.debugf("socks> connecting via %s", u.Scheme)
+		if p.resolvesLocally() {
+			// socks5:// resolves the target locally, socks5h:// leaves it to the proxy
+			resolved, err := resolveTarget(ctx, p, addr, p.SOCKS.ResolveTimeout)
+			if err != nil {
+				p.debugf("socks> Could not resolve %s: %s", addr, err)
+				return nil, &SOCKSError{Phase: "resolve", Err: err}
+			}
+			addr = resolved
+		}
+		conn, err := baseDial()
+		if err != nil {
+			p.debugf("socks> Could not call dial context with proxy: %s", err)
+			return nil, err
+		}
+		if err := socks5Connect(conn, p, addr); err != nil {
+			p.debugf("socks> Could not establish socks5 tunnel: %s", err)
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
 	}
-	debugf("socks> Unsupported socks scheme: %s", u.Scheme)
+	p.debugf("socks> Unsupported socks scheme: %s", u.Scheme)
 	return nil, errors.New("Unsupported socks URL scheme")
 }
+
+// socks5Connect authenticates with the SOCKS5 proxy on conn and requests a tunnel to
+// addr, limiting each phase by p.SOCKS.
+func socks5Connect(conn net.Conn, p Proxy, addr string) error {
+	if err := socks5Authenticate(conn, p); err != nil {
+		return err
+	}
+	req, err := socks5Request(socks5CmdConnect, addr)
+	if err != nil {
+		return err
+	}
+	return socksPhase(conn, "reply", p.SOCKS.ReplyTimeout, func() error {
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		_, err := readSOCKS5Reply(conn)
+		return err
+	})
+}
+
+// socksPhase runs f, a phase of a SOCKS5 handshake on conn, aborting its I/O after
+// timeout. Errors are returned as a *SOCKSError.
+func socksPhase(conn net.Conn, phase string, timeout time.Duration, f func() error) error {
+	var timer *time.Timer
+	var expired int32
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&expired, 1)
+			conn.SetDeadline(aLongTimeAgo)
+		})
+	}
+	err := f()
+	if timer != nil && !timer.Stop() && atomic.LoadInt32(&expired) == 1 {
+		// the phase completed too late: conn can no longer be used
+		err = os.ErrDeadlineExceeded
+	}
+	if err == nil {
+		return nil
+	}
+	var se *SOCKSError
+	if errors.As(err, &se) {
+		se.Phase = phase
+		return se
+	}
+	return &SOCKSError{Phase: phase, Err: err}
+}
@@ -0,0 +1,281 @@
+package proxyplease
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	socks5Version      = 0x05
+	socks5NoAuth       = 0x00
+	socks5UserPass     = 0x02
+	socks5NoAcceptable = 0xff
+	socks5CmdConnect   = 0x01
+	socks5CmdBind      = 0x02
+	socks5AtypIPv4     = 0x01
+	socks5AtypDomain   = 0x03
+	socks5AtypIPv6     = 0x04
+)
+
+// BindListener accepts a single inbound connection on an address allocated by a SOCKS5
+// proxy with the BIND command, as required by active FTP and some P2P handshakes.
+type BindListener struct {
+	conn net.Conn
+	addr *net.TCPAddr
+
+	mu       sync.Mutex
+	accepted bool
+}
+
+// ListenBind asks the SOCKS5 proxy described by p to accept a connection from peer, the
+// address of the host expected to connect. Advertise the returned listener's Addr to the
+// peer, for example in an FTP PORT command, then call Accept.
+func ListenBind(ctx context.Context, p Proxy, peer string) (*BindListener, error) {
+	if p.TargetURL == nil {
+		p.TargetURL = defaultTargetURL()
+	}
+	d := decide(p)
+	if d.URL == nil {
+		return nil, errors.New("no SOCKS5 proxy could be determined")
+	}
+	p = withProxyURL(p, d.URL)
+	switch p.URL.Scheme {
+	case "socks5", "socks5h", "socks":
+	default:
+		return nil, fmt.Errorf("BIND requires a socks5 proxy, got '%s'", p.URL.Scheme)
+	}
+
+	conn, err := p.dialTagged(ctx, "tcp", peer)
+	if err != nil {
+		p.debugf("bind> Could not connect to proxy: %s", err)
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	addr, err := socks5Bind(conn, p, peer)
+	if err != nil {
+		p.debugf("bind> BIND failed: %s", err)
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	// proxies listening on all interfaces report the unspecified address
+	if addr.IP.IsUnspecified() {
+		if ra, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			addr.IP = ra.IP
+		}
+	}
+	p.debugf("bind> Proxy is listening on %s", addr)
+	return &BindListener{conn: conn, addr: addr}, nil
+}
+
+// Accept waits for the peer to connect and returns the connection. Only one connection
+// is accepted; later calls return an error.
+func (l *BindListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.accepted {
+		l.mu.Unlock()
+		return nil, errors.New("BIND listener accepts a single connection")
+	}
+	l.accepted = true
+	l.mu.Unlock()
+
+	peer, err := readSOCKS5Reply(l.conn)
+	if err != nil {
+		debugf("bind> Peer did not connect: %s", err)
+		l.conn.Close()
+		return nil, err
+	}
+	debugf("bind> Accepted connection from %s", peer)
+	return &bindConn{Conn: l.conn, remote: peer}, nil
+}
+
+// Close closes the listener. A connection already returned by Accept is closed as well.
+func (l *BindListener) Close() error {
+	return l.conn.Close()
+}
+
+// Addr returns the address allocated by the proxy.
+func (l *BindListener) Addr() net.Addr {
+	return l.addr
+}
+
+// bindConn reports the peer as its remote address.
+type bindConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *bindConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// errSOCKS5NoAcceptable is returned when the proxy requires an authentication method
+// that was not offered, ex: username/password when no credentials are set.
+var errSOCKS5NoAcceptable = errors.New("proxy accepted none of the offered authentication methods")
+
+// socks5Bind negotiates authentication and sends a BIND request for peer, returning the
+// address allocated by the proxy.
+func socks5Bind(conn net.Conn, p Proxy, peer string) (*net.TCPAddr, error) {
+	if err := socks5Authenticate(conn, p); err != nil {
+		return nil, err
+	}
+	req, err := socks5Request(socks5CmdBind, peer)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	return readSOCKS5Reply(conn)
+}
+
+// socks5Authenticate negotiates the authentication method with the proxy and performs
+// the username/password sub-negotiation (RFC 1929) if it is selected. Each phase is
+// limited by p.SOCKS.
+func socks5Authenticate(conn net.Conn, p Proxy) error {
+	var method byte
+	err := socksPhase(conn, "greeting", p.SOCKS.GreetingTimeout, func() error {
+		methods := []byte{socks5NoAuth}
+		if p.Username != "" {
+			methods = append(methods, socks5UserPass)
+		}
+		if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+			return err
+		}
+		var sel [2]byte
+		if _, err := io.ReadFull(conn, sel[:]); err != nil {
+			return err
+		}
+		method = sel[1]
+		switch method {
+		case socks5NoAuth, socks5UserPass:
+			return nil
+		case socks5NoAcceptable:
+			return errSOCKS5NoAcceptable
+		}
+		return fmt.Errorf("proxy selected unsupported authentication method %d", method)
+	})
+	if err != nil || method == socks5NoAuth {
+		return err
+	}
+
+	return socksPhase(conn, "auth", p.SOCKS.AuthTimeout, func() error {
+		if len(p.Username) > 255 || len(p.Password) > 255 {
+			return errors.New("username and password must be at most 255 bytes")
+		}
+		req := []byte{0x01, byte(len(p.Username))}
+		req = append(req, p.Username...)
+		req = append(req, byte(len(p.Password)))
+		req = append(req, p.Password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		var status [2]byte
+		if _, err := io.ReadFull(conn, status[:]); err != nil {
+			return err
+		}
+		if status[1] != 0x00 {
+			return errors.New("username/password rejected")
+		}
+		return nil
+	})
+}
+
+// socks5Request encodes a SOCKS5 request of cmd for addr.
+func socks5Request(cmd byte, addr string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	portnum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port '%s'", port)
+	}
+	req := []byte{socks5Version, cmd, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(append(req, socks5AtypIPv4), ip4...)
+		} else {
+			req = append(append(req, socks5AtypIPv6), ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("SOCKS5 host name must be at most 255 bytes")
+		}
+		req = append(append(req, socks5AtypDomain, byte(len(host))), host...)
+	}
+	return append(req, byte(portnum>>8), byte(portnum)), nil
+}
+
+// socks5Replies are the messages of SOCKS5 reply codes (RFC 1928, section 6).
+var socks5Replies = []string{
+	"succeeded",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// readSOCKS5Reply reads a SOCKS5 reply and returns its address.
+func readSOCKS5Reply(r io.Reader) (*net.TCPAddr, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	if head[0] != socks5Version {
+		return nil, fmt.Errorf("unexpected SOCKS version %d", head[0])
+	}
+	if head[1] != 0x00 {
+		if int(head[1]) < len(socks5Replies) {
+			return nil, &SOCKSError{Phase: "reply", Reply: head[1], Err: errors.New(socks5Replies[head[1]])}
+		}
+		return nil, &SOCKSError{Phase: "reply", Reply: head[1], Err: fmt.Errorf("unknown error %d", head[1])}
+	}
+
+	addr := &net.TCPAddr{}
+	switch head[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		addr.IP = make(net.IP, net.IPv4len)
+		if head[3] == socks5AtypIPv6 {
+			addr.IP = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, addr.IP); err != nil {
+			return nil, err
+		}
+	case socks5AtypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return nil, err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, err
+		}
+		// a bound address given by name is resolved so it can be advertised
+		if ips, err := net.LookupIP(string(name)); err == nil && len(ips) > 0 {
+			addr.IP = ips[0]
+		}
+	default:
+		return nil, fmt.Errorf("unknown SOCKS5 address type %d", head[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, err
+	}
+	addr.Port = int(binary.BigEndian.Uint16(port[:]))
+	return addr, nil
+}
@@ -0,0 +1,141 @@
+package proxyplease
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+
+	ggp "github.com/bdwyertech/go-get-proxied/proxy"
+)
+
+// Source identifies where a proxy configuration came from.
+type Source int
+
+const (
+	// SourceDirect means no proxy was found and connections are made directly.
+	SourceDirect Source = iota
+	// SourceStatic means the proxy was supplied in Proxy.URL or Proxy.Upstreams.
+	SourceStatic
+	// SourceEnv means the proxy came from HTTPS_PROXY, HTTP_PROXY or a similar variable.
+	SourceEnv
+	// SourcePAC means the proxy was returned by a configured PAC script.
+	SourcePAC
+	// SourceWPADDHCP means the PAC script was located through DHCP option 252.
+	SourceWPADDHCP
+	// SourceWPADDNS means the PAC script was located through WPAD DNS lookups. Operating
+	// system auto-detection that does not report the discovery method is also reported
+	// as SourceWPADDNS.
+	SourceWPADDNS
+	// SourceSystem means the proxy came from the operating system's manual proxy settings.
+	SourceSystem
+)
+
+var sourceNames = []string{"direct", "static", "env", "pac", "wpad-dhcp", "wpad-dns", "system"}
+
+func (s Source) String() string {
+	if int(s) < len(sourceNames) {
+		return sourceNames[s]
+	}
+	return "unknown"
+}
+
+// MarshalText encodes s as its name, ex: "wpad-dns".
+func (s Source) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes a name produced by MarshalText.
+func (s *Source) UnmarshalText(b []byte) error {
+	for i, name := range sourceNames {
+		if name == string(b) {
+			*s = Source(i)
+			return nil
+		}
+	}
+	return errors.New("unknown proxy source '" + string(b) + "'")
+}
+
+// Decision describes the proxy selected for a target.
+type Decision struct {
+	URL    *url.URL // Proxy to use, or nil for a direct connection.
+	Source Source   // Where the proxy configuration came from.
+
+	script string // PAC script discovered through WPAD, if any
+}
+
+// Decide returns the proxy decision NewDialContext makes for p. If p.URL is not set, the
+// proxy is taken from the PAC script of p.PACURL or p.PACScript, if set, or inferred from
+// the local system for p.TargetURL. When p.Upstreams is set, the first upstream is
+// returned. Targets matching p.Bypass or p.BypassFunc are direct, and those matching a
+// DIRECT or PROXY rule of p.Routes are reached as it says.
+func Decide(p Proxy) Decision {
+	if p.TargetURL == nil {
+		p.TargetURL = defaultTargetURL()
+	}
+	if rule := matchRoute(p.Routes, targetAuthority(p.TargetURL)); rule != nil {
+		switch rule.Action {
+		case RouteDirect:
+			return Decision{Source: SourceDirect}
+		case RouteProxy:
+			return Decision{URL: rule.Proxy, Source: SourceStatic}
+		}
+	}
+	if p.bypassed(p.TargetURL.Host) {
+		return Decision{Source: SourceDirect}
+	}
+	return decide(p)
+}
+
+func decide(p Proxy) Decision {
+	if len(p.Upstreams) > 0 {
+		return Decision{URL: p.Upstreams[0].URL, Source: SourceStatic}
+	}
+	if p.URL != nil && p.URL.String() != "" {
+		return Decision{URL: p.URL, Source: SourceStatic}
+	}
+	if usesPAC(p) {
+		return newPACDialer(p).decision(context.Background(), toASCIIURL(p.TargetURL))
+	}
+
+	// if no provided Proxy.URL, infer from system settings
+	p.debugf("proxy> No proxy provided. Attempting to infer from system.")
+	target := toASCIIURL(p.TargetURL)
+	systemProxy := ggp.NewProvider("").GetProxy(target.Scheme, target.String())
+	if systemProxy == nil {
+		if s, err := SystemProxy(); err == nil {
+			if d, ok := s.decision(p, target); ok {
+				p.debugf("proxy> Using the %s proxy settings for %s", d.Source, target.Hostname())
+				return d
+			}
+		}
+		if r := discoverPAC(p); r != nil {
+			p.PACScript = r.Script
+			d := newPACDialer(p).decision(context.Background(), target)
+			d.Source, d.script = r.Source, r.Script
+			return d
+		}
+		return Decision{Source: SourceDirect}
+	}
+	d := Decision{URL: systemProxy.URL(), Source: systemSource(systemProxy.Src())}
+	p.debugf("proxy> Inferred proxy from system (%s): %s", d.Source, d.URL.String())
+	return d
+}
+
+// systemSource maps a go-get-proxied source description to a Source.
+func systemSource(src string) Source {
+	switch {
+	case strings.HasPrefix(src, "Environment"):
+		return SourceEnv
+	case src == "WinHTTP:AutoConfigUrl":
+		return SourcePAC
+	case src == "WinHTTP:AutoDetect":
+		return SourceWPADDNS
+	}
+	return SourceSystem
+}
+
+func defaultTargetURL() *url.URL {
+	u, _ := url.Parse("https://www.google.com")
+	return u
+}
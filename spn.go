@@ -0,0 +1,94 @@
+package proxyplease
+
+import (
+	"net"
+	"strings"
+)
+
+// Canonicalization selects the DNS lookups used to canonicalize the proxy host name before
+// building its service principal, like dns_canonicalize_hostname and rdns in krb5.conf.
+type Canonicalization int
+
+const (
+	// CanonicalizeReverse resolves the host name and uses the name of its first address
+	// found by a reverse (PTR) lookup. This is the MIT Kerberos default.
+	CanonicalizeReverse Canonicalization = iota
+	// CanonicalizeForward follows CNAME records only (rdns = false), so proxy farms fronted
+	// by an alias use the principal of the alias target rather than of an individual node.
+	CanonicalizeForward
+	// CanonicalizeNone uses the host name as configured (dns_canonicalize_hostname = false).
+	CanonicalizeNone
+)
+
+// CanonicalizeFunc returns the canonical name of a proxy host, ex: from a static map of
+// proxy farm aliases to the name their principal was registered under.
+type CanonicalizeFunc func(host string) (string, error)
+
+// SPNOptions control how the service principal of the proxy is derived from its host name
+// when Proxy.SPN is not set.
+type SPNOptions struct {
+	Canonicalize Canonicalization // DNS lookups used to canonicalize the host name. Defaults to CanonicalizeReverse.
+	Func         CanonicalizeFunc // Canonicalizes the host name instead of Canonicalize.
+}
+
+// proxySPN returns the service principal of the proxy for Negotiate: p.SPN, or HTTP/ and
+// the host name canonicalized according to p.SPNOptions.
+func proxySPN(p Proxy) (string, error) {
+	if p.SPN != "" {
+		return p.SPN, nil
+	}
+	host := p.URL.Hostname()
+	var h string
+	var err error
+	switch {
+	case p.SPNOptions.Func != nil:
+		h, err = p.SPNOptions.Func(host)
+	case p.SPNOptions.Canonicalize == CanonicalizeNone:
+		h = host
+	case p.SPNOptions.Canonicalize == CanonicalizeForward:
+		h, err = canonicalizeForward(host)
+	default:
+		h, err = canonicalizeHostname(host)
+	}
+	if err != nil {
+		return "", err
+	}
+	if h != host {
+		p.debugf("negotiate> Canonicalized %s to %s", host, h)
+	}
+	return "HTTP/" + h, nil
+}
+
+// canonicalizeForward returns the target of the CNAME records of hostname, or hostname.
+func canonicalizeForward(hostname string) (string, error) {
+	if net.ParseIP(hostname) != nil {
+		return hostname, nil
+	}
+	cname, err := net.LookupCNAME(hostname)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(cname, "."), nil
+}
+
+// canonicalizeHostname returns the name of the first address of hostname found by a
+// reverse lookup, or hostname.
+func canonicalizeHostname(hostname string) (string, error) {
+	addrs, err := net.LookupHost(hostname)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) < 1 {
+		return hostname, nil
+	}
+
+	names, err := net.LookupAddr(addrs[0])
+	if err != nil {
+		return "", err
+	}
+	if len(names) < 1 {
+		return hostname, nil
+	}
+
+	return strings.TrimRight(names[0], "."), nil
+}
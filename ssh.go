@@ -0,0 +1,125 @@
+package proxyplease
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHJump connects through an SSH server, like ssh -J, for hybrid environments combining
+// bastions and authenticated proxies. Use its DialContext as Proxy.BaseDial to reach the
+// proxy through the bastion, or set Dial to the DialContext of a Proxy to reach the
+// bastion through the proxy and targets through the bastion. One SSH connection is shared
+// by its dials, and established again once broken. Connections through it do not support
+// deadlines.
+type SSHJump struct {
+	Addr   string            // Address (host:port) of the SSH server.
+	Config *ssh.ClientConfig // User, authentication methods and host key verification.
+	Dial   DialContext       // Connects to the SSH server, ex: through a proxy. Defaults to a direct TCP connection.
+
+	mu     sync.Mutex
+	client *ssh.Client
+	closed bool
+}
+
+// ErrSSHJumpClosed is returned by dials made after an SSHJump was closed.
+var ErrSSHJumpClosed = errors.New("SSH jump host is closed")
+
+// DialContext connects to addr through the SSH server, which must allow TCP forwarding.
+// It can be assigned to Proxy.BaseDial or http.Transport.DialContext.
+func (j *SSHJump) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	cl, err := j.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := cl.Dial(network, addr)
+		done <- result{conn, err}
+	}()
+	select {
+	case r := <-done:
+		var oe *ssh.OpenChannelError
+		if r.err != nil && !errors.As(r.err, &oe) {
+			// the SSH connection is broken rather than the target refused
+			j.drop(cl)
+		}
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// Close closes the SSH connection. Connections made through it are closed too.
+func (j *SSHJump) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.closed = true
+	if j.client == nil {
+		return nil
+	}
+	err := j.client.Close()
+	j.client = nil
+	return err
+}
+
+// connect returns the SSH connection, establishing it if needed. The SSH handshake is
+// limited by the deadline of ctx.
+func (j *SSHJump) connect(ctx context.Context) (*ssh.Client, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return nil, ErrSSHJumpClosed
+	}
+	if j.client != nil {
+		return j.client, nil
+	}
+	dial := j.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, "tcp", j.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, j.Addr, j.Config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	cl := ssh.NewClient(c, chans, reqs)
+	j.client = cl
+	go func() {
+		cl.Wait()
+		j.drop(cl)
+	}()
+	return cl, nil
+}
+
+// drop forgets cl if it is the current SSH connection, so the next dial establishes
+// another.
+func (j *SSHJump) drop(cl *ssh.Client) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.client == cl {
+		j.client = nil
+		cl.Close()
+	}
+}
@@ -0,0 +1,111 @@
+package proxyplease
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultStateTTL is how long a State returned by Dialer.State remains usable.
+const DefaultStateTTL = time.Hour
+
+// State holds the results of proxy discovery and the health of upstreams, so short-lived
+// processes behind slow WPAD or PAC discovery can skip it on the next run. Save it when
+// the process exits and assign the loaded State to Proxy.State on start.
+type State struct {
+	Saved     time.Time            `json:"saved"`
+	Expires   time.Time            `json:"expires"`              // The State is ignored after this time.
+	Target    string               `json:"target"`               // TargetURL the decision was made for.
+	Proxy     string               `json:"proxy,omitempty"`      // Selected proxy, without credentials. Empty for direct connections.
+	Source    Source               `json:"source"`               // Where the proxy configuration came from.
+	PACSHA256 string               `json:"pac_sha256,omitempty"` // Hash of the PAC script the decision was made with, if known.
+	Down      map[string]time.Time `json:"down,omitempty"`       // Upstreams marked down, by host, and until when.
+}
+
+// LoadState reads a State written by Save.
+func LoadState(path string) (*State, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &State{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Save writes s to path atomically, readable only by the current user.
+func (s *State) Save(path string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// State returns the discovery results and upstream health of d, valid for
+// DefaultStateTTL. Adjust Expires before saving to change how long it is used.
+func (d *Dialer) State() *State {
+	d.mu.Lock()
+	decision, b := d.decision, d.balancer
+	d.mu.Unlock()
+	now := time.Now()
+	s := &State{
+		Saved:   now,
+		Expires: now.Add(DefaultStateTTL),
+		Target:  d.target,
+		Source:  decision.Source,
+	}
+	if decision.URL != nil {
+		u := *decision.URL
+		u.User = nil
+		s.Proxy = u.String()
+	}
+	if b != nil {
+		s.Down = b.downUntil(now)
+	}
+	return s
+}
+
+// usable reports whether s can be used in place of discovery for p.
+func (s *State) usable(p Proxy) bool {
+	if s == nil || (p.URL != nil && p.URL.String() != "") {
+		return false
+	}
+	if time.Now().After(s.Expires) {
+		p.debugf("state> Ignoring state saved at %s: expired", s.Saved)
+		return false
+	}
+	if s.Target != p.TargetURL.String() {
+		p.debugf("state> Ignoring state saved at %s: made for %s", s.Saved, s.Target)
+		return false
+	}
+	return true
+}
+
+// decision returns the proxy decision recorded in s.
+func (s *State) decision() Decision {
+	d := Decision{Source: s.Source}
+	if s.Proxy != "" {
+		if u, err := url.Parse(s.Proxy); err == nil {
+			d.URL = u
+		}
+	}
+	return d
+}
@@ -0,0 +1,164 @@
+package proxyplease
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Violation is a deviation of a proxy response from HTTP semantics and framing (RFC 9110
+// and RFC 9112), such as a body announced on a 204. A missing reason phrase is tolerated.
+type Violation struct {
+	Proxy  *url.URL // Proxy that sent the response. Credentials are removed.
+	Status int      // Status code of the response, or 0 if the status line is malformed.
+	Rule   string   // Short identifier of the violated requirement, ex: "header-value".
+	Detail string   // What was received and which requirement it violates.
+}
+
+// ViolationFunc receives the Violations found in a proxy response. It is called
+// synchronously and should not block.
+type ViolationFunc func(Violation)
+
+// ViolationError is returned when Proxy.StrictResponses is set and a proxy response
+// violates HTTP.
+type ViolationError struct {
+	Violations []Violation
+}
+
+func (e *ViolationError) Error() string {
+	s := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		s[i] = v.Rule + ": " + v.Detail
+	}
+	return "proxy response violates HTTP: " + strings.Join(s, "; ")
+}
+
+// checkResponses reports whether responses of the proxy are validated.
+func (p Proxy) checkResponses() bool {
+	return p.StrictResponses || p.OnViolation != nil
+}
+
+// validateResponse returns the violations found in the raw status line and headers of a
+// response to req, and in resp as parsed, if it could be.
+func validateResponse(req *http.Request, raw []byte, resp *http.Response) []Violation {
+	var vs []Violation
+	add := func(rule, format string, a ...interface{}) {
+		v := Violation{Rule: rule, Detail: fmt.Sprintf(format, a...)}
+		if resp != nil {
+			v.Status = resp.StatusCode
+		}
+		vs = append(vs, v)
+	}
+
+	if end := bytes.Index(raw, []byte("\n\r\n")); end >= 0 {
+		raw = raw[:end+1]
+	} else if end := bytes.Index(raw, []byte("\n\n")); end >= 0 {
+		raw = raw[:end+1]
+	}
+	lines := bytes.SplitAfter(raw, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		if !bytes.HasSuffix(line, []byte("\r\n")) {
+			add("bare-lf", "line %d does not end with CRLF", i+1)
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if i == 0 {
+			if !validStatusLine(line) {
+				add("status-line", "malformed status line %q", line)
+			}
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			add("obs-fold", "header line %d is folded onto the previous one", i+1)
+			continue
+		}
+		colon := bytes.IndexByte(line, ':')
+		if colon <= 0 {
+			add("header-name", "header line %q has no field name", line)
+			continue
+		}
+		name := line[:colon]
+		for _, c := range name {
+			if !isTokenChar(c) {
+				add("header-name", "field name %q contains %q, which is not a token character", name, c)
+				break
+			}
+		}
+		for _, c := range line[colon+1:] {
+			if (c < 0x20 && c != '\t') || c == 0x7f {
+				add("header-value", "value of %s contains control character %#x", name, c)
+				break
+			}
+		}
+	}
+
+	if resp == nil {
+		return vs
+	}
+	framed := resp.Header.Get("Transfer-Encoding") != "" || len(resp.TransferEncoding) > 0 || resp.Header.Get("Content-Length") != ""
+	if (resp.StatusCode/100 == 1 || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified) &&
+		framed && resp.Header.Get("Content-Length") != "0" {
+		// RFC 9110, sections 6.4.1 and 15.3.5
+		add("unexpected-body", "%d response announces a body", resp.StatusCode)
+	}
+	if req.Method == http.MethodConnect && resp.StatusCode/100 == 2 && framed {
+		// RFC 9110, section 8.6
+		add("connect-framing", "%d response to CONNECT carries Content-Length or Transfer-Encoding", resp.StatusCode)
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired && len(resp.Header["Proxy-Authenticate"]) == 0 {
+		// RFC 9110, section 15.5.8
+		add("missing-challenge", "407 response has no Proxy-Authenticate header")
+	}
+	return vs
+}
+
+// validStatusLine reports whether line is "HTTP/1.x" followed by a 3-digit status code
+// and an optional reason phrase.
+func validStatusLine(line []byte) bool {
+	if len(line) < 12 || !bytes.HasPrefix(line, []byte("HTTP/1.")) || line[7] < '0' || line[7] > '9' || line[8] != ' ' {
+		return false
+	}
+	for _, c := range line[9:12] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(line) == 12 || line[12] == ' '
+}
+
+// isTokenChar reports whether c may appear in a token (RFC 9110, section 5.6.2).
+func isTokenChar(c byte) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// reportViolations passes vs to p.OnViolation and returns a *ViolationError if
+// p.StrictResponses is set.
+func (p Proxy) reportViolations(vs []Violation) error {
+	if len(vs) == 0 {
+		return nil
+	}
+	var proxy *url.URL
+	if p.URL != nil {
+		u := *p.URL
+		u.User = nil
+		proxy = &u
+	}
+	for i := range vs {
+		vs[i].Proxy = proxy
+		p.debugf("strict> Proxy response violates HTTP: %s: %s", vs[i].Rule, vs[i].Detail)
+		if p.OnViolation != nil {
+			p.OnViolation(vs[i])
+		}
+	}
+	if p.StrictResponses {
+		return &ViolationError{Violations: vs}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package proxyplease
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// supportEnv are the environment variables recorded in a SupportBundle.
+var supportEnv = []string{
+	"HTTP_PROXY", "http_proxy",
+	"HTTPS_PROXY", "https_proxy",
+	"FTP_PROXY", "ftp_proxy",
+	"ALL_PROXY", "all_proxy",
+	"NO_PROXY", "no_proxy",
+}
+
+// SupportBundle gathers what is needed to diagnose a proxy problem: the platform, the
+// proxy environment, the discovery result and the debug output of a handshake. Secrets
+// are redacted. Attach its JSON encoding to bug reports.
+type SupportBundle struct {
+	Generated   time.Time         `json:"generated"`
+	Platform    SupportPlatform   `json:"platform"`
+	Environment map[string]string `json:"environment"`
+	Config      SupportConfig     `json:"config"`
+	Decision    SupportDecision   `json:"decision"`
+	PACScript   *SupportPAC       `json:"pac_script,omitempty"`
+	Target      string            `json:"target"`
+	Handshake   []string          `json:"handshake"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// SupportPlatform describes the host and the build of the package.
+type SupportPlatform struct {
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	GoVersion string `json:"go_version"`
+	Version   string `json:"version,omitempty"` // Version of this package, if known.
+}
+
+// SupportConfig summarizes the Proxy configuration without its credentials.
+type SupportConfig struct {
+	URL              string   `json:"url,omitempty"`
+	Username         bool     `json:"username"` // Whether a username is configured.
+	Password         bool     `json:"password"` // Whether a password is configured.
+	Domain           string   `json:"domain,omitempty"`
+	AuthSchemeFilter []string `json:"auth_scheme_filter,omitempty"`
+	Upstreams        []string `json:"upstreams,omitempty"`
+	TargetURL        string   `json:"target_url,omitempty"`
+}
+
+// SupportDecision is the proxy discovery result for the target.
+type SupportDecision struct {
+	Proxy  string `json:"proxy,omitempty"`
+	Source string `json:"source"`
+}
+
+// SupportPAC identifies the PAC script in use without including it.
+type SupportPAC struct {
+	SHA256 string `json:"sha256"`
+	Size   int    `json:"size"`
+}
+
+// CollectSupportBundle dials target (host:port) through the proxy described by p while
+// capturing the debug output of the handshake, and returns the collected diagnostics.
+func CollectSupportBundle(ctx context.Context, p Proxy, target string) *SupportBundle {
+	b := &SupportBundle{
+		Generated: time.Now().UTC(),
+		Platform: SupportPlatform{
+			OS:        runtime.GOOS,
+			Arch:      runtime.GOARCH,
+			GoVersion: runtime.Version(),
+			Version:   moduleVersion(),
+		},
+		Environment: map[string]string{},
+		Target:      target,
+		Handshake:   []string{},
+	}
+	for _, name := range supportEnv {
+		if v, ok := os.LookupEnv(name); ok {
+			b.Environment[name] = redactURL(v)
+		}
+	}
+
+	if p.TargetURL == nil {
+		host, _, err := net.SplitHostPort(target)
+		if err != nil {
+			host = target
+		}
+		p.TargetURL = &url.URL{Scheme: "https", Host: host}
+	}
+	b.Config = SupportConfig{
+		Username:         p.Username != "",
+		Password:         p.Password != "",
+		Domain:           p.Domain,
+		AuthSchemeFilter: p.AuthSchemeFilter,
+		TargetURL:        p.TargetURL.String(),
+	}
+	if p.URL != nil {
+		b.Config.URL = p.URL.Redacted()
+	}
+	for _, u := range p.Upstreams {
+		if u.URL != nil {
+			b.Config.Upstreams = append(b.Config.Upstreams, u.URL.Redacted())
+		}
+	}
+
+	if p.PACScript != "" {
+		b.SetPACScript(p.PACScript)
+	}
+
+	d := Decide(p)
+	b.Decision.Source = d.Source.String()
+	if d.URL != nil {
+		b.Decision.Proxy = d.URL.Redacted()
+	}
+
+	var mu sync.Mutex
+	ctx = WithDebugf(ctx, func(format string, a ...interface{}) {
+		mu.Lock()
+		b.Handshake = append(b.Handshake, fmt.Sprintf(format, a...))
+		mu.Unlock()
+	})
+	dialer := NewDialer(p)
+	conn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		b.Error = err.Error()
+	} else {
+		conn.Close()
+	}
+	dialer.Close()
+	return b
+}
+
+// SetPACScript records the hash and size of the PAC script in use, so support can tell
+// whether it matches the expected one without the script being shared.
+func (b *SupportBundle) SetPACScript(script string) {
+	sum := sha256.Sum256([]byte(script))
+	b.PACScript = &SupportPAC{SHA256: hex.EncodeToString(sum[:]), Size: len(script)}
+}
+
+// redactURL hides the credentials of a proxy URL, everything before its last '@', as
+// plain text so values url.Parse rejects, or scheme-less ones such as
+// "user:secret@proxy:8080", are redacted too. Values without '@', such as NO_PROXY lists,
+// are returned unchanged.
+func redactURL(v string) string {
+	at := strings.LastIndexByte(v, '@')
+	if at < 0 {
+		return v
+	}
+	scheme := ""
+	if i := strings.Index(v, "://"); i >= 0 && i < at {
+		scheme = v[:i+3]
+	}
+	return scheme + "REDACTED@" + v[at+1:]
+}
+
+// moduleVersion returns the version of this package recorded in the build.
+func moduleVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	const path = "github.com/bdwyertech/proxyplease"
+	if info.Main.Path == path {
+		return info.Main.Version
+	}
+	for _, m := range info.Deps {
+		if m.Path == path {
+			return m.Version
+		}
+	}
+	return ""
+}
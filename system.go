@@ -0,0 +1,113 @@
+package proxyplease
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// systemPACTimeout bounds the download of a PAC script named by the system settings.
+const systemPACTimeout = 10 * time.Second
+
+// SystemSettings are the proxy settings of the environment or the operating system.
+type SystemSettings struct {
+	URL        *url.URL // Proxy for HTTPS, or else HTTP, connections. Nil if none is set.
+	Bypass     []string // Destinations reached directly, ex: "localhost", "*.corp.example.com", "10.0.0.0/8" or "<local>".
+	PACURL     *url.URL // Automatic configuration script. Nil if none is set.
+	AutoDetect bool     // Whether WPAD discovery is enabled.
+	Source     Source   // SourceEnv or SourceSystem.
+}
+
+// SystemProxy returns the proxy settings of the environment (HTTPS_PROXY, HTTP_PROXY,
+// ALL_PROXY and NO_PROXY) if any are set, and otherwise those of the operating system:
+// the WinINET settings of the current user on Windows, the SystemConfiguration settings
+// reported by scutil on macOS, and the GNOME or KDE settings on Linux.
+func SystemProxy() (*SystemSettings, error) {
+	if s := envSettings(); s != nil {
+		return s, nil
+	}
+	s, err := platformSettings()
+	if err != nil {
+		return nil, err
+	}
+	s.Source = SourceSystem
+	return s, nil
+}
+
+// envSettings returns the settings of the proxy environment variables, or nil if none is set.
+func envSettings() *SystemSettings {
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy", "ALL_PROXY", "all_proxy"} {
+		if u := parseSystemProxy(os.Getenv(name), "http"); u != nil {
+			s := &SystemSettings{URL: u, Source: SourceEnv}
+			noProxy := os.Getenv("NO_PROXY")
+			if noProxy == "" {
+				noProxy = os.Getenv("no_proxy")
+			}
+			s.Bypass = splitList(noProxy, ",")
+			return s
+		}
+	}
+	return nil
+}
+
+// parseSystemProxy parses a proxy setting that may lack a scheme, ex: "proxy:8080",
+// assuming scheme. It returns nil for empty or invalid settings.
+func parseSystemProxy(raw, scheme string) *url.URL {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil
+	}
+	if !strings.Contains(raw, "://") {
+		raw = scheme + "://" + raw
+	}
+	u, err := ParseProxyURL(raw)
+	if err != nil || u.Host == "" {
+		debugf("system> Ignoring invalid proxy setting '%s'", raw)
+		return nil
+	}
+	return u
+}
+
+// splitList splits a list of settings separated by any of seps, dropping empty entries.
+func splitList(s, seps string) []string {
+	var l []string
+	for _, e := range strings.FieldsFunc(s, func(r rune) bool { return strings.ContainsRune(seps, r) }) {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+// Bypassed reports whether host is reached directly according to s.Bypass, as described
+// for Proxy.Bypass.
+func (s *SystemSettings) Bypassed(host string) bool {
+	return bypassMatch(host, s.Bypass)
+}
+
+// decision returns the Decision of s for target, and false if s configures nothing for
+// it. A PAC script named by s is downloaded to select proxies per destination.
+func (s *SystemSettings) decision(p Proxy, target *url.URL) (Decision, bool) {
+	if s.Bypassed(target.Hostname()) {
+		p.debugf("system> %s is bypassed by the %s settings", target.Hostname(), s.Source)
+		return Decision{Source: s.Source}, true
+	}
+	if s.PACURL != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), systemPACTimeout)
+		script, err := fetchPAC(ctx, s.PACURL)
+		cancel()
+		if err == nil {
+			p.PACScript = script
+			d := newPACDialer(p).decision(context.Background(), target)
+			d.Source, d.script = SourcePAC, script
+			return d, true
+		}
+		p.debugf("system> Could not download the PAC script %s: %s", s.PACURL.Redacted(), err)
+	}
+	if s.URL != nil {
+		return Decision{URL: s.URL, Source: s.Source}, true
+	}
+	return Decision{}, false
+}
@@ -0,0 +1,74 @@
+// +build darwin
+
+package proxyplease
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// platformSettings reads the SystemConfiguration proxy settings reported by scutil.
+func platformSettings() (*SystemSettings, error) {
+	out, err := exec.Command("scutil", "--proxy").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseScutil(out), nil
+}
+
+// parseScutil parses the dictionary printed by scutil --proxy, ex:
+//
+//	<dictionary> {
+//	  ExceptionsList : <array> {
+//	    0 : *.local
+//	  }
+//	  HTTPSEnable : 1
+//	  HTTPSPort : 8080
+//	  HTTPSProxy : proxy.example.com
+//	}
+func parseScutil(out []byte) *SystemSettings {
+	values := map[string]string{}
+	var exceptions []string
+	inExceptions := false
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "}" {
+			inExceptions = false
+			continue
+		}
+		i := strings.Index(line, " : ")
+		if i < 0 {
+			continue
+		}
+		key, value := line[:i], line[i+3:]
+		switch {
+		case inExceptions:
+			exceptions = append(exceptions, value)
+		case key == "ExceptionsList":
+			inExceptions = true
+		default:
+			values[key] = value
+		}
+	}
+
+	s := &SystemSettings{Bypass: exceptions}
+	for _, proto := range []string{"HTTPS", "HTTP"} {
+		if values[proto+"Enable"] == "1" && values[proto+"Proxy"] != "" {
+			host := values[proto+"Proxy"]
+			if port := values[proto+"Port"]; port != "" {
+				host = net.JoinHostPort(host, port)
+			}
+			s.URL = parseSystemProxy(host, "http")
+			break
+		}
+	}
+	if values["ProxyAutoConfigEnable"] == "1" {
+		s.PACURL = parseSystemProxy(values["ProxyAutoConfigURLString"], "http")
+	}
+	s.AutoDetect = values["ProxyAutoDiscoveryEnable"] == "1"
+	return s
+}
@@ -0,0 +1,115 @@
+// +build linux
+
+package proxyplease
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// platformSettings reads the GNOME proxy settings, or else those of KDE.
+func platformSettings() (*SystemSettings, error) {
+	if s, ok := gnomeSettings(); ok {
+		return s, nil
+	}
+	if s, ok := kdeSettings(); ok {
+		return s, nil
+	}
+	return &SystemSettings{}, nil
+}
+
+// gsettings returns the value of key in the GNOME schema, without GVariant quoting.
+func gsettings(schema, key string) string {
+	out, err := exec.Command("gsettings", "get", schema, key).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.Trim(strings.TrimSpace(string(out)), "'")
+}
+
+// gnomeSettings reads the org.gnome.system.proxy schema. It reports false if gsettings
+// or the schema is not available.
+func gnomeSettings() (*SystemSettings, bool) {
+	mode := gsettings("org.gnome.system.proxy", "mode")
+	if mode == "" {
+		return nil, false
+	}
+	s := &SystemSettings{}
+	switch mode {
+	case "manual":
+		for _, proto := range []string{"https", "http"} {
+			schema := "org.gnome.system.proxy." + proto
+			if host := gsettings(schema, "host"); host != "" {
+				s.URL = parseSystemProxy(net.JoinHostPort(host, gsettings(schema, "port")), "http")
+				break
+			}
+		}
+		// a GVariant string array, ex: ['localhost', '127.0.0.0/8']
+		ignore := strings.Trim(gsettings("org.gnome.system.proxy", "ignore-hosts"), "[]@as ")
+		for _, h := range splitList(ignore, ",") {
+			s.Bypass = append(s.Bypass, strings.Trim(h, "' "))
+		}
+	case "auto":
+		if pac := gsettings("org.gnome.system.proxy", "autoconfig-url"); pac != "" {
+			s.PACURL = parseSystemProxy(pac, "http")
+		} else {
+			s.AutoDetect = true
+		}
+	}
+	return s, true
+}
+
+// kdeSettings reads the [Proxy Settings] of kioslaverc. It reports false if the file
+// does not exist.
+func kdeSettings() (*SystemSettings, bool) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, false
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	f, err := os.Open(filepath.Join(dir, "kioslaverc"))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+	section := ""
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "[") {
+			section = line
+			continue
+		}
+		if i := strings.Index(line, "="); i > 0 && section == "[Proxy Settings]" {
+			values[line[:i]] = line[i+1:]
+		}
+	}
+
+	s := &SystemSettings{}
+	// ProxyType: 0 none, 1 manual, 2 PAC script, 3 WPAD, 4 environment variables
+	switch values["ProxyType"] {
+	case "1":
+		for _, key := range []string{"httpsProxy", "httpProxy"} {
+			// KDE separates the port with a space, ex: "http://proxy 8080"
+			if v := strings.Replace(values[key], " ", ":", 1); v != "" {
+				s.URL = parseSystemProxy(v, "http")
+				break
+			}
+		}
+		s.Bypass = splitList(values["NoProxyFor"], ",")
+	case "2":
+		s.PACURL = parseSystemProxy(values["Proxy Config Script"], "http")
+	case "3":
+		s.AutoDetect = true
+	}
+	return s, true
+}
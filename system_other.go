@@ -0,0 +1,9 @@
+// +build !windows,!darwin,!linux
+
+package proxyplease
+
+// platformSettings returns no settings, since this platform has no system-wide proxy
+// configuration.
+func platformSettings() (*SystemSettings, error) {
+	return &SystemSettings{}, nil
+}
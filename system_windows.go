@@ -0,0 +1,59 @@
+// +build windows
+
+package proxyplease
+
+import (
+	"strings"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// internetSettingsKey holds the WinINET proxy settings of the current user, which
+// WinHTTP applications importing them (netsh winhttp import proxy) share.
+const internetSettingsKey = `Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+
+// platformSettings reads the WinINET settings of the current user.
+func platformSettings() (*SystemSettings, error) {
+	k, err := registry.OpenKey(registry.CURRENT_USER, internetSettingsKey, registry.QUERY_VALUE)
+	if err != nil {
+		return nil, err
+	}
+	defer k.Close()
+
+	s := &SystemSettings{}
+	if enabled, _, _ := k.GetIntegerValue("ProxyEnable"); enabled != 0 {
+		server, _, _ := k.GetStringValue("ProxyServer")
+		s.URL = parseSystemProxy(winProxyServer(server), "http")
+		override, _, _ := k.GetStringValue("ProxyOverride")
+		s.Bypass = splitList(override, ";")
+	}
+	if pac, _, err := k.GetStringValue("AutoConfigURL"); err == nil {
+		s.PACURL = parseSystemProxy(pac, "http")
+	}
+	// the auto-detect flag is bit 3 of the first flags byte of DefaultConnectionSettings
+	if c, err := registry.OpenKey(k, "Connections", registry.QUERY_VALUE); err == nil {
+		if b, _, err := c.GetBinaryValue("DefaultConnectionSettings"); err == nil && len(b) > 8 {
+			s.AutoDetect = b[8]&0x08 != 0
+		}
+		c.Close()
+	}
+	return s, nil
+}
+
+// winProxyServer returns the proxy for HTTPS, or else HTTP, of a ProxyServer value, which
+// is either a single proxy or per-protocol entries, ex: "http=a:80;https=b:8443".
+func winProxyServer(server string) string {
+	if !strings.Contains(server, "=") {
+		return server
+	}
+	entries := map[string]string{}
+	for _, e := range splitList(server, "; ") {
+		if i := strings.Index(e, "="); i > 0 {
+			entries[strings.ToLower(e[:i])] = e[i+1:]
+		}
+	}
+	if v, ok := entries["https"]; ok {
+		return v
+	}
+	return entries["http"]
+}
@@ -0,0 +1,67 @@
+package proxyplease
+
+import (
+	"fmt"
+	"time"
+)
+
+// systemPollInterval is how often watched system proxy settings are re-read.
+const systemPollInterval = 30 * time.Second
+
+// watchesSystem reports whether p follows changes of the system proxy settings: it sets
+// WatchSystem and selects proxies from the system rather than from its own settings.
+func watchesSystem(p Proxy) bool {
+	return p.WatchSystem && (p.URL == nil || p.URL.String() == "") && len(p.Upstreams) == 0 && !usesPAC(p)
+}
+
+// watchSystem calls changed whenever the system proxy settings or the network change,
+// until stop is closed. Changes are noticed as they happen where the platform reports
+// them (the registry on Windows, SystemConfiguration on macOS), and otherwise by reading
+// the settings again every systemPollInterval.
+func watchSystem(p Proxy, stop chan struct{}, changed func()) {
+	last := systemFingerprint()
+	notifications := systemChanges(p, stop)
+	clock := clockOr(p.Clock)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-notifications:
+		case <-clock.After(systemPollInterval):
+		}
+		if fp := systemFingerprint(); fp != last {
+			p.debugf("system> Proxy settings or network changed. Re-running proxy discovery.")
+			last = fp
+			changed()
+		}
+	}
+}
+
+// systemFingerprint summarizes the system proxy settings and the network addresses.
+func systemFingerprint() string {
+	s, err := SystemProxy()
+	if err != nil {
+		return "error: " + err.Error() + "|" + networkFingerprint()
+	}
+	return fmt.Sprintf("%s %v %v %t %s|%s", s.URL, s.Bypass, s.PACURL, s.AutoDetect, s.Source, networkFingerprint())
+}
+
+// reload re-runs proxy discovery for p and sends new dials through its result. Tunnels
+// established before are left running.
+func (d *Dialer) reload(p Proxy) {
+	resetWPADCache()
+	p.DecisionCache.Flush()
+	// saved state describes the previous settings
+	p.State = nil
+	dial, decision, b := newDialFunc(p)
+	dial = fallbackDirectFunc(p, routedDialFunc(p, dial))
+
+	d.mu.Lock()
+	prev := d.decision
+	d.dial, d.decision, d.balancer = dial, decision, b
+	d.mu.Unlock()
+	if !sameDecision(prev, decision) {
+		p.debugf("system> Switching from %s to %s", decisionString(prev), decisionString(decision))
+		p.event(EventProxySwitched, "Dialer switched from %s to %s after the system proxy settings changed", decisionString(prev), decisionString(decision))
+	}
+}
@@ -0,0 +1,59 @@
+// +build darwin
+
+package proxyplease
+
+import (
+	"bufio"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// scutilWatch makes scutil print a notification whenever the global proxy settings change.
+const scutilWatch = "n.add State:/Network/Global/Proxies\nn.watch\n"
+
+// systemChanges reports changes of the SystemConfiguration proxy settings, as notified
+// to an interactive scutil, until stop is closed.
+func systemChanges(p Proxy, stop chan struct{}) <-chan struct{} {
+	cmd := exec.Command("scutil")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil
+	}
+	if err := cmd.Start(); err != nil {
+		p.debugf("system> Could not watch the SystemConfiguration settings: %s", err)
+		return nil
+	}
+	// scutil exits when its input is closed, so it is kept open until stop
+	if _, err := io.WriteString(stdin, scutilWatch); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil
+	}
+	go func() {
+		<-stop
+		stdin.Close()
+		cmd.Process.Kill()
+	}()
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer cmd.Wait()
+		sc := bufio.NewScanner(stdout)
+		for sc.Scan() {
+			// ex: "  changed key [0] = State:/Network/Global/Proxies"
+			if !strings.Contains(sc.Text(), "changed key") {
+				continue
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes
+}
@@ -0,0 +1,9 @@
+// +build !windows,!darwin
+
+package proxyplease
+
+// systemChanges returns nil, since this platform does not report changes of the proxy
+// settings. They are read again periodically instead.
+func systemChanges(p Proxy, stop chan struct{}) <-chan struct{} {
+	return nil
+}
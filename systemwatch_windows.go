@@ -0,0 +1,55 @@
+// +build windows
+
+package proxyplease
+
+import (
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+// systemChanges reports changes of the WinINET settings of the current user, including
+// those of the Connections subkey, until stop is closed.
+func systemChanges(p Proxy, stop chan struct{}) <-chan struct{} {
+	k, err := registry.OpenKey(registry.CURRENT_USER, internetSettingsKey, registry.NOTIFY)
+	if err != nil {
+		p.debugf("system> Could not watch the Internet Settings: %s", err)
+		return nil
+	}
+	event, err := windows.CreateEvent(nil, 0, 0, nil)
+	if err != nil {
+		k.Close()
+		p.debugf("system> Could not watch the Internet Settings: %s", err)
+		return nil
+	}
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer k.Close()
+		defer windows.CloseHandle(event)
+		for {
+			if err := windows.RegNotifyChangeKeyValue(windows.Handle(k), true, windows.REG_NOTIFY_CHANGE_NAME|windows.REG_NOTIFY_CHANGE_LAST_SET, event, true); err != nil {
+				p.debugf("system> Could not watch the Internet Settings: %s", err)
+				return
+			}
+			// wake up every second to notice stop
+			for {
+				r, err := windows.WaitForSingleObject(event, 1000)
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err != nil {
+					return
+				}
+				if r == windows.WAIT_OBJECT_0 {
+					break
+				}
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes
+}
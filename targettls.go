@@ -0,0 +1,99 @@
+package proxyplease
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+)
+
+// InterceptionFunc is called with the target address and the root of its certificate
+// chain when a TLS-inspecting proxy re-signed the target certificate.
+type InterceptionFunc func(addr string, root *x509.Certificate)
+
+// NewDialTLSContext returns a DialContext that establishes a tunnel to addr and then
+// negotiates TLS with the target, for use as http.Transport.DialTLSContext. The handshake
+// uses Proxy.TargetTLSConfig and Proxy.TargetTLSClient, and additionally trusts the roots
+// in Proxy.TargetCAFile, such as the CA a TLS-inspecting proxy uses to re-sign
+// certificates. None applies to the connection with the proxy itself, which is configured
+// by Proxy.TLSConfig and Proxy.TLSClient.
+func NewDialTLSContext(p Proxy) DialContext {
+	dialContext := NewDialContext(p)
+	config, cfgErr := targetTLSConfig(p)
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if cfgErr != nil {
+			return nil, cfgErr
+		}
+		conn, err := dialContext(ctx, network, addr)
+		if err != nil {
+			return conn, err
+		}
+
+		c := config.Clone()
+		if c.ServerName == "" {
+			c.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tc, err := tlsHandshake(ctx, p.TargetTLSClient, conn, c)
+		if err != nil {
+			p.debugf("tls> TLS handshake with %s failed: %s", addr, err)
+			return nil, err
+		}
+		if state, ok := tlsState(tc); ok && p.OnInterception != nil {
+			if root, ok := interceptedBy(state); ok {
+				p.debugf("tls> Certificate for %s was re-signed by '%s'", addr, root.Subject)
+				p.OnInterception(addr, root)
+			}
+		}
+		return tc, nil
+	}
+}
+
+// IsIntercepted reports whether the certificate chain in state cannot be verified with the
+// system roots, which happens when a TLS-inspecting proxy re-signed it with its own CA.
+// Use it with http.Response.TLS to adjust certificate pinning or warn users. A proxy CA
+// installed in the system store cannot be told apart from a public CA.
+func IsIntercepted(state tls.ConnectionState) bool {
+	_, ok := interceptedBy(state)
+	return ok
+}
+
+// interceptedBy returns the root of the chain in state if it is not trusted by the system.
+func interceptedBy(state tls.ConnectionState) (*x509.Certificate, bool) {
+	certs := state.PeerCertificates
+	if len(certs) == 0 {
+		return nil, false
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		debugf("tls> Could not load system roots: %s", err)
+		return nil, false
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err = certs[0].Verify(x509.VerifyOptions{
+		DNSName:       state.ServerName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err == nil {
+		return nil, false
+	}
+
+	root := certs[len(certs)-1]
+	if len(state.VerifiedChains) > 0 {
+		chain := state.VerifiedChains[0]
+		root = chain[len(chain)-1]
+	}
+	return root, true
+}
+
+// targetTLSConfig returns the TLS configuration for target handshakes described by p.
+func targetTLSConfig(p Proxy) (*tls.Config, error) {
+	config := &tls.Config{}
+	if p.TargetTLSConfig != nil {
+		config = p.TargetTLSConfig.Clone()
+	}
+	return extendRoots(p, config, p.TargetCAFile)
+}
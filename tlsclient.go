@@ -0,0 +1,43 @@
+package proxyplease
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// TLSClientFunc performs a TLS handshake with config over conn and returns the resulting
+// connection, closing conn if the handshake fails. It lets another TLS implementation,
+// such as uTLS with a browser ClientHello, replace crypto/tls where TLS-inspecting proxies
+// fingerprint and block Go's ClientHello. The returned connection should have a
+// ConnectionState() tls.ConnectionState method, as *tls.Conn does, for HTTP/2, channel
+// binding and interception detection, which are skipped otherwise.
+type TLSClientFunc func(ctx context.Context, conn net.Conn, config *tls.Config) (net.Conn, error)
+
+// ClientCertFunc selects the certificate presented to an https:// proxy requesting
+// one, as tls.Config.GetClientCertificate.
+type ClientCertFunc func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+
+// tlsHandshake negotiates TLS with config over conn, with client if set or crypto/tls
+// otherwise. conn is closed if the handshake fails.
+func tlsHandshake(ctx context.Context, client TLSClientFunc, conn net.Conn, config *tls.Config) (net.Conn, error) {
+	if client != nil {
+		return client(ctx, conn, config)
+	}
+	tc := tls.Client(conn, config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// tlsState returns the TLS connection state of conn, if it exposes one.
+func tlsState(conn net.Conn) (tls.ConnectionState, bool) {
+	if s, ok := conn.(interface {
+		ConnectionState() tls.ConnectionState
+	}); ok {
+		return s.ConnectionState(), true
+	}
+	return tls.ConnectionState{}, false
+}
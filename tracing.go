@@ -0,0 +1,94 @@
+package proxyplease
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// Names of the spans started during dials.
+const (
+	spanDial      = "proxyplease.dial"       // a dial through a proxy
+	spanBaseDial  = "proxyplease.base_dial"  // a connection to the proxy, including TLS for https:// proxies
+	spanNegotiate = "proxyplease.negotiate"  // selection of the authentication scheme after a 407
+	spanAuth      = "proxyplease.auth"       // an attempt to authenticate with one scheme
+	spanRoundTrip = "proxyplease.round_trip" // reading the proxy response to a CONNECT request
+)
+
+// Tracer starts spans around the phases of dials, so slow proxies can be diagnosed in
+// distributed traces. Implementations adapt it to a tracing system, ex: OpenTelemetry,
+// and must be safe for concurrent use.
+//
+// Each dial through a proxy has a proxyplease.dial span, child of the span in the dial's
+// context, with proxyplease.base_dial spans for the connections to the proxy,
+// proxyplease.round_trip spans for the responses to CONNECT requests, and, when the proxy
+// requires authentication, a proxyplease.negotiate span with a proxyplease.auth span per
+// scheme attempted. Spans carry the attributes proxy.addr, proxy.scheme, target.addr,
+// auth.scheme, auth.offered and http.status_code where they apply.
+type Tracer interface {
+	// Start starts a span named name, child of the span in ctx if any, and returns a
+	// context carrying the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	// End ends the span, recording err, if not nil, as its status.
+	End(err error)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+
+func (noopSpan) End(err error) {}
+
+// startSpan starts a span of p.Tracer, child of the current span of the dial, and returns
+// p with the new span as the current one.
+func (p Proxy) startSpan(name string) (Proxy, Span) {
+	if p.Tracer == nil || p.trace == nil {
+		return p, noopSpan{}
+	}
+	ctx, span := p.Tracer.Start(p.trace, name)
+	p.trace = ctx
+	return p, span
+}
+
+// startDialSpan starts the span of a dial to addr through p, child of the span in ctx.
+func (p Proxy) startDialSpan(ctx context.Context, addr string) (Proxy, Span) {
+	p.trace = ctx
+	p, span := p.startSpan(spanDial)
+	span.SetAttribute("proxy.addr", p.URL.Host)
+	span.SetAttribute("proxy.scheme", p.URL.Scheme)
+	span.SetAttribute("target.addr", addr)
+	return p, span
+}
+
+// endSpan ends span, recording the scheme the tunnel was authenticated with.
+func endSpan(span Span, conn net.Conn, err error) {
+	if c, ok := conn.(*Conn); ok && err == nil && c.info.AuthScheme != "" {
+		span.SetAttribute("auth.scheme", c.info.AuthScheme)
+	}
+	span.End(err)
+}
+
+// traceNegotiation starts the span of the selection among the schemes offered by a proxy.
+func (p Proxy) traceNegotiation(offered []string) (Proxy, Span) {
+	p, span := p.startSpan(spanNegotiate)
+	schemes := make([]string, 0, len(offered))
+	for _, s := range offered {
+		schemes = append(schemes, strings.Split(s, " ")[0])
+	}
+	span.SetAttribute("auth.offered", strings.Join(schemes, ","))
+	return p, span
+}
+
+// traceAuth runs the authentication attempt of scheme in its own span.
+func traceAuth(p Proxy, scheme string, attempt func(Proxy) (net.Conn, error)) (net.Conn, error) {
+	p, span := p.startSpan(spanAuth)
+	span.SetAttribute("auth.scheme", scheme)
+	conn, err := attempt(p)
+	span.End(err)
+	return conn, err
+}
@@ -0,0 +1,120 @@
+package proxyplease
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+// TransferStats aggregates the bytes transferred through tunnels by proxy, destination
+// and application component, so operators can attribute proxy bandwidth. Counts are
+// updated as data flows, not only when tunnels are closed. Its zero value is ready for
+// use, and it is safe for concurrent use. Destinations are kept until Reset, so long
+// running services dialing many of them should reset it periodically.
+type TransferStats struct {
+	mu         sync.Mutex
+	proxies    map[string]*transferCounter
+	targets    map[string]*transferCounter
+	components map[string]*transferCounter
+}
+
+// Transfer is the traffic of a set of tunnels.
+type Transfer struct {
+	Tunnels  int64 // Tunnels established.
+	Sent     int64 // Bytes sent to the destinations.
+	Received int64 // Bytes received from the destinations, including those sent along with the CONNECT response.
+}
+
+type transferCounter struct {
+	tunnels, sent, received int64
+}
+
+type componentKey struct{}
+
+// WithComponent returns a copy of ctx attributing the tunnels dialed with it to the
+// application component name in Proxy.Transfers, ex: "billing-sync".
+func WithComponent(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, componentKey{}, name)
+}
+
+// ByProxy returns the traffic per proxy (host:port), with "direct" for connections made
+// without a proxy.
+func (s *TransferStats) ByProxy() map[string]Transfer {
+	return s.snapshot(func() map[string]*transferCounter { return s.proxies })
+}
+
+// ByTarget returns the traffic per destination (host:port).
+func (s *TransferStats) ByTarget() map[string]Transfer {
+	return s.snapshot(func() map[string]*transferCounter { return s.targets })
+}
+
+// ByComponent returns the traffic per component set with WithComponent. Tunnels dialed
+// without one are not included.
+func (s *TransferStats) ByComponent() map[string]Transfer {
+	return s.snapshot(func() map[string]*transferCounter { return s.components })
+}
+
+// Reset discards the counts. Tunnels still open are no longer counted.
+func (s *TransferStats) Reset() {
+	s.mu.Lock()
+	s.proxies, s.targets, s.components = nil, nil, nil
+	s.mu.Unlock()
+}
+
+// Publish exports the counts as the expvar name, served by /debug/vars, with the
+// objects proxies, targets and components. It panics if name is already published.
+func (s *TransferStats) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return map[string]map[string]Transfer{
+			"proxies":    s.ByProxy(),
+			"targets":    s.ByTarget(),
+			"components": s.ByComponent(),
+		}
+	}))
+}
+
+func (s *TransferStats) snapshot(counters func() map[string]*transferCounter) map[string]Transfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := map[string]Transfer{}
+	for k, c := range counters() {
+		m[k] = Transfer{
+			Tunnels:  atomic.LoadInt64(&c.tunnels),
+			Sent:     atomic.LoadInt64(&c.sent),
+			Received: atomic.LoadInt64(&c.received),
+		}
+	}
+	return m
+}
+
+// track has s count the traffic of c, a tunnel to addr dialed with ctx.
+func (s *TransferStats) track(ctx context.Context, c *Conn, addr string) {
+	proxy := "direct"
+	if c.info.Proxy != nil {
+		proxy = c.info.Proxy.Host
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.transfers = []*transferCounter{counterFor(&s.proxies, proxy), counterFor(&s.targets, addr)}
+	if name, ok := ctx.Value(componentKey{}).(string); ok && name != "" {
+		c.transfers = append(c.transfers, counterFor(&s.components, name))
+	}
+	for _, t := range c.transfers {
+		atomic.AddInt64(&t.tunnels, 1)
+	}
+}
+
+// counterFor returns the counter of key in *m, creating both as needed. The mutex of the
+// TransferStats must be held.
+func counterFor(m *map[string]*transferCounter, key string) *transferCounter {
+	if *m == nil {
+		*m = map[string]*transferCounter{}
+	}
+	c := (*m)[key]
+	if c == nil {
+		c = &transferCounter{}
+		(*m)[key] = c
+	}
+	return c
+}
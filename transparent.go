@@ -0,0 +1,118 @@
+package proxyplease
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// TransparentMode selects how a TransparentListener recovers the original destination
+// of an intercepted connection.
+type TransparentMode int
+
+const (
+	// Redirect handles connections diverted with the iptables REDIRECT target. The
+	// original destination is recovered with SO_ORIGINAL_DST.
+	Redirect TransparentMode = iota
+	// TProxy handles connections diverted with the iptables TPROXY target. The listening
+	// socket is opened with IP_TRANSPARENT and the original destination is the local address.
+	TProxy
+)
+
+// TransparentListener accepts intercepted connections and tunnels each one to its
+// original destination through the proxy described by Proxy.
+type TransparentListener struct {
+	Proxy Proxy           // Upstream proxy used for every intercepted connection.
+	Mode  TransparentMode // How the original destination is recovered.
+
+	listener net.Listener
+	dial     DialContext
+	mu       sync.Mutex
+	closed   bool
+}
+
+// ListenTransparent opens a listener on addr suitable for iptables REDIRECT or TPROXY
+// interception. Call Serve to begin accepting connections.
+func ListenTransparent(addr string, mode TransparentMode, p Proxy) (*TransparentListener, error) {
+	ln, err := listenTransparent(addr, mode)
+	if err != nil {
+		p.debugf("transparent> Could not listen on %s: %s", addr, err)
+		return nil, err
+	}
+	p.debugf("transparent> Listening on %s", ln.Addr())
+	return &TransparentListener{
+		Proxy:    p,
+		Mode:     mode,
+		listener: ln,
+		dial:     NewDialContext(p),
+	}, nil
+}
+
+// Addr returns the listener's network address.
+func (t *TransparentListener) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// Serve accepts intercepted connections until the listener is closed.
+func (t *TransparentListener) Serve() error {
+	t.Proxy.event(EventListenerStarted, "Transparent listener on %s started", t.listener.Addr())
+	defer t.Proxy.event(EventListenerStopped, "Transparent listener on %s stopped", t.listener.Addr())
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			t.mu.Lock()
+			closed := t.closed
+			t.mu.Unlock()
+			if closed {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				t.Proxy.debugf("transparent> Temporary accept error: %s", err)
+				continue
+			}
+			return err
+		}
+		go t.handle(conn)
+	}
+}
+
+// Close stops accepting new connections. Established tunnels are left running.
+func (t *TransparentListener) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+	return t.listener.Close()
+}
+
+func (t *TransparentListener) handle(conn net.Conn) {
+	dst, err := t.originalDst(conn)
+	if err != nil {
+		t.Proxy.debugf("transparent> Could not recover original destination for %s: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	t.Proxy.debugf("transparent> %s -> %s", conn.RemoteAddr(), dst)
+
+	upstream, err := t.dial(context.Background(), "tcp", dst)
+	if err != nil {
+		t.Proxy.debugf("transparent> Could not tunnel to %s: %s", dst, err)
+		conn.Close()
+		return
+	}
+	relay(conn, upstream)
+}
+
+func (t *TransparentListener) originalDst(conn net.Conn) (string, error) {
+	switch t.Mode {
+	case TProxy:
+		return conn.LocalAddr().String(), nil
+	case Redirect:
+		tc, ok := conn.(*net.TCPConn)
+		if !ok {
+			return "", errors.New("transparent interception requires a TCP connection")
+		}
+		return originalDst(tc)
+	}
+	return "", errors.New("unknown transparent mode")
+}
@@ -0,0 +1,70 @@
+// +build linux
+
+package proxyplease
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h. The IPv6 equivalent
+// (IP6T_SO_ORIGINAL_DST) shares the same value.
+const soOriginalDst = 80
+
+func listenTransparent(addr string, mode TransparentMode) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if mode == TProxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				if serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1); serr != nil {
+					return
+				}
+				// IPv6 sockets need the v6 option as well. Failure is expected on v4-only sockets.
+				unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+func originalDst(conn *net.TCPConn) (string, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	var dst string
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		// sockaddr_in fits inside IPv6Mreq; try IPv4 first
+		if mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst); err == nil {
+			raw := (*unix.RawSockaddrInet4)(unsafe.Pointer(&mreq.Multiaddr[0]))
+			port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&raw.Port))[:])
+			dst = net.JoinHostPort(net.IP(raw.Addr[:]).String(), strconv.Itoa(int(port)))
+			return
+		}
+		// sockaddr_in6 fits inside IPv6MTUInfo
+		info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst)
+		if err != nil {
+			serr = err
+			return
+		}
+		port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&info.Addr.Port))[:])
+		dst = net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), strconv.Itoa(int(port)))
+	})
+	if err != nil {
+		return "", err
+	}
+	return dst, serr
+}
@@ -0,0 +1,16 @@
+// +build !linux
+
+package proxyplease
+
+import (
+	"errors"
+	"net"
+)
+
+func listenTransparent(addr string, mode TransparentMode) (net.Listener, error) {
+	return nil, errors.New("transparent proxy interception is only available on Linux")
+}
+
+func originalDst(conn *net.TCPConn) (string, error) {
+	return "", errors.New("transparent proxy interception is only available on Linux")
+}
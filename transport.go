@@ -0,0 +1,35 @@
+package proxyplease
+
+import (
+	"net/http"
+	"time"
+)
+
+// NewTransport returns an *http.Transport sending requests through the proxy described
+// by p, with idle connection settings matching http.DefaultTransport. Target handshakes
+// use p.TargetTLSConfig and the roots of p.TargetCAFile. The transport can be adjusted
+// before use, ex: to change the idle limits.
+func NewTransport(p Proxy) *http.Transport {
+	config, err := targetTLSConfig(p)
+	if err != nil {
+		p.debugf("transport> Not trusting TargetCAFile: %s", err)
+		config = p.TargetTLSConfig
+	}
+	return &http.Transport{
+		Proxy:                 nil, // the dialer connects through the proxy
+		DialContext:           NewDialContext(p),
+		TLSClientConfig:       config,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// NewRoundTripper returns a RoundTripper sending requests through the proxy described by
+// p, ex: for http.Client{Transport: proxyplease.NewRoundTripper(p)}.
+func NewRoundTripper(p Proxy) http.RoundTripper {
+	return NewTransport(p)
+}
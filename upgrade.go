@@ -0,0 +1,134 @@
+package proxyplease
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxUpgradeErrorBody caps the body kept from a response refusing an upgrade.
+const maxUpgradeErrorBody = 64 << 10
+
+// DialUpgrade establishes a tunnel to the host of req through the proxy described by p,
+// sends req on it as an HTTP/1.1 Upgrade request, ex: for WebSocket or h2c, and returns
+// the upgraded connection with the 101 Switching Protocols response. req must set the
+// Upgrade header and any protocol headers, such as Sec-WebSocket-Key. ws and wss URLs are
+// dialed as http and https; TLS uses p.TargetTLSConfig and only offers HTTP/1.1. Data the
+// server sent after the response is returned by the first reads of the connection. If the
+// server does not switch protocols, the response is returned with an error.
+func DialUpgrade(ctx context.Context, p Proxy, req *http.Request) (net.Conn, *http.Response, error) {
+	if req.Header.Get("Upgrade") == "" {
+		return nil, nil, errors.New("request has no Upgrade header")
+	}
+	target := *req.URL
+	switch target.Scheme {
+	case "ws", "http":
+		target.Scheme = "http"
+	case "wss", "https":
+		target.Scheme = "https"
+	default:
+		return nil, nil, fmt.Errorf("cannot upgrade a '%s' URL", req.URL.Scheme)
+	}
+	addr := targetAuthority(&target)
+
+	p.TargetURL = &target
+	var conn net.Conn
+	var err error
+	if target.Scheme == "https" {
+		config, cerr := targetTLSConfig(p)
+		if cerr != nil {
+			return nil, nil, cerr
+		}
+		// the upgrade is an HTTP/1.1 mechanism
+		config.NextProtos = []string{"http/1.1"}
+		p.TargetTLSConfig, p.TargetCAFile = config, ""
+		conn, err = NewDialTLSContext(p)(ctx, "tcp", addr)
+	} else {
+		conn, err = NewDialContext(p)(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	g := &handshakeGuard{ctx: ctx}
+	g.watch(conn)
+	defer g.release()
+
+	out := req.WithContext(ctx)
+	out.Header = req.Header.Clone()
+	if !headerHasToken(out.Header, "Connection", "upgrade") {
+		out.Header.Add("Connection", "Upgrade")
+	}
+	if err := out.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, out)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		p.debugf("upgrade> %s did not switch protocols, got: %d", addr, resp.StatusCode)
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxUpgradeErrorBody))
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		conn.Close()
+		return nil, resp, fmt.Errorf("upgrade refused: %s", resp.Status)
+	}
+	return withPending(conn, br), resp, nil
+}
+
+// defaultPort returns the default port of an http or https URL.
+func defaultPort(scheme string) string {
+	if scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// targetAuthority returns the host:port of target, with the default port of its scheme
+// if it has none.
+func targetAuthority(target *url.URL) string {
+	if target.Port() != "" {
+		return target.Host
+	}
+	return net.JoinHostPort(target.Hostname(), defaultPort(target.Scheme))
+}
+
+// headerHasToken reports whether the comma separated values of header name contain token.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// withPending returns conn such that its first reads return the data br read ahead.
+func withPending(conn net.Conn, br *bufio.Reader) net.Conn {
+	if br.Buffered() == 0 {
+		return conn
+	}
+	b, _ := br.Peek(br.Buffered())
+	if c, ok := conn.(*Conn); ok {
+		c.pending = append(append([]byte(nil), b...), c.pending...)
+		return c
+	}
+	return &Conn{Conn: conn, pending: b}
+}
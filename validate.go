@@ -0,0 +1,182 @@
+package proxyplease
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bdwyertech/proxyplease/pac"
+)
+
+// FieldError describes a single invalid field of a Proxy.
+type FieldError struct {
+	Field   string // Name of the Proxy field, ex: "URL" or "Domain".
+	Message string // What is wrong with the field and how to fix it.
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationError is returned by Proxy.Validate. It lists every problem found.
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	s := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		s[i] = fe.Error()
+	}
+	return "invalid proxy configuration: " + strings.Join(s, "; ")
+}
+
+var knownAuthSchemes = []string{"Basic", "Digest", "NTLM", "Negotiate", "Bearer"}
+
+// Validate performs cross-field checks on p and returns a *ValidationError describing
+// every problem found, or nil if p is usable. NewDialContext does not call Validate;
+// call it before the first dial to surface configuration mistakes early.
+func (p Proxy) Validate() error {
+	var errs []FieldError
+	add := func(field, format string, a ...interface{}) {
+		errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf(format, a...)})
+	}
+
+	username, password := p.Username, p.Password
+	if p.URL != nil && p.URL.String() != "" {
+		p.URL = normalizeProxyURL(p.URL, p.DefaultHTTPPort)
+		if u := p.URL.User.Username(); u != "" {
+			username = u
+		}
+		if pass, _ := p.URL.User.Password(); pass != "" {
+			password = pass
+		}
+
+		switch p.URL.Scheme {
+		case "http", "https":
+		case "socks4", "socks4a":
+			if username != "" || password != "" {
+				add("URL", "%s does not support username/password authentication; use socks5", p.URL.Scheme)
+			}
+			fallthrough
+		case "socks5", "socks5h", "socks":
+			if p.Domain != "" {
+				add("Domain", "is only used for NTLM and Negotiate authentication and has no effect with a %s proxy", p.URL.Scheme)
+			}
+			if p.AuthSchemeFilter != nil {
+				add("AuthSchemeFilter", "has no effect with a %s proxy", p.URL.Scheme)
+			}
+			if p.FormAuth != nil {
+				add("FormAuth", "has no effect with a %s proxy", p.URL.Scheme)
+			}
+		default:
+			add("URL", "has unsupported scheme '%s'", p.URL.Scheme)
+		}
+		if p.URL.Hostname() == "" {
+			add("URL", "is missing a host")
+		}
+	}
+
+	for i, u := range p.Upstreams {
+		field := fmt.Sprintf("Upstreams[%d].URL", i)
+		if u.URL == nil {
+			add(field, "is nil")
+			continue
+		}
+		if _, ok := defaultPorts[normalizeProxyURL(u.URL, "").Scheme]; !ok {
+			add(field, "has unsupported scheme '%s'", u.URL.Scheme)
+		}
+	}
+
+	if p.ProxyList != "" {
+		if _, err := pac.ParseResult(p.ProxyList); err != nil {
+			add("ProxyList", "'%s' is not a list of PAC directives, ex: \"PROXY a:8080; PROXY b:8080; DIRECT\"", p.ProxyList)
+		}
+	}
+
+	for i, r := range p.Routes {
+		field := fmt.Sprintf("Routes[%d]", i)
+		switch r.Action {
+		case RouteDirect, RouteBlock:
+		case RouteProxy:
+			if r.Proxy == nil {
+				add(field, "PROXY rule for '%s' has no Proxy", r.Match)
+			} else if _, ok := defaultPorts[normalizeProxyURL(r.Proxy, "").Scheme]; !ok {
+				add(field, "has unsupported scheme '%s'", r.Proxy.Scheme)
+			}
+		default:
+			add(field, "unknown action '%s'; use DIRECT, BLOCK or PROXY", r.Action)
+		}
+	}
+
+	if len(p.Chain) > 0 && len(p.Upstreams) > 0 {
+		add("Chain", "cannot be combined with Upstreams")
+	}
+	for i, h := range p.Chain {
+		field := fmt.Sprintf("Chain[%d]", i)
+		if h.URL == nil {
+			add(field+".URL", "is nil")
+			continue
+		}
+		switch s := normalizeProxyURL(h.URL, h.DefaultHTTPPort).Scheme; s {
+		case "http", "https", "socks5", "socks5h", "socks":
+		case "socks4", "socks4a":
+			if i > 0 {
+				add(field+".URL", "%s proxies can only be the first hop of a chain", s)
+			}
+		default:
+			add(field+".URL", "has unsupported scheme '%s'", s)
+		}
+	}
+	if len(p.Chain) > 0 && p.URL != nil {
+		if s := normalizeProxyURL(p.URL, p.DefaultHTTPPort).Scheme; s == "socks4" || s == "socks4a" {
+			add("URL", "%s proxies can only be the first hop of a chain", s)
+		}
+	}
+
+	if p.FormAuth != nil && p.FormAuth.LoginURL == nil {
+		add("FormAuth.LoginURL", "is nil; set it to the URL the login form is posted to")
+	}
+
+	if p.Domain != "" && username == "" {
+		add("Domain", "is set but Username is empty; set Username and Password or clear Domain to use the current user's credentials")
+	}
+
+	for _, s := range p.AuthSchemeFilter {
+		// registered schemes are filtered by the name they were registered with
+		if r, ok := lookupScheme(s); !contains(knownAuthSchemes, s) && (!ok || r.name != s) {
+			add("AuthSchemeFilter", "unknown authentication scheme '%s'; expected one of %s or a scheme added with RegisterScheme", s, strings.Join(knownAuthSchemes, ", "))
+		}
+	}
+
+	if p.TargetURL != nil && p.TargetURL.Scheme != "" {
+		switch p.TargetURL.Scheme {
+		case "http", "https", "ws", "wss", "ftp":
+		default:
+			add("TargetURL", "has scheme '%s' which cannot be used for proxy lookups", p.TargetURL.Scheme)
+		}
+	}
+
+	switch p.TargetResolution {
+	case ResolveByScheme, ResolveLocal, ResolveOnProxy:
+	default:
+		add("TargetResolution", "unknown mode '%s'; use ResolveLocal, ResolveOnProxy or ResolveByScheme", p.TargetResolution)
+	}
+
+	if dp := p.Authority.DefaultPort; dp != "" && !validPort(dp) {
+		add("Authority.DefaultPort", "'%s' is not a valid port", dp)
+	}
+	if dp := p.DefaultHTTPPort; dp != "" && !validPort(dp) {
+		add("DefaultHTTPPort", "'%s' is not a valid port", dp)
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
+
+func validPort(s string) bool {
+	n, err := strconv.Atoi(s)
+	return err == nil && n > 0 && n <= 65535
+}
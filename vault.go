@@ -0,0 +1,75 @@
+package proxyplease
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// VaultSecret is a SecretStore reading proxy credentials from a HashiCorp Vault KV
+// version 2 secrets engine.
+type VaultSecret struct {
+	Addr      string       // Address of Vault, ex: "https://vault.example.com:8200". Defaults to $VAULT_ADDR.
+	Token     string       // Vault token. Defaults to $VAULT_TOKEN.
+	Namespace string       // Vault Enterprise namespace. Defaults to $VAULT_NAMESPACE.
+	Mount     string       // Mount path of the KV engine. Defaults to "secret".
+	Path      string       // Path of the secret within the engine, ex: "proxy/corp".
+	Client    *http.Client // Client for Vault. Defaults to http.DefaultClient.
+}
+
+// Fetch reads the latest version of the secret.
+func (v *VaultSecret) Fetch(ctx context.Context) (Credentials, error) {
+	addr, token, namespace, mount := v.Addr, v.Token, v.Namespace, v.Mount
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if namespace == "" {
+		namespace = os.Getenv("VAULT_NAMESPACE")
+	}
+	if mount == "" {
+		mount = "secret"
+	}
+	if addr == "" || v.Path == "" {
+		return Credentials{}, errors.New("vault: address and secret path are required")
+	}
+
+	u := strings.TrimSuffix(addr, "/") + "/v1/" + strings.Trim(mount, "/") + "/data/" + strings.TrimPrefix(v.Path, "/")
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Vault-Token", token)
+	if namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+	var resp struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := doSecretRequest(v.Client, req, "vault", &resp); err != nil {
+		return Credentials{}, err
+	}
+	debugf("secrets> Fetched credentials from Vault at %s", v.Path)
+	return mapCredentials(resp.Data.Data)
+}
+
+// mapCredentials returns the credentials of the key/value pairs of a secret.
+func mapCredentials(m map[string]interface{}) (Credentials, error) {
+	var c Credentials
+	for key, dst := range map[string]*string{"domain": &c.Domain, "username": &c.Username, "password": &c.Password} {
+		if s, ok := m[key].(string); ok {
+			*dst = s
+		}
+	}
+	if c.Username == "" && c.Password == "" {
+		return Credentials{}, errSecretFields
+	}
+	return c, nil
+}
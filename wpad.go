@@ -0,0 +1,349 @@
+package proxyplease
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPACSize caps the size of a PAC script downloaded during discovery.
+const maxPACSize = 1 << 20
+
+// wpadCacheTTL is how long the result of the discovery made for dialers is reused.
+const wpadCacheTTL = 5 * time.Minute
+
+// wpadCache holds the last discovery made for dialers, so it is not repeated for every
+// Proxy and target.
+var wpadCache struct {
+	sync.Mutex
+	key     string
+	result  *WPADResult
+	expires time.Time
+}
+
+// pacFetchKey marks the context of PAC downloads, which dialers of this package make
+// directly to avoid routing them through the proxy being discovered.
+type pacFetchKey struct{}
+
+// isPACFetch reports whether ctx belongs to a PAC download.
+func isPACFetch(ctx context.Context) bool {
+	v, _ := ctx.Value(pacFetchKey{}).(bool)
+	return v
+}
+
+// virtualInterfacePrefixes are name prefixes of container, hypervisor and overlay network
+// adapters, which never lead to a WPAD server.
+var virtualInterfacePrefixes = []string{
+	"docker", "veth", "br-", "virbr", "vmnet", "vboxnet", "cni", "flannel", "cali", "lxc", "lxd", "podman", "kube",
+}
+
+// WPADOptions control Web Proxy Auto-Discovery through DNS performed by DiscoverWPAD.
+type WPADOptions struct {
+	Interface string        // Restrict discovery to the named network interface, ex: "eth0".
+	Domains   []string      // DNS domains to search. Defaults to the resolver's search domains and the host's domain.
+	Timeout   time.Duration // Timeout of each probe. Defaults to 2s.
+	Client    *http.Client  // Client downloading wpad.dat, ex: with custom TLS or DNS. Defaults to a direct client bound to the probed interface.
+}
+
+// WPADResult is a PAC script located by DiscoverWPAD.
+type WPADResult struct {
+	URL       *url.URL // Where the script was downloaded from.
+	Interface string   // Interface the script was found through. Empty for DHCP.
+	Script    string   // Content of the PAC script.
+	Source    Source   // SourceWPADDHCP or SourceWPADDNS.
+}
+
+// DiscoverWPAD locates a PAC script. On Windows, the URL served by DHCP (option 252) is
+// used first. Otherwise wpad.<domain>/wpad.dat is looked up for each DNS search domain,
+// from the most to the least specific, through every usable network interface. Loopback,
+// disconnected, link-local-only and virtual (container, hypervisor) interfaces are
+// skipped. Each server is probed over IPv4 and then IPv6 (AAAA records), so discovery
+// works on IPv6-only networks.
+func DiscoverWPAD(ctx context.Context, o WPADOptions) (*WPADResult, error) {
+	timeout := o.Timeout
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	if r, err := discoverWPADDHCP(ctx, o, timeout); err == nil {
+		return r, nil
+	}
+
+	ifaces, err := wpadInterfaces(o.Interface)
+	if err != nil {
+		return nil, err
+	}
+	if len(ifaces) == 0 {
+		debugf("wpad> No usable network interface")
+		return nil, errors.New("no usable network interface for WPAD")
+	}
+	domains := o.Domains
+	if len(domains) == 0 {
+		domains = searchDomains()
+	}
+	candidates := wpadCandidates(domains)
+	if len(candidates) == 0 {
+		debugf("wpad> No DNS domain to search")
+		return nil, errors.New("no DNS domain to search for WPAD")
+	}
+
+	for _, iface := range ifaces {
+		for _, host := range candidates {
+			u := &url.URL{Scheme: "http", Host: host, Path: "/wpad.dat"}
+			for _, addr := range iface.addrs {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				script, err := fetchWPAD(ctx, o.Client, u, addr, timeout)
+				if err != nil {
+					debugf("wpad> %s via %s (%s): %s", u, iface.name, addr, err)
+					continue
+				}
+				debugf("wpad> Found PAC script at %s via %s (%s)", u, iface.name, addr)
+				return &WPADResult{URL: u, Interface: iface.name, Script: script, Source: SourceWPADDNS}, nil
+			}
+		}
+	}
+	return nil, errors.New("no WPAD server found")
+}
+
+// discoverWPADDHCP downloads the PAC script at the URL served by DHCP.
+func discoverWPADDHCP(ctx context.Context, o WPADOptions, timeout time.Duration) (*WPADResult, error) {
+	raw, err := dhcpWPAD(o.Interface)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		debugf("wpad> Invalid PAC URL from DHCP '%s': %s", raw, err)
+		return nil, err
+	}
+	script, err := fetchWPAD(ctx, o.Client, u, nil, timeout)
+	if err != nil {
+		debugf("wpad> %s from DHCP: %s", u, err)
+		return nil, err
+	}
+	debugf("wpad> Found PAC script at %s via DHCP", u)
+	return &WPADResult{URL: u, Script: script, Source: SourceWPADDHCP}, nil
+}
+
+// discoverPAC returns the PAC script found by DiscoverWPAD with p.WPAD, reusing recent
+// results, or nil if discovery is disabled or found nothing.
+func discoverPAC(p Proxy) *WPADResult {
+	if p.DisableWPAD {
+		return nil
+	}
+	key := p.WPAD.Interface + "|" + strings.Join(p.WPAD.Domains, ",")
+	wpadCache.Lock()
+	defer wpadCache.Unlock()
+	if wpadCache.key == key && time.Now().Before(wpadCache.expires) {
+		return wpadCache.result
+	}
+	p.debugf("wpad> No proxy found in the system settings. Attempting discovery.")
+	r, err := DiscoverWPAD(context.Background(), p.WPAD)
+	if err != nil {
+		p.debugf("wpad> Discovery failed: %s", err)
+	}
+	wpadCache.key, wpadCache.result, wpadCache.expires = key, r, time.Now().Add(wpadCacheTTL)
+	return r
+}
+
+// resetWPADCache discards the last discovery, ex: after the network changed.
+func resetWPADCache() {
+	wpadCache.Lock()
+	wpadCache.expires = time.Time{}
+	wpadCache.Unlock()
+}
+
+// wpadInterface is a network interface usable for discovery and the addresses probes are
+// sent from.
+type wpadInterface struct {
+	name  string
+	addrs []net.IP
+}
+
+// wpadInterfaces returns the interfaces suitable for discovery, restricted to name if set.
+func wpadInterfaces(name string) ([]wpadInterface, error) {
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var usable []wpadInterface
+	for _, iface := range all {
+		if name != "" && iface.Name != name {
+			continue
+		}
+		if reason := skipInterface(iface); reason != "" {
+			debugf("wpad> Skipping interface %s: %s", iface.Name, reason)
+			continue
+		}
+		addrs := interfaceAddrs(iface)
+		if len(addrs) == 0 {
+			debugf("wpad> Skipping interface %s: only link-local addresses", iface.Name)
+			continue
+		}
+		usable = append(usable, wpadInterface{name: iface.Name, addrs: addrs})
+	}
+	if name != "" && len(usable) == 0 {
+		return nil, errors.New("network interface '" + name + "' is not usable for WPAD")
+	}
+	return usable, nil
+}
+
+// skipInterface returns why iface is not used for discovery, or an empty string.
+func skipInterface(iface net.Interface) string {
+	switch {
+	case iface.Flags&net.FlagLoopback != 0:
+		return "loopback"
+	case iface.Flags&net.FlagUp == 0, iface.Flags&net.FlagRunning == 0:
+		return "disconnected"
+	}
+	lower := strings.ToLower(iface.Name)
+	for _, prefix := range virtualInterfacePrefixes {
+		if strings.HasPrefix(lower, prefix) {
+			return "virtual adapter"
+		}
+	}
+	return ""
+}
+
+// interfaceAddrs returns the first routable IPv4 and IPv6 addresses of iface, in that order.
+func interfaceAddrs(iface net.Interface) []net.IP {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	return routableAddrs(addrs)
+}
+
+// routableAddrs returns the first IPv4 and IPv6 addresses of addrs, in that order,
+// skipping link-local and loopback addresses.
+func routableAddrs(addrs []net.Addr) []net.IP {
+	var v4, v6 net.IP
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || n.IP.IsLinkLocalUnicast() || n.IP.IsLoopback() {
+			continue
+		}
+		if n.IP.To4() != nil && v4 == nil {
+			v4 = n.IP
+		} else if n.IP.To4() == nil && v6 == nil {
+			v6 = n.IP
+		}
+	}
+	var ips []net.IP
+	for _, ip := range []net.IP{v4, v6} {
+		if ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// wpadCandidates returns the WPAD hosts for domains, from the most to the least specific.
+// Top level domains are never searched, since wpad.<tld> could be registered by anyone.
+func wpadCandidates(domains []string) []string {
+	seen := map[string]bool{}
+	var hosts []string
+	for _, d := range domains {
+		d = strings.Trim(strings.ToLower(d), ".")
+		for strings.Count(d, ".") >= 1 {
+			h := "wpad." + d
+			if !seen[h] {
+				seen[h] = true
+				hosts = append(hosts, h)
+			}
+			d = d[strings.Index(d, ".")+1:]
+		}
+	}
+	return hosts
+}
+
+// searchDomains returns the DNS search domains of the system resolver and the domain of
+// the host name.
+func searchDomains() []string {
+	var domains []string
+	if f, err := os.Open("/etc/resolv.conf"); err == nil {
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) > 1 && (fields[0] == "search" || fields[0] == "domain") {
+				domains = append(domains, fields[1:]...)
+			}
+		}
+		f.Close()
+	}
+	if h, err := os.Hostname(); err == nil {
+		if i := strings.Index(h, "."); i > 0 {
+			domains = append(domains, h[i+1:])
+		}
+	}
+	return domains
+}
+
+// fetchWPAD downloads a PAC script from u with client, or a direct client sending the
+// request from local.
+func fetchWPAD(ctx context.Context, client *http.Client, u *url.URL, local net.IP, timeout time.Duration) (string, error) {
+	if client == nil {
+		dialer := &net.Dialer{Timeout: timeout, LocalAddr: &net.TCPAddr{IP: local}}
+		client = &http.Client{
+			Transport: &http.Transport{
+				Proxy:       nil, // discovery must not go through a proxy
+				DialContext: dialer.DialContext,
+			},
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return FetchPAC(ctx, client, u)
+}
+
+// FetchPAC downloads the PAC script at u with client, or http.DefaultClient if nil. The
+// fetch never goes through a proxy: a Proxy set on an *http.Transport is ignored, and
+// dialers of this package connect directly for it, so a PAC script cannot be fetched
+// through the proxy it selects.
+func FetchPAC(ctx context.Context, client *http.Client, u *url.URL) (string, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	t, ok := client.Transport.(*http.Transport)
+	if client.Transport == nil {
+		t, ok = http.DefaultTransport.(*http.Transport)
+	}
+	if ok && t.Proxy != nil {
+		t = t.Clone()
+		t.Proxy = nil
+		defer t.CloseIdleConnections()
+		c := *client
+		c.Transport = t
+		client = &c
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req.WithContext(context.WithValue(ctx, pacFetchKey{}, true)))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(resp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPACSize))
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(string(b), "FindProxyForURL") {
+		return "", errors.New("response is not a PAC script")
+	}
+	return string(b), nil
+}
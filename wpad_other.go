@@ -0,0 +1,11 @@
+// +build !windows
+
+package proxyplease
+
+import "errors"
+
+// dhcpWPAD returns the PAC URL served in DHCP option 252. The DHCP clients of other
+// platforms do not expose it, so only DNS discovery is performed there.
+func dhcpWPAD(name string) (string, error) {
+	return "", errors.New("DHCP option 252 is only read on Windows")
+}
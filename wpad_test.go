@@ -0,0 +1,118 @@
+package proxyplease
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// listenIPv6 listens on the IPv6 loopback address only, skipping the test if IPv6 is not
+// available.
+func listenIPv6(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %s", err)
+	}
+	return ln
+}
+
+func TestRoutableAddrs(t *testing.T) {
+	ipNet := func(s string) net.Addr {
+		ip, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.IP = ip
+		return n
+	}
+	tests := []struct {
+		addrs []net.Addr
+		want  string
+	}{
+		// IPv6-only network: the link-local and loopback addresses are not usable
+		{[]net.Addr{ipNet("::1/128"), ipNet("fe80::1/64"), ipNet("2001:db8::5/64"), ipNet("2001:db8::6/64")}, "[2001:db8::5]"},
+		{[]net.Addr{ipNet("2001:db8::5/64"), ipNet("192.0.2.5/24")}, "[192.0.2.5 2001:db8::5]"},
+		{[]net.Addr{ipNet("192.0.2.5/24")}, "[192.0.2.5]"},
+		{[]net.Addr{ipNet("fe80::1/64"), ipNet("127.0.0.1/8")}, "[]"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(routableAddrs(tt.addrs)); got != tt.want {
+			t.Errorf("routableAddrs(%v) = %s, want %s", tt.addrs, got, tt.want)
+		}
+	}
+}
+
+func TestFetchWPADIPv6(t *testing.T) {
+	ln := listenIPv6(t)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `function FindProxyForURL(url, host) { return "PROXY [2001:db8::8]:3128"; }`)
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	u := &url.URL{Scheme: "http", Host: ln.Addr().String(), Path: "/wpad.dat"}
+	script, err := fetchWPAD(context.Background(), nil, u, net.ParseIP("::1"), 2*time.Second)
+	if err != nil {
+		t.Fatalf("fetching %s from ::1: %s", u, err)
+	}
+	if script == "" {
+		t.Error("empty PAC script")
+	}
+	// probes from an IPv4 address cannot reach a server with only an IPv6 address
+	if _, err := fetchWPAD(context.Background(), nil, u, net.ParseIP("127.0.0.1"), 2*time.Second); err == nil {
+		t.Errorf("fetching %s from 127.0.0.1 succeeded", u)
+	}
+}
+
+func TestNormalizeProxyURLIPv6(t *testing.T) {
+	tests := []struct {
+		in   *url.URL
+		want string
+	}{
+		{&url.URL{Scheme: "http", Host: "[2001:db8::8]:3128"}, "http://[2001:db8::8]:3128"},
+		{&url.URL{Scheme: "http", Host: "[2001:DB8::8]"}, "http://[2001:db8::8]:80"},
+		{&url.URL{Scheme: "https", Host: "2001:db8::8"}, "https://[2001:db8::8]:443"},
+		{&url.URL{Scheme: "socks5", Host: "[::1]"}, "socks5://[::1]:1080"},
+	}
+	for _, tt := range tests {
+		if got := normalizeProxyURL(tt.in, "").String(); got != tt.want {
+			t.Errorf("normalizeProxyURL(%s) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDialIPv6Proxy(t *testing.T) {
+	target := newEchoServer(t)
+	defer target.Close()
+	s := newTestServer("user", "secret", "Basic")
+	defer s.Close()
+
+	// the proxy is only known by its IPv6 address; the test server relays to it
+	ln := listenIPv6(t)
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				up, err := net.Dial("tcp", s.URL.Host)
+				if err != nil {
+					c.Close()
+					return
+				}
+				relay(c, up)
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	p := Proxy{URL: &url.URL{Scheme: "http", Host: "[::1]:" + port}, Username: "user", Password: "secret", Debugf: t.Logf}
+	if _, err := dialEcho(NewDialContext(p), target.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,143 @@
+//go:build windows
+// +build windows
+
+package proxyplease
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	dhcpOptionWPAD          = 252
+	dhcpRequestSynchronous  = 2
+	dhcpRequestBufferLength = 4096
+	ipAdapterDHCPEnabled    = 0x4 // IP_ADAPTER_DHCP_ENABLED
+)
+
+var (
+	dhcpcsvc               = windows.NewLazySystemDLL("dhcpcsvc.dll")
+	procDhcpCApiInitialize = dhcpcsvc.NewProc("DhcpCApiInitialize")
+	procDhcpCApiCleanup    = dhcpcsvc.NewProc("DhcpCApiCleanup")
+	procDhcpRequestParams  = dhcpcsvc.NewProc("DhcpRequestParams")
+)
+
+// dhcpParams mirrors DHCPCAPI_PARAMS.
+type dhcpParams struct {
+	Flags      uint32
+	OptionID   uint32
+	IsVendor   int32
+	Data       *byte
+	nBytesData uint32
+}
+
+// dhcpParamsArray mirrors DHCPCAPI_PARAMS_ARRAY.
+type dhcpParamsArray struct {
+	nParams uint32
+	Params  *dhcpParams
+}
+
+// args returns a as the arguments of a by-value DHCPCAPI_PARAMS_ARRAY: by reference on
+// amd64, where structures larger than 8 bytes are passed so, and as its fields otherwise.
+func (a *dhcpParamsArray) args() []uintptr {
+	if runtime.GOARCH == "amd64" {
+		return []uintptr{uintptr(unsafe.Pointer(a))}
+	}
+	return []uintptr{uintptr(a.nParams), uintptr(unsafe.Pointer(a.Params))}
+}
+
+// dhcpWPAD returns the PAC URL served in DHCP option 252 to the adapter with the given
+// friendly name, or to the first adapter with one if name is empty.
+func dhcpWPAD(name string) (string, error) {
+	var version uint32
+	if r, _, _ := procDhcpCApiInitialize.Call(uintptr(unsafe.Pointer(&version))); r != 0 {
+		return "", syscall.Errno(r)
+	}
+	defer procDhcpCApiCleanup.Call()
+
+	adapters, err := dhcpAdapters()
+	if err != nil {
+		return "", err
+	}
+	for _, a := range adapters {
+		if name != "" && a.friendly != name {
+			continue
+		}
+		u, err := dhcpRequestWPAD(a.guid)
+		if err != nil {
+			debugf("wpad> DHCP option 252 not available through %s: %s", a.friendly, err)
+			continue
+		}
+		debugf("wpad> DHCP option 252 of %s: %s", a.friendly, u)
+		return u, nil
+	}
+	return "", errors.New("no DHCP server provided a PAC URL")
+}
+
+type dhcpAdapter struct {
+	guid, friendly string
+}
+
+// dhcpAdapters returns the connected adapters with DHCP enabled.
+func dhcpAdapters() ([]dhcpAdapter, error) {
+	size := uint32(15000)
+	for {
+		buf := make([]byte, size)
+		first := (*windows.IpAdapterAddresses)(unsafe.Pointer(&buf[0]))
+		err := windows.GetAdaptersAddresses(windows.AF_UNSPEC, 0, 0, first, &size)
+		if err == windows.ERROR_BUFFER_OVERFLOW {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var adapters []dhcpAdapter
+		for a := first; a != nil; a = a.Next {
+			if a.OperStatus != windows.IfOperStatusUp || a.Flags&ipAdapterDHCPEnabled == 0 {
+				continue
+			}
+			adapters = append(adapters, dhcpAdapter{
+				guid:     windows.BytePtrToString(a.AdapterName),
+				friendly: windows.UTF16PtrToString(a.FriendlyName),
+			})
+		}
+		return adapters, nil
+	}
+}
+
+// dhcpRequestWPAD asks the DHCP client service for option 252 of the adapter guid.
+func dhcpRequestWPAD(guid string) (string, error) {
+	adapter, err := windows.UTF16PtrFromString(guid)
+	if err != nil {
+		return "", err
+	}
+	param := dhcpParams{OptionID: dhcpOptionWPAD}
+	send := dhcpParamsArray{}
+	recv := dhcpParamsArray{nParams: 1, Params: &param}
+	size := uint32(dhcpRequestBufferLength)
+	for {
+		buf := make([]byte, size)
+		args := []uintptr{dhcpRequestSynchronous, 0, uintptr(unsafe.Pointer(adapter)), 0}
+		args = append(args, send.args()...)
+		args = append(args, recv.args()...)
+		args = append(args, uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0)
+		r, _, _ := procDhcpRequestParams.Call(args...)
+		if syscall.Errno(r) == windows.ERROR_MORE_DATA {
+			continue
+		}
+		if r != 0 {
+			return "", syscall.Errno(r)
+		}
+		if param.Data == nil || param.nBytesData == 0 {
+			return "", errors.New("option not set")
+		}
+		u := string((*[1 << 20]byte)(unsafe.Pointer(param.Data))[:param.nBytesData:param.nBytesData])
+		runtime.KeepAlive(buf)
+		return strings.TrimRight(u, "\x00 \r\n"), nil
+	}
+}
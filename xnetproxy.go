@@ -0,0 +1,47 @@
+package proxyplease
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// Dialer implements the Dialer and ContextDialer interfaces of golang.org/x/net/proxy.
+var (
+	_ proxy.Dialer        = (*Dialer)(nil)
+	_ proxy.ContextDialer = (*Dialer)(nil)
+)
+
+// errForwardDialer is returned for proxy URLs registered with RegisterDialerType when
+// x/net/proxy asks to reach the proxy through another dialer.
+var errForwardDialer = errors.New("only proxy.Direct is supported as forward dialer, use Proxy.Chain instead")
+
+// Dial connects to addr through the proxy. Together with DialContext, it lets a Dialer be
+// used where golang.org/x/net/proxy dialers are accepted, ex: by SSH clients.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// RegisterDialerType registers scheme with golang.org/x/net/proxy, so proxy.FromURL and
+// proxy.FromEnvironment return a *Dialer configured like p for proxy URLs with that
+// scheme, ex: "http" or "https", which x/net/proxy does not support itself. The URL
+// replaces p.URL. Schemes proxyplease does not know, ex: "corp", are dialed as HTTP
+// CONNECT proxies. The forward dialer must be proxy.Direct; use p.Chain to reach the
+// proxy through others.
+func RegisterDialerType(scheme string, p Proxy) {
+	proxy.RegisterDialerType(scheme, func(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+		if forward != proxy.Direct {
+			return nil, errForwardDialer
+		}
+		c := *u
+		if _, ok := defaultPorts[c.Scheme]; !ok {
+			c.Scheme = "http"
+		}
+		q := p
+		q.URL = &c
+		return NewDialer(q), nil
+	})
+}